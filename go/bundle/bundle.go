@@ -6,8 +6,11 @@ import (
 	"fmt"
 	"net/http"
 	"net/url"
+	"sort"
+	"strings"
 
 	"github.com/WICG/webpackage/go/bundle/version"
+	"github.com/WICG/webpackage/go/internal/cbor"
 	"github.com/WICG/webpackage/go/signedexchange/certurl"
 )
 
@@ -50,6 +53,31 @@ type Bundle struct {
 	Signatures  *Signatures
 }
 
+// indexLocation is a location-in-responses of an index entry.
+type indexLocation struct {
+	URL    string
+	Offset uint64 // Offset within the responses section
+	Length uint64
+}
+
+type bundleIndex struct {
+	locations       []indexLocation // sorted by sortIndexLocations
+	responsesLength uint64          // Length of the responses section
+	numResponses    uint64          // Number of items in the responses section
+}
+
+func sortIndexLocations(ls []indexLocation) {
+	sort.Slice(ls, func(i, j int) bool {
+		if ls[i].Offset != ls[j].Offset {
+			return ls[i].Offset < ls[j].Offset
+		}
+		if ls[i].Length != ls[j].Length {
+			return ls[i].Length < ls[j].Length
+		}
+		return ls[i].URL < ls[j].URL
+	})
+}
+
 // AddPayloadIntegrity encodes the exchange's payload with Merkle Integrity
 // content encoding, and adds `Content-Encoding` and `Digest` response headers.
 // It returns an identifier for the "payload-integrity-header" field of the
@@ -73,6 +101,167 @@ func (e *Exchange) AddPayloadIntegrity(ver version.Version, recordSize int) (str
 	return encoding.IntegrityIdentifier(), nil
 }
 
+// ValidateIndex cross-checks the index section b is serialized with against
+// its responses section. Read performs the same check on the serialized index
+// section before loading any response, so it rejects a corrupted bundle with
+// the error ValidateIndex would return.
+func (b *Bundle) ValidateIndex() error {
+	is, rs, err := b.sections()
+	if err != nil {
+		return err
+	}
+	index, err := newBundleIndex(b.Version, is, rs, len(b.Exchanges))
+	if err != nil {
+		return err
+	}
+	return index.validate()
+}
+
+// validate returns an error describing the first entry that points past the
+// end of the responses section, into its header, or into a part of another
+// response, or if there are more distinct locations than responses.
+func (index *bundleIndex) validate() error {
+	var head bytes.Buffer
+	if err := cbor.NewEncoder(&head).EncodeArrayHeader(int(index.numResponses)); err != nil {
+		return err
+	}
+	headerLength := uint64(head.Len())
+
+	numLocations := uint64(0)
+	var prev *indexLocation
+	for i := range index.locations {
+		l := &index.locations[i]
+		if l.Offset < headerLength {
+			return fmt.Errorf("bundle: index entry for %s (offset %d, length %d) points into the header of the responses section", l.URL, l.Offset, l.Length)
+		}
+		if l.Length > index.responsesLength || l.Offset > index.responsesLength-l.Length {
+			return fmt.Errorf("bundle: index entry for %s (offset %d, length %d) points past the end of the responses section (length %d)", l.URL, l.Offset, l.Length, index.responsesLength)
+		}
+		if prev != nil && l.Offset == prev.Offset && l.Length == prev.Length {
+			// Entries for variants may share a response.
+			continue
+		}
+		if prev != nil && l.Offset < prev.Offset+prev.Length {
+			return fmt.Errorf("bundle: index entry for %s (offset %d, length %d) overlaps the entry for %s (offset %d, length %d)", l.URL, l.Offset, l.Length, prev.URL, prev.Offset, prev.Length)
+		}
+		numLocations++
+		if numLocations > index.numResponses {
+			return fmt.Errorf("bundle: index entry for %s (offset %d, length %d) is dangling; the responses section has only %d responses", l.URL, l.Offset, l.Length, index.numResponses)
+		}
+		prev = l
+	}
+	return nil
+}
+
+// ResponseHeaderError describes a response header of a bundle exchange that
+// browsers would reject.
+type ResponseHeaderError struct {
+	URL string
+	// Header is the lowercased name of the offending header, or ":status".
+	Header string
+	Reason string
+}
+
+func (e *ResponseHeaderError) Error() string {
+	return fmt.Sprintf("%s: header %q: %s", e.URL, e.Header, e.Reason)
+}
+
+// ResponseHeaderErrors is returned by ValidateResponseHeaders.
+type ResponseHeaderErrors []*ResponseHeaderError
+
+func (es ResponseHeaderErrors) Error() string {
+	msgs := make([]string, len(es))
+	for i, e := range es {
+		msgs[i] = e.Error()
+	}
+	return "bundle: invalid response headers: " + strings.Join(msgs, "; ")
+}
+
+// connectionSpecificHeaders are not allowed in bundled responses, as in
+// HTTP/2 responses (Section 8.1.2.2 of RFC7540).
+var connectionSpecificHeaders = map[string]bool{
+	"connection":        true,
+	"keep-alive":        true,
+	"proxy-connection":  true,
+	"transfer-encoding": true,
+	"upgrade":           true,
+}
+
+// ValidateResponseHeaders checks that the response of each exchange of b has
+// a valid status and headers that can be encoded in a bundle and are allowed
+// there: header names must be tokens that are unique when lowercased, values
+// must be ASCII without line breaks, and connection-specific headers are not
+// allowed. It returns a ResponseHeaderErrors listing every violation, or nil
+// if there are none.
+func (b *Bundle) ValidateResponseHeaders() error {
+	var errs ResponseHeaderErrors
+	for _, e := range b.Exchanges {
+		errs = append(errs, e.validateResponseHeaders()...)
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func (e *Exchange) validateResponseHeaders() []*ResponseHeaderError {
+	var url string
+	if e.Request.URL != nil {
+		url = e.Request.URL.String()
+	}
+	var errs []*ResponseHeaderError
+	report := func(header, reason string) {
+		errs = append(errs, &ResponseHeaderError{URL: url, Header: header, Reason: reason})
+	}
+
+	if e.Response.Status < 100 || e.Response.Status > 999 {
+		report(":status", fmt.Sprintf("status %d is not a three-digit code", e.Response.Status))
+	}
+	names := make([]string, 0, len(e.Response.Header))
+	for name := range e.Response.Header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	seen := make(map[string]bool)
+	for _, name := range names {
+		lower := strings.ToLower(name)
+		switch {
+		case strings.HasPrefix(name, ":"):
+			report(lower, "pseudo-headers other than :status are not allowed")
+		case !isToken(name):
+			report(lower, "name is not a valid token")
+		case seen[lower]:
+			report(lower, "appears more than once with different cases")
+		case connectionSpecificHeaders[lower]:
+			report(lower, "connection-specific headers are not allowed")
+		}
+		seen[lower] = true
+		for _, value := range e.Response.Header[name] {
+			if !isAscii(value) || strings.ContainsAny(value, "\r\n\x00") {
+				report(lower, fmt.Sprintf("invalid value %q", value))
+			}
+		}
+	}
+	return errs
+}
+
+// isToken returns true if s is a token (Section 3.2.6 of RFC7230).
+func isToken(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		case strings.IndexByte("!#$%&'*+-.^_`|~", c) >= 0:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
 // Validate performs basic sanity checks on the bundle.
 func (b *Bundle) Validate() error {
 	if b.PrimaryURL != nil {
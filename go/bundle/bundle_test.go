@@ -2,13 +2,22 @@ package bundle_test
 
 import (
 	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
 	"net/http"
 	"net/url"
 	"reflect"
 	"testing"
+	"testing/iotest"
 
 	. "github.com/WICG/webpackage/go/bundle"
 	"github.com/WICG/webpackage/go/bundle/version"
+	"github.com/WICG/webpackage/go/integrityblock"
+	"github.com/WICG/webpackage/go/integrityblock/webbundleid"
 	"github.com/WICG/webpackage/go/internal/signingalgorithm"
 	"github.com/WICG/webpackage/go/signedexchange/certurl"
 )
@@ -159,3 +168,211 @@ func TestB2BundleWithSpecifiedManifestURLShouldFail(t *testing.T) {
 		t.Errorf("Bundle write should fail as version B2 does not support manifest URL.")
 	}
 }
+
+func streamingBundleFrom(b *Bundle) *StreamingBundle {
+	sb := &StreamingBundle{
+		Version:     b.Version,
+		PrimaryURL:  b.PrimaryURL,
+		ManifestURL: b.ManifestURL,
+		Signatures:  b.Signatures,
+	}
+	for _, e := range b.Exchanges {
+		body := e.Response.Body
+		sb.Exchanges = append(sb.Exchanges, &StreamingExchange{
+			Request:    e.Request,
+			Status:     e.Response.Status,
+			Header:     e.Response.Header,
+			BodyLength: int64(len(body)),
+			OpenBody: func() (io.ReadCloser, error) {
+				return ioutil.NopCloser(bytes.NewReader(body)), nil
+			},
+		})
+	}
+	return sb
+}
+
+func TestStreamingBundleMatchesBundle(t *testing.T) {
+	for _, ver := range version.AllVersions {
+		bundles := []*Bundle{createTestBundle(t, ver)}
+		if ver.SupportsVariants() {
+			bundles = append(bundles, createTestBundleWithVariants(ver))
+		}
+		for _, bundle := range bundles {
+			var want bytes.Buffer
+			if _, err := bundle.WriteTo(&want); err != nil {
+				t.Fatalf("Bundle.WriteTo unexpectedly failed: %v", err)
+			}
+
+			sb := streamingBundleFrom(bundle)
+			if err := sb.ValidateIndex(); err != nil {
+				t.Errorf("%s: StreamingBundle.ValidateIndex unexpectedly failed: %v", ver, err)
+			}
+			var got bytes.Buffer
+			n, err := sb.WriteTo(&got)
+			if err != nil {
+				t.Fatalf("StreamingBundle.WriteTo unexpectedly failed: %v", err)
+			}
+			if n != int64(got.Len()) {
+				t.Errorf("StreamingBundle.WriteTo returned %d, but wrote %d bytes", n, got.Len())
+			}
+			if !bytes.Equal(got.Bytes(), want.Bytes()) {
+				t.Errorf("%s: streamed bundle differs from buffered one:\ngot: %x\nwant: %x", ver, got.Bytes(), want.Bytes())
+			}
+		}
+	}
+}
+
+func TestStreamingBundleBodyLengthMismatch(t *testing.T) {
+	for _, delta := range []int64{-1, 1} {
+		sb := streamingBundleFrom(createTestBundle(t, version.VersionB2))
+		sb.Exchanges[0].BodyLength += delta
+		if _, err := sb.WriteTo(ioutil.Discard); err == nil {
+			t.Errorf("StreamingBundle.WriteTo unexpectedly succeeded with BodyLength off by %d", delta)
+		}
+	}
+}
+
+func TestStreamingBundleBodyReadError(t *testing.T) {
+	// The body fails after BodyLength bytes, when it is checked for more.
+	errRead := errors.New("connection reset")
+	sb := streamingBundleFrom(createTestBundle(t, version.VersionB2))
+	e := sb.Exchanges[0]
+	open := e.OpenBody
+	e.OpenBody = func() (io.ReadCloser, error) {
+		body, err := open()
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.NopCloser(io.MultiReader(body, iotest.ErrReader(errRead))), nil
+	}
+	if _, err := sb.WriteTo(ioutil.Discard); !errors.Is(err, errRead) {
+		t.Errorf("StreamingBundle.WriteTo: got error %v, want %v", err, errRead)
+	}
+}
+
+func signBundleForTest(t *testing.T, bundleBytes []byte, privKey ed25519.PrivateKey) []byte {
+	webBundleHash, err := integrityblock.ComputeWebBundleSha512(bytes.NewReader(bundleBytes), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ibs := integrityblock.IntegrityBlockSigner{
+		SigningStrategy: integrityblock.NewParsedEd25519KeySigningStrategy(privKey),
+		WebBundleHash:   webBundleHash,
+		IntegrityBlock: &integrityblock.IntegrityBlock{
+			Magic:   integrityblock.IntegrityBlockMagic,
+			Version: integrityblock.VersionB1,
+		},
+	}
+	pubKey := privKey.Public().(ed25519.PublicKey)
+	if err := ibs.SignAndAddNewSignature(pubKey, integrityblock.GenerateSignatureAttributesWithPublicKey(pubKey)); err != nil {
+		t.Fatal(err)
+	}
+	integrityBlockBytes, err := ibs.IntegrityBlock.CborBytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return append(integrityBlockBytes, bundleBytes...)
+}
+
+func TestReadSignedBundle(t *testing.T) {
+	pubKey, privKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bundle := createTestBundle(t, version.VersionB2)
+	var buf bytes.Buffer
+	if _, err := bundle.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	signed := signBundleForTest(t, buf.Bytes(), privKey)
+
+	got, webBundleId, err := ReadSignedBundle(bytes.NewReader(signed))
+	if err != nil {
+		t.Fatalf("ReadSignedBundle unexpectedly failed: %v", err)
+	}
+	if !reflect.DeepEqual(got, bundle) {
+		t.Errorf("got: %v\nwant: %v", got, bundle)
+	}
+	if want := webbundleid.GetWebBundleId(pubKey); webBundleId != want {
+		t.Errorf("Web Bundle ID: got %q, want %q", webBundleId, want)
+	}
+
+	tampered := append([]byte(nil), signed...)
+	tampered[len(tampered)-20] ^= 1
+	if _, _, err := ReadSignedBundle(bytes.NewReader(tampered)); !errors.Is(err, ErrSignatureMismatch) {
+		t.Errorf("ReadSignedBundle of a tampered bundle: got error %v, want %v", err, ErrSignatureMismatch)
+	}
+
+	if _, _, err := ReadSignedBundle(bytes.NewReader(buf.Bytes())); !errors.Is(err, ErrNoIntegrityBlock) {
+		t.Errorf("ReadSignedBundle of an unsigned bundle: got error %v, want %v", err, ErrNoIntegrityBlock)
+	}
+}
+
+func TestComputeHash(t *testing.T) {
+	bundleBytes, err := ioutil.ReadFile("../integrityblock/testfile.wbn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := hex.DecodeString("95f8713d382ffefb8f1e4f464e39a2bf18280c8b26434d2fcfc08d7d710c8919ace5a652e25e66f9292cda424f20e4b53bf613bf9488140272f56a455393f7e6")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ComputeHash(bundleBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("got: %x\nwant: %x", got, want)
+	}
+
+	// The integrity block of a signed bundle is not hashed.
+	_, privKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err = ComputeHash(signBundleForTest(t, bundleBytes, privKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("signed bundle: got: %x\nwant: %x", got, want)
+	}
+
+	if _, err := ComputeHash([]byte("not a web bundle")); err == nil {
+		t.Error("ComputeHash unexpectedly accepted non-bundle bytes")
+	}
+}
+
+func TestValidateResponseHeaders(t *testing.T) {
+	for _, ver := range version.AllVersions {
+		b := createTestBundle(t, ver)
+		if err := b.ValidateResponseHeaders(); err != nil {
+			t.Errorf("%s: conformant bundle: unexpected error %v", ver, err)
+		}
+
+		b.Exchanges = append(b.Exchanges, &Exchange{
+			Request{URL: urlMustParse("https://bundle.example.com/bad.js")},
+			Response{
+				Status: 200,
+				Header: http.Header{
+					"Content-Type":      []string{"text/javascript"},
+					"Transfer-Encoding": []string{"chunked"},
+					"X-Folded":          []string{"a\r\n b"},
+				},
+				Body: []byte("alert(1)"),
+			},
+		})
+		err := b.ValidateResponseHeaders()
+		errs, ok := err.(ResponseHeaderErrors)
+		if !ok {
+			t.Fatalf("%s: got error %v, want ResponseHeaderErrors", ver, err)
+		}
+		want := ResponseHeaderErrors{
+			{URL: "https://bundle.example.com/bad.js", Header: "transfer-encoding", Reason: "connection-specific headers are not allowed"},
+			{URL: "https://bundle.example.com/bad.js", Header: "x-folded", Reason: `invalid value "a\r\n b"`},
+		}
+		if !reflect.DeepEqual(errs, want) {
+			t.Errorf("%s: got %v, want %v", ver, errs, want)
+		}
+	}
+}
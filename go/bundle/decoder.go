@@ -561,9 +561,42 @@ func loadMetadata(bs []byte) (*meta, error) {
 		offset = end
 	}
 
+	// Reject a corrupted index before any response is loaded from it.
+	index, err := meta.index(bs)
+	if err != nil {
+		return nil, &LoadMetadataError{err, FormatError, fallbackURL}
+	}
+	if err := index.validate(); err != nil {
+		return nil, &LoadMetadataError{err, FormatError, fallbackURL}
+	}
+
 	return meta, nil
 }
 
+// index returns the index described by m.requests, relative to the responses
+// section of bs.
+func (m *meta) index(bs []byte) (*bundleIndex, error) {
+	respso, respSectionRelOffset, _ := FindSection(m.sectionOffsets, "responses")
+	respSectionOffset := m.sectionsStart + respSectionRelOffset
+	if uint64(len(bs)) <= respSectionOffset {
+		return nil, errors.New("bundle: responses section out-of-range")
+	}
+	numResponses, err := cbor.NewDecoder(bytes.NewReader(bs[respSectionOffset:])).DecodeArrayHeader()
+	if err != nil {
+		return nil, fmt.Errorf("bundle: failed to decode responses section array header: %v", err)
+	}
+	index := &bundleIndex{responsesLength: respso.Length, numResponses: numResponses}
+	for _, req := range m.requests {
+		index.locations = append(index.locations, indexLocation{
+			URL:    req.URL.String(),
+			Offset: req.Offset - respSectionOffset,
+			Length: req.Length,
+		})
+	}
+	sortIndexLocations(index.locations)
+	return index, nil
+}
+
 var reStatus = regexp.MustCompile("^\\d\\d\\d$")
 
 // https://wicg.github.io/webpackage/draft-yasskin-dispatch-bundled-exchanges.html#load-response
@@ -91,8 +91,9 @@ type section interface {
 
 // staging area for writing index section
 type indexSection struct {
-	es    []*indexEntry
-	bytes []byte
+	es        []*indexEntry
+	bytes     []byte
+	locations []indexLocation // the locations in bytes
 }
 
 func (is *indexSection) addExchange(e *Exchange, offset, length int) error {
@@ -152,6 +153,7 @@ func (is *indexSection) Finalize(ver version.Version) error {
 					panic(err)
 				}
 				for _, e := range es {
+					is.locations = append(is.locations, indexLocation{URL: url, Offset: e.Offset, Length: e.Length})
 					if err := valueE.EncodeUint(e.Offset); err != nil {
 						panic(err)
 					}
@@ -189,6 +191,7 @@ func (is *indexSection) Finalize(ver version.Version) error {
 				if err := valueE.EncodeArrayHeader(2); err != nil {
 					panic(err)
 				}
+				is.locations = append(is.locations, indexLocation{URL: url, Offset: es[0].Offset, Length: es[0].Length})
 				if err := valueE.EncodeUint(es[0].Offset); err != nil {
 					panic(err)
 				}
@@ -204,6 +207,7 @@ func (is *indexSection) Finalize(ver version.Version) error {
 	}
 
 	is.bytes = b.Bytes()
+	sortIndexLocations(is.locations)
 	return nil
 }
 
@@ -560,41 +564,70 @@ func writeFooter(w io.Writer, offset int) error {
 }
 
 func (b *Bundle) WriteTo(w io.Writer) (int64, error) {
-	cw := NewCountingWriter(w)
+	is, rs, err := b.sections()
+	if err != nil {
+		return 0, err
+	}
+	return writeBundle(w, b.Version, b.PrimaryURL, b.ManifestURL, b.Signatures, is, rs)
+}
 
+// sections returns the index and responses sections of the bundle. The index
+// section is not finalized yet.
+func (b *Bundle) sections() (*indexSection, *responsesSection, error) {
 	is := &indexSection{}
 	rs := newResponsesSection(len(b.Exchanges))
 
 	for _, e := range b.Exchanges {
 		if err := addExchange(is, rs, e); err != nil {
-			return cw.Written, err
+			return nil, nil, err
 		}
 	}
-	if err := is.Finalize(b.Version); err != nil {
+	return is, rs, nil
+}
+
+// newBundleIndex finalizes is and returns the index it describes in the
+// responses section rs of numResponses responses.
+func newBundleIndex(ver version.Version, is *indexSection, rs section, numResponses int) (*bundleIndex, error) {
+	if err := is.Finalize(ver); err != nil {
+		return nil, err
+	}
+	return &bundleIndex{
+		locations:       is.locations,
+		responsesLength: uint64(rs.Len()),
+		numResponses:    uint64(numResponses),
+	}, nil
+}
+
+// writeBundle writes a bundle with the index section is and the responses
+// section rs, which must contain the same exchanges.
+func writeBundle(w io.Writer, ver version.Version, primaryURL, manifestURL *url.URL, sigs *Signatures, is *indexSection, rs section) (int64, error) {
+	cw := NewCountingWriter(w)
+
+	if err := is.Finalize(ver); err != nil {
 		return cw.Written, err
 	}
 
 	sections := []section{}
 	sections = append(sections, is)
-	if !b.Version.HasPrimaryURLFieldInHeader() && b.PrimaryURL != nil {
-		ps, err := newPrimarySection(b.PrimaryURL)
+	if !ver.HasPrimaryURLFieldInHeader() && primaryURL != nil {
+		ps, err := newPrimarySection(primaryURL)
 		if err != nil {
 			return cw.Written, err
 		}
 		sections = append(sections, ps)
 	}
-	if b.ManifestURL != nil {
-		if !b.Version.SupportsManifestSection() {
+	if manifestURL != nil {
+		if !ver.SupportsManifestSection() {
 			return cw.Written, errors.New("This version of the WebBundle does not support storing manifest URL.")
 		}
-		ms, err := newManifestSection(b.ManifestURL)
+		ms, err := newManifestSection(manifestURL)
 		if err != nil {
 			return cw.Written, err
 		}
 		sections = append(sections, ms)
 	}
-	if b.Signatures != nil && b.Version.SupportsSignatures() {
-		ss, err := newSignaturesSection(b.Signatures)
+	if sigs != nil && ver.SupportsSignatures() {
+		ss, err := newSignaturesSection(sigs)
 		if err != nil {
 			return cw.Written, err
 		}
@@ -602,11 +635,11 @@ func (b *Bundle) WriteTo(w io.Writer) (int64, error) {
 	}
 	sections = append(sections, rs) // resources section must be the last.
 
-	if _, err := cw.Write(b.Version.HeaderMagicBytes()); err != nil {
+	if _, err := cw.Write(ver.HeaderMagicBytes()); err != nil {
 		return cw.Written, err
 	}
-	if b.Version.HasPrimaryURLFieldInHeader() {
-		if err := writePrimaryURL(cw, b.PrimaryURL); err != nil {
+	if ver.HasPrimaryURLFieldInHeader() {
+		if err := writePrimaryURL(cw, primaryURL); err != nil {
 			return cw.Written, err
 		}
 	}
@@ -1,9 +1,11 @@
 package bundle
 
 import (
+	"bytes"
 	"net/http"
 	"net/url"
 	"reflect"
+	"strings"
 	"testing"
 
 	"github.com/WICG/webpackage/go/bundle/version"
@@ -117,3 +119,91 @@ func TestIndexSectionMultipleResourcesPerURL(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestValidateIndex(t *testing.T) {
+	for _, ver := range version.AllVersions {
+		b := &Bundle{
+			Version:    ver,
+			PrimaryURL: urlMustParse("https://example.com/"),
+			Exchanges: []*Exchange{
+				&Exchange{
+					Request{URL: urlMustParse("https://example.com/")},
+					Response{Status: 200, Header: http.Header{"Content-Type": []string{"text/html"}}, Body: []byte("<p>hello</p>")},
+				},
+				&Exchange{
+					Request{URL: urlMustParse("https://example.com/style.css")},
+					Response{Status: 200, Header: http.Header{"Content-Type": []string{"text/css"}}, Body: []byte("p {}")},
+				},
+			},
+		}
+		if err := b.ValidateIndex(); err != nil {
+			t.Errorf("%s: Bundle.ValidateIndex unexpectedly failed: %v", ver, err)
+		}
+		var buf bytes.Buffer
+		if _, err := b.WriteTo(&buf); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := Read(&buf); err != nil {
+			t.Errorf("%s: Read unexpectedly failed: %v", ver, err)
+		}
+
+		type location struct {
+			url            *url.URL
+			offset, length int
+		}
+		cases := []struct {
+			name    string
+			corrupt func(ls []location) []location
+			want    string
+		}{
+			{"overlapping offset", func(ls []location) []location {
+				ls[1].offset = ls[0].offset + 1
+				return ls
+			}, "overlaps"},
+			{"offset past end", func(ls []location) []location {
+				ls[1].offset += ls[1].length
+				return ls
+			}, "out-of-range"},
+			{"offset into header", func(ls []location) []location {
+				ls[0].offset = 0
+				return ls
+			}, "header"},
+			{"dangling offset", func(ls []location) []location {
+				// Split the second response in two.
+				extra := location{urlMustParse("https://example.com/extra"), ls[1].offset + 1, ls[1].length - 1}
+				ls[1].length = 1
+				return append(ls, extra)
+			}, "dangling"},
+		}
+		for _, c := range cases {
+			// Serialize the bundle with an index pointing at the corrupted
+			// locations of its responses.
+			rs := newResponsesSection(len(b.Exchanges))
+			var ls []location
+			for _, e := range b.Exchanges {
+				offset, length, err := rs.addResponse(e.Response)
+				if err != nil {
+					t.Fatal(err)
+				}
+				ls = append(ls, location{e.URL, offset, length})
+			}
+			is := &indexSection{}
+			for _, l := range c.corrupt(ls) {
+				if err := is.addExchange(&Exchange{Request: Request{URL: l.url}}, l.offset, l.length); err != nil {
+					t.Fatal(err)
+				}
+			}
+			var buf bytes.Buffer
+			if _, err := writeBundle(&buf, ver, b.PrimaryURL, nil, nil, is, rs); err != nil {
+				t.Fatal(err)
+			}
+
+			_, err := Read(&buf)
+			if err == nil {
+				t.Errorf("%s: %s: Read unexpectedly succeeded", ver, c.name)
+			} else if !strings.Contains(err.Error(), c.want) {
+				t.Errorf("%s: %s: error %q does not contain %q", ver, c.name, err, c.want)
+			}
+		}
+	}
+}
@@ -13,13 +13,9 @@ import (
 	"github.com/WICG/webpackage/go/internal/cbor"
 	"github.com/WICG/webpackage/go/internal/signingalgorithm"
 	"github.com/WICG/webpackage/go/signedexchange/certurl"
+	"github.com/WICG/webpackage/go/signedexchange/mice"
 )
 
-// draft-yasskin-http-origin-signed-responses.html#signature-validity
-// Step 8. "If validating integrity using the selected header field requires
-// the client to process records larger than 16384 bytes, return "invalid"."
-const maxMIRecordSize = 16384
-
 type Verifier struct {
 	Version               version.Version
 	VerifiedSignedSubsets []*VerifiedSignedSubset
@@ -84,7 +80,7 @@ func (v *Verifier) VerifyExchange(e *bundle.Exchange) (*VerifyExchangeResult, er
 	if digest == "" {
 		return nil, errors.New("signature: digest response header not present")
 	}
-	dec, err := encoding.NewDecoder(bytes.NewReader(e.Response.Body), digest, maxMIRecordSize)
+	dec, err := encoding.NewDecoder(bytes.NewReader(e.Response.Body), digest, mice.MaxRecordSize)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,77 @@
+package bundle
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/WICG/webpackage/go/bundle/version"
+	"github.com/WICG/webpackage/go/integrityblock"
+	"github.com/WICG/webpackage/go/integrityblock/webbundleid"
+)
+
+var (
+	// ErrNoIntegrityBlock is returned by ReadSignedBundle if the input does
+	// not start with an integrity block.
+	ErrNoIntegrityBlock = errors.New("bundle: no integrity block")
+	// ErrSignatureMismatch is returned by ReadSignedBundle if a signature in
+	// the integrity block does not match the bundle.
+	ErrSignatureMismatch = errors.New("bundle: integrity block signature mismatch")
+)
+
+// ComputeHash returns the hash of a web bundle that the signatures of an
+// integrity block cover, i.e. the SHA-512 hash of the web bundle bytes. If
+// bundleBytes is a signed web bundle, its integrity block is excluded from the
+// hash.
+func ComputeHash(bundleBytes []byte) ([]byte, error) {
+	offset := int64(0)
+	if hasIntegrityBlock, _ := integrityblock.WebBundleHasIntegrityBlock(bytes.NewReader(bundleBytes)); hasIntegrityBlock {
+		var err error
+		if _, offset, err = integrityblock.ReadIntegrityBlock(bundleBytes); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := version.ParseMagicBytes(bytes.NewReader(bundleBytes[offset:])); err != nil {
+		return nil, err
+	}
+	return integrityblock.ComputeWebBundleSha512(bytes.NewReader(bundleBytes), offset)
+}
+
+// ReadSignedBundle reads a signed web bundle, i.e. a web bundle preceded by
+// an integrity block, from r. It verifies the ed25519 signatures in the
+// integrity block over the hash of the bundle, and returns the bundle and the
+// Web Bundle ID derived from the public key of the newest signature.
+// https://github.com/WICG/webpackage/blob/main/explainers/integrity-signature.md
+func ReadSignedBundle(r io.Reader) (*Bundle, string, error) {
+	bs, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, "", err
+	}
+
+	hasIntegrityBlock, err := integrityblock.WebBundleHasIntegrityBlock(bytes.NewReader(bs))
+	if err != nil || !hasIntegrityBlock {
+		return nil, "", ErrNoIntegrityBlock
+	}
+	integrityBlock, offset, err := integrityblock.ReadIntegrityBlock(bs)
+	if err != nil {
+		return nil, "", err
+	}
+
+	webBundleHash, err := ComputeHash(bs[offset:])
+	if err != nil {
+		return nil, "", err
+	}
+	if err := integrityBlock.VerifySignatures(webBundleHash); err != nil {
+		return nil, "", fmt.Errorf("%w: %v", ErrSignatureMismatch, err)
+	}
+
+	b, err := Read(bytes.NewReader(bs[offset:]))
+	if err != nil {
+		return nil, "", err
+	}
+	publicKey := integrityBlock.SignatureStack[0].SignatureAttributes[integrityblock.Ed25519publicKeyAttributeName]
+	return b, webbundleid.GetWebBundleId(ed25519.PublicKey(publicKey)), nil
+}
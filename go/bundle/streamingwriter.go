@@ -0,0 +1,182 @@
+package bundle
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+
+	"github.com/WICG/webpackage/go/bundle/version"
+	"github.com/WICG/webpackage/go/internal/cbor"
+)
+
+// StreamingExchange is an exchange whose response body is not held in memory,
+// but read when the bundle is written.
+type StreamingExchange struct {
+	Request
+	Status int
+	Header http.Header
+
+	// BodyLength is the length of the response body in bytes.
+	BodyLength int64
+	// OpenBody returns a reader for the response body, which must yield
+	// exactly BodyLength bytes. It is called once per write, in the order of
+	// the exchanges, and the returned reader is closed before the next body
+	// is opened.
+	OpenBody func() (io.ReadCloser, error)
+}
+
+// StreamingBundle is like Bundle, but its response bodies are streamed to the
+// output instead of being buffered. Since the section lengths and the index
+// are computed from the body lengths up front, writing a StreamingBundle only
+// needs memory for the response headers, regardless of the size of the
+// bodies. The output is identical to the one of the equivalent Bundle.
+type StreamingBundle struct {
+	Version     version.Version
+	PrimaryURL  *url.URL
+	Exchanges   []*StreamingExchange
+	ManifestURL *url.URL
+	Signatures  *Signatures
+}
+
+var _ = io.WriterTo(&StreamingBundle{})
+
+// streamingResponse is a response in a streamingResponsesSection.
+type streamingResponse struct {
+	head []byte // the CBOR encoding of everything but the body content
+	e    *StreamingExchange
+}
+
+// streamingResponsesSection is a responses section that reads response bodies
+// only when written.
+type streamingResponsesSection struct {
+	head      []byte // the array header of the section
+	responses []*streamingResponse
+	length    int
+}
+
+func newStreamingResponsesSection(n int) *streamingResponsesSection {
+	var b bytes.Buffer
+	if err := cbor.NewEncoder(&b).EncodeArrayHeader(n); err != nil {
+		panic(err)
+	}
+	return &streamingResponsesSection{head: b.Bytes(), length: b.Len()}
+}
+
+// addResponse is the streaming counterpart of responsesSection.addResponse.
+func (rs *streamingResponsesSection) addResponse(e *StreamingExchange) (int, int, error) {
+	if e.BodyLength < 0 {
+		return 0, 0, fmt.Errorf("bundle: negative body length %d for %v", e.BodyLength, e.URL)
+	}
+	offset := rs.length
+
+	headerCbor, err := Response{Status: e.Status, Header: e.Header}.EncodeHeader()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var b bytes.Buffer
+	enc := cbor.NewEncoder(&b)
+	if err := enc.EncodeArrayHeader(2); err != nil {
+		return 0, 0, fmt.Errorf("bundle: failed to encode response array header: %v", err)
+	}
+	if err := enc.EncodeByteString(headerCbor); err != nil {
+		return 0, 0, fmt.Errorf("bundle: failed to encode response header cbor bytestring: %v", err)
+	}
+	if err := enc.EncodeByteStringHeader(uint64(e.BodyLength)); err != nil {
+		return 0, 0, fmt.Errorf("bundle: failed to encode response payload bytestring header: %v", err)
+	}
+	rs.responses = append(rs.responses, &streamingResponse{head: b.Bytes(), e: e})
+
+	length := b.Len() + int(e.BodyLength)
+	rs.length += length
+	return offset, length, nil
+}
+
+func (rs *streamingResponsesSection) Name() string { return "responses" }
+func (rs *streamingResponsesSection) Len() int     { return rs.length }
+
+func (rs *streamingResponsesSection) WriteTo(w io.Writer) (int64, error) {
+	cw := NewCountingWriter(w)
+	if _, err := cw.Write(rs.head); err != nil {
+		return cw.Written, err
+	}
+	for _, r := range rs.responses {
+		if _, err := cw.Write(r.head); err != nil {
+			return cw.Written, err
+		}
+		if err := copyBody(cw, r.e); err != nil {
+			return cw.Written, err
+		}
+	}
+	return cw.Written, nil
+}
+
+func copyBody(w io.Writer, e *StreamingExchange) error {
+	body, err := e.OpenBody()
+	if err != nil {
+		return fmt.Errorf("bundle: failed to open the response body for %v: %v", e.URL, err)
+	}
+	defer body.Close()
+
+	n, err := io.Copy(w, io.LimitReader(body, e.BodyLength))
+	if err != nil {
+		return err
+	}
+	if n != e.BodyLength {
+		return fmt.Errorf("bundle: the response body for %v is %d bytes, but BodyLength is %d", e.URL, n, e.BodyLength)
+	}
+	// The body must not be longer than BodyLength either.
+	extra, err := io.Copy(ioutil.Discard, io.LimitReader(body, 1))
+	if err != nil {
+		return err
+	}
+	if extra != 0 {
+		return fmt.Errorf("bundle: the response body for %v is longer than BodyLength %d", e.URL, e.BodyLength)
+	}
+	return nil
+}
+
+// WriteTo writes the bundle to w, reading the response bodies one at a time.
+func (b *StreamingBundle) WriteTo(w io.Writer) (int64, error) {
+	is, rs, err := b.sections()
+	if err != nil {
+		return 0, err
+	}
+	return writeBundle(w, b.Version, b.PrimaryURL, b.ManifestURL, b.Signatures, is, rs)
+}
+
+// ValidateIndex is like Bundle.ValidateIndex. It does not open the response
+// bodies.
+func (b *StreamingBundle) ValidateIndex() error {
+	is, rs, err := b.sections()
+	if err != nil {
+		return err
+	}
+	index, err := newBundleIndex(b.Version, is, rs, len(b.Exchanges))
+	if err != nil {
+		return err
+	}
+	return index.validate()
+}
+
+// sections is the streaming counterpart of Bundle.sections.
+func (b *StreamingBundle) sections() (*indexSection, *streamingResponsesSection, error) {
+	is := &indexSection{}
+	rs := newStreamingResponsesSection(len(b.Exchanges))
+
+	for _, e := range b.Exchanges {
+		offset, length, err := rs.addResponse(e)
+		if err != nil {
+			return nil, nil, err
+		}
+		// The index only looks at the request and the response headers.
+		ie := &Exchange{Request: e.Request, Response: Response{Status: e.Status, Header: e.Header}}
+		if err := is.addExchange(ie, offset, length); err != nil {
+			return nil, nil, err
+		}
+	}
+	return is, rs, nil
+}
@@ -155,6 +155,104 @@ func ObtainIntegrityBlock(bundleFile *os.File) (*IntegrityBlock, int64, error) {
 	return integrityBlock, integrityBlockLen, nil
 }
 
+// ReadIntegrityBlock parses the integrity block at the start of bs, which
+// holds a signed web bundle. It returns the parsed integrity block and its
+// length in bytes, i.e. the offset of the web bundle in bs.
+func ReadIntegrityBlock(bs []byte) (*IntegrityBlock, int64, error) {
+	r := bytes.NewReader(bs)
+	dec := cbor.NewDecoder(r)
+
+	n, err := dec.DecodeArrayHeader()
+	if err != nil {
+		return nil, 0, fmt.Errorf("integrityblock: Failed to decode integrity block array header: %v", err)
+	}
+	if n != 3 {
+		return nil, 0, fmt.Errorf("integrityblock: Integrity block array must have 3 elements, got %d", n)
+	}
+	magic, err := dec.DecodeByteString()
+	if err != nil {
+		return nil, 0, fmt.Errorf("integrityblock: Failed to decode magic: %v", err)
+	}
+	if !bytes.Equal(magic, IntegrityBlockMagic) {
+		return nil, 0, fmt.Errorf("integrityblock: Wrong magic: %v", magic)
+	}
+	version, err := dec.DecodeByteString()
+	if err != nil {
+		return nil, 0, fmt.Errorf("integrityblock: Failed to decode version: %v", err)
+	}
+	if !bytes.Equal(version, VersionB1) {
+		return nil, 0, fmt.Errorf("integrityblock: Unsupported version: %v", version)
+	}
+
+	numSignatures, err := dec.DecodeArrayHeader()
+	if err != nil {
+		return nil, 0, fmt.Errorf("integrityblock: Failed to decode signature stack array header: %v", err)
+	}
+	integrityBlock := &IntegrityBlock{Magic: magic, Version: version}
+	for i := uint64(0); i < numSignatures; i++ {
+		if n, err := dec.DecodeArrayHeader(); err != nil || n != 2 {
+			return nil, 0, fmt.Errorf("integrityblock: Signature %d must be an array of 2 elements", i)
+		}
+		numAttributes, err := dec.DecodeMapHeader()
+		if err != nil {
+			return nil, 0, fmt.Errorf("integrityblock: Failed to decode signature %d attributes map header: %v", i, err)
+		}
+		attributes := SignatureAttributesMap{}
+		for j := uint64(0); j < numAttributes; j++ {
+			key, err := dec.DecodeTextString()
+			if err != nil {
+				return nil, 0, fmt.Errorf("integrityblock: Failed to decode signature %d attribute name: %v", i, err)
+			}
+			value, err := dec.DecodeByteString()
+			if err != nil {
+				return nil, 0, fmt.Errorf("integrityblock: Failed to decode signature %d attribute %q: %v", i, key, err)
+			}
+			attributes[key] = value
+		}
+		signature, err := dec.DecodeByteString()
+		if err != nil {
+			return nil, 0, fmt.Errorf("integrityblock: Failed to decode signature %d: %v", i, err)
+		}
+		integrityBlock.SignatureStack = append(integrityBlock.SignatureStack, &IntegritySignature{
+			SignatureAttributes: attributes,
+			Signature:           signature,
+		})
+	}
+	return integrityBlock, int64(len(bs) - r.Len()), nil
+}
+
+// VerifySignatures verifies every signature in the signature stack against
+// webBundleHash, the SHA-512 hash of the web bundle. Each signature covers the
+// integrity block as it was before the signature was prepended to the stack.
+func (integrityBlock *IntegrityBlock) VerifySignatures(webBundleHash []byte) error {
+	if len(integrityBlock.SignatureStack) == 0 {
+		return errors.New("integrityblock: The signature stack is empty.")
+	}
+	for i, integritySignature := range integrityBlock.SignatureStack {
+		publicKey := integritySignature.SignatureAttributes[Ed25519publicKeyAttributeName]
+		if len(publicKey) != ed25519.PublicKeySize {
+			return fmt.Errorf("integrityblock: Signature %d has no valid %q attribute.", i, Ed25519publicKeyAttributeName)
+		}
+		signedIntegrityBlock := &IntegrityBlock{
+			Magic:          integrityBlock.Magic,
+			Version:        integrityBlock.Version,
+			SignatureStack: integrityBlock.SignatureStack[i+1:],
+		}
+		signedIntegrityBlockBytes, err := signedIntegrityBlock.CborBytes()
+		if err != nil {
+			return err
+		}
+		dataToBeSigned, err := GenerateDataToBeSigned(webBundleHash, signedIntegrityBlockBytes, integritySignature.SignatureAttributes)
+		if err != nil {
+			return err
+		}
+		if _, err := VerifyEd25519Signature(ed25519.PublicKey(publicKey), integritySignature.Signature, dataToBeSigned); err != nil {
+			return fmt.Errorf("integrityblock: Signature %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
 func (integrityBlock *IntegrityBlock) addNewSignatureToIntegrityBlock(signatureAttributes SignatureAttributesMap, signature []byte) {
 	is := []*IntegritySignature{{
 		SignatureAttributes: signatureAttributes,
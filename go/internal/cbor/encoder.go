@@ -112,6 +112,12 @@ func (e *Encoder) EncodeByteString(bs []byte) error {
 	return e.encodeBytes(TypeBytes, bs)
 }
 
+// EncodeByteStringHeader encodes only the head of a byte string of n bytes.
+// The caller must write the n bytes of content to the underlying writer.
+func (e *Encoder) EncodeByteStringHeader(n uint64) error {
+	return e.encodeTypedUint(TypeBytes, n)
+}
+
 func (e *Encoder) EncodeTextString(s string) error {
 	// Major type 3:  a text string, specifically a string of Unicode
 	//   characters that is encoded as UTF-8 [RFC3629].  The format of this
@@ -4,11 +4,14 @@ import (
 	"crypto"
 	"crypto/ecdsa"
 	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
 	"crypto/x509"
 	"encoding/pem"
 	"errors"
 	"fmt"
 	"os"
+	"strings"
 
 	"github.com/youmark/pkcs8"
 	"golang.org/x/crypto/ssh/terminal"
@@ -37,7 +40,21 @@ func ParseCertificates(text []byte) ([]*x509.Certificate, error) {
 	return certs, nil
 }
 
+// ParsePrivateKey parses a private key from PEM text (see ParsePrivateKeyPEM),
+// or from the DER encoding of an SEC1 or unencrypted PKCS#8 private key.
 func ParsePrivateKey(text []byte) (crypto.PrivateKey, error) {
+	if block, _ := pem.Decode(text); block == nil {
+		return parsePrivateKeyBlock(text)
+	}
+	return ParsePrivateKeyPEM(text)
+}
+
+// ParsePrivateKeyPEM parses the first private key in PEM text, from an
+// "EC PRIVATE KEY" (SEC1), "PRIVATE KEY" (PKCS#8) or "ENCRYPTED PRIVATE KEY"
+// block. Blocks that do not hold a private key, e.g. certificates, are
+// skipped. The key must be an ECDSA P-256 or P-384 key, or an Ed25519 key.
+func ParsePrivateKeyPEM(text []byte) (crypto.PrivateKey, error) {
+	err := errors.New("signingalgorithm: could not find private key.")
 	for len(text) > 0 {
 		var block *pem.Block
 		block, text = pem.Decode(text)
@@ -45,39 +62,56 @@ func ParsePrivateKey(text []byte) (crypto.PrivateKey, error) {
 			return nil, errors.New("signingalgorithm: invalid PEM block in private key.")
 		}
 
+		var privkey crypto.PrivateKey
+		var blockErr error
 		if block.Type == "ENCRYPTED PRIVATE KEY" {
-			if privkey, err := parseEncryptedPrivateKeyBlock(block.Bytes); err == nil {
-				return privkey, nil
-			}
+			privkey, blockErr = parseEncryptedPrivateKeyBlock(block.Bytes)
 		} else {
-			if privkey, err := parsePrivateKeyBlock(block.Bytes); err == nil {
-				return privkey, nil
-			}
+			privkey, blockErr = parsePrivateKeyBlock(block.Bytes)
+		}
+		if blockErr == nil {
+			return privkey, nil
+		}
+		if strings.HasSuffix(block.Type, "PRIVATE KEY") {
+			err = blockErr
 		}
 	}
 
-	return nil, errors.New("signingalgorithm: could not find private key.")
+	return nil, err
 }
 
-func typeSupportedPKCS8key(keyInterface any) (crypto.PrivateKey, error) {
-	switch typedKey := keyInterface.(type) {
+// supportedPrivateKey returns key if it is of a supported type and curve.
+func supportedPrivateKey(key any) (crypto.PrivateKey, error) {
+	switch typedKey := key.(type) {
 	case *ecdsa.PrivateKey:
-		return typedKey, nil
+		switch name := typedKey.Curve.Params().Name; name {
+		case elliptic.P256().Params().Name, elliptic.P384().Params().Name:
+			return typedKey, nil
+		default:
+			return nil, fmt.Errorf("signingalgorithm: unsupported private key algorithm: ECDSA with curve %s", name)
+		}
 	case ed25519.PrivateKey:
 		return typedKey, nil
+	case *rsa.PrivateKey:
+		return nil, errors.New("signingalgorithm: unsupported private key algorithm: RSA")
 	default:
-		return nil, fmt.Errorf("signingalgorithm: unknown private key type in PKCS#8: %T", typedKey)
+		return nil, fmt.Errorf("signingalgorithm: unsupported private key type: %T", typedKey)
 	}
 }
 
 func parsePrivateKeyBlock(derKey []byte) (crypto.PrivateKey, error) {
-	// Try each of 2 key formats and take the first one that successfully parses.
+	// Try each key format and take the first one that successfully parses.
 	if key, err := x509.ParseECPrivateKey(derKey); err == nil {
-		return key, nil
+		return supportedPrivateKey(key)
 	}
 
 	if keyInterface, err := x509.ParsePKCS8PrivateKey(derKey); err == nil {
-		return typeSupportedPKCS8key(keyInterface)
+		return supportedPrivateKey(keyInterface)
+	}
+
+	// PKCS#1 is only parsed to report that RSA keys are unsupported.
+	if key, err := x509.ParsePKCS1PrivateKey(derKey); err == nil {
+		return supportedPrivateKey(key)
 	}
 
 	return nil, errors.New("signingalgorithm: couldn't parse private key.")
@@ -99,7 +133,7 @@ func parseEncryptedPrivateKeyBlock(derKey []byte) (crypto.PrivateKey, error) {
 	}
 
 	if keyInterface, err := pkcs8.ParsePKCS8PrivateKey(derKey, passphrase); err == nil {
-		return typeSupportedPKCS8key(keyInterface)
+		return supportedPrivateKey(keyInterface)
 	}
 
 	return nil, errors.New("signingalgorithm: couldn't parse encrypted private key.")
@@ -0,0 +1,156 @@
+package signingalgorithm
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"encoding/asn1"
+	"fmt"
+	"math/big"
+)
+
+// DeterministicSigningAlgorithmForPrivateKey is like
+// SigningAlgorithmForPrivateKey, but returns a SigningAlgorithm whose
+// signatures depend only on pk and the message, so that signing the same
+// message twice gives the same bytes. ECDSA nonces are derived from pk and
+// the hash of the message as in RFC 6979, with the hash function of the
+// curve. Ed25519 signatures are deterministic anyway. Other crypto.Signers
+// are refused, as there is no telling how they sign.
+func DeterministicSigningAlgorithmForPrivateKey(pk crypto.PrivateKey) (SigningAlgorithm, error) {
+	switch pk := pk.(type) {
+	case ed25519.PrivateKey:
+		return &ed25519SigningAlgorithm{pk}, nil
+	case *ecdsa.PrivateKey:
+		switch name := pk.Curve.Params().Name; name {
+		case elliptic.P256().Params().Name:
+			return newRFC6979SigningAlgorithm(pk, crypto.SHA256), nil
+		case elliptic.P384().Params().Name:
+			return newRFC6979SigningAlgorithm(pk, crypto.SHA384), nil
+		default:
+			return nil, fmt.Errorf("signingalgorithm: unknown ECDSA curve: %s", name)
+		}
+	}
+	return nil, fmt.Errorf("signingalgorithm: deterministic signing is not supported for private key type: %T", pk)
+}
+
+// rfc6979SigningAlgorithm signs with an ECDSA key whose curve has an order of
+// a whole number of bytes, like P-256 and P-384. The arithmetic on the nonce
+// and the private key is done in constant time by scalarField.
+type rfc6979SigningAlgorithm struct {
+	privKey *ecdsa.PrivateKey
+	hash    crypto.Hash
+	field   *scalarField
+}
+
+func newRFC6979SigningAlgorithm(pk *ecdsa.PrivateKey, hash crypto.Hash) *rfc6979SigningAlgorithm {
+	return &rfc6979SigningAlgorithm{pk, hash, newScalarField(pk.Curve.Params().N)}
+}
+
+func (e *rfc6979SigningAlgorithm) Sign(m []byte) ([]byte, error) {
+	hash := e.hash.New()
+	hash.Write(m)
+	digest := hash.Sum(nil)
+
+	curve := e.privKey.Curve
+	n := curve.Params().N
+	f := e.field
+	// The digest is public, so big.Int may be used for it.
+	z := bits2int(digest, n)
+	if z.Cmp(n) >= 0 {
+		z.Sub(z, n)
+	}
+	zm := f.fromBytes(z.FillBytes(make([]byte, f.size)))
+	d := f.fromBytes(e.privKey.D.FillBytes(make([]byte, f.size)))
+	nonces := newRFC6979Nonces(e.privKey.D, digest, n, e.hash, f)
+	for {
+		k := nonces.next()
+		x, _ := curve.ScalarBaseMult(k)
+		r := new(big.Int).Mod(x, n)
+		if r.Sign() == 0 {
+			continue
+		}
+		// s = k^-1 (z + r d) mod n
+		rd := f.mul(f.fromBytes(r.FillBytes(make([]byte, f.size))), d)
+		s := new(big.Int).SetBytes(f.bytes(f.mul(f.inverse(f.fromBytes(k)), f.add(zm, rd))))
+		if s.Sign() == 0 {
+			continue
+		}
+		return asn1.Marshal(ecdsaSigValue{r, s})
+	}
+}
+
+// bits2int is the bits2int of Section 2.3.2 of RFC 6979: b as a big-endian
+// integer, truncated to the bit length of the group order n.
+func bits2int(b []byte, n *big.Int) *big.Int {
+	z := new(big.Int).SetBytes(b)
+	if excess := len(b)*8 - n.BitLen(); excess > 0 {
+		z.Rsh(z, uint(excess))
+	}
+	return z
+}
+
+// rfc6979Nonces generates the candidate nonces of Section 3.2 of RFC 6979.
+type rfc6979Nonces struct {
+	n     *big.Int
+	hash  crypto.Hash
+	field *scalarField
+	k, v  []byte
+}
+
+func newRFC6979Nonces(d *big.Int, digest []byte, n *big.Int, hash crypto.Hash, field *scalarField) *rfc6979Nonces {
+	rlen := (n.BitLen() + 7) / 8
+	// int2octets(x) || bits2octets(h1), see Sections 2.3.3 and 2.3.4.
+	z := bits2int(digest, n)
+	if z.Cmp(n) >= 0 {
+		z.Sub(z, n)
+	}
+	seed := append(d.FillBytes(make([]byte, rlen)), z.FillBytes(make([]byte, rlen))...)
+
+	g := &rfc6979Nonces{
+		n:     n,
+		hash:  hash,
+		field: field,
+		k:     make([]byte, hash.Size()),
+		v:     make([]byte, hash.Size()),
+	}
+	for i := range g.v {
+		g.v[i] = 0x01
+	}
+	// Steps d. to g.
+	g.k = g.mac(g.v, []byte{0x00}, seed)
+	g.v = g.mac(g.v)
+	g.k = g.mac(g.v, []byte{0x01}, seed)
+	g.v = g.mac(g.v)
+	return g
+}
+
+func (g *rfc6979Nonces) mac(data ...[]byte) []byte {
+	m := hmac.New(g.hash.New, g.k)
+	for _, d := range data {
+		m.Write(d)
+	}
+	return m.Sum(nil)
+}
+
+// next returns the next nonce candidate in [1, n-1], following step h, as a
+// big-endian number of the byte length of n. The state is updated
+// afterwards, so that a nonce rejected by the caller is followed by a new
+// one. Since the bit length of n is a multiple of 8, bits2int of the
+// candidate is its first bytes, so the secret nonce is never a big.Int.
+func (g *rfc6979Nonces) next() []byte {
+	for {
+		var t []byte
+		for len(t)*8 < g.n.BitLen() {
+			g.v = g.mac(g.v)
+			t = append(t, g.v...)
+		}
+		k := t[:g.field.size]
+		g.k = g.mac(g.v, []byte{0x00})
+		g.v = g.mac(g.v)
+		if g.field.isValidScalar(k) {
+			return k
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package signingalgorithm
+
+import (
+	"encoding/binary"
+	"math/big"
+	"math/bits"
+)
+
+// scalarField implements arithmetic modulo the odd order n of an elliptic
+// curve, on fixed-size numbers in the Montgomery domain, in constant time with
+// respect to the values operated on, unlike big.Int. It is used for the
+// secret nonce and private key of ECDSA signing. Numbers are little-endian
+// slices of 64-bit limbs, as many as n has.
+//
+// crypto/ecdsa signs deterministically per RFC 6979 from Go 1.24 on; this can
+// be replaced with it once go.mod requires that version.
+type scalarField struct {
+	n []uint64
+	// n0inv is -n^-1 mod 2^64.
+	n0inv uint64
+	// rr is R^2 mod n, where R is 2^(64*len(n)), for converting into the
+	// Montgomery domain.
+	rr []uint64
+	// size is the byte length of n.
+	size int
+}
+
+func newScalarField(n *big.Int) *scalarField {
+	limbs := (n.BitLen() + 63) / 64
+	f := &scalarField{size: (n.BitLen() + 7) / 8}
+	f.n = f.limbsFromBytes(n.Bytes(), limbs)
+	// Newton's iteration doubles the number of correct low bits of the
+	// inverse of an odd number, starting from 1 which is correct mod 2.
+	inv := uint64(1)
+	for i := 0; i < 6; i++ {
+		inv *= 2 - f.n[0]*inv
+	}
+	f.n0inv = -inv
+	// n is public, so big.Int may be used for it.
+	rr := new(big.Int).Lsh(big.NewInt(1), uint(128*limbs))
+	f.rr = f.limbsFromBytes(rr.Mod(rr, n).Bytes(), limbs)
+	return f
+}
+
+// limbsFromBytes returns the big-endian number b as limbs limbs.
+func (f *scalarField) limbsFromBytes(b []byte, limbs int) []uint64 {
+	buf := make([]byte, limbs*8)
+	copy(buf[len(buf)-len(b):], b)
+	x := make([]uint64, limbs)
+	for i := range x {
+		x[i] = binary.BigEndian.Uint64(buf[len(buf)-8*(i+1):])
+	}
+	return x
+}
+
+// fromBytes returns the big-endian number b of at most f.size bytes, which
+// must be less than n, in the Montgomery domain.
+func (f *scalarField) fromBytes(b []byte) []uint64 {
+	return f.mul(f.limbsFromBytes(b, len(f.n)), f.rr)
+}
+
+// bytes returns x, in the Montgomery domain, as a big-endian number of
+// f.size bytes.
+func (f *scalarField) bytes(x []uint64) []byte {
+	one := make([]uint64, len(f.n))
+	one[0] = 1
+	x = f.mul(x, one)
+	buf := make([]byte, len(x)*8)
+	for i, l := range x {
+		binary.BigEndian.PutUint64(buf[len(buf)-8*(i+1):], l)
+	}
+	return buf[len(buf)-f.size:]
+}
+
+// isValidScalar returns true if the big-endian number b of f.size bytes is in
+// [1, n-1].
+func (f *scalarField) isValidScalar(b []byte) bool {
+	x := f.limbsFromBytes(b, len(f.n))
+	var borrow, nonZero uint64
+	for i := range x {
+		_, borrow = bits.Sub64(x[i], f.n[i], borrow)
+		nonZero |= x[i]
+	}
+	// x < n if subtracting n borrows.
+	return borrow&((nonZero|-nonZero)>>63) == 1
+}
+
+// mul returns a*b*R^-1 mod n, i.e. the product of a and b in the Montgomery
+// domain, by the coarsely integrated operand scanning method. a and b must be
+// less than n.
+func (f *scalarField) mul(a, b []uint64) []uint64 {
+	limbs := len(f.n)
+	t := make([]uint64, limbs+2)
+	for i := 0; i < limbs; i++ {
+		// t += a * b[i]
+		var c, cc uint64
+		for j := 0; j < limbs; j++ {
+			hi, lo := bits.Mul64(a[j], b[i])
+			lo, cc = bits.Add64(lo, t[j], 0)
+			hi += cc
+			lo, cc = bits.Add64(lo, c, 0)
+			hi += cc
+			t[j], c = lo, hi
+		}
+		t[limbs], cc = bits.Add64(t[limbs], c, 0)
+		t[limbs+1] = cc
+
+		// t = (t + m*n) / 2^64, where m makes the lowest limb zero.
+		m := t[0] * f.n0inv
+		hi, lo := bits.Mul64(m, f.n[0])
+		_, cc = bits.Add64(lo, t[0], 0)
+		c = hi + cc
+		for j := 1; j < limbs; j++ {
+			hi, lo = bits.Mul64(m, f.n[j])
+			lo, cc = bits.Add64(lo, t[j], 0)
+			hi += cc
+			lo, cc = bits.Add64(lo, c, 0)
+			hi += cc
+			t[j-1], c = lo, hi
+		}
+		t[limbs-1], cc = bits.Add64(t[limbs], c, 0)
+		t[limbs] = t[limbs+1] + cc
+	}
+	return f.reduce(t[:limbs], t[limbs])
+}
+
+// add returns a+b mod n. a and b must be less than n.
+func (f *scalarField) add(a, b []uint64) []uint64 {
+	sum := make([]uint64, len(f.n))
+	var carry uint64
+	for i := range sum {
+		sum[i], carry = bits.Add64(a[i], b[i], carry)
+	}
+	return f.reduce(sum, carry)
+}
+
+// reduce returns x mod n for x = carry*R + x less than 2n, subtracting n if
+// needed without branching on x.
+func (f *scalarField) reduce(x []uint64, carry uint64) []uint64 {
+	d := make([]uint64, len(x))
+	var borrow uint64
+	for i := range x {
+		d[i], borrow = bits.Sub64(x[i], f.n[i], borrow)
+	}
+	// x >= n if there is a carry, or if subtracting n does not borrow.
+	mask := -(carry | (1 - borrow))
+	for i := range d {
+		d[i] = x[i] ^ (mask & (x[i] ^ d[i]))
+	}
+	return d
+}
+
+// inverse returns x^-1 mod n, by Fermat's little theorem as x^(n-2), in the
+// Montgomery domain. The exponent is public, so only the multiplications need
+// to be constant time.
+func (f *scalarField) inverse(x []uint64) []uint64 {
+	e := make([]uint64, len(f.n))
+	copy(e, f.n)
+	var borrow uint64
+	e[0], borrow = bits.Sub64(e[0], 2, 0)
+	for i := 1; i < len(e); i++ {
+		e[i], borrow = bits.Sub64(e[i], 0, borrow)
+	}
+
+	one := make([]uint64, len(f.n))
+	one[0] = 1
+	// R mod n, the Montgomery form of 1.
+	z := f.mul(f.rr, one)
+	for i := len(e) - 1; i >= 0; i-- {
+		for j := 63; j >= 0; j-- {
+			z = f.mul(z, z)
+			if e[i]>>uint(j)&1 == 1 {
+				z = f.mul(z, x)
+			}
+		}
+	}
+	return z
+}
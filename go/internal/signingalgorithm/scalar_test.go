@@ -0,0 +1,135 @@
+package signingalgorithm
+
+import (
+	"crypto/elliptic"
+	"crypto/rand"
+	"math/big"
+	"testing"
+)
+
+// scalarTestValues returns the edge cases 0, 1, 2, n-2 and n-1, and random
+// numbers less than n.
+func scalarTestValues(t *testing.T, n *big.Int) []*big.Int {
+	one := big.NewInt(1)
+	values := []*big.Int{
+		big.NewInt(0),
+		one,
+		big.NewInt(2),
+		new(big.Int).Sub(n, big.NewInt(2)),
+		new(big.Int).Sub(n, one),
+	}
+	for i := 0; i < 20; i++ {
+		x, err := rand.Int(rand.Reader, n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		values = append(values, x)
+	}
+	return values
+}
+
+func limbsToInt(x []uint64) *big.Int {
+	z := new(big.Int)
+	for i := len(x) - 1; i >= 0; i-- {
+		z.Lsh(z, 64)
+		z.Or(z, new(big.Int).SetUint64(x[i]))
+	}
+	return z
+}
+
+func forEachCurve(t *testing.T, f func(t *testing.T, field *scalarField, n *big.Int)) {
+	for _, curve := range []elliptic.Curve{elliptic.P224(), elliptic.P256(), elliptic.P384(), elliptic.P521()} {
+		n := curve.Params().N
+		t.Run(curve.Params().Name, func(t *testing.T) {
+			f(t, newScalarField(n), n)
+		})
+	}
+}
+
+func TestScalarFieldMul(t *testing.T) {
+	forEachCurve(t, func(t *testing.T, field *scalarField, n *big.Int) {
+		values := scalarTestValues(t, n)
+		for _, a := range values {
+			for _, b := range values {
+				got := new(big.Int).SetBytes(field.bytes(field.mul(field.fromBytes(a.Bytes()), field.fromBytes(b.Bytes()))))
+				want := new(big.Int).Mul(a, b)
+				want.Mod(want, n)
+				if got.Cmp(want) != 0 {
+					t.Errorf("%x * %x: got %x, want %x", a, b, got, want)
+				}
+			}
+		}
+	})
+}
+
+func TestScalarFieldAdd(t *testing.T) {
+	forEachCurve(t, func(t *testing.T, field *scalarField, n *big.Int) {
+		values := scalarTestValues(t, n)
+		for _, a := range values {
+			for _, b := range values {
+				got := new(big.Int).SetBytes(field.bytes(field.add(field.fromBytes(a.Bytes()), field.fromBytes(b.Bytes()))))
+				want := new(big.Int).Add(a, b)
+				want.Mod(want, n)
+				if got.Cmp(want) != 0 {
+					t.Errorf("%x + %x: got %x, want %x", a, b, got, want)
+				}
+			}
+		}
+	})
+}
+
+func TestScalarFieldInverse(t *testing.T) {
+	forEachCurve(t, func(t *testing.T, field *scalarField, n *big.Int) {
+		for _, a := range scalarTestValues(t, n) {
+			if a.Sign() == 0 {
+				continue
+			}
+			got := new(big.Int).SetBytes(field.bytes(field.inverse(field.fromBytes(a.Bytes()))))
+			if want := new(big.Int).ModInverse(a, n); got.Cmp(want) != 0 {
+				t.Errorf("%x^-1: got %x, want %x", a, got, want)
+			}
+		}
+	})
+}
+
+func TestScalarFieldReduce(t *testing.T) {
+	forEachCurve(t, func(t *testing.T, field *scalarField, n *big.Int) {
+		limbs := len(field.n)
+		r := new(big.Int).Lsh(big.NewInt(1), uint(64*limbs))
+		for _, a := range scalarTestValues(t, n) {
+			// Both a and a+n, which may not fit in the limbs, reduce to a.
+			for _, x := range []*big.Int{a, new(big.Int).Add(a, n)} {
+				low := new(big.Int).Mod(x, r)
+				carry := new(big.Int).Rsh(x, uint(64*limbs)).Uint64()
+				got := limbsToInt(field.reduce(field.limbsFromBytes(low.Bytes(), limbs), carry))
+				if got.Cmp(a) != 0 {
+					t.Errorf("%x mod n: got %x, want %x", x, got, a)
+				}
+			}
+		}
+	})
+}
+
+func TestScalarFieldIsValidScalar(t *testing.T) {
+	forEachCurve(t, func(t *testing.T, field *scalarField, n *big.Int) {
+		pad := func(x *big.Int) []byte {
+			return x.FillBytes(make([]byte, field.size))
+		}
+		one := big.NewInt(1)
+		for _, tc := range []struct {
+			x    *big.Int
+			want bool
+		}{
+			{big.NewInt(0), false},
+			{one, true},
+			{new(big.Int).Sub(n, one), true},
+			{n, false},
+			{new(big.Int).Add(n, one), false},
+			{new(big.Int).Sub(new(big.Int).Lsh(one, uint(8*field.size)), one), false},
+		} {
+			if got := field.isValidScalar(pad(tc.x)); got != tc.want {
+				t.Errorf("isValidScalar(%x): got %v, want %v", tc.x, got, tc.want)
+			}
+		}
+	})
+}
@@ -3,6 +3,7 @@ package signingalgorithm
 import (
 	"crypto"
 	"crypto/ecdsa"
+	"crypto/ed25519"
 	"crypto/elliptic"
 	"crypto/sha256"
 	_ "crypto/sha512"
@@ -46,8 +47,21 @@ func (e *ecdsaSigningAlgorithm) Sign(m []byte) ([]byte, error) {
 	return asn1.Marshal(ecdsaSigValue{r, s})
 }
 
+type ed25519SigningAlgorithm struct {
+	privKey ed25519.PrivateKey
+}
+
+func (e *ed25519SigningAlgorithm) Sign(m []byte) ([]byte, error) {
+	return ed25519.Sign(e.privKey, m), nil
+}
+
+// SigningAlgorithmForPrivateKey returns a SigningAlgorithm that signs with pk,
+// an *ecdsa.PrivateKey, an ed25519.PrivateKey or any other crypto.Signer (see
+// SigningAlgorithmForSigner). rand is the source of randomness for signing.
 func SigningAlgorithmForPrivateKey(pk crypto.PrivateKey, rand io.Reader) (SigningAlgorithm, error) {
 	switch pk := pk.(type) {
+	case ed25519.PrivateKey:
+		return &ed25519SigningAlgorithm{pk}, nil
 	case *ecdsa.PrivateKey:
 		switch name := pk.Curve.Params().Name; name {
 		case elliptic.P256().Params().Name:
@@ -57,10 +71,51 @@ func SigningAlgorithmForPrivateKey(pk crypto.PrivateKey, rand io.Reader) (Signin
 		default:
 			return nil, fmt.Errorf("signingalgorithm: unknown ECDSA curve: %s", name)
 		}
+	case crypto.Signer:
+		// Keys held outside the process, e.g. in a hardware module or a KMS.
+		return SigningAlgorithmForSigner(pk, rand)
 	}
 	return nil, fmt.Errorf("signingalgorithm: unknown private key type: %T", pk)
 }
 
+type cryptoSignerSigningAlgorithm struct {
+	signer crypto.Signer
+	hash   crypto.Hash
+	rand   io.Reader
+}
+
+func (c *cryptoSignerSigningAlgorithm) Sign(m []byte) ([]byte, error) {
+	if c.hash == 0 {
+		// Ed25519 signs the message itself.
+		return c.signer.Sign(c.rand, m, crypto.Hash(0))
+	}
+	hash := c.hash.New()
+	hash.Write(m)
+	return c.signer.Sign(c.rand, hash.Sum(nil), c.hash)
+}
+
+// SigningAlgorithmForSigner returns a SigningAlgorithm that signs with signer,
+// e.g. a key held in a hardware module. The public key of signer must be an
+// ECDSA key, and signer must return ASN.1 encoded ECDSA signatures like
+// *ecdsa.PrivateKey does, or an Ed25519 key. The returned SigningAlgorithm is
+// safe for concurrent use if signer is.
+func SigningAlgorithmForSigner(signer crypto.Signer, rand io.Reader) (SigningAlgorithm, error) {
+	switch pub := signer.Public().(type) {
+	case ed25519.PublicKey:
+		return &cryptoSignerSigningAlgorithm{signer, crypto.Hash(0), rand}, nil
+	case *ecdsa.PublicKey:
+		switch name := pub.Params().Name; name {
+		case elliptic.P256().Params().Name:
+			return &cryptoSignerSigningAlgorithm{signer, crypto.SHA256, rand}, nil
+		case elliptic.P384().Params().Name:
+			return &cryptoSignerSigningAlgorithm{signer, crypto.SHA384, rand}, nil
+		default:
+			return nil, fmt.Errorf("signingalgorithm: unknown ECDSA curve: %s", name)
+		}
+	}
+	return nil, fmt.Errorf("signingalgorithm: unknown public key type: %T", signer.Public())
+}
+
 type Verifier interface {
 	Verify(msg, sig []byte) (bool, error)
 }
@@ -85,8 +140,18 @@ func (e *ecdsaVerifier) Verify(msg, sig []byte) (bool, error) {
 	return ecdsa.Verify(e.pubKey, hash.Sum(nil), v.R, v.S), nil
 }
 
+type ed25519Verifier struct {
+	pubKey ed25519.PublicKey
+}
+
+func (e *ed25519Verifier) Verify(msg, sig []byte) (bool, error) {
+	return ed25519.Verify(e.pubKey, msg, sig), nil
+}
+
 func VerifierForPublicKey(k crypto.PublicKey) (Verifier, error) {
 	switch k := k.(type) {
+	case ed25519.PublicKey:
+		return &ed25519Verifier{k}, nil
 	case *ecdsa.PublicKey:
 		switch name := k.Params().Name; name {
 		case elliptic.P256().Params().Name:
@@ -99,3 +164,29 @@ func VerifierForPublicKey(k crypto.PublicKey) (Verifier, error) {
 	}
 	return nil, fmt.Errorf("signingalgorithm: unknown public key type: %T", k)
 }
+
+// Names of the signature algorithms, from the TLS SignatureScheme registry.
+const (
+	ECDSAP256SHA256 = "ecdsa_secp256r1_sha256"
+	ECDSAP384SHA384 = "ecdsa_secp384r1_sha384"
+	Ed25519         = "ed25519"
+)
+
+// AlgorithmName returns the name of the signature algorithm used with the
+// public key k, e.g. ECDSAP256SHA256.
+func AlgorithmName(k crypto.PublicKey) (string, error) {
+	switch k := k.(type) {
+	case *ecdsa.PublicKey:
+		switch name := k.Params().Name; name {
+		case elliptic.P256().Params().Name:
+			return ECDSAP256SHA256, nil
+		case elliptic.P384().Params().Name:
+			return ECDSAP384SHA384, nil
+		default:
+			return "", fmt.Errorf("signingalgorithm: unknown ECDSA curve: %s", name)
+		}
+	case ed25519.PublicKey:
+		return Ed25519, nil
+	}
+	return "", fmt.Errorf("signingalgorithm: unknown public key type: %T", k)
+}
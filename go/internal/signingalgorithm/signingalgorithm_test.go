@@ -1,11 +1,19 @@
 package signingalgorithm_test
 
 import (
+	"bytes"
+	"crypto"
 	"crypto/ecdsa"
 	"crypto/ed25519"
 	"crypto/elliptic"
 	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/pem"
+	"math/big"
 	"os"
+	"strings"
 	"testing"
 
 	. "github.com/WICG/webpackage/go/internal/signingalgorithm"
@@ -94,3 +102,231 @@ func TestSignVerify_ED25519_Encrypted(t *testing.T) {
 		t.Error("Signature verification failed with encrypted Ed25519 key")
 	}
 }
+
+func TestParsePrivateKeyFormats(t *testing.T) {
+	pk, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate ecdsa private key: %v", err)
+	}
+	sec1, err := x509.MarshalECPrivateKey(pk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(pk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sec1PEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: sec1})
+	pkcs8PEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8})
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: []byte("not a cert")})
+
+	for _, test := range []struct {
+		name  string
+		parse func([]byte) (crypto.PrivateKey, error)
+		text  []byte
+	}{
+		{"SEC1 DER", ParsePrivateKey, sec1},
+		{"PKCS#8 DER", ParsePrivateKey, pkcs8},
+		{"SEC1 PEM", ParsePrivateKey, sec1PEM},
+		{"PKCS#8 PEM", ParsePrivateKey, pkcs8PEM},
+		{"SEC1 PEM via ParsePrivateKeyPEM", ParsePrivateKeyPEM, sec1PEM},
+		{"PKCS#8 PEM after a certificate", ParsePrivateKeyPEM, append(certPEM, pkcs8PEM...)},
+	} {
+		got, err := test.parse(test.text)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+			continue
+		}
+		if !pk.Equal(got) {
+			t.Errorf("%s: parsed key does not match the original key", test.name)
+		}
+	}
+}
+
+func TestParsePrivateKeyUnsupported(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatalf("Failed to generate rsa private key: %v", err)
+	}
+	rsaPKCS8, err := x509.MarshalPKCS8PrivateKey(rsaKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p224Key, err := ecdsa.GenerateKey(elliptic.P224(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate ecdsa private key: %v", err)
+	}
+	p224SEC1, err := x509.MarshalECPrivateKey(p224Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name    string
+		text    []byte
+		wantErr string
+	}{
+		{"RSA PKCS#8 DER", rsaPKCS8, "RSA"},
+		{"RSA PKCS#8 PEM", pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: rsaPKCS8}), "RSA"},
+		{"RSA PKCS#1 PEM", pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)}), "RSA"},
+		{"P-224 SEC1 PEM", pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: p224SEC1}), "P-224"},
+		{"garbage DER", []byte("garbage"), "couldn't parse private key"},
+		{"no private key", pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: []byte("x")}), "could not find private key"},
+	} {
+		_, err := ParsePrivateKey(test.text)
+		if err == nil {
+			t.Errorf("%s: unexpectedly succeeded", test.name)
+			continue
+		}
+		if !strings.Contains(err.Error(), test.wantErr) {
+			t.Errorf("%s: error %q does not mention %q", test.name, err, test.wantErr)
+		}
+	}
+}
+
+func TestSigningAlgorithm_ED25519(t *testing.T) {
+	pub, pk, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate ed25519 private key: %v", err)
+	}
+	verifier, err := VerifierForPublicKey(pub)
+	if err != nil {
+		t.Fatalf("Failed to get verifier: %v", err)
+	}
+	msg := []byte("foobar")
+	for _, newAlg := range []func() (SigningAlgorithm, error){
+		func() (SigningAlgorithm, error) { return SigningAlgorithmForPrivateKey(pk, rand.Reader) },
+		func() (SigningAlgorithm, error) { return SigningAlgorithmForSigner(pk, rand.Reader) },
+	} {
+		alg, err := newAlg()
+		if err != nil {
+			t.Fatalf("Failed to get signing algorithm: %v", err)
+		}
+		sig, err := alg.Sign(msg)
+		if err != nil {
+			t.Fatalf("Failed to sign: %v", err)
+		}
+		if ok, err := verifier.Verify(msg, sig); !ok || err != nil {
+			t.Errorf("Verification failed: %v", err)
+		}
+	}
+	if name, err := AlgorithmName(pub); err != nil || name != "ed25519" {
+		t.Errorf("AlgorithmName: got %q, %v", name, err)
+	}
+}
+
+func TestDeterministicSigningAlgorithm_RFC6979(t *testing.T) {
+	// Test vectors of Appendix A.2.5 of RFC 6979 (ECDSA, 256 bits, SHA-256).
+	fromHex := func(s string) *big.Int {
+		n, ok := new(big.Int).SetString(s, 16)
+		if !ok {
+			t.Fatalf("bad hex %q", s)
+		}
+		return n
+	}
+	pk := &ecdsa.PrivateKey{
+		PublicKey: ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X:     fromHex("60FED4BA255A9D31C961EB74C6356D68C049B8923B61FA6CE669622E60F29FB6"),
+			Y:     fromHex("7903FE1008B8BC99A41AE9E95628BC64F2F1B20C2D7E9F5177A3C294D4462299"),
+		},
+		D: fromHex("C9AFA9D845BA75166B5C215767B1D6934E50C3DB36E89B127B8A622B120F6721"),
+	}
+	alg, err := DeterministicSigningAlgorithmForPrivateKey(pk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		msg, r, s string
+	}{
+		{"sample", "EFD48B2AACB6A8FD1140DD9CD45E81D69D2C877B56AAF991C34D0EA84EAF3716", "F7CB1C942D657C41D436C7A1B6E29F65F3E900DBB9AFF4064DC4AB2F843ACDA8"},
+		{"test", "F1ABB023518351CD71D881567B1EA663ED3EFCF6C5132B354F28D3B0B7D38367", "019F4113742A2B14BD25926B49C649155F267E60D3814B4C0CC84250E46F0083"},
+	} {
+		sig, err := alg.Sign([]byte(c.msg))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got struct{ R, S *big.Int }
+		if _, err := asn1.Unmarshal(sig, &got); err != nil {
+			t.Fatal(err)
+		}
+		if got.R.Cmp(fromHex(c.r)) != 0 || got.S.Cmp(fromHex(c.s)) != 0 {
+			t.Errorf("%q: got r = %X, s = %X, want r = %s, s = %s", c.msg, got.R, got.S, c.r, c.s)
+		}
+	}
+}
+
+func TestDeterministicSigningAlgorithm(t *testing.T) {
+	p384, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, ed25519Key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, pk := range []crypto.Signer{p384, ed25519Key} {
+		alg, err := DeterministicSigningAlgorithmForPrivateKey(pk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg := []byte("foobar")
+		sig, err := alg.Sign(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		again, err := alg.Sign(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(sig, again) {
+			t.Errorf("%T: signatures of the same message differ", pk)
+		}
+		verifier, err := VerifierForPublicKey(pk.Public())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok, err := verifier.Verify(msg, sig); !ok || err != nil {
+			t.Errorf("%T: verification failed: %v, %v", pk, ok, err)
+		}
+	}
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := DeterministicSigningAlgorithmForPrivateKey(rsaKey); err == nil {
+		t.Error("DeterministicSigningAlgorithmForPrivateKey unexpectedly accepted an RSA key")
+	}
+}
+
+func TestDeterministicSigningAlgorithm_ManyMessages(t *testing.T) {
+	// Exercises the constant-time scalar arithmetic on many nonces, checking
+	// the signatures with crypto/ecdsa.
+	for _, curve := range []elliptic.Curve{elliptic.P256(), elliptic.P384()} {
+		pk, err := ecdsa.GenerateKey(curve, rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		alg, err := DeterministicSigningAlgorithmForPrivateKey(pk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hash := crypto.SHA256
+		if curve == elliptic.P384() {
+			hash = crypto.SHA384
+		}
+		for i := 0; i < 100; i++ {
+			msg := []byte{byte(i)}
+			sig, err := alg.Sign(msg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			h := hash.New()
+			h.Write(msg)
+			if !ecdsa.VerifyASN1(&pk.PublicKey, h.Sum(nil), sig) {
+				t.Fatalf("%s: signature of message %d does not verify", curve.Params().Name, i)
+			}
+		}
+	}
+}
@@ -0,0 +1,56 @@
+// Package batch signs many signed exchanges concurrently, e.g. all pages of a
+// static site.
+package batch
+
+import (
+	"context"
+	"runtime"
+	"sync"
+
+	"github.com/WICG/webpackage/go/signedexchange"
+)
+
+// SignAll signs each of exchanges with s, like e.AddSignatureHeader(s), using
+// up to concurrency goroutines. If concurrency is not positive,
+// runtime.GOMAXPROCS(0) goroutines are used.
+//
+// Signing does not modify s, so all exchanges are signed with it
+// concurrently. The signing algorithm, and so s.PrivKey or s.Algorithm, must
+// therefore be safe for concurrent use, which *ecdsa.PrivateKey and
+// ed25519.PrivateKey are. If s.Date is zero, each exchange is dated when it is
+// signed, see Signer.Now.
+//
+// SignAll returns the errors of the exchanges, in the order of exchanges;
+// errs[i] is nil if exchanges[i] was signed. Once ctx is done, the exchanges
+// that have not been signed yet fail with ctx.Err(). The exchanges must not be
+// used by other goroutines during the call.
+func SignAll(ctx context.Context, exchanges []*signedexchange.Exchange, s *signedexchange.Signer, concurrency int) (errs []error) {
+	errs = make([]error, len(exchanges))
+	if concurrency <= 0 {
+		concurrency = runtime.GOMAXPROCS(0)
+	}
+	if concurrency > len(exchanges) {
+		concurrency = len(exchanges)
+	}
+	indices := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < concurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indices {
+				if err := ctx.Err(); err != nil {
+					errs[i] = err
+					continue
+				}
+				errs[i] = exchanges[i].AddSignatureHeader(s)
+			}
+		}()
+	}
+	for i := range exchanges {
+		indices <- i
+	}
+	close(indices)
+	wg.Wait()
+	return errs
+}
@@ -0,0 +1,79 @@
+package batch_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/WICG/webpackage/go/signedexchange"
+	. "github.com/WICG/webpackage/go/signedexchange/batch"
+	"github.com/WICG/webpackage/go/signedexchange/signedexchangetest"
+	"github.com/WICG/webpackage/go/signedexchange/version"
+)
+
+var signatureDate = signedexchangetest.SignatureDate
+
+func createTestExchanges(t *testing.T, n int) []*signedexchange.Exchange {
+	var exchanges []*signedexchange.Exchange
+	for i := 0; i < n; i++ {
+		header := http.Header{}
+		header.Add("Content-Type", "text/html; charset=utf-8")
+		uri := fmt.Sprintf("https://example.com/page%d.html", i)
+		payload := []byte(fmt.Sprintf("<p>page %d</p>", i))
+		e := signedexchange.NewExchange(version.Version1b3, uri, http.MethodGet, nil, 200, header, payload)
+		if err := e.MiEncodePayload(16); err != nil {
+			t.Fatal(err)
+		}
+		exchanges = append(exchanges, e)
+	}
+	return exchanges
+}
+
+func TestSignAll(t *testing.T) {
+	s, certBytes := signedexchangetest.NewSigner(t)
+	exchanges := createTestExchanges(t, 20)
+	// A request URL without the https scheme cannot be signed.
+	exchanges[7].RequestURI = "http://example.com/page7.html"
+
+	errs := SignAll(context.Background(), exchanges, s, 4)
+	if len(errs) != len(exchanges) {
+		t.Fatalf("len(errs): got %d, want %d", len(errs), len(exchanges))
+	}
+	certFetcher := func(_ string) ([]byte, error) { return certBytes, nil }
+	for i, e := range exchanges {
+		if i == 7 {
+			if errs[i] == nil {
+				t.Errorf("exchange %d: unexpectedly signed", i)
+			}
+			continue
+		}
+		if errs[i] != nil {
+			t.Errorf("exchange %d: %v", i, errs[i])
+			continue
+		}
+		if _, err := e.VerifyWithResult(signatureDate, certFetcher); err != nil {
+			t.Errorf("exchange %d: verification failed: %v", i, err)
+		}
+	}
+	if s.Algorithm != nil {
+		t.Error("SignAll modified the Signer")
+	}
+}
+
+func TestSignAllCanceled(t *testing.T) {
+	s, _ := signedexchangetest.NewSigner(t)
+	exchanges := createTestExchanges(t, 5)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	for i, err := range SignAll(ctx, exchanges, s, 0) {
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("exchange %d: got error %v, want %v", i, err, context.Canceled)
+		}
+		if exchanges[i].SignatureHeaderValue != "" {
+			t.Errorf("exchange %d: unexpectedly signed", i)
+		}
+	}
+}
@@ -0,0 +1,275 @@
+package batch
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/WICG/webpackage/go/signedexchange"
+)
+
+// maxValidity is the longest validity of a signature.
+const maxValidity = 7 * 24 * time.Hour
+
+// Resigner signs exchanges again before their signatures expire, so that they
+// can be served for longer than the 7 days a signature can be valid for.
+//
+// The exchanges are Exchanges, and the signed exchanges in the .sxg files
+// under Dir, which are replaced by the re-signed ones. An exchange is due to
+// be re-signed once its first signature expires within RefreshBefore, or if it
+// has no signature.
+type Resigner struct {
+	// Signer signs the exchanges, see SignAll. It is not modified: the
+	// exchanges are signed with a copy of it whose Date and Expires are the
+	// time of signing and Validity after it.
+	Signer *signedexchange.Signer
+
+	// Exchanges are re-signed in place, or replaced if Fetch returns a new
+	// exchange. They must not be used by other goroutines while the
+	// Resigner runs.
+	Exchanges []*signedexchange.Exchange
+
+	// Dir, if non-empty, is a directory whose .sxg files, including those
+	// in subdirectories, are re-signed.
+	Dir string
+
+	// Validity is the duration signatures are valid for. If zero, 7 days
+	// is used.
+	Validity time.Duration
+
+	// RefreshBefore is how long before their expiry exchanges are
+	// re-signed. If zero, half of Validity is used.
+	RefreshBefore time.Duration
+
+	// Interval is the time between two checks of Run. If zero, an hour is
+	// used.
+	Interval time.Duration
+
+	// Concurrency is passed to SignAll.
+	Concurrency int
+
+	// Fetch, if non-nil, is called with each exchange due to be re-signed,
+	// e.g. to fetch the resource from the origin again. If the resource
+	// changed, it returns a new, MI-encoded exchange that is signed in
+	// place of e; otherwise it returns nil. If it fails, e is not
+	// re-signed, and is retried by the next check.
+	Fetch func(ctx context.Context, e *signedexchange.Exchange) (*signedexchange.Exchange, error)
+
+	// Report, if non-nil, is called with the result of each exchange due
+	// to be re-signed.
+	Report func(ResignResult)
+
+	// Now returns the current time. If nil, time.Now is used.
+	Now func() time.Time
+}
+
+// ResignResult is the result of re-signing an exchange.
+type ResignResult struct {
+	RequestURI string
+	// Path is the file of the exchange if it is in Resigner.Dir.
+	Path string
+	// Expires is the expiry of the new signature.
+	Expires time.Time
+	// Fetched is true if Resigner.Fetch returned a new exchange.
+	Fetched bool
+	// Err is non-nil if the exchange was not re-signed.
+	Err error
+}
+
+// resignItem is an exchange due to be re-signed.
+type resignItem struct {
+	e      *signedexchange.Exchange
+	index  int // in Resigner.Exchanges, if path is empty
+	path   string
+	result ResignResult
+}
+
+func (r *Resigner) validity() time.Duration {
+	if r.Validity == 0 {
+		return maxValidity
+	}
+	return r.Validity
+}
+
+func (r *Resigner) refreshBefore() time.Duration {
+	if r.RefreshBefore == 0 {
+		return r.validity() / 2
+	}
+	return r.RefreshBefore
+}
+
+func (r *Resigner) interval() time.Duration {
+	if r.Interval == 0 {
+		return time.Hour
+	}
+	return r.Interval
+}
+
+func (r *Resigner) now() time.Time {
+	if r.Now == nil {
+		return time.Now()
+	}
+	return r.Now()
+}
+
+// due reports whether e is due to be re-signed at now.
+func (r *Resigner) due(e *signedexchange.Exchange, now time.Time) bool {
+	m, err := e.Metadata()
+	if err != nil {
+		return true
+	}
+	return m.Expires.Sub(now) <= r.refreshBefore()
+}
+
+// Run re-signs the exchanges that are due, like ResignDue, every Interval
+// until ctx is done, and returns ctx.Err(). It returns early if the .sxg files
+// of Dir cannot be listed.
+func (r *Resigner) Run(ctx context.Context) error {
+	for {
+		if _, err := r.ResignDue(ctx); err != nil {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(r.interval()):
+		}
+	}
+}
+
+// ResignDue re-signs the exchanges that are due and returns their results,
+// which are also passed to Report. It fails only if the .sxg files of Dir
+// cannot be listed; the errors of each exchange are in its result.
+func (r *Resigner) ResignDue(ctx context.Context) ([]ResignResult, error) {
+	now := r.now()
+	items, err := r.dueItems(now)
+	if err != nil {
+		return nil, err
+	}
+
+	var toSign []*resignItem
+	for _, item := range items {
+		if item.result.Err != nil {
+			continue
+		}
+		if r.Fetch != nil {
+			fresh, err := r.Fetch(ctx, item.e)
+			if err != nil {
+				item.result.Err = fmt.Errorf("batch: failed to fetch %q: %w", item.e.RequestURI, err)
+				continue
+			}
+			if fresh != nil {
+				item.e = fresh
+				item.result.Fetched = true
+			}
+		}
+		toSign = append(toSign, item)
+	}
+
+	signer := *r.Signer
+	signer.Date = now
+	signer.Expires = now.Add(r.validity())
+	exchanges := make([]*signedexchange.Exchange, len(toSign))
+	for i, item := range toSign {
+		exchanges[i] = item.e
+	}
+	for i, err := range SignAll(ctx, exchanges, &signer, r.Concurrency) {
+		item := toSign[i]
+		if err != nil {
+			item.result.Err = err
+			continue
+		}
+		if m, err := item.e.Metadata(); err == nil {
+			item.result.Expires = m.Expires
+		}
+		if item.path == "" {
+			r.Exchanges[item.index] = item.e
+		} else if err := writeExchange(item.path, item.e); err != nil {
+			item.result.Err = err
+		}
+	}
+
+	results := make([]ResignResult, len(items))
+	for i, item := range items {
+		results[i] = item.result
+		if r.Report != nil {
+			r.Report(item.result)
+		}
+	}
+	return results, nil
+}
+
+// dueItems returns the exchanges that are due to be re-signed at now. The
+// files of Dir that cannot be read are returned with an error in their
+// result.
+func (r *Resigner) dueItems(now time.Time) ([]*resignItem, error) {
+	var items []*resignItem
+	for i, e := range r.Exchanges {
+		if r.due(e, now) {
+			items = append(items, &resignItem{e: e, index: i, result: ResignResult{RequestURI: e.RequestURI}})
+		}
+	}
+	if r.Dir == "" {
+		return items, nil
+	}
+	err := filepath.WalkDir(r.Dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || !strings.HasSuffix(path, ".sxg") {
+			return nil
+		}
+		item := &resignItem{path: path, result: ResignResult{Path: path}}
+		b, err := ioutil.ReadFile(path)
+		if err == nil {
+			item.e, err = signedexchange.ReadExchange(bytes.NewReader(b))
+		}
+		if err != nil {
+			item.result.Err = fmt.Errorf("batch: cannot read %s: %v", path, err)
+			items = append(items, item)
+			return nil
+		}
+		item.result.RequestURI = item.e.RequestURI
+		if r.due(item.e, now) {
+			items = append(items, item)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("batch: cannot list the signed exchanges in %s: %v", r.Dir, err)
+	}
+	return items, nil
+}
+
+// writeExchange replaces the file at path with e, atomically.
+func writeExchange(path string, e *signedexchange.Exchange) error {
+	var buf bytes.Buffer
+	if err := e.Write(&buf); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return fmt.Errorf("batch: %v", err)
+	}
+	_, err = f.Write(buf.Bytes())
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(f.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return fmt.Errorf("batch: cannot write %s: %v", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,160 @@
+package batch_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/WICG/webpackage/go/signedexchange"
+	. "github.com/WICG/webpackage/go/signedexchange/batch"
+	"github.com/WICG/webpackage/go/signedexchange/signedexchangetest"
+)
+
+func expiresOf(t *testing.T, e *signedexchange.Exchange) time.Time {
+	t.Helper()
+	m, err := e.Metadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m.Expires
+}
+
+func TestResigner(t *testing.T) {
+	s, certBytes := signedexchangetest.NewSigner(t)
+	now := signatureDate
+	var reports []ResignResult
+	r := &Resigner{
+		Signer:    s,
+		Exchanges: createTestExchanges(t, 3),
+		Validity:  4 * 24 * time.Hour,
+		Now:       func() time.Time { return now },
+		Report:    func(result ResignResult) { reports = append(reports, result) },
+	}
+
+	// Unsigned exchanges are signed.
+	results, err := r.ResignDue(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 3 || len(reports) != 3 {
+		t.Fatalf("got %d results and %d reports, want 3", len(results), len(reports))
+	}
+	for i, result := range results {
+		if result.Err != nil || !result.Expires.Equal(now.Add(r.Validity)) {
+			t.Errorf("exchange %d: unexpected result %+v", i, result)
+		}
+	}
+
+	// Exchanges are not re-signed before half of their validity is left.
+	now = signatureDate.Add(1 * 24 * time.Hour)
+	if results, err := r.ResignDue(context.Background()); err != nil || len(results) != 0 {
+		t.Errorf("Unexpected results %+v, error %v", results, err)
+	}
+
+	// Exchanges whose resource changed are replaced.
+	now = signatureDate.Add(3 * 24 * time.Hour)
+	changed := createTestExchanges(t, 1)[0]
+	r.Fetch = func(_ context.Context, e *signedexchange.Exchange) (*signedexchange.Exchange, error) {
+		switch e.RequestURI {
+		case "https://example.com/page0.html":
+			return changed, nil
+		case "https://example.com/page1.html":
+			return nil, errors.New("origin is down")
+		}
+		return nil, nil
+	}
+	old := r.Exchanges[1]
+	results, err = r.ResignDue(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 3 {
+		t.Fatalf("got %d results, want 3", len(results))
+	}
+	if !results[0].Fetched || r.Exchanges[0] != changed {
+		t.Error("Changed exchange was not replaced")
+	}
+	if results[1].Err == nil || r.Exchanges[1] != old || expiresOf(t, old).After(now.Add(1*24*time.Hour)) {
+		t.Error("Exchange that failed to be fetched was re-signed")
+	}
+	if results[2].Err != nil || results[2].Fetched {
+		t.Errorf("Unexpected result %+v", results[2])
+	}
+	certFetcher := func(_ string) ([]byte, error) { return certBytes, nil }
+	for _, i := range []int{0, 2} {
+		if got := expiresOf(t, r.Exchanges[i]); !got.Equal(now.Add(r.Validity)) {
+			t.Errorf("exchange %d: expires at %v, want %v", i, got, now.Add(r.Validity))
+		}
+		if _, err := r.Exchanges[i].VerifyWithResult(now, certFetcher); err != nil {
+			t.Errorf("exchange %d: %v", i, err)
+		}
+	}
+}
+
+func TestResignerDir(t *testing.T) {
+	s, _ := signedexchangetest.NewSigner(t)
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for i, e := range createTestExchanges(t, 2) {
+		var buf bytes.Buffer
+		if err := e.Write(&buf); err != nil {
+			t.Fatal(err)
+		}
+		path := filepath.Join(dir, "a.sxg")
+		if i == 1 {
+			path = filepath.Join(dir, "sub", "b.sxg")
+		}
+		if err := ioutil.WriteFile(path, buf.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "broken.sxg"), []byte("broken"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "other.txt"), []byte("other"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var results []ResignResult
+	r := &Resigner{
+		Signer: s,
+		Dir:    dir,
+		Now:    func() time.Time { return signatureDate },
+		Report: func(result ResignResult) {
+			results = append(results, result)
+			cancel()
+		},
+	}
+	if err := r.Run(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("Run: got error %v, want %v", err, context.Canceled)
+	}
+	if len(results) != 3 {
+		t.Fatalf("got %d results, want 3", len(results))
+	}
+	for _, result := range results {
+		if (result.Err != nil) != (filepath.Base(result.Path) == "broken.sxg") {
+			t.Errorf("Unexpected result %+v", result)
+		}
+	}
+	for _, path := range []string{"a.sxg", "sub/b.sxg"} {
+		b, err := ioutil.ReadFile(filepath.Join(dir, path))
+		if err != nil {
+			t.Fatal(err)
+		}
+		e, err := signedexchange.ReadExchange(bytes.NewReader(b))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := expiresOf(t, e), signatureDate.Add(7*24*time.Hour); !got.Equal(want) {
+			t.Errorf("%s: expires at %v, want %v", path, got, want)
+		}
+	}
+}
@@ -0,0 +1,408 @@
+// Package cache stores signed exchanges on disk until their signatures
+// expire, and refreshes them before they do.
+package cache
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/WICG/webpackage/go/internal/cbor"
+	"github.com/WICG/webpackage/go/signedexchange"
+)
+
+// ErrNotFound is returned by Cache.Get if the cache has no unexpired signed
+// exchange for the key.
+var ErrNotFound = errors.New("cache: signed exchange not found")
+
+const (
+	sxgExt  = ".sxg"
+	metaExt = ".meta"
+)
+
+// Key identifies a cached signed exchange: its URL, and the variant of the
+// resource it is, e.g. the value of its Variant-Key header or of the Accept
+// header it was negotiated for. Variant is empty for resources without
+// variants.
+type Key struct {
+	URL     string
+	Variant string
+}
+
+// Entry describes a cached signed exchange.
+type Entry struct {
+	Key Key
+	// Metadata is the metadata of the exchange. Its Expires is the expiry
+	// of the first signature, after which the exchange is not served.
+	Metadata *signedexchange.Metadata
+}
+
+// Cache stores signed exchanges in a directory. Each exchange is stored in a
+// file named after the hash of its key, next to a file holding its key and
+// metadata. The methods of Cache are safe for concurrent use, but a directory
+// must not be used by several Caches at once.
+type Cache struct {
+	dir string
+	mu  sync.Mutex
+	// refreshing holds the calls of Refresh in progress, by key. It is
+	// guarded by mu.
+	refreshing map[Key]*refreshCall
+
+	// Refresh, if non-nil, returns a new signed exchange to replace the
+	// cached signed exchange sxg of key, e.g. by signing it again or by
+	// fetching it from the origin. It is called for the exchanges that
+	// expire within RefreshBefore, by Get and RefreshExpiring, without
+	// holding the lock of the cache, so it may take long or use the cache.
+	// Concurrent refreshes of a key share a single call.
+	Refresh func(key Key, sxg []byte) ([]byte, error)
+
+	// RefreshBefore is how long before their expiry exchanges are
+	// refreshed.
+	RefreshBefore time.Duration
+
+	// Now returns the current time. If nil, time.Now is used.
+	Now func() time.Time
+}
+
+// Open returns a Cache storing signed exchanges in dir, which is created if
+// it does not exist. Exchanges stored in dir before are kept.
+func Open(dir string) (*Cache, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("cache: %v", err)
+	}
+	return &Cache{dir: dir}, nil
+}
+
+func (c *Cache) now() time.Time {
+	if c.Now == nil {
+		return time.Now()
+	}
+	return c.Now()
+}
+
+func (c *Cache) path(key Key, ext string) string {
+	sum := sha256.Sum256([]byte(key.URL + "\x00" + key.Variant))
+	return filepath.Join(c.dir, hex.EncodeToString(sum[:])+ext)
+}
+
+// Put stores the serialized signed exchange sxg with key, replacing any
+// exchange stored with key before. It fails if sxg cannot be parsed, is not
+// signed, or has already expired.
+func (c *Cache) Put(key Key, sxg []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.put(key, sxg)
+}
+
+func (c *Cache) put(key Key, sxg []byte) error {
+	e, err := signedexchange.ReadExchange(bytes.NewReader(sxg))
+	if err != nil {
+		return fmt.Errorf("cache: cannot parse the signed exchange of %q: %v", key.URL, err)
+	}
+	m, err := e.Metadata()
+	if err != nil {
+		return fmt.Errorf("cache: %q: %v", key.URL, err)
+	}
+	if !c.now().Before(m.Expires) {
+		return fmt.Errorf("cache: the signed exchange of %q expired at %v", key.URL, m.Expires)
+	}
+	meta, err := marshalEntry(&Entry{key, m})
+	if err != nil {
+		return err
+	}
+	// The exchange is written first, so that an entry whose metadata
+	// exists is complete.
+	if err := writeFile(c.path(key, sxgExt), sxg); err != nil {
+		return err
+	}
+	return writeFile(c.path(key, metaExt), meta)
+}
+
+// writeFile replaces the file at path with data, atomically.
+func writeFile(path string, data []byte) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return fmt.Errorf("cache: %v", err)
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return fmt.Errorf("cache: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return fmt.Errorf("cache: %v", err)
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		os.Remove(f.Name())
+		return fmt.Errorf("cache: %v", err)
+	}
+	return nil
+}
+
+// Get returns the signed exchange stored with key. If it expires within
+// RefreshBefore, it is refreshed first; if Refresh fails, the stored exchange
+// is returned until it expires. Expired exchanges are removed, and Get returns
+// ErrNotFound for them.
+func (c *Cache) Get(key Key) ([]byte, error) {
+	sxg, expiring, err := c.get(key)
+	if err != nil {
+		return nil, err
+	}
+	if expiring {
+		if refreshed, err := c.refresh(key, sxg); err == nil {
+			return refreshed, nil
+		}
+	}
+	return sxg, nil
+}
+
+// get returns the signed exchange stored with key, and whether it is to be
+// refreshed.
+func (c *Cache) get(key Key) (sxg []byte, expiring bool, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, err := c.entry(key)
+	if err != nil {
+		return nil, false, err
+	}
+	now := c.now()
+	if !now.Before(entry.Metadata.Expires) {
+		c.delete(key)
+		return nil, false, ErrNotFound
+	}
+	sxg, err = ioutil.ReadFile(c.path(key, sxgExt))
+	if os.IsNotExist(err) {
+		return nil, false, ErrNotFound
+	} else if err != nil {
+		return nil, false, fmt.Errorf("cache: %v", err)
+	}
+	return sxg, c.Refresh != nil && entry.Metadata.Expires.Sub(now) <= c.RefreshBefore, nil
+}
+
+// entry returns the stored entry of key.
+func (c *Cache) entry(key Key) (*Entry, error) {
+	meta, err := ioutil.ReadFile(c.path(key, metaExt))
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, fmt.Errorf("cache: %v", err)
+	}
+	return unmarshalEntry(meta)
+}
+
+// refreshCall is a call of Cache.Refresh in progress.
+type refreshCall struct {
+	done chan struct{} // closed when sxg and err are set
+	sxg  []byte
+	err  error
+}
+
+// refresh replaces the signed exchange sxg of key with the one returned by
+// c.Refresh, or waits for the refresh of key in progress and returns its
+// result. c.mu must not be held; it is only taken to store the result.
+func (c *Cache) refresh(key Key, sxg []byte) ([]byte, error) {
+	c.mu.Lock()
+	if call, ok := c.refreshing[key]; ok {
+		c.mu.Unlock()
+		<-call.done
+		return call.sxg, call.err
+	}
+	call := &refreshCall{done: make(chan struct{})}
+	if c.refreshing == nil {
+		c.refreshing = make(map[Key]*refreshCall)
+	}
+	c.refreshing[key] = call
+	c.mu.Unlock()
+
+	refreshed, err := c.Refresh(key, sxg)
+	if err != nil {
+		err = fmt.Errorf("cache: failed to refresh %q: %w", key.URL, err)
+	}
+
+	c.mu.Lock()
+	if err == nil {
+		err = c.replace(key, sxg, refreshed)
+	}
+	delete(c.refreshing, key)
+	c.mu.Unlock()
+
+	if err == nil {
+		call.sxg = refreshed
+	}
+	call.err = err
+	close(call.done)
+	return call.sxg, call.err
+}
+
+// replace stores sxg with key if old is still stored with it. An exchange
+// put or deleted while old was being refreshed is kept.
+func (c *Cache) replace(key Key, old, sxg []byte) error {
+	stored, err := ioutil.ReadFile(c.path(key, sxgExt))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("cache: %v", err)
+	}
+	if !bytes.Equal(stored, old) {
+		return nil
+	}
+	return c.put(key, sxg)
+}
+
+// Delete removes the signed exchange stored with key, if any.
+func (c *Cache) Delete(key Key) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.delete(key)
+}
+
+func (c *Cache) delete(key Key) error {
+	// The metadata is removed first, so that the entry is gone even if
+	// removing the exchange fails.
+	for _, ext := range []string{metaExt, sxgExt} {
+		if err := os.Remove(c.path(key, ext)); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("cache: %v", err)
+		}
+	}
+	return nil
+}
+
+// Entries returns the entries of the cache, including expired ones that have
+// not been removed yet.
+func (c *Cache) Entries() ([]*Entry, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.entries()
+}
+
+func (c *Cache) entries() ([]*Entry, error) {
+	files, err := ioutil.ReadDir(c.dir)
+	if err != nil {
+		return nil, fmt.Errorf("cache: %v", err)
+	}
+	var entries []*Entry
+	for _, f := range files {
+		if !strings.HasSuffix(f.Name(), metaExt) {
+			continue
+		}
+		meta, err := ioutil.ReadFile(filepath.Join(c.dir, f.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("cache: %v", err)
+		}
+		entry, err := unmarshalEntry(meta)
+		if err != nil {
+			return nil, fmt.Errorf("cache: %s: %v", f.Name(), err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// RefreshExpiring refreshes the signed exchanges that expire within
+// RefreshBefore, and removes the expired ones. It is meant to be called
+// periodically, more often than RefreshBefore. It returns the errors of the
+// exchanges that failed to be refreshed, joined; the other exchanges are
+// refreshed regardless.
+func (c *Cache) RefreshExpiring() error {
+	expiring, errs := c.removeExpired()
+	for key, sxg := range expiring {
+		if _, err := c.refresh(key, sxg); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// removeExpired removes the expired signed exchanges, and returns the ones
+// to be refreshed by key.
+func (c *Cache) removeExpired() (map[Key][]byte, []error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entries, err := c.entries()
+	if err != nil {
+		return nil, []error{err}
+	}
+	now := c.now()
+	expiring := make(map[Key][]byte)
+	var errs []error
+	for _, entry := range entries {
+		if !now.Before(entry.Metadata.Expires) {
+			if err := c.delete(entry.Key); err != nil {
+				errs = append(errs, err)
+			}
+			continue
+		}
+		if c.Refresh == nil || entry.Metadata.Expires.Sub(now) > c.RefreshBefore {
+			continue
+		}
+		sxg, err := ioutil.ReadFile(c.path(entry.Key, sxgExt))
+		if err != nil {
+			errs = append(errs, fmt.Errorf("cache: %v", err))
+			continue
+		}
+		expiring[entry.Key] = sxg
+	}
+	return expiring, errs
+}
+
+// marshalEntry encodes entry as a CBOR array of the URL, the variant and the
+// binary encoding of the metadata.
+func marshalEntry(entry *Entry) ([]byte, error) {
+	m, err := entry.Metadata.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	enc := cbor.NewEncoder(&buf)
+	if err := enc.EncodeArrayHeader(3); err != nil {
+		return nil, err
+	}
+	if err := enc.EncodeTextString(entry.Key.URL); err != nil {
+		return nil, err
+	}
+	if err := enc.EncodeTextString(entry.Key.Variant); err != nil {
+		return nil, err
+	}
+	if err := enc.EncodeByteString(m); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// unmarshalEntry decodes an entry encoded by marshalEntry.
+func unmarshalEntry(data []byte) (*Entry, error) {
+	dec := cbor.NewDecoder(bytes.NewReader(data))
+	n, err := dec.DecodeArrayHeader()
+	if err != nil {
+		return nil, fmt.Errorf("cache: failed to decode entry array header: %v", err)
+	}
+	if n != 3 {
+		return nil, fmt.Errorf("cache: entry array must have 3 elements, got %d", n)
+	}
+	url, err := dec.DecodeTextString()
+	if err != nil {
+		return nil, fmt.Errorf("cache: failed to decode entry URL: %v", err)
+	}
+	variant, err := dec.DecodeTextString()
+	if err != nil {
+		return nil, fmt.Errorf("cache: failed to decode entry variant: %v", err)
+	}
+	m, err := dec.DecodeByteString()
+	if err != nil {
+		return nil, fmt.Errorf("cache: failed to decode entry metadata: %v", err)
+	}
+	metadata := &signedexchange.Metadata{}
+	if err := metadata.UnmarshalBinary(m); err != nil {
+		return nil, err
+	}
+	return &Entry{Key{url, variant}, metadata}, nil
+}
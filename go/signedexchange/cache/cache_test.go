@@ -0,0 +1,220 @@
+package cache_test
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/WICG/webpackage/go/signedexchange"
+	. "github.com/WICG/webpackage/go/signedexchange/cache"
+	"github.com/WICG/webpackage/go/signedexchange/signedexchangetest"
+	"github.com/WICG/webpackage/go/signedexchange/version"
+)
+
+const requestURL = "https://example.com/"
+
+var signatureDate = signedexchangetest.SignatureDate
+
+// signTestExchange returns a signed exchange of body that is signed at date
+// and expires an hour later.
+func signTestExchange(t *testing.T, body string, date time.Time) []byte {
+	t.Helper()
+	s, _ := signedexchangetest.NewSigner(t)
+	s.Date = date
+	s.Expires = date.Add(1 * time.Hour)
+	header := http.Header{"Content-Type": {"text/html; charset=utf-8"}}
+	e := signedexchange.NewExchange(version.Version1b3, requestURL, http.MethodGet, nil, 200, header, []byte(body))
+	if err := e.MiEncodePayload(16); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.AddSignatureHeader(s); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := e.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestCache(t *testing.T) {
+	dir := t.TempDir()
+	c, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := signatureDate
+	c.Now = func() time.Time { return now }
+
+	en := Key{requestURL, "en"}
+	fr := Key{requestURL, "fr"}
+	enSXG := signTestExchange(t, "hello", signatureDate)
+	frSXG := signTestExchange(t, "bonjour", signatureDate)
+	if err := c.Put(en, enSXG); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Put(fr, frSXG); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Put(Key{URL: requestURL}, []byte("not a signed exchange")); err == nil {
+		t.Error("Put unexpectedly accepted an invalid signed exchange")
+	}
+
+	// Entries are kept across Caches.
+	c, err = Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Now = func() time.Time { return now }
+	for key, want := range map[Key][]byte{en: enSXG, fr: frSXG} {
+		if got, err := c.Get(key); err != nil || !bytes.Equal(got, want) {
+			t.Errorf("Get(%v): got %d bytes, error %v", key, len(got), err)
+		}
+	}
+	if _, err := c.Get(Key{requestURL, "de"}); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Get of a missing key: got error %v, want %v", err, ErrNotFound)
+	}
+	entries, err := c.Entries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("Entries: got %d entries, want 2", len(entries))
+	}
+	for _, entry := range entries {
+		if entry.Key != en && entry.Key != fr || !entry.Metadata.Expires.Equal(signatureDate.Add(1*time.Hour)) {
+			t.Errorf("Unexpected entry %v expiring at %v", entry.Key, entry.Metadata.Expires)
+		}
+	}
+
+	// Expired exchanges are removed.
+	now = signatureDate.Add(1 * time.Hour)
+	if _, err := c.Get(en); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Get of an expired exchange: got error %v, want %v", err, ErrNotFound)
+	}
+	if err := c.Delete(fr); err != nil {
+		t.Fatal(err)
+	}
+	if entries, err := c.Entries(); err != nil || len(entries) != 0 {
+		t.Errorf("Entries: got %d entries, error %v", len(entries), err)
+	}
+}
+
+func TestCacheRefresh(t *testing.T) {
+	c, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := signatureDate
+	c.Now = func() time.Time { return now }
+	c.RefreshBefore = 10 * time.Minute
+	var refreshed []Key
+	c.Refresh = func(key Key, sxg []byte) ([]byte, error) {
+		refreshed = append(refreshed, key)
+		if key.Variant == "broken" {
+			return nil, errors.New("origin is down")
+		}
+		return signTestExchange(t, "new", now), nil
+	}
+	old := signTestExchange(t, "old", signatureDate)
+	for _, variant := range []string{"a", "b", "broken"} {
+		if err := c.Put(Key{requestURL, variant}, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Exchanges are not refreshed long before they expire.
+	if err := c.RefreshExpiring(); err != nil || len(refreshed) != 0 {
+		t.Errorf("RefreshExpiring: refreshed %v, error %v", refreshed, err)
+	}
+
+	// Get refreshes an exchange about to expire.
+	now = signatureDate.Add(55 * time.Minute)
+	got, err := c.Get(Key{requestURL, "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(got, old) || len(refreshed) != 1 {
+		t.Errorf("Get did not refresh the exchange: refreshed %v", refreshed)
+	}
+	// If refreshing fails, the old exchange is returned until it expires.
+	if got, err := c.Get(Key{requestURL, "broken"}); err != nil || !bytes.Equal(got, old) {
+		t.Errorf("Get of an exchange failing to refresh: got %d bytes, error %v", len(got), err)
+	}
+
+	refreshed = nil
+	if err := c.RefreshExpiring(); err == nil {
+		t.Error("RefreshExpiring did not report the failed refresh")
+	}
+	if len(refreshed) != 2 {
+		t.Errorf("RefreshExpiring: got refreshed %v, want b and broken", refreshed)
+	}
+	entries, err := c.Entries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		want := now.Add(1 * time.Hour)
+		if entry.Key.Variant == "broken" {
+			want = signatureDate.Add(1 * time.Hour)
+		}
+		if !entry.Metadata.Expires.Equal(want) {
+			t.Errorf("%v: expires at %v, want %v", entry.Key, entry.Metadata.Expires, want)
+		}
+	}
+}
+
+func TestCacheRefreshConcurrent(t *testing.T) {
+	c, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := signatureDate.Add(55 * time.Minute)
+	c.Now = func() time.Time { return now }
+	c.RefreshBefore = 10 * time.Minute
+	key := Key{URL: requestURL}
+	if err := c.Put(key, signTestExchange(t, "old", signatureDate)); err != nil {
+		t.Fatal(err)
+	}
+	refreshed := signTestExchange(t, "new", now)
+	started := make(chan struct{})
+	release := make(chan struct{})
+	var calls int32
+	c.Refresh = func(key Key, sxg []byte) ([]byte, error) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			close(started)
+		}
+		<-release
+		return refreshed, nil
+	}
+
+	type result struct {
+		sxg []byte
+		err error
+	}
+	results := make(chan result, 2)
+	get := func() {
+		sxg, err := c.Get(key)
+		results <- result{sxg, err}
+	}
+	go get()
+	<-started
+	// The cache is not locked while Refresh runs.
+	if _, err := c.Entries(); err != nil {
+		t.Fatal(err)
+	}
+	go get()
+	close(release)
+	for i := 0; i < 2; i++ {
+		r := <-results
+		if r.err != nil || !bytes.Equal(r.sxg, refreshed) {
+			t.Errorf("Get: got %d bytes, error %v, want the refreshed exchange", len(r.sxg), r.err)
+		}
+	}
+	if calls != 1 {
+		t.Errorf("Refresh was called %d times, want once", calls)
+	}
+}
@@ -0,0 +1,336 @@
+package signedexchange
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/WICG/webpackage/go/signedexchange/certurl"
+)
+
+// certChainContentType is the media type of cert chains served at cert-urls.
+const certChainContentType = "application/cert-chain+cbor"
+
+// NewHTTPCertFetcher returns the Fetch method of an HTTPCertFetcher with
+// client and maxSize, which neither retries nor caches.
+//
+// Deprecated: Use HTTPCertFetcher.
+func NewHTTPCertFetcher(client *http.Client, maxSize int64) CertFetcher {
+	return newUncachedHTTPCertFetcher(client, maxSize).Fetch
+}
+
+// NewHTTPContextCertFetcher is like NewHTTPCertFetcher, but returns the
+// HTTPCertFetcher itself, whose requests are cancelled with the context
+// passed to it.
+//
+// Deprecated: Use HTTPCertFetcher.
+func NewHTTPContextCertFetcher(client *http.Client, maxSize int64) ContextCertFetcher {
+	return newUncachedHTTPCertFetcher(client, maxSize)
+}
+
+func newUncachedHTTPCertFetcher(client *http.Client, maxSize int64) *HTTPCertFetcher {
+	return &HTTPCertFetcher{Client: client, MaxSize: maxSize, Retries: -1, MaxTTL: -1}
+}
+
+// fetchHTTPCertChain fetches the cert chain at url for HTTPCertFetcher. On
+// failure, transient reports whether trying again later
+// may succeed, i.e. if the request failed for another reason than ctx being
+// done, or the server answered with a 5xx or 429 (Too Many Requests) status.
+func fetchHTTPCertChain(ctx context.Context, client *http.Client, url string, maxSize int64) (b []byte, transient bool, err error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, false, fmt.Errorf("verify: could not fetch %q: %w", url, err)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, ctx.Err() == nil, fmt.Errorf("verify: could not fetch %q: %w", url, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		transient := resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+		return nil, transient, fmt.Errorf("verify: fetching %q returned status %d", url, resp.StatusCode)
+	}
+	contentType := resp.Header.Get("Content-Type")
+	if mediaType, _, err := mime.ParseMediaType(contentType); err != nil || mediaType != certChainContentType {
+		return nil, false, fmt.Errorf("verify: %q has Content-Type %q, want %q", url, contentType, certChainContentType)
+	}
+	var body io.Reader = resp.Body
+	if maxSize > 0 {
+		body = io.LimitReader(resp.Body, maxSize+1)
+	}
+	b, err = ioutil.ReadAll(body)
+	if err != nil {
+		return nil, ctx.Err() == nil, fmt.Errorf("verify: could not read response body of %q: %w", url, err)
+	}
+	if maxSize > 0 && int64(len(b)) > maxSize {
+		return nil, false, fmt.Errorf("verify: response body of %q is larger than %d bytes", url, maxSize)
+	}
+	return b, false, nil
+}
+
+// Defaults of HTTPCertFetcher.
+const (
+	defaultMaxCertChainSize = 1 << 20
+	defaultCertFetchRetries = 2
+	defaultCertRetryDelay   = 100 * time.Millisecond
+	defaultMaxCertChainTTL  = 24 * time.Hour
+)
+
+// HTTPCertFetcher fetches cert chains from https cert-urls and caches them.
+// It is a ContextCertFetcher, and its Fetch method is a CertFetcher.
+//
+// A fetch fails unless the response has the status 200 and the Content-Type
+// application/cert-chain+cbor, and the body is a cert chain of at most
+// MaxSize bytes. Transient failures, i.e. network errors and responses with a
+// 5xx or 429 (Too Many Requests) status, are retried. The cert chains of
+// "data:" cert-urls are decoded without fetching or caching them, and other
+// URLs than https and data ones are rejected.
+//
+// A fetched cert chain is cached by URL until its OCSP response is due to be
+// updated, i.e. until the earliest of the nextUpdate of the OCSP response,
+// certurl.MaxOCSPResponseAge after its thisUpdate, and the expiry of the
+// certificate, but for no longer than MaxTTL. Failed fetches are not cached.
+//
+// The zero value is ready to use, and an HTTPCertFetcher is safe for
+// concurrent use. The fields must not be changed once it is in use.
+type HTTPCertFetcher struct {
+	// Client makes the requests. If nil, http.DefaultClient is used.
+	Client *http.Client
+
+	// MaxSize is the maximum size of a cert chain in bytes. If not
+	// positive, 1 MiB is used.
+	MaxSize int64
+
+	// Retries is how many times a transiently failing fetch is retried. If
+	// zero, 2 is used, and if negative, failures are not retried.
+	Retries int
+	// RetryDelay is the delay before the first retry, which is doubled for
+	// each following one. If not positive, 100ms is used.
+	RetryDelay time.Duration
+
+	// MaxTTL caps how long a cert chain is cached. If zero, 24 hours is
+	// used, and if negative, nothing is cached.
+	MaxTTL time.Duration
+
+	// Now returns the current time, for the cache. If nil, time.Now is
+	// used.
+	Now func() time.Time
+
+	mu    sync.Mutex
+	cache map[string]cachedCertBytes
+}
+
+// DefaultCertFetcher fetches cert chains with a shared HTTPCertFetcher with
+// the default settings, so it caches them and cert-urls must be https URLs
+// serving application/cert-chain+cbor, or data URLs.
+func DefaultCertFetcher(url string) ([]byte, error) {
+	return defaultHTTPCertFetcher.Fetch(url)
+}
+
+var defaultHTTPCertFetcher = &HTTPCertFetcher{}
+
+// Fetch is like FetchCertChain with context.Background().
+func (f *HTTPCertFetcher) Fetch(url string) ([]byte, error) {
+	return f.FetchCertChain(context.Background(), url)
+}
+
+// FetchCertChain returns the cert chain at certURL, from the cache if it has
+// a fresh one. It implements ContextCertFetcher.
+func (f *HTTPCertFetcher) FetchCertChain(ctx context.Context, certURL string) ([]byte, error) {
+	u, err := url.Parse(certURL)
+	if err != nil {
+		return nil, fmt.Errorf("verify: cannot parse cert-url %q: %v", certURL, err)
+	}
+	switch u.Scheme {
+	case "data":
+		return parseDataURL(certURL)
+	case "https":
+	default:
+		return nil, fmt.Errorf("verify: cert-url %q is neither an https: nor a data: URL", certURL)
+	}
+
+	now := f.now()
+	f.mu.Lock()
+	c, ok := f.cache[certURL]
+	f.mu.Unlock()
+	if ok && now.Before(c.expires) {
+		return c.certs, nil
+	}
+
+	certs, err := f.fetchWithRetries(ctx, certURL)
+	if err != nil {
+		return nil, err
+	}
+	chain, err := certurl.ReadCertChain(bytes.NewReader(certs))
+	if err != nil {
+		return nil, fmt.Errorf("verify: could not parse the cert chain at %q: %v", certURL, err)
+	}
+	if expires := f.cacheExpiry(chain, now); expires.After(now) {
+		f.mu.Lock()
+		if f.cache == nil {
+			f.cache = map[string]cachedCertBytes{}
+		}
+		for u, c := range f.cache {
+			if !now.Before(c.expires) {
+				delete(f.cache, u)
+			}
+		}
+		f.cache[certURL] = cachedCertBytes{certs: certs, expires: expires}
+		f.mu.Unlock()
+	}
+	return certs, nil
+}
+
+func (f *HTTPCertFetcher) fetchWithRetries(ctx context.Context, certURL string) ([]byte, error) {
+	client := f.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	maxSize := f.MaxSize
+	if maxSize <= 0 {
+		maxSize = defaultMaxCertChainSize
+	}
+	retries := f.Retries
+	if retries == 0 {
+		retries = defaultCertFetchRetries
+	}
+	delay := f.RetryDelay
+	if delay <= 0 {
+		delay = defaultCertRetryDelay
+	}
+	for attempt := 0; ; attempt++ {
+		certs, transient, err := fetchHTTPCertChain(ctx, client, certURL, maxSize)
+		if err == nil || !transient || attempt >= retries {
+			return certs, err
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, fmt.Errorf("verify: gave up fetching %q: %w, after: %v", certURL, ctx.Err(), err)
+		case <-timer.C:
+		}
+		delay *= 2
+	}
+}
+
+// cacheExpiry returns until when chain, fetched at now, may be cached.
+func (f *HTTPCertFetcher) cacheExpiry(chain certurl.CertChain, now time.Time) time.Time {
+	maxTTL := f.MaxTTL
+	if maxTTL == 0 {
+		maxTTL = defaultMaxCertChainTTL
+	}
+	expires := now.Add(maxTTL)
+	earlier := func(t time.Time) {
+		if !t.IsZero() && t.Before(expires) {
+			expires = t
+		}
+	}
+	if len(chain) > 0 {
+		earlier(chain[0].Cert.NotAfter)
+	}
+	if resp, err := chain.ParsedOCSPResponse(); err == nil && resp != nil {
+		earlier(resp.NextUpdate)
+		earlier(resp.ThisUpdate.Add(certurl.MaxOCSPResponseAge))
+	}
+	return expires
+}
+
+func (f *HTTPCertFetcher) now() time.Time {
+	if f.Now == nil {
+		return time.Now()
+	}
+	return f.Now()
+}
+
+type cachedCertBytes struct {
+	certs   []byte
+	expires time.Time
+}
+
+// NewCachingCertFetcher returns a CertFetcher that returns the result of
+// fetch for a URL for ttl after fetching it, without fetching it again.
+// Failed fetches are not cached. The returned CertFetcher is safe for
+// concurrent use if fetch is.
+//
+// Deprecated: HTTPCertFetcher caches the cert chains it fetches for as long
+// as their OCSP responses are fresh, which a fixed ttl does not account for.
+func NewCachingCertFetcher(fetch CertFetcher, ttl time.Duration) CertFetcher {
+	var mu sync.Mutex
+	cache := map[string]cachedCertBytes{}
+	return func(url string) ([]byte, error) {
+		now := time.Now()
+		mu.Lock()
+		c, ok := cache[url]
+		mu.Unlock()
+		if ok && now.Before(c.expires) {
+			return c.certs, nil
+		}
+		certs, err := fetch(url)
+		if err != nil {
+			return nil, err
+		}
+		mu.Lock()
+		cache[url] = cachedCertBytes{certs: certs, expires: now.Add(ttl)}
+		mu.Unlock()
+		return certs, nil
+	}
+}
+
+// LocalCertFetcher is a CertFetcher that reads cert chains without network
+// access, from the data of "data:" URLs and from the files of "file:" URLs.
+// Other URLs are rejected. It is meant for verifying exchanges offline, with
+// cert-urls rewritten to local ones.
+func LocalCertFetcher(certURL string) ([]byte, error) {
+	u, err := url.Parse(certURL)
+	if err != nil {
+		return nil, fmt.Errorf("verify: cannot parse cert-url %q: %v", certURL, err)
+	}
+	switch u.Scheme {
+	case "data":
+		return parseDataURL(certURL)
+	case "file":
+		if u.Host != "" && u.Host != "localhost" {
+			return nil, fmt.Errorf("verify: file URL %q is not on the local host", certURL)
+		}
+		certs, err := ioutil.ReadFile(u.Path)
+		if err != nil {
+			return nil, fmt.Errorf("verify: %v", err)
+		}
+		return certs, nil
+	default:
+		return nil, fmt.Errorf("verify: cert-url %q is neither a data: nor a file: URL", certURL)
+	}
+}
+
+// parseDataURL returns the data of a "data:" URL (RFC2397). The media type is
+// ignored.
+func parseDataURL(dataURL string) ([]byte, error) {
+	comma := strings.IndexByte(dataURL, ',')
+	if comma < 0 {
+		return nil, errors.New("verify: data URL has no comma")
+	}
+	params, data := dataURL[len("data:"):comma], dataURL[comma+1:]
+	if strings.HasSuffix(strings.ToLower(params), ";base64") {
+		b, err := base64.StdEncoding.DecodeString(data)
+		if err != nil {
+			return nil, fmt.Errorf("verify: invalid base64 in data URL: %v", err)
+		}
+		return b, nil
+	}
+	s, err := url.PathUnescape(data)
+	if err != nil {
+		return nil, fmt.Errorf("verify: invalid data URL: %v", err)
+	}
+	return []byte(s), nil
+}
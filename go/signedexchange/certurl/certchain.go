@@ -14,6 +14,7 @@ import (
 	"time"
 
 	"github.com/WICG/webpackage/go/internal/cbor"
+	"github.com/WICG/webpackage/go/internal/signingalgorithm"
 )
 
 // AugmentedCertificate represents an augmented-certificate CBOR structure.
@@ -28,6 +29,9 @@ type CertChain []*AugmentedCertificate
 
 const magicString = "\U0001F4DC\u26D3" // "📜⛓"
 
+// https://wicg.github.io/webpackage/draft-yasskin-http-origin-signed-responses.html#cross-origin-cert-req
+var oidCanSignHttpExchangesDraft = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 11129, 2, 1, 22}
+
 // NewCertChain creates a new CertChain from a list of X.509 certificates,
 // an OCSP response, and a SCT.
 func NewCertChain(certs []*x509.Certificate, ocsp, sct []byte) (CertChain, error) {
@@ -44,6 +48,80 @@ func NewCertChain(certs []*x509.Certificate, ocsp, sct []byte) (CertChain, error
 	return certChain, nil
 }
 
+// Certs returns the X.509 certificates of the chain, leaf first.
+func (certChain CertChain) Certs() []*x509.Certificate {
+	certs := make([]*x509.Certificate, len(certChain))
+	for i, ac := range certChain {
+		certs[i] = ac.Cert
+	}
+	return certs
+}
+
+// CertChainCBORFromPEM parses the PEM-encoded certificates in certPEM and
+// returns the application/cert-chain+cbor serialization of them, with the
+// DER-encoded OCSP response ocspDER and the SignedCertificateTimestampList
+// sctDER attached to the leaf certificate. sctDER may be nil.
+// It returns an error if the leaf certificate does not have the
+// CanSignHttpExchanges extension.
+func CertChainCBORFromPEM(certPEM, ocspDER, sctDER []byte) ([]byte, error) {
+	certs, err := signingalgorithm.ParseCertificates(certPEM)
+	if err != nil {
+		return nil, err
+	}
+	certChain, err := NewCertChain(certs, ocspDER, sctDER)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkCanSignHttpExchanges(certChain[0].Cert); err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := certChain.Write(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// checkCanSignHttpExchanges returns an error unless cert has the
+// CanSignHttpExchanges extension with an ASN.1 NULL value.
+func checkCanSignHttpExchanges(cert *x509.Certificate) error {
+	ext := findExtensionWithOID(cert.Extensions, oidCanSignHttpExchangesDraft)
+	if ext == nil {
+		return errors.New("cert-chain: the main certificate does not have canSignHttpExchangesDraft extension")
+	}
+	if !bytes.Equal(ext.Value, asn1.NullBytes) {
+		return fmt.Errorf("cert-chain: value of canSignHttpExchangesDraft extension must be ASN1:NULL, got %v", ext.Value)
+	}
+	return nil
+}
+
+// maxMainCertValidity is the longest validity period of a main certificate
+// that clients accept after mainCertValidityEnforced.
+const maxMainCertValidity = 90 * 24 * time.Hour
+
+var mainCertValidityEnforced = time.Date(2019, 8, 1, 0, 0, 0, 0, time.UTC)
+
+// VerifyMainCertRequirements checks that the main certificate of the chain
+// meets the requirements that clients enforce at now, see
+// https://wicg.github.io/webpackage/draft-yasskin-http-origin-signed-responses.html#cross-origin-cert-req:
+// it must have the CanSignHttpExchanges extension and, after 2019-08-01, a
+// validity period of at most 90 days.
+func (chain CertChain) VerifyMainCertRequirements(now time.Time) error {
+	if len(chain) == 0 {
+		return errors.New("cert-chain: empty chain")
+	}
+	cert := chain[0].Cert
+	if err := checkCanSignHttpExchanges(cert); err != nil {
+		return err
+	}
+	// "After 2019-08-01, clients MUST reject all certificates with this
+	// extension that have a Validity Period longer than 90 days." [spec text]
+	if validity := cert.NotAfter.Sub(cert.NotBefore); now.After(mainCertValidityEnforced) && validity > maxMainCertValidity {
+		return fmt.Errorf("cert-chain: the main certificate has a validity period of %v, longer than 90 days", validity)
+	}
+	return nil
+}
+
 // Validate performs basic sanity checks on the cert chain.
 // It returns nil if the chain is valid, or else an error describing a problem.
 func (certChain CertChain) Validate() error {
@@ -201,7 +279,6 @@ func (chain CertChain) PrettyPrint(w io.Writer) {
 		if i == 0 {
 			// Check if the main certificate meets the requirements:
 			// https://wicg.github.io/webpackage/draft-yasskin-http-origin-signed-responses.html#cross-origin-cert-req
-			oidCanSignHttpExchangesDraft := asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 11129, 2, 1, 22}
 			ext := findExtensionWithOID(item.Cert.Extensions, oidCanSignHttpExchangesDraft)
 			if ext == nil {
 				fmt.Fprintln(w, "Error: The main certificate does not have canSignHttpExchangesDraft extension")
@@ -2,8 +2,15 @@ package certurl_test
 
 import (
 	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
 	"io/ioutil"
+	"reflect"
 	"testing"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
 
 	"github.com/WICG/webpackage/go/internal/signingalgorithm"
 	"github.com/WICG/webpackage/go/internal/testhelper"
@@ -80,3 +87,123 @@ func TestRoundtrip(t *testing.T) {
 		}
 	}
 }
+
+func TestCertChainCBORFromPEM(t *testing.T) {
+	in, err := ioutil.ReadFile("test-cert-long.pem")
+	if err != nil {
+		t.Fatalf("Cannot read test-cert-long.pem: %v", err)
+	}
+	certs, err := signingalgorithm.ParseCertificates(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bs, err := CertChainCBORFromPEM(in, []byte("OCSP"), []byte("SCT"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := ReadCertChain(bytes.NewReader(bs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(parsed) != len(certs) {
+		t.Fatalf("Cert chain length differs: want %d, got %d", len(certs), len(parsed))
+	}
+	if !bytes.Equal(parsed[0].Cert.Raw, certs[0].Raw) {
+		t.Errorf("Leaf cert differs:\n want: %v\n got: %v", certs[0].Raw, parsed[0].Cert.Raw)
+	}
+	if !bytes.Equal(parsed[0].OCSPResponse, []byte("OCSP")) {
+		t.Errorf("OCSP differs: got %q", parsed[0].OCSPResponse)
+	}
+	if !bytes.Equal(parsed[0].SCTList, []byte("SCT")) {
+		t.Errorf("SCT differs: got %q", parsed[0].SCTList)
+	}
+}
+
+func TestCertChainCBORFromPEMWithoutExtension(t *testing.T) {
+	in, err := ioutil.ReadFile("test-cert.pem")
+	if err != nil {
+		t.Fatalf("Cannot read test-cert.pem: %v", err)
+	}
+	if _, err := CertChainCBORFromPEM(in, []byte("OCSP"), nil); err == nil {
+		t.Error("CertChainCBORFromPEM unexpectedly accepted a certificate without CanSignHttpExchanges extension")
+	}
+}
+
+func TestCertChainAccessors(t *testing.T) {
+	in, err := ioutil.ReadFile("test-cert.pem")
+	if err != nil {
+		t.Fatalf("Cannot read test-cert.pem: %v", err)
+	}
+	certs, err := signingalgorithm.ParseCertificates(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(certs) < 2 {
+		t.Fatalf("test-cert.pem has %d certificates, want at least 2", len(certs))
+	}
+
+	// The signature of the OCSP response is not verified, so any key will do.
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	thisUpdate := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	ocspDER, err := ocsp.CreateResponse(certs[1], certs[1], ocsp.Response{
+		Status:       ocsp.Good,
+		SerialNumber: certs[0].SerialNumber,
+		ThisUpdate:   thisUpdate,
+		NextUpdate:   thisUpdate.Add(7 * 24 * time.Hour),
+	}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sctList, err := SerializeSCTList([][]byte{{1, 2, 3}, {4, 5, 6}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	chain, err := NewCertChain(certs, ocspDER, sctList)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := &bytes.Buffer{}
+	if err := chain.Write(buf); err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := ReadCertChain(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := parsed.Certs()
+	if len(got) != len(certs) {
+		t.Fatalf("Certs() returned %d certificates, want %d", len(got), len(certs))
+	}
+	for i := range certs {
+		if !bytes.Equal(got[i].Raw, certs[i].Raw) {
+			t.Errorf("Cert at position %d differs", i)
+		}
+	}
+
+	o, err := parsed.ParsedOCSPResponse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o.Status != ocsp.Good || o.SerialNumber.Cmp(certs[0].SerialNumber) != 0 || !o.ThisUpdate.Equal(thisUpdate) {
+		t.Errorf("Unexpected OCSP response: status %d, serial %v, thisUpdate %v", o.Status, o.SerialNumber, o.ThisUpdate)
+	}
+
+	scts, err := parsed[0].SCTs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := [][]byte{{1, 2, 3}, {4, 5, 6}}; !reflect.DeepEqual(scts, want) {
+		t.Errorf("SCTs() = %v, want %v", scts, want)
+	}
+
+	// The intermediate has neither an OCSP response nor SCTs.
+	if scts, err := parsed[1].SCTs(); scts != nil || err != nil {
+		t.Errorf("SCTs() of the intermediate = %v, %v, want nil, nil", scts, err)
+	}
+}
@@ -0,0 +1,76 @@
+package certurl
+
+import (
+	"bytes"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ChainPolicy configures how CertChain.VerifyChain validates a cert chain.
+type ChainPolicy struct {
+	// Roots are the trusted root certificates. If nil, the system roots are
+	// used.
+	Roots *x509.CertPool
+	// Intermediates are intermediate certificates to build the chain with,
+	// in addition to the ones in the chain itself.
+	Intermediates *x509.CertPool
+	// AllowSelfSigned accepts a self-signed main certificate without
+	// building a chain to the roots, e.g. for development certificates. The
+	// certificate must still be valid for the host and at the time.
+	AllowSelfSigned bool
+}
+
+// VerifyChain checks that the main certificate of the chain has the
+// CanSignHttpExchanges extension, is valid for the DNS name host at now and
+// for TLS server authentication, and chains to one of policy.Roots through
+// the other certificates of the chain and policy.Intermediates. The OCSP
+// response and the SCTs are not checked, see VerifyOCSPResponse and
+// VerifyCTPolicy.
+func (chain CertChain) VerifyChain(policy ChainPolicy, host string, now time.Time) error {
+	if len(chain) == 0 {
+		return errors.New("cert-chain: empty chain")
+	}
+	leaf := chain[0].Cert
+	if err := checkCanSignHttpExchanges(leaf); err != nil {
+		return err
+	}
+
+	if policy.AllowSelfSigned && isSelfSigned(leaf) {
+		if now.Before(leaf.NotBefore) || now.After(leaf.NotAfter) {
+			return fmt.Errorf("cert-chain: the self-signed certificate is valid from %v to %v, not at %v", leaf.NotBefore, leaf.NotAfter, now)
+		}
+		if err := leaf.VerifyHostname(host); err != nil {
+			return fmt.Errorf("cert-chain: %v", err)
+		}
+		return nil
+	}
+
+	intermediates := x509.NewCertPool()
+	if policy.Intermediates != nil {
+		intermediates = policy.Intermediates.Clone()
+	}
+	for _, item := range chain[1:] {
+		intermediates.AddCert(item.Cert)
+	}
+	_, err := leaf.Verify(x509.VerifyOptions{
+		DNSName:       host,
+		Roots:         policy.Roots,
+		Intermediates: intermediates,
+		CurrentTime:   now,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	})
+	if err != nil {
+		return fmt.Errorf("cert-chain: %v", err)
+	}
+	return nil
+}
+
+// isSelfSigned returns true if cert is issued by its subject and signed by
+// its own key. Unlike CheckSignatureFrom, it does not require cert to be a CA
+// certificate, which development certificates often are not.
+func isSelfSigned(cert *x509.Certificate) bool {
+	return bytes.Equal(cert.RawIssuer, cert.RawSubject) &&
+		cert.CheckSignature(cert.SignatureAlgorithm, cert.RawTBSCertificate, cert.Signature) == nil
+}
@@ -0,0 +1,125 @@
+package certurl_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"math/big"
+	"testing"
+	"time"
+
+	. "github.com/WICG/webpackage/go/signedexchange/certurl"
+)
+
+var chainTestTime = time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+// issueCert creates a certificate for template, issued by parent, or
+// self-signed if parent is nil.
+func issueCert(t *testing.T, template *x509.Certificate, parent *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template.SerialNumber = big.NewInt(1)
+	template.NotBefore = chainTestTime.Add(-24 * time.Hour)
+	template.NotAfter = chainTestTime.Add(24 * time.Hour)
+	issuer, signer := template, key
+	if parent != nil {
+		issuer, signer = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, issuer, &key.PublicKey, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{cert, key}
+}
+
+func caTemplate(name string) *x509.Certificate {
+	return &x509.Certificate{
+		Subject:               pkix.Name{CommonName: name},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+}
+
+func leafTemplate(canSignHttpExchanges bool, ekus ...x509.ExtKeyUsage) *x509.Certificate {
+	template := &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "example.com"},
+		DNSNames:    []string{"example.com"},
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: ekus,
+	}
+	if canSignHttpExchanges {
+		template.ExtraExtensions = []pkix.Extension{{
+			Id:    asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 11129, 2, 1, 22},
+			Value: asn1.NullBytes,
+		}}
+	}
+	return template
+}
+
+func TestVerifyChain(t *testing.T) {
+	root := issueCert(t, caTemplate("Root"), nil)
+	intermediate := issueCert(t, caTemplate("Intermediate"), root)
+	leaf := issueCert(t, leafTemplate(true, x509.ExtKeyUsageServerAuth), intermediate)
+	roots := x509.NewCertPool()
+	roots.AddCert(root.cert)
+	intermediates := x509.NewCertPool()
+	intermediates.AddCert(intermediate.cert)
+
+	newChain := func(certs ...*testCert) CertChain {
+		var cs []*x509.Certificate
+		for _, c := range certs {
+			cs = append(cs, c.cert)
+		}
+		chain, err := NewCertChain(cs, []byte("OCSP"), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return chain
+	}
+	selfSigned := issueCert(t, leafTemplate(true), nil)
+
+	for _, c := range []struct {
+		name   string
+		chain  CertChain
+		policy ChainPolicy
+		host   string
+		now    time.Time
+		ok     bool
+	}{
+		{"valid", newChain(leaf, intermediate), ChainPolicy{Roots: roots}, "example.com", chainTestTime, true},
+		{"intermediate from the policy", newChain(leaf), ChainPolicy{Roots: roots, Intermediates: intermediates}, "example.com", chainTestTime, true},
+		{"missing intermediate", newChain(leaf), ChainPolicy{Roots: roots}, "example.com", chainTestTime, false},
+		{"untrusted root", newChain(leaf, intermediate), ChainPolicy{Roots: x509.NewCertPool()}, "example.com", chainTestTime, false},
+		{"other host", newChain(leaf, intermediate), ChainPolicy{Roots: roots}, "example.org", chainTestTime, false},
+		{"expired", newChain(leaf, intermediate), ChainPolicy{Roots: roots}, "example.com", chainTestTime.Add(48 * time.Hour), false},
+		{"client auth only", newChain(issueCert(t, leafTemplate(true, x509.ExtKeyUsageClientAuth), intermediate), intermediate), ChainPolicy{Roots: roots}, "example.com", chainTestTime, false},
+		{"no CanSignHttpExchanges", newChain(issueCert(t, leafTemplate(false, x509.ExtKeyUsageServerAuth), intermediate), intermediate), ChainPolicy{Roots: roots}, "example.com", chainTestTime, false},
+		{"self-signed", newChain(selfSigned), ChainPolicy{Roots: roots}, "example.com", chainTestTime, false},
+		{"self-signed allowed", newChain(selfSigned), ChainPolicy{AllowSelfSigned: true}, "example.com", chainTestTime, true},
+		{"self-signed allowed, other host", newChain(selfSigned), ChainPolicy{AllowSelfSigned: true}, "example.org", chainTestTime, false},
+		{"self-signed allowed, expired", newChain(selfSigned), ChainPolicy{AllowSelfSigned: true}, "example.com", chainTestTime.Add(48 * time.Hour), false},
+	} {
+		err := c.chain.VerifyChain(c.policy, c.host, c.now)
+		if c.ok && err != nil {
+			t.Errorf("%s: VerifyChain failed: %v", c.name, err)
+		}
+		if !c.ok && err == nil {
+			t.Errorf("%s: VerifyChain unexpectedly succeeded", c.name)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package certurl
+
+import (
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// CTPolicy is a Certificate Transparency policy the main certificate of a
+// chain must satisfy.
+type CTPolicy struct {
+	// MinSCTs is the minimum number of SCTs.
+	MinSCTs int
+	// MinDistinctLogs is the minimum number of distinct logs the SCTs are
+	// issued by.
+	MinDistinctLogs int
+}
+
+// SignedCertificateTimestamp holds the fields of an SCT (Section 3.2 of
+// RFC6962) that CT policies look at.
+type SignedCertificateTimestamp struct {
+	LogID     [32]byte
+	Timestamp time.Time
+}
+
+// parseSCT parses the version, the log ID and the timestamp of a
+// SerializedSCT.
+func parseSCT(sct []byte) (*SignedCertificateTimestamp, error) {
+	// sct[0] is the Version, sct[1:33] is the LogID and sct[33:41] is the
+	// timestamp in milliseconds since the epoch.
+	if len(sct) < 41 {
+		return nil, fmt.Errorf("cert-chain: SCT too short (%d bytes)", len(sct))
+	}
+	if sct[0] != 0 {
+		return nil, fmt.Errorf("cert-chain: unknown version of SCT (%d)", sct[0])
+	}
+	s := &SignedCertificateTimestamp{}
+	copy(s.LogID[:], sct[1:33])
+	ms := int64(binary.BigEndian.Uint64(sct[33:41]))
+	s.Timestamp = time.Unix(ms/1000, (ms%1000)*int64(time.Millisecond))
+	return s, nil
+}
+
+// embeddedSCTList returns the SignedCertificateTimestampList in the extension
+// with the OID oid, or nil if there is no such extension.
+func embeddedSCTList(extensions []pkix.Extension, oid asn1.ObjectIdentifier) ([]byte, error) {
+	ext := findExtensionWithOID(extensions, oid)
+	if ext == nil {
+		return nil, nil
+	}
+	var sctList []byte
+	if _, err := asn1.Unmarshal(ext.Value, &sctList); err != nil {
+		return nil, fmt.Errorf("cert-chain: cannot parse SCT extension as ASN.1 OCTET STRING: %v", err)
+	}
+	return sctList, nil
+}
+
+// SignedCertificateTimestamps returns the SCTs for the main certificate of the
+// chain, from the SCT list of the chain, the certificate itself and its OCSP
+// response.
+func (chain CertChain) SignedCertificateTimestamps() ([]*SignedCertificateTimestamp, error) {
+	if len(chain) == 0 {
+		return nil, errors.New("cert-chain: cert chain must not be empty")
+	}
+	sctLists := [][]byte{chain[0].SCTList}
+	certSCTs, err := embeddedSCTList(chain[0].Cert.Extensions, oidCertExtension)
+	if err != nil {
+		return nil, err
+	}
+	sctLists = append(sctLists, certSCTs)
+	ocspResp, err := chain.ParsedOCSPResponse()
+	if err != nil {
+		return nil, err
+	}
+	if ocspResp != nil {
+		ocspSCTs, err := embeddedSCTList(ocspResp.Extensions, oidOCSPExtension)
+		if err != nil {
+			return nil, err
+		}
+		sctLists = append(sctLists, ocspSCTs)
+	}
+
+	var result []*SignedCertificateTimestamp
+	for _, sctList := range sctLists {
+		if sctList == nil {
+			continue
+		}
+		scts, err := ParseSCTList(sctList)
+		if err != nil {
+			return nil, err
+		}
+		for _, sct := range scts {
+			s, err := parseSCT(sct)
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, s)
+		}
+	}
+	return result, nil
+}
+
+// VerifyCTPolicy checks that the main certificate of the chain has SCTs that
+// satisfy policy. SCTs with a timestamp after now are not counted. The
+// signatures of the SCTs are not verified. The returned error tells which
+// part of the policy was not met.
+func (chain CertChain) VerifyCTPolicy(policy CTPolicy, now time.Time) error {
+	scts, err := chain.SignedCertificateTimestamps()
+	if err != nil {
+		return err
+	}
+	numSCTs := 0
+	logs := map[[32]byte]bool{}
+	for _, sct := range scts {
+		if sct.Timestamp.After(now) {
+			continue
+		}
+		numSCTs++
+		logs[sct.LogID] = true
+	}
+	if numSCTs < policy.MinSCTs {
+		return fmt.Errorf("cert-chain: CT policy requires at least %d SCTs, got %d", policy.MinSCTs, numSCTs)
+	}
+	if len(logs) < policy.MinDistinctLogs {
+		return fmt.Errorf("cert-chain: CT policy requires SCTs from at least %d distinct logs, got %d", policy.MinDistinctLogs, len(logs))
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+package certurl_test
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+
+	. "github.com/WICG/webpackage/go/signedexchange/certurl"
+)
+
+var sctTestTime = time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// fakeSCT returns a SerializedSCT from the log logID, issued at timestamp.
+// Only the fields that CT policies look at are meaningful.
+func fakeSCT(logID byte, timestamp time.Time) []byte {
+	sct := make([]byte, 41, 47)
+	sct[0] = 0 // v1
+	for i := 1; i < 33; i++ {
+		sct[i] = logID
+	}
+	binary.BigEndian.PutUint64(sct[33:41], uint64(timestamp.UnixNano()/int64(time.Millisecond)))
+	return append(sct, 0, 0, 4, 3, 0, 0) // no extensions, empty signature
+}
+
+func chainWithSCTs(t *testing.T, scts ...[]byte) CertChain {
+	chain := createCertChain(t)
+	chain[0].OCSPResponse = nil
+	sctList, err := SerializeSCTList(scts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain[0].SCTList = sctList
+	return chain
+}
+
+func TestVerifyCTPolicy(t *testing.T) {
+	policy := CTPolicy{MinSCTs: 2, MinDistinctLogs: 2}
+	issued := sctTestTime.Add(-time.Hour)
+
+	chain := chainWithSCTs(t, fakeSCT(1, issued), fakeSCT(2, issued))
+	if err := chain.VerifyCTPolicy(policy, sctTestTime); err != nil {
+		t.Errorf("VerifyCTPolicy failed for SCTs from 2 distinct logs: %v", err)
+	}
+	scts, err := chain.SignedCertificateTimestamps()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(scts) != 2 || scts[0].LogID[0] != 1 || scts[1].LogID[0] != 2 || !scts[0].Timestamp.Equal(issued) {
+		t.Errorf("Unexpected SCTs: %+v", scts)
+	}
+
+	failing := map[string]CertChain{
+		"one SCT":             chainWithSCTs(t, fakeSCT(1, issued)),
+		"same log":            chainWithSCTs(t, fakeSCT(1, issued), fakeSCT(1, issued)),
+		"SCT from the future": chainWithSCTs(t, fakeSCT(1, issued), fakeSCT(2, sctTestTime.Add(time.Hour))),
+		"no SCTs":             chainWithSCTs(t),
+	}
+	for name, chain := range failing {
+		if err := chain.VerifyCTPolicy(policy, sctTestTime); err == nil {
+			t.Errorf("%s: VerifyCTPolicy unexpectedly succeeded", name)
+		}
+	}
+
+	malformed := createCertChain(t)
+	malformed[0].OCSPResponse = nil
+	malformed[0].SCTList = []byte{0, 3, 0, 1, 0}
+	if err := malformed.VerifyCTPolicy(policy, sctTestTime); err == nil {
+		t.Error("VerifyCTPolicy unexpectedly succeeded for a malformed SCT")
+	}
+}
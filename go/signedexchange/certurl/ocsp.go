@@ -4,14 +4,20 @@ import (
 	"bytes"
 	"crypto/x509"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"golang.org/x/crypto/ocsp"
 	"io"
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"time"
 )
 
+// MaxOCSPResponseAge is how long after its thisUpdate an OCSP response can be
+// used to validate a signed exchange.
+const MaxOCSPResponseAge = 7 * 24 * time.Hour
+
 func CreateOCSPRequest(certs []*x509.Certificate, preferGET bool) (*http.Request, error) {
 	if len(certs) < 2 {
 		return nil, fmt.Errorf("Could not fetch OCSP response: Issuer certificate not found")
@@ -72,6 +78,99 @@ func FetchOCSPResponse(certs []*x509.Certificate, preferGET bool) ([]byte, error
 	return output, nil
 }
 
+// ParsedOCSPResponse parses the OCSP response of the leaf certificate of the
+// chain. The signature of the response is not verified. It returns nil if the
+// leaf certificate has no OCSP response.
+func (chain CertChain) ParsedOCSPResponse() (*ocsp.Response, error) {
+	if len(chain) == 0 || chain[0].OCSPResponse == nil {
+		return nil, nil
+	}
+	o, err := ocsp.ParseResponse(chain[0].OCSPResponse, nil)
+	if err != nil {
+		return nil, fmt.Errorf("cert-chain: invalid OCSP response: %v", err)
+	}
+	return o, nil
+}
+
+// VerifyOCSPResponse checks that the main certificate of the chain has an OCSP
+// response with the "good" status, whose thisUpdate is at most
+// MaxOCSPResponseAge before now and whose nextUpdate, if any, is not before
+// now. See VerifiedOCSPResponse for how its issuer is checked.
+func (chain CertChain) VerifyOCSPResponse(now time.Time) error {
+	_, err := chain.VerifiedOCSPResponse(now)
+	return err
+}
+
+// VerifiedOCSPResponse is like VerifyOCSPResponse, but also returns the
+// verified OCSP response. The issuer of the main certificate is the second
+// certificate of the chain, or the main certificate itself if it is
+// self-signed. The issuer must have signed the main certificate, and the
+// response must be signed by it or by a responder certificate it issued for
+// OCSP signing. It is an error if the chain has no issuer.
+func (chain CertChain) VerifiedOCSPResponse(now time.Time) (*ocsp.Response, error) {
+	if len(chain) == 0 {
+		return nil, errors.New("cert-chain: cert chain must not be empty")
+	}
+	if chain[0].OCSPResponse == nil {
+		return nil, errors.New("cert-chain: the main certificate has no OCSP response")
+	}
+	leaf := chain[0].Cert
+	var issuer *x509.Certificate
+	if len(chain) >= 2 {
+		issuer = chain[1].Cert
+		if err := leaf.CheckSignatureFrom(issuer); err != nil {
+			return nil, fmt.Errorf("cert-chain: the main certificate is not issued by the second certificate: %v", err)
+		}
+	} else if isSelfSigned(leaf) {
+		issuer = leaf
+	} else {
+		return nil, errors.New("cert-chain: the issuer of the main certificate is needed to verify its OCSP response")
+	}
+	o, err := ocsp.ParseResponseForCert(chain[0].OCSPResponse, leaf, issuer)
+	if err != nil {
+		return nil, fmt.Errorf("cert-chain: invalid OCSP response: %v", err)
+	}
+	// ParseResponseForCert checks that a delegated responder certificate is
+	// signed by the issuer, but not that it is meant for OCSP signing.
+	if o.Certificate != nil && !o.Certificate.Equal(issuer) && !hasExtKeyUsage(o.Certificate, x509.ExtKeyUsageOCSPSigning) {
+		return nil, errors.New("cert-chain: the OCSP responder certificate is not authorized for OCSP signing")
+	}
+	if o.Status != ocsp.Good {
+		return nil, fmt.Errorf("cert-chain: OCSP status of the main certificate is %d (%s)", o.Status, ocspStatusString(o.Status))
+	}
+	if now.Before(o.ThisUpdate) {
+		return nil, fmt.Errorf("cert-chain: OCSP response is not yet valid. thisUpdate=%v", o.ThisUpdate)
+	}
+	if now.Sub(o.ThisUpdate) > MaxOCSPResponseAge {
+		return nil, fmt.Errorf("cert-chain: OCSP response is older than %v. thisUpdate=%v", MaxOCSPResponseAge, o.ThisUpdate)
+	}
+	if !o.NextUpdate.IsZero() && now.After(o.NextUpdate) {
+		return nil, fmt.Errorf("cert-chain: OCSP response is expired. nextUpdate=%v", o.NextUpdate)
+	}
+	return o, nil
+}
+
+func hasExtKeyUsage(cert *x509.Certificate, usage x509.ExtKeyUsage) bool {
+	for _, u := range cert.ExtKeyUsage {
+		if u == usage {
+			return true
+		}
+	}
+	return false
+}
+
+func ocspStatusString(status int) string {
+	switch status {
+	case ocsp.Good:
+		return "good"
+	case ocsp.Revoked:
+		return "revoked"
+	case ocsp.Unknown:
+		return "unknown"
+	}
+	return ""
+}
+
 func (chain CertChain) prettyPrintOCSP(w io.Writer, OCSPResponse []byte) {
 	var issuer *x509.Certificate
 	if len(chain) >= 2 {
@@ -82,12 +181,7 @@ func (chain CertChain) prettyPrintOCSP(w io.Writer, OCSPResponse []byte) {
 		fmt.Fprintln(w, "Error: Invalid OCSP response:", err)
 		return
 	}
-	ocspStatusToString := map[int]string{
-		ocsp.Good:    "good",
-		ocsp.Revoked: "revoked",
-		ocsp.Unknown: "unknown",
-	}
-	fmt.Fprintf(w, "  Status: %d (%s)\n", o.Status, ocspStatusToString[o.Status])
+	fmt.Fprintf(w, "  Status: %d (%s)\n", o.Status, ocspStatusString(o.Status))
 	fmt.Fprintln(w, "  ProducedAt:", o.ProducedAt)
 	fmt.Fprintln(w, "  ThisUpdate:", o.ThisUpdate)
 	fmt.Fprintln(w, "  NextUpdate:", o.NextUpdate)
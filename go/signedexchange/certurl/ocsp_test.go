@@ -1,8 +1,10 @@
 package certurl_test
 
 import (
+	"crypto/x509"
 	"io/ioutil"
 	"testing"
+	"time"
 
 	"github.com/WICG/webpackage/go/internal/signingalgorithm"
 	. "github.com/WICG/webpackage/go/signedexchange/certurl"
@@ -87,3 +89,111 @@ func TestCreateOCSPRequestLarge(t *testing.T) {
 		t.Errorf("Cannot parse request body as an OCSP request: %v", err)
 	}
 }
+
+func TestVerifyOCSPResponse(t *testing.T) {
+	root := issueCert(t, caTemplate("Root"), nil)
+	leaf := issueCert(t, leafTemplate(true), root)
+	now := chainTestTime
+	createResponse := func(status int, thisUpdate, nextUpdate time.Time) []byte {
+		der, err := ocsp.CreateResponse(root.cert, root.cert, ocsp.Response{
+			Status:       status,
+			SerialNumber: leaf.cert.SerialNumber,
+			ThisUpdate:   thisUpdate,
+			NextUpdate:   nextUpdate,
+		}, root.key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return der
+	}
+	withIssuer := func(ocspDER []byte) CertChain {
+		return CertChain{{Cert: leaf.cert, OCSPResponse: ocspDER}, {Cert: root.cert}}
+	}
+	good := createResponse(ocsp.Good, now.Add(-24*time.Hour), time.Time{})
+	if err := withIssuer(good).VerifyOCSPResponse(now); err != nil {
+		t.Errorf("VerifyOCSPResponse failed: %v", err)
+	}
+
+	cases := []struct {
+		name  string
+		chain CertChain
+	}{
+		{"no OCSP response", withIssuer(nil)},
+		{"malformed", withIssuer([]byte("dummy"))},
+		{"revoked", withIssuer(createResponse(ocsp.Revoked, now.Add(-24*time.Hour), time.Time{}))},
+		{"too old", withIssuer(createResponse(ocsp.Good, now.Add(-MaxOCSPResponseAge-time.Second), time.Time{}))},
+		{"not yet valid", withIssuer(createResponse(ocsp.Good, now.Add(time.Hour), time.Time{}))},
+		{"expired", withIssuer(createResponse(ocsp.Good, now.Add(-48*time.Hour), now.Add(-24*time.Hour)))},
+		{"no issuer", CertChain{{Cert: leaf.cert, OCSPResponse: good}}},
+	}
+	for _, c := range cases {
+		if err := c.chain.VerifyOCSPResponse(now); err == nil {
+			t.Errorf("%s: VerifyOCSPResponse unexpectedly succeeded", c.name)
+		}
+	}
+}
+
+func TestVerifiedOCSPResponse(t *testing.T) {
+	root := issueCert(t, caTemplate("Root"), nil)
+	otherRoot := issueCert(t, caTemplate("Other Root"), nil)
+	leaf := issueCert(t, leafTemplate(true), root)
+	selfSigned := issueCert(t, leafTemplate(true), nil)
+	responderTemplate := leafTemplate(false, x509.ExtKeyUsageOCSPSigning)
+	responderTemplate.Subject.CommonName = "Responder"
+	responder := issueCert(t, responderTemplate, root)
+	notResponder := issueCert(t, leafTemplate(false, x509.ExtKeyUsageServerAuth), root)
+	otherResponder := issueCert(t, leafTemplate(false, x509.ExtKeyUsageOCSPSigning), otherRoot)
+	thisUpdate := chainTestTime.Add(-time.Hour)
+	// createResponse creates a response for cert signed by signer, naming
+	// issuer in the CertID. If signer is not issuer, its certificate is
+	// embedded as the delegated responder.
+	createResponse := func(cert, issuer, signer *testCert) []byte {
+		template := ocsp.Response{
+			Status:       ocsp.Good,
+			SerialNumber: cert.cert.SerialNumber,
+			ThisUpdate:   thisUpdate,
+			NextUpdate:   chainTestTime.Add(time.Hour),
+		}
+		if signer != issuer {
+			template.Certificate = signer.cert
+		}
+		der, err := ocsp.CreateResponse(issuer.cert, signer.cert, template, signer.key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return der
+	}
+
+	for _, c := range []struct {
+		name  string
+		chain CertChain
+		ok    bool
+	}{
+		{"issuer", CertChain{{Cert: leaf.cert, OCSPResponse: createResponse(leaf, root, root)}, {Cert: root.cert}}, true},
+		{"delegated responder", CertChain{{Cert: leaf.cert, OCSPResponse: createResponse(leaf, root, responder)}, {Cert: root.cert}}, true},
+		{"responder without OCSP signing", CertChain{{Cert: leaf.cert, OCSPResponse: createResponse(leaf, root, notResponder)}, {Cert: root.cert}}, false},
+		{"responder of another issuer", CertChain{{Cert: leaf.cert, OCSPResponse: createResponse(leaf, root, otherResponder)}, {Cert: root.cert}}, false},
+		{"self-signed", CertChain{{Cert: selfSigned.cert, OCSPResponse: createResponse(selfSigned, selfSigned, selfSigned)}}, true},
+		{"self-signed, other responder", CertChain{{Cert: selfSigned.cert, OCSPResponse: createResponse(selfSigned, otherRoot, otherRoot)}}, false},
+		{"issuer mismatch", CertChain{{Cert: leaf.cert, OCSPResponse: createResponse(leaf, otherRoot, otherRoot)}, {Cert: otherRoot.cert}}, false},
+		// Without the issuer, a response signed by anyone must not be
+		// accepted.
+		{"single certificate, forged response", CertChain{{Cert: leaf.cert, OCSPResponse: createResponse(leaf, otherRoot, otherRoot)}}, false},
+		{"single certificate, genuine response", CertChain{{Cert: leaf.cert, OCSPResponse: createResponse(leaf, root, root)}}, false},
+	} {
+		o, err := c.chain.VerifiedOCSPResponse(chainTestTime)
+		if !c.ok {
+			if err == nil {
+				t.Errorf("%s: VerifiedOCSPResponse unexpectedly succeeded", c.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: VerifiedOCSPResponse failed: %v", c.name, err)
+			continue
+		}
+		if o.Status != ocsp.Good || !o.ThisUpdate.Equal(thisUpdate) {
+			t.Errorf("%s: got status %d, thisUpdate %v", c.name, o.Status, o.ThisUpdate)
+		}
+	}
+}
@@ -49,6 +49,42 @@ func SerializeSCTList(scts [][]byte) ([]byte, error) {
 	return buf.Bytes(), nil
 }
 
+// ParseSCTList splits a SignedCertificateTimestampList (RFC6962 Section 3.3)
+// into its SerializedSCTs. It is the inverse of SerializeSCTList.
+func ParseSCTList(sctList []byte) ([][]byte, error) {
+	buf := bytes.NewBuffer(sctList)
+
+	var total_length uint16
+	if err := binary.Read(buf, binary.BigEndian, &total_length); err != nil {
+		return nil, fmt.Errorf("cert-chain: cannot parse length of SignedCertificateTimestampList: %v", err)
+	}
+	if int(total_length) != buf.Len() {
+		return nil, fmt.Errorf("cert-chain: unexpected length of SignedCertificateTimestampList. expected: %d, actual: %d", total_length, buf.Len())
+	}
+
+	var scts [][]byte
+	for buf.Len() > 0 {
+		var length uint16
+		if err := binary.Read(buf, binary.BigEndian, &length); err != nil {
+			return nil, fmt.Errorf("cert-chain: cannot parse length of SerializedSCT: %v", err)
+		}
+		sct := buf.Next(int(length))
+		if int(length) != len(sct) {
+			return nil, fmt.Errorf("cert-chain: unexpected length of SerializedSCT. expected: %d, actual: %d", length, len(sct))
+		}
+		scts = append(scts, sct)
+	}
+	return scts, nil
+}
+
+// SCTs returns the SerializedSCTs in the SCTList of ac, or nil if it has none.
+func (ac *AugmentedCertificate) SCTs() ([][]byte, error) {
+	if ac.SCTList == nil {
+		return nil, nil
+	}
+	return ParseSCTList(ac.SCTList)
+}
+
 // HasEmbeddedSCT returns true if the certificate or the OCSP response have
 // embedded SCT list.
 func HasEmbeddedSCT(cert *x509.Certificate, ocsp_resp *ocsp.Response) bool {
@@ -88,30 +124,13 @@ func prettyPrintSCTExtension(w io.Writer, extensions []pkix.Extension, oid asn1.
 }
 
 func prettyPrintSCT(w io.Writer, SCTList []byte) {
-	buf := bytes.NewBuffer(SCTList)
-
-	var total_length uint16
-	if err := binary.Read(buf, binary.BigEndian, &total_length); err != nil {
-		fmt.Fprintln(w, "Error: Cannot parse length of SignedCertificateTimestampList:", err)
+	scts, err := ParseSCTList(SCTList)
+	if err != nil {
+		fmt.Fprintln(w, "Error:", err)
 		return
 	}
-	if int(total_length) != buf.Len() {
-		fmt.Fprintf(w, "Error: Unexpected length of SignedCertificateTimestampList. expected: %d, actual: %d\n", total_length, buf.Len())
-		return
-	}
-
-	for buf.Len() > 0 {
-		var length uint16
-		if err := binary.Read(buf, binary.BigEndian, &length); err != nil {
-			fmt.Fprintln(w, "Error: Cannot parse length of SerializedSCT:", err)
-			return
-		}
-		sct := buf.Next(int(length))
-		if int(length) != len(sct) {
-			fmt.Fprintf(w, "Error: Unexpected length of SerializedSCT. expected: %d, actual: %d\n", length, len(sct))
-			return
-		}
 
+	for _, sct := range scts {
 		// sct[0] is the Version and sct[1:33] is the LogID of the SCT (Section 3.2 of RFC6962).
 		if len(sct) < 33 {
 			fmt.Fprintf(w, "Error: SCT too short (%d bytes)\n", len(sct))
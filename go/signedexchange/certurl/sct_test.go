@@ -2,6 +2,7 @@ package certurl_test
 
 import (
 	"bytes"
+	"reflect"
 	"testing"
 
 	. "github.com/WICG/webpackage/go/signedexchange/certurl"
@@ -34,3 +35,22 @@ func TestSerializeSCTListTooLarge(t *testing.T) {
 		t.Errorf("SerializeSCTList didn't fail with too large SCT list")
 	}
 }
+
+func TestParseSCTList(t *testing.T) {
+	scts := [][]byte{{1, 2, 3}, {4, 5, 6}}
+	serialized, err := SerializeSCTList(scts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := ParseSCTList(serialized)
+	if err != nil {
+		t.Fatalf("ParseSCTList failed: %v", err)
+	}
+	if !reflect.DeepEqual(parsed, scts) {
+		t.Errorf("ParseSCTList returned %v, want %v", parsed, scts)
+	}
+
+	if _, err := ParseSCTList(serialized[:len(serialized)-1]); err == nil {
+		t.Error("ParseSCTList didn't fail with truncated SCT list")
+	}
+}
@@ -0,0 +1,155 @@
+// Package client provides an http.RoundTripper that unwraps signed exchanges,
+// so that HTTP clients can fetch signed exchanges like ordinary responses.
+package client
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"time"
+
+	"github.com/WICG/webpackage/go/signedexchange"
+)
+
+// Transport is an http.RoundTripper that verifies the signed exchanges it
+// receives and returns the responses inside them.
+//
+// A response with the Content-Type application/signed-exchange is read and
+// verified, and the response inside the exchange (see
+// signedexchange.Exchange.ToResponse) is returned in its place. If the
+// exchange cannot be read or verified, the response is returned as received,
+// so that the caller can fall back to it like a browser falls back to the
+// fallback URL. Other responses are returned as received.
+//
+// Transport does not add signed exchanges to the Accept header of requests;
+// requests must ask for them.
+type Transport struct {
+	// Base makes the requests. If nil, http.DefaultTransport is used.
+	Base http.RoundTripper
+
+	// MaxSize is the maximum size of a signed exchange in bytes. A larger
+	// one is returned as received, without reading all of it. If not
+	// positive, DefaultMaxSize is used.
+	MaxSize int64
+
+	// CertFetcher fetches the certificate chains of the signatures. If
+	// nil, signedexchange.DefaultCertFetcher is used.
+	CertFetcher signedexchange.CertFetcher
+
+	// ContextCertFetcher, if non-nil, is used instead of CertFetcher, and
+	// is passed the context of the request, so that fetching certificate
+	// chains is cancelled with the request.
+	ContextCertFetcher signedexchange.ContextCertFetcher
+
+	// Now returns the time exchanges are verified at. If nil, time.Now is
+	// used.
+	Now func() time.Time
+
+	// VerifyOptions are passed to Exchange.VerifyContext.
+	VerifyOptions []signedexchange.VerifyOption
+
+	// OnVerifyError, if non-nil, is called with the request and the error
+	// when a signed exchange cannot be read or verified, before the
+	// response is returned as received.
+	OnVerifyError func(req *http.Request, err error)
+}
+
+// DefaultMaxSize is the default of Transport.MaxSize.
+const DefaultMaxSize = 8 << 20
+
+func (t *Transport) base() http.RoundTripper {
+	if t.Base == nil {
+		return http.DefaultTransport
+	}
+	return t.Base
+}
+
+func (t *Transport) certFetcher() signedexchange.ContextCertFetcher {
+	if t.ContextCertFetcher != nil {
+		return t.ContextCertFetcher
+	}
+	if t.CertFetcher == nil {
+		return signedexchange.CertFetcher(signedexchange.DefaultCertFetcher)
+	}
+	return t.CertFetcher
+}
+
+func (t *Transport) maxSize() int64 {
+	if t.MaxSize <= 0 {
+		return DefaultMaxSize
+	}
+	return t.MaxSize
+}
+
+func (t *Transport) now() time.Time {
+	if t.Now == nil {
+		return time.Now()
+	}
+	return t.Now()
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.base().RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	mediaType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil || mediaType != "application/signed-exchange" {
+		return resp, nil
+	}
+
+	maxSize := t.maxSize()
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxSize+1))
+	if err != nil {
+		resp.Body.Close()
+		return nil, fmt.Errorf("client: failed to read the signed exchange from %q: %v", req.URL, err)
+	}
+	if int64(len(body)) > maxSize {
+		// The rest of the body is left to the caller.
+		resp.Body = readCloser{io.MultiReader(bytes.NewReader(body), resp.Body), resp.Body}
+		t.verifyError(req, fmt.Errorf("client: the signed exchange from %q is larger than %d bytes", req.URL, maxSize))
+		return resp, nil
+	}
+	resp.Body.Close()
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	inner, err := t.unwrap(req.Context(), resp, body)
+	if err != nil {
+		t.verifyError(req, err)
+		return resp, nil
+	}
+	return inner, nil
+}
+
+func (t *Transport) verifyError(req *http.Request, err error) {
+	if t.OnVerifyError != nil {
+		t.OnVerifyError(req, err)
+	}
+}
+
+// readCloser reads from Reader and closes Closer.
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// unwrap verifies the signed exchange body of resp and returns the response
+// inside it.
+func (t *Transport) unwrap(ctx context.Context, resp *http.Response, body []byte) (*http.Response, error) {
+	raw := *resp
+	raw.Body = ioutil.NopCloser(bytes.NewReader(body))
+	e, err := signedexchange.ReadExchangeFromResponse(&raw)
+	if err != nil {
+		return nil, err
+	}
+	result, err := e.VerifyContext(ctx, t.now(), t.certFetcher(), t.VerifyOptions...)
+	if err != nil {
+		return nil, err
+	}
+	return e.ResponseWithPayload(result.Payload)
+}
@@ -0,0 +1,131 @@
+package client_test
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/WICG/webpackage/go/signedexchange"
+	. "github.com/WICG/webpackage/go/signedexchange/client"
+	"github.com/WICG/webpackage/go/signedexchange/signedexchangetest"
+	"github.com/WICG/webpackage/go/signedexchange/version"
+)
+
+const (
+	requestURL = "https://example.com/"
+	payload    = "<p>Hello, world!</p>"
+)
+
+var signatureDate = signedexchangetest.SignatureDate
+
+// createTestExchange returns a signed exchange of payload and the
+// cert-chain+cbor its certificate is served as.
+func createTestExchange(t *testing.T) (sxg, certBytes []byte) {
+	s, certBytes := signedexchangetest.NewSigner(t)
+	header := http.Header{"Content-Type": {"text/html; charset=utf-8"}}
+	e := signedexchange.NewExchange(version.Version1b3, requestURL, http.MethodGet, nil, 200, header, []byte(payload))
+	if err := e.MiEncodePayload(16); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.AddSignatureHeader(s); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := e.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes(), certBytes
+}
+
+func TestTransport(t *testing.T) {
+	sxg, certBytes := createTestExchange(t)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/sxg":
+			w.Header().Set("Content-Type", version.Version1b3.MimeType())
+			w.Write(sxg)
+		case "/garbage":
+			w.Header().Set("Content-Type", version.Version1b3.MimeType())
+			w.Write([]byte("not a signed exchange"))
+		default:
+			w.Header().Set("Content-Type", "text/plain")
+			w.Write([]byte("plain"))
+		}
+	}))
+	defer server.Close()
+
+	get := func(transport *Transport, path string) (*http.Response, []byte) {
+		t.Helper()
+		resp, err := (&http.Client{Transport: transport}).Get(server.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp, body
+	}
+	certFetcher := func(_ string) ([]byte, error) { return certBytes, nil }
+
+	// A valid signed exchange is unwrapped.
+	var verifyErr error
+	transport := &Transport{
+		CertFetcher:   certFetcher,
+		Now:           func() time.Time { return signatureDate },
+		OnVerifyError: func(_ *http.Request, err error) { verifyErr = err },
+	}
+	resp, body := get(transport, "/sxg")
+	if verifyErr != nil {
+		t.Errorf("Unexpected verification error: %v", verifyErr)
+	}
+	if string(body) != payload || resp.Header.Get("Content-Type") != "text/html; charset=utf-8" {
+		t.Errorf("Unexpected inner response: Content-Type %q, body %q", resp.Header.Get("Content-Type"), body)
+	}
+	if resp.Request.URL.String() != requestURL {
+		t.Errorf("Unexpected request URL: %v", resp.Request.URL)
+	}
+
+	// Other responses are returned as received.
+	if _, body := get(transport, "/plain"); string(body) != "plain" {
+		t.Errorf("Unexpected body: %q", body)
+	}
+
+	// If verification fails, the signed exchange is returned as received.
+	transport.Now = func() time.Time { return signatureDate.Add(48 * time.Hour) }
+	resp, body = get(transport, "/sxg")
+	var verificationErr *signedexchange.VerificationError
+	if !errors.As(verifyErr, &verificationErr) {
+		t.Errorf("got verification error %v, want a *signedexchange.VerificationError", verifyErr)
+	}
+	if !bytes.Equal(body, sxg) || resp.Header.Get("Content-Type") != version.Version1b3.MimeType() {
+		t.Errorf("Signed exchange was not returned as received: Content-Type %q, %d bytes", resp.Header.Get("Content-Type"), len(body))
+	}
+
+	// So is a signed exchange larger than MaxSize, without reading it
+	// further than MaxSize.
+	transport.Now = func() time.Time { return signatureDate }
+	transport.MaxSize = int64(len(sxg) - 1)
+	verifyErr = nil
+	resp, body = get(transport, "/sxg")
+	if verifyErr == nil || !strings.Contains(verifyErr.Error(), "larger than") {
+		t.Errorf("got error %v for a too large signed exchange", verifyErr)
+	}
+	if !bytes.Equal(body, sxg) || resp.Header.Get("Content-Type") != version.Version1b3.MimeType() {
+		t.Errorf("Too large signed exchange was not returned as received: Content-Type %q, %d bytes", resp.Header.Get("Content-Type"), len(body))
+	}
+	transport.MaxSize = 0
+
+	// So is a body that is not a signed exchange.
+	transport.CertFetcher = func(_ string) ([]byte, error) { return nil, errors.New("unexpected fetch") }
+	verifyErr = nil
+	if _, body := get(transport, "/garbage"); string(body) != "not a signed exchange" || verifyErr == nil {
+		t.Errorf("Unexpected body %q and error %v", body, verifyErr)
+	}
+}
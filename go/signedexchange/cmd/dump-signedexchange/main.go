@@ -39,6 +39,8 @@ var (
 	flagHeaderIntegrity = flag.Bool("headerIntegrity", false, "Print only header-integrity, for use with subresource substitution")
 	flagHeaders         = flag.Bool("headers", true, "Print headers")
 	flagFilename        = flag.String("i", "", "Signed-exchange input file")
+	flagIgnoreOCSP      = flag.Bool("ignoreOCSP", false, "Do not check the OCSP response of the certificate when verifying, e.g. for a development certificate")
+	flagIgnoreCertReqs  = flag.Bool("ignoreCertRequirements", false, "Do not check the CanSignHttpExchanges extension and the 90-day validity limit of the certificate when verifying")
 	flagJSON            = flag.Bool("json", false, "Print output as JSON")
 	flagPayload         = flag.Bool("payload", true, "Print payload")
 	flagSignature       = flag.Bool("signature", false, "Print only signature value")
@@ -87,24 +89,26 @@ func run() error {
 		if err != nil {
 			return err
 		}
-		respMimeType := resp.Header.Get("Content-Type")
-		if respMimeType != mimeType {
-			return fmt.Errorf("GET %q responded with unexpected content type %q", *flagURI, respMimeType)
+		e, err = signedexchange.ReadExchangeFromResponse(resp)
+		if err != nil {
+			return fmt.Errorf("GET %q: %v", *flagURI, err)
+		}
+		if e.Version != ver {
+			return fmt.Errorf("GET %q responded with unexpected version %s", *flagURI, e.Version)
 		}
-		in = resp.Body
-		defer resp.Body.Close()
 	} else if (fi.Mode() & os.ModeCharDevice) == 0 { // read sxg from pipe
 		in = os.Stdin
 	}
 
-	if in == nil {
-		flag.PrintDefaults()
-		return nil
-	}
-
-	e, err = signedexchange.ReadExchange(in)
-	if err != nil {
-		return err
+	if e == nil {
+		if in == nil {
+			flag.PrintDefaults()
+			return nil
+		}
+		e, err = signedexchange.ReadExchange(in)
+		if err != nil {
+			return err
+		}
 	}
 
 	certFetcher, err := initCertFetcher()
@@ -178,8 +182,19 @@ func initCertFetcher() (signedexchange.CertFetcher, error) {
 	return certFetcher, nil
 }
 
+func verifyOptions() []signedexchange.VerifyOption {
+	var opts []signedexchange.VerifyOption
+	if *flagIgnoreOCSP {
+		opts = append(opts, signedexchange.WithIgnoreOCSP())
+	}
+	if *flagIgnoreCertReqs {
+		opts = append(opts, signedexchange.WithIgnoreCertRequirements())
+	}
+	return opts
+}
+
 func verify(e *signedexchange.Exchange, certFetcher signedexchange.CertFetcher, verificationTime time.Time) error {
-	if decodedPayload, ok := e.Verify(verificationTime, certFetcher, log.New(os.Stdout, "", 0)); ok {
+	if decodedPayload, ok := e.Verify(verificationTime, certFetcher, log.New(os.Stdout, "", 0), verifyOptions()...); ok {
 		e.Payload = decodedPayload
 		fmt.Println("The exchange has a valid signature.")
                 return nil
@@ -189,7 +204,7 @@ func verify(e *signedexchange.Exchange, certFetcher signedexchange.CertFetcher,
 
 func jsonPrintHeaders(e *signedexchange.Exchange, certFetcher signedexchange.CertFetcher, verificationTime time.Time, w io.Writer) error {
 	// TODO: Add verification error messages to the output.
-	_, valid := e.Verify(verificationTime, certFetcher, log.New(ioutil.Discard, "", 0))
+	_, valid := e.Verify(verificationTime, certFetcher, log.New(ioutil.Discard, "", 0), verifyOptions()...)
 
 	sigs, err := structuredheader.ParseParameterisedList(e.SignatureHeaderValue)
 	if err != nil {
@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"flag"
 	"fmt"
 	"io"
@@ -16,9 +17,12 @@ import (
 	"github.com/WICG/webpackage/go/internal/signingalgorithm"
 	"github.com/WICG/webpackage/go/signedexchange"
 	"github.com/WICG/webpackage/go/signedexchange/certurl"
+	"github.com/WICG/webpackage/go/signedexchange/mice"
 	"github.com/WICG/webpackage/go/signedexchange/version"
 )
 
+const defaultMIRecordSize = 4096
+
 type headerArgs []string
 
 func (h *headerArgs) String() string {
@@ -40,9 +44,12 @@ var (
 	flagCertificateUrl = flag.String("certUrl", "https://example.com/cert.msg", "The URL where the certificate chain is hosted at.")
 	flagValidityUrl    = flag.String("validityUrl", "https://example.com/resource.validity.msg", "The URL where resource validity info is hosted at.")
 	flagPrivateKey     = flag.String("privateKey", "cert-key.pem", "Private key PEM file of the origin")
-	flagMIRecordSize   = flag.Int("miRecordSize", 4096, "The record size of Merkle Integrity Content Encoding")
+	flagMIRecordSize   = flag.Int("miRecordSize", defaultMIRecordSize, fmt.Sprintf("The record size of Merkle Integrity Content Encoding in bytes, between 1 and %d. Smaller records let browsers verify and use the payload in smaller chunks while streaming, but add %d bytes of integrity proof per record.", mice.MaxRecordSize, sha256.Size))
 	flagDate           = flag.String("date", "", "The datetime for the signed exchange in RFC3339 format (2006-01-02T15:04:05Z). Use now by default.")
 	flagExpire         = flag.Duration("expire", 1*time.Hour, "The expire time of the signed exchange")
+	flagDeterministic  = flag.Bool("deterministic", false, "Sign reproducibly, so that the same inputs give a byte-identical exchange. Requires -date.")
+
+	flagExperimentalMiSha512 = flag.Bool("experimentalMiSha512", false, "Encode the payload with the experimental mi-sha512-03 encoding instead of mi-sha256-03. Only for version 1b3, and not supported by browsers.")
 
 	flagDumpSignatureMessage = flag.String("dumpSignatureMessage", "", "Dump signature message bytes to a file for debugging.")
 	flagDumpHeadersCbor      = flag.String("dumpHeadersCbor", "", "Dump metadata and headers encoded as a canonical CBOR to a file for debugging.")
@@ -92,6 +99,9 @@ func run() error {
 	if !ok {
 		return fmt.Errorf("failed to parse version %q", *flagVersion)
 	}
+	if err := signedexchange.ValidateRecordSize(ver, *flagMIRecordSize); err != nil && (*flagMIRecordSize < 1 || !*flagIgnoreErrors) {
+		return fmt.Errorf("invalid miRecordSize: %v", err)
+	}
 	privkey, err := signingalgorithm.ParsePrivateKey(privkeytext)
 	if err != nil {
 		return fmt.Errorf("failed to parse private key file %q. err: %v", *flagPrivateKey, err)
@@ -142,12 +152,22 @@ func run() error {
 	}
 
 	e := signedexchange.NewExchange(ver, *flagUri, *flagMethod, reqHeader, *flagResponseStatus, resHeader, payload)
-	if err := e.MiEncodePayload(*flagMIRecordSize); err != nil {
+	enc := ver.MiceEncoding()
+	if *flagExperimentalMiSha512 {
+		enc = mice.Draft03SHA512Encoding
+	}
+	if err := e.MiEncodePayloadWithEncoding(*flagMIRecordSize, enc); err != nil {
+		return err
+	}
+	if err := e.Validate(); err != nil && !*flagIgnoreErrors {
 		return err
 	}
 
 	var date time.Time
 	if *flagDate == "" {
+		if *flagDeterministic {
+			return fmt.Errorf("-deterministic requires -date")
+		}
 		date = time.Now()
 	} else {
 		var err error
@@ -164,6 +184,8 @@ func run() error {
 		CertUrl:     certUrl,
 		ValidityUrl: validityUrl,
 		PrivKey:     privkey,
+
+		Deterministic: *flagDeterministic,
 	}
 	if err := e.AddSignatureHeader(s); err != nil {
 		return err
@@ -186,7 +208,10 @@ func run() error {
 			return certBuf.Bytes(), nil
 		}
 		var logBuf bytes.Buffer
-		if _, ok := e.Verify(date, certFetcher, log.New(&logBuf, "", 0)); !ok {
+		// The cert chain has a dummy OCSP response, so skip checking it. The
+		// check is about the signing, so the certificate may be a
+		// development one that browsers would not accept.
+		if _, ok := e.Verify(date, certFetcher, log.New(&logBuf, "", 0), signedexchange.WithIgnoreOCSP(), signedexchange.WithIgnoreCertRequirements()); !ok {
 			return fmt.Errorf("failed to verify generated exchange: %s", logBuf.String())
 		}
 	}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"flag"
+	"io/ioutil"
+	"math/big"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/WICG/webpackage/go/signedexchange"
+	"github.com/WICG/webpackage/go/signedexchange/mice"
+)
+
+var testDate = time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// writeTestFiles writes a payload, a self-signed certificate and its private
+// key to dir, and points the flags at them.
+func writeTestFiles(t *testing.T, dir string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "example.com"},
+		DNSNames:     []string{"example.com"},
+		NotBefore:    testDate.Add(-24 * time.Hour),
+		NotAfter:     testDate.Add(24 * time.Hour),
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files := map[string][]byte{
+		"index.html":   bytes.Repeat([]byte("<p>Hello</p>"), 1000),
+		"cert.pem":     pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER}),
+		"cert-key.pem": pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), content, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	setFlags(t, map[string]string{
+		"content":     filepath.Join(dir, "index.html"),
+		"certificate": filepath.Join(dir, "cert.pem"),
+		"privateKey":  filepath.Join(dir, "cert-key.pem"),
+		"date":        testDate.Format(time.RFC3339),
+		"o":           filepath.Join(dir, "out.sxg"),
+	})
+}
+
+// setFlags sets the flags, and restores their values when the test finishes.
+func setFlags(t *testing.T, values map[string]string) {
+	for name, value := range values {
+		f := flag.Lookup(name)
+		old := f.Value.String()
+		if err := f.Value.Set(value); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { f.Value.Set(old) })
+	}
+}
+
+func TestMIRecordSize(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFiles(t, dir)
+
+	for _, size := range []int{16, defaultMIRecordSize, mice.MaxRecordSize} {
+		setFlags(t, map[string]string{"miRecordSize": strconv.Itoa(size)})
+		if err := run(); err != nil {
+			t.Fatalf("miRecordSize=%d: %v", size, err)
+		}
+		out, err := ioutil.ReadFile(filepath.Join(dir, "out.sxg"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		e, err := signedexchange.ReadExchange(bytes.NewReader(out))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := e.MIRecordSize()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != uint64(size) {
+			t.Errorf("miRecordSize=%d: the exchange has record size %d", size, got)
+		}
+	}
+
+	for _, size := range []int{0, -1, mice.MaxRecordSize + 1} {
+		setFlags(t, map[string]string{"miRecordSize": strconv.Itoa(size)})
+		if err := run(); err == nil {
+			t.Errorf("miRecordSize=%d unexpectedly accepted", size)
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package signedexchange
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/WICG/webpackage/go/signedexchange/structuredheader"
+	"github.com/WICG/webpackage/go/signedexchange/version"
+)
+
+// Difference is a semantic difference between two exchanges, see Diff.
+type Difference struct {
+	// Kind names what differs: "version", "request-url", "request-method",
+	// "request-header", "response-status", "response-header", "payload" or
+	// "signature".
+	Kind string
+	// Name is the header name for headers, and the label and the parameter
+	// name for signatures, e.g. "label;cert-url", or just the label if only
+	// one of the exchanges has a signature with it.
+	Name string
+	// A and B are the values in the first and the second exchange, or empty
+	// if absent. Header values are combined with commas, the payloads are
+	// described by their SHA-256 hashes, and byte sequence parameters of
+	// signatures are base64 encoded.
+	A, B string
+}
+
+func (d Difference) String() string {
+	value := func(v string) string {
+		if v == "" {
+			return "absent"
+		}
+		return strconv.Quote(v)
+	}
+	if d.Name == "" {
+		return fmt.Sprintf("%s: %s != %s", d.Kind, value(d.A), value(d.B))
+	}
+	return fmt.Sprintf("%s %q: %s != %s", d.Kind, d.Name, value(d.A), value(d.B))
+}
+
+// Differences is the result of Diff.
+type Differences []Difference
+
+// SignatureOnly returns true if the exchanges differ only in their
+// signatures, e.g. because one is the other re-signed.
+func (ds Differences) SignatureOnly() bool {
+	for _, d := range ds {
+		if d.Kind != "signature" {
+			return false
+		}
+	}
+	return true
+}
+
+// Diff returns the semantic differences between the exchanges a and b, in a
+// stable order: the version, the request URL, method and headers, the
+// response status and headers, the payload and the signatures. Header names
+// are compared case-insensitively, and repeated header fields as if combined
+// with commas. The request method and headers are compared only if both
+// versions sign them. Signatures are matched by label, and compared
+// parameter by parameter. Diff neither verifies the exchanges nor needs their
+// certificates, and returns nil if they are the same.
+func Diff(a, b *Exchange) Differences {
+	var ds Differences
+	add := func(kind, name, va, vb string) {
+		if va != vb {
+			ds = append(ds, Difference{Kind: kind, Name: name, A: va, B: vb})
+		}
+	}
+	signsRequest := func(v version.Version) bool {
+		return v == version.Version1b1 || v == version.Version1b2
+	}
+
+	add("version", "", string(a.Version), string(b.Version))
+	add("request-url", "", a.RequestURI, b.RequestURI)
+	if signsRequest(a.Version) && signsRequest(b.Version) {
+		add("request-method", "", a.RequestMethod, b.RequestMethod)
+		ds = append(ds, diffHeaderValues("request-header", a.RequestHeaders, b.RequestHeaders)...)
+	}
+	add("response-status", "", strconv.Itoa(a.ResponseStatus), strconv.Itoa(b.ResponseStatus))
+	ds = append(ds, diffHeaderValues("response-header", a.ResponseHeaders, b.ResponseHeaders)...)
+	add("payload", "", payloadHash(a.Payload), payloadHash(b.Payload))
+	ds = append(ds, diffSignatures(a.SignatureHeaderValue, b.SignatureHeaderValue)...)
+	return ds
+}
+
+// diffHeaderValues is like diffHeaders, but for Diff.
+func diffHeaderValues(kind string, a, b http.Header) []Difference {
+	values := func(h http.Header) map[string]string {
+		m := make(map[string]string, len(h))
+		for name, vs := range h {
+			name = http.CanonicalHeaderKey(name)
+			if v, ok := m[name]; ok {
+				m[name] = v + "," + normalizeHeaderValues(name, vs)
+			} else {
+				m[name] = normalizeHeaderValues(name, vs)
+			}
+		}
+		return m
+	}
+	va, vb := values(a), values(b)
+	var ds []Difference
+	for _, name := range unionKeys(va, vb) {
+		if va[name] != vb[name] {
+			ds = append(ds, Difference{Kind: kind, Name: name, A: va[name], B: vb[name]})
+		}
+	}
+	return ds
+}
+
+// diffSignatures compares the Signature header values a and b. If either
+// cannot be parsed, the values are compared as a whole.
+func diffSignatures(a, b string) []Difference {
+	params := func(value string) (map[string]map[string]string, error) {
+		list, err := structuredheader.ParseParameterisedList(value)
+		if err != nil {
+			return nil, err
+		}
+		m := make(map[string]map[string]string, len(list))
+		for _, pi := range list {
+			ps := make(map[string]string, len(pi.Params))
+			for k, v := range pi.Params {
+				ps[string(k)] = formatSignatureParam(v)
+			}
+			m[string(pi.Label)] = ps
+		}
+		return m, nil
+	}
+	pa, errA := params(a)
+	pb, errB := params(b)
+	if errA != nil || errB != nil {
+		if a != b {
+			return []Difference{{Kind: "signature", A: a, B: b}}
+		}
+		return nil
+	}
+
+	presence := func(m map[string]map[string]string) map[string]string {
+		labels := make(map[string]string, len(m))
+		for label := range m {
+			labels[label] = "present"
+		}
+		return labels
+	}
+	inA, inB := presence(pa), presence(pb)
+	var ds []Difference
+	for _, label := range unionKeys(inA, inB) {
+		if inA[label] != inB[label] {
+			ds = append(ds, Difference{Kind: "signature", Name: label, A: inA[label], B: inB[label]})
+			continue
+		}
+		sa, sb := pa[label], pb[label]
+		for _, k := range unionKeys(sa, sb) {
+			if sa[k] != sb[k] {
+				ds = append(ds, Difference{Kind: "signature", Name: label + ";" + k, A: sa[k], B: sb[k]})
+			}
+		}
+	}
+	return ds
+}
+
+func formatSignatureParam(v structuredheader.Item) string {
+	switch v := v.(type) {
+	case []byte:
+		return base64.StdEncoding.EncodeToString(v)
+	case int64:
+		return strconv.FormatInt(v, 10)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+func payloadHash(payload []byte) string {
+	sum := sha256.Sum256(payload)
+	return "sha256-" + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// unionKeys returns the keys of a and b, sorted.
+func unionKeys(a, b map[string]string) []string {
+	keys := make([]string, 0, len(a)+len(b))
+	for k := range a {
+		keys = append(keys, k)
+	}
+	for k := range b {
+		if _, ok := a[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
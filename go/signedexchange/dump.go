@@ -0,0 +1,256 @@
+package signedexchange
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/WICG/webpackage/go/signedexchange/structuredheader"
+	"github.com/WICG/webpackage/go/signedexchange/version"
+)
+
+// Dump writes a human-readable description of the exchange to w: the
+// version, the request, the response status and headers, the parameters of
+// each signature, and the size of the payload. If verbose is true, it also
+// writes the Merkle Integrity records of the payload with their integrity
+// proofs, and whether the proofs match. Dump neither verifies the exchange
+// nor needs its certificates, so it can describe broken exchanges. It fails
+// only if writing to w fails.
+func (e *Exchange) Dump(w io.Writer, verbose bool) error {
+	d := &dumper{w: w}
+	d.printf("format version: %s\n", e.Version)
+	d.printf("request:\n")
+	if e.Version == version.Version1b1 || e.Version == version.Version1b2 {
+		d.printf("  method: %s\n", e.RequestMethod)
+	}
+	d.printf("  uri: %s\n", e.RequestURI)
+	if e.Version == version.Version1b1 || e.Version == version.Version1b2 {
+		d.printf("  headers:\n")
+		d.headers(e.RequestHeaders)
+	}
+	d.printf("response:\n")
+	d.printf("  status: %d\n", e.ResponseStatus)
+	d.printf("  headers:\n")
+	d.headers(e.ResponseHeaders)
+	d.signatures(e.SignatureHeaderValue)
+	d.payload(e, verbose)
+	return d.err
+}
+
+// dumper writes the output of Exchange.Dump, keeping the first write error.
+type dumper struct {
+	w   io.Writer
+	err error
+}
+
+func (d *dumper) printf(format string, args ...interface{}) {
+	if d.err == nil {
+		_, d.err = fmt.Fprintf(d.w, format, args...)
+	}
+}
+
+func (d *dumper) headers(h http.Header) {
+	var names []string
+	for name := range h {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, value := range h[name] {
+			d.printf("    %s: %s\n", name, value)
+		}
+	}
+}
+
+func (d *dumper) signatures(value string) {
+	signatures, err := structuredheader.ParseParameterisedList(value)
+	if err != nil {
+		d.printf("signature: %s\n", value)
+		d.printf("  cannot parse: %v\n", err)
+		return
+	}
+	for _, sig := range signatures {
+		d.printf("signature %s:\n", sig.Label)
+		var keys []string
+		for k := range sig.Params {
+			keys = append(keys, string(k))
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			switch v := sig.Params[structuredheader.Key(k)].(type) {
+			case []byte:
+				d.printf("  %s: %s\n", k, base64.StdEncoding.EncodeToString(v))
+			case int64:
+				if k == "date" || k == "expires" {
+					d.printf("  %s: %d (%v)\n", k, v, time.Unix(v, 0).UTC())
+				} else {
+					d.printf("  %s: %d\n", k, v)
+				}
+			default:
+				d.printf("  %s: %v\n", k, v)
+			}
+		}
+	}
+}
+
+func (d *dumper) payload(e *Exchange, verbose bool) {
+	enc, err := e.MiceEncoding()
+	if err != nil {
+		d.printf("payload: %d bytes\n", len(e.Payload))
+		return
+	}
+	records, err := enc.Records(e.Payload)
+	if err != nil {
+		d.printf("payload: %d bytes, %s\n", len(e.Payload), enc)
+		d.printf("  cannot read records: %v\n", err)
+		return
+	}
+	recordSize, _ := enc.RecordSize(e.Payload)
+	d.printf("payload: %d bytes, %s, record size %d, %d records\n", len(e.Payload), enc, recordSize, len(records))
+	if !verbose {
+		return
+	}
+	digests := strings.Split(e.ResponseHeaders.Get(enc.DigestHeaderName()), ",")
+	for i, r := range records {
+		var match string
+		if i == 0 {
+			match = fmt.Sprintf("does not match the %s header", enc.DigestHeaderName())
+			for _, digest := range digests {
+				if strings.TrimSpace(digest) == enc.FormatDigestHeader(r.Proof) {
+					match = fmt.Sprintf("matches the %s header", enc.DigestHeaderName())
+				}
+			}
+		} else if bytes.Equal(r.EncodedProof, r.Proof) {
+			match = "matches the encoded proof"
+		} else {
+			match = fmt.Sprintf("does not match the encoded proof %s", base64.StdEncoding.EncodeToString(r.EncodedProof))
+		}
+		d.printf("  record %d: offset %d, %d bytes, proof %s (%s)\n", i, r.Offset, r.Size, base64.StdEncoding.EncodeToString(r.Proof), match)
+	}
+}
+
+// DumpJSON writes a JSON description of the exchange to w, for tools that
+// consume the metadata of exchanges, e.g. dashboards and CI checks. It
+// describes what Dump does except the Merkle Integrity records, and adds the
+// header-integrity of the exchange and the SHA-256 hash of the payload as it
+// is stored in the exchange. The output is stable: object members are in a
+// fixed order, header names are sorted and the same exchange always produces
+// the same bytes. The members are
+//
+//	version          the format version, e.g. "1b3"
+//	request          method, uri and headers of the request; method is
+//	                 omitted for versions that don't sign it, and headers
+//	                 if there are none or the version doesn't sign them
+//	response         status and headers of the response
+//	signatures       the label and the parameters of each signature, with
+//	                 byte sequences base64 encoded and date and expires as
+//	                 Unix times
+//	signatureError   why the Signature header cannot be parsed, if it can't
+//	headerIntegrity  see ComputeHeaderIntegrity
+//	payload          size, sha256, and for MI-encoded payloads the
+//	                 contentEncoding, digest header value and recordSize
+//
+// Like Dump, DumpJSON needs neither the certificates nor a valid exchange,
+// and fails only if writing to w fails. As JSON is a subset of YAML 1.2, the
+// output can be read by YAML tools as well.
+func (e *Exchange) DumpJSON(w io.Writer) error {
+	d := jsonDump{
+		Version: string(e.Version),
+		Request: jsonRequest{URI: e.RequestURI},
+		Response: jsonResponse{
+			Status:  e.ResponseStatus,
+			Headers: nonNilHeader(e.ResponseHeaders),
+		},
+		Signatures: []jsonSignature{},
+	}
+	if e.Version == version.Version1b1 || e.Version == version.Version1b2 {
+		d.Request.Method = e.RequestMethod
+		d.Request.Headers = nonNilHeader(e.RequestHeaders)
+	}
+	if signatures, err := structuredheader.ParseParameterisedList(e.SignatureHeaderValue); err != nil {
+		d.SignatureError = err.Error()
+	} else {
+		for _, sig := range signatures {
+			params := make(map[string]interface{}, len(sig.Params))
+			for k, v := range sig.Params {
+				params[string(k)] = v
+			}
+			d.Signatures = append(d.Signatures, jsonSignature{Label: string(sig.Label), Params: params})
+		}
+	}
+	if headerIntegrity, err := e.ComputeHeaderIntegrity(); err == nil {
+		d.HeaderIntegrity = headerIntegrity
+	}
+	sum := sha256.Sum256(e.Payload)
+	d.Payload = jsonPayload{Size: len(e.Payload), SHA256: sum[:]}
+	if enc, err := e.MiceEncoding(); err == nil {
+		d.Payload.ContentEncoding = enc.ContentEncoding()
+		d.Payload.Digest = e.ResponseHeaders.Get(enc.DigestHeaderName())
+		if recordSize, err := enc.RecordSize(e.Payload); err == nil {
+			d.Payload.RecordSize = recordSize
+		}
+	}
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(&d); err != nil {
+		return err
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// nonNilHeader returns h, or an empty header if h is nil, so that it is
+// encoded as a JSON object rather than null.
+func nonNilHeader(h http.Header) http.Header {
+	if h == nil {
+		return http.Header{}
+	}
+	return h
+}
+
+// jsonDump and the types below are the output of Exchange.DumpJSON.
+// encoding/json writes struct fields in declaration order and map keys
+// sorted, which keeps the output stable.
+type jsonDump struct {
+	Version         string          `json:"version"`
+	Request         jsonRequest     `json:"request"`
+	Response        jsonResponse    `json:"response"`
+	Signatures      []jsonSignature `json:"signatures"`
+	SignatureError  string          `json:"signatureError,omitempty"`
+	HeaderIntegrity string          `json:"headerIntegrity,omitempty"`
+	Payload         jsonPayload     `json:"payload"`
+}
+
+type jsonRequest struct {
+	Method  string      `json:"method,omitempty"`
+	URI     string      `json:"uri"`
+	Headers http.Header `json:"headers,omitempty"`
+}
+
+type jsonResponse struct {
+	Status  int         `json:"status"`
+	Headers http.Header `json:"headers"`
+}
+
+type jsonSignature struct {
+	Label  string                 `json:"label"`
+	Params map[string]interface{} `json:"params"`
+}
+
+type jsonPayload struct {
+	Size            int    `json:"size"`
+	SHA256          []byte `json:"sha256"`
+	ContentEncoding string `json:"contentEncoding,omitempty"`
+	Digest          string `json:"digest,omitempty"`
+	RecordSize      uint64 `json:"recordSize,omitempty"`
+}
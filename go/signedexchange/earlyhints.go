@@ -0,0 +1,190 @@
+package signedexchange
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// earlyHintDestinations is the set of "as" values of preloads that may be
+// sent as Early Hints. These are subresource destinations whose responses are
+// cacheable by the browser's preload cache.
+var earlyHintDestinations = map[string]bool{
+	"audio":  true,
+	"font":   true,
+	"image":  true,
+	"script": true,
+	"style":  true,
+	"track":  true,
+	"video":  true,
+}
+
+// EarlyHint is a preload derived from a Link header of an exchange.
+type EarlyHint struct {
+	// URL is the absolute URL of the preloaded resource.
+	URL *url.URL
+	// As is the value of the "as" parameter of the link.
+	As string
+	// CrossOrigin is the value of the "crossorigin" parameter of the link,
+	// and HasCrossOrigin tells if the parameter was present.
+	CrossOrigin    string
+	HasCrossOrigin bool
+	// Eligible is true if the preload can be sent in a 103 Early Hints
+	// response, i.e. it is an https, same-origin subresource with a
+	// cacheable destination.
+	Eligible bool
+}
+
+// String returns the Link header value for the hint.
+func (h *EarlyHint) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "<%s>;rel=preload", h.URL)
+	if h.As != "" {
+		fmt.Fprintf(&b, ";as=%s", h.As)
+	}
+	if h.HasCrossOrigin {
+		if h.CrossOrigin == "" {
+			b.WriteString(";crossorigin")
+		} else {
+			fmt.Fprintf(&b, ";crossorigin=%s", h.CrossOrigin)
+		}
+	}
+	return b.String()
+}
+
+// EarlyHints returns the preloads in the Link response headers of the
+// exchange, in order. Relative URLs are resolved against the request URL.
+// Cross-origin preloads are skipped unless they have a "crossorigin"
+// parameter.
+func (e *Exchange) EarlyHints() ([]*EarlyHint, error) {
+	base, err := url.Parse(e.RequestURI)
+	if err != nil {
+		return nil, fmt.Errorf("signedexchange: cannot parse request URL %q: %v", e.RequestURI, err)
+	}
+	var hints []*EarlyHint
+	for _, value := range e.ResponseHeaders.Values("Link") {
+		links, err := parseLinkHeader(value)
+		if err != nil {
+			return nil, err
+		}
+		for _, l := range links {
+			if !l.hasRel("preload") {
+				continue
+			}
+			ref, err := url.Parse(l.target)
+			if err != nil {
+				return nil, fmt.Errorf("signedexchange: cannot parse Link target %q: %v", l.target, err)
+			}
+			h := &EarlyHint{URL: base.ResolveReference(ref), As: l.params["as"]}
+			h.CrossOrigin, h.HasCrossOrigin = l.params["crossorigin"]
+			sameOrigin := isSameOrigin(base, h.URL)
+			if !sameOrigin && !h.HasCrossOrigin {
+				continue
+			}
+			h.Eligible = sameOrigin && h.URL.Scheme == "https" && earlyHintDestinations[h.As]
+			hints = append(hints, h)
+		}
+	}
+	return hints, nil
+}
+
+// link is a link-value of a Link header (Section 3 of [RFC8288]).
+type link struct {
+	target string
+	params map[string]string // keys are lowercased
+}
+
+func (l *link) hasRel(rel string) bool {
+	for _, r := range strings.Fields(l.params["rel"]) {
+		if strings.EqualFold(r, rel) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseLinkHeader parses a Link header value into its link-values. If a
+// parameter appears more than once, its first occurrence is used.
+func parseLinkHeader(value string) ([]*link, error) {
+	var links []*link
+	s := value
+	for {
+		s = strings.TrimLeft(s, " \t")
+		if s == "" {
+			return links, nil
+		}
+		if s[0] != '<' {
+			return nil, fmt.Errorf("signedexchange: malformed Link header %q", value)
+		}
+		end := strings.IndexByte(s, '>')
+		if end < 0 {
+			return nil, fmt.Errorf("signedexchange: malformed Link header %q", value)
+		}
+		l := &link{target: s[1:end], params: map[string]string{}}
+		s = s[end+1:]
+		for {
+			s = strings.TrimLeft(s, " \t")
+			if s == "" {
+				break
+			}
+			if s[0] == ',' {
+				s = s[1:]
+				break
+			}
+			if s[0] != ';' {
+				return nil, fmt.Errorf("signedexchange: malformed Link header %q", value)
+			}
+			var name, val string
+			var err error
+			name, val, s, err = parseLinkParam(s[1:])
+			if err != nil {
+				return nil, fmt.Errorf("signedexchange: malformed Link header %q: %v", value, err)
+			}
+			if _, ok := l.params[name]; !ok {
+				l.params[name] = val
+			}
+		}
+		links = append(links, l)
+	}
+}
+
+// parseLinkParam parses a link-param at the start of s and returns its
+// lowercased name, its value and the rest of s.
+func parseLinkParam(s string) (string, string, string, error) {
+	s = strings.TrimLeft(s, " \t")
+	i := strings.IndexAny(s, "=;, \t")
+	if i < 0 {
+		i = len(s)
+	}
+	name := strings.ToLower(s[:i])
+	if name == "" {
+		return "", "", "", fmt.Errorf("empty parameter name")
+	}
+	s = strings.TrimLeft(s[i:], " \t")
+	if s == "" || s[0] != '=' {
+		return name, "", s, nil
+	}
+	s = strings.TrimLeft(s[1:], " \t")
+	if s != "" && s[0] == '"' {
+		var b strings.Builder
+		for i := 1; i < len(s); i++ {
+			switch s[i] {
+			case '\\':
+				i++
+				if i < len(s) {
+					b.WriteByte(s[i])
+				}
+			case '"':
+				return name, b.String(), s[i+1:], nil
+			default:
+				b.WriteByte(s[i])
+			}
+		}
+		return "", "", "", fmt.Errorf("unterminated quoted string")
+	}
+	i = strings.IndexAny(s, ";, \t")
+	if i < 0 {
+		i = len(s)
+	}
+	return name, s[:i], s[i:], nil
+}
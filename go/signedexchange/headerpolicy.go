@@ -0,0 +1,92 @@
+package signedexchange
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// protectedHeaders lists the response headers a HeaderPolicy never removes,
+// since the exchange cannot be decoded or verified without them.
+var protectedHeaders = []string{"Content-Type", "Content-Encoding", "Digest", "MI-Draft2"}
+
+// HeaderPolicy decides which response headers are captured inside an
+// exchange, so that operators can drop e.g. Set-Cookie, Server-Timing and
+// internal headers instead of producing exchanges that fail verification.
+//
+// Header names are matched case-insensitively, and a name ending with "*"
+// matches every name with that prefix, e.g. "X-Internal-*". The protected
+// headers Content-Type, Content-Encoding, Digest and MI-Draft2 are always
+// kept.
+type HeaderPolicy struct {
+	// Rename maps header names to the names their values are moved to,
+	// e.g. to expose an internal header under a public name. Renaming is
+	// done before the other rules are applied.
+	Rename map[string]string
+
+	// StripByDefault makes the policy remove the headers that are not
+	// listed in Allow.
+	StripByDefault bool
+	Allow          []string
+
+	// Deny lists the headers that are removed, even if they are listed in
+	// Allow.
+	Deny []string
+
+	// StripUncached makes the policy remove the uncached headers, see
+	// IsUncachedHeader, e.g. Set-Cookie.
+	StripUncached bool
+}
+
+// Apply applies the policy to the response headers h, e.g. before passing
+// them to NewExchange.
+func (p *HeaderPolicy) Apply(h http.Header) {
+	var from []string
+	for name := range p.Rename {
+		from = append(from, name)
+	}
+	sort.Strings(from)
+	for _, name := range from {
+		name, to := http.CanonicalHeaderKey(name), http.CanonicalHeaderKey(p.Rename[name])
+		if values, ok := h[name]; ok && name != to {
+			delete(h, name)
+			h[to] = append(h[to], values...)
+		}
+	}
+	for name := range h {
+		if !p.keeps(name) {
+			delete(h, name)
+		}
+	}
+}
+
+// keeps reports whether the policy keeps the header name.
+func (p *HeaderPolicy) keeps(name string) bool {
+	if matchHeaderName(protectedHeaders, name) {
+		return true
+	}
+	if p.StripUncached && IsUncachedHeader(name) {
+		return false
+	}
+	if matchHeaderName(p.Deny, name) {
+		return false
+	}
+	return !p.StripByDefault || matchHeaderName(p.Allow, name)
+}
+
+// matchHeaderName reports whether name matches any of patterns, see
+// HeaderPolicy.
+func matchHeaderName(patterns []string, name string) bool {
+	name = strings.ToLower(name)
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(pattern)
+		if prefix := strings.TrimSuffix(pattern, "*"); prefix != pattern {
+			if strings.HasPrefix(name, prefix) {
+				return true
+			}
+		} else if name == pattern {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,183 @@
+package signedexchange
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/WICG/webpackage/go/internal/cbor"
+	"github.com/WICG/webpackage/go/signedexchange/certurl"
+	"github.com/WICG/webpackage/go/signedexchange/version"
+)
+
+// Metadata identifies a signed exchange without its headers and payload, e.g.
+// for indexing stored exchanges.
+type Metadata struct {
+	Version    version.Version
+	RequestURI string
+	// CertSha256 and Expires are the ones of the first signature.
+	CertSha256 []byte
+	Expires    time.Time
+	// PayloadDigest is the value of the digest header of the payload
+	// encoding, i.e. Digest or MI-Draft2.
+	PayloadDigest string
+}
+
+// Metadata returns the metadata of the exchange. It fails if the exchange has
+// no valid signature header.
+func (e *Exchange) Metadata() (*Metadata, error) {
+	params, err := ParseSignatureHeaderBytes([]byte(e.SignatureHeaderValue), e.Version)
+	if err != nil {
+		return nil, err
+	}
+	if len(params.Signatures) == 0 {
+		return nil, errors.New("signedexchange: exchange has no signature")
+	}
+	sig := params.Signatures[0]
+	return &Metadata{
+		Version:       e.Version,
+		RequestURI:    e.RequestURI,
+		CertSha256:    sig.CertSha256,
+		Expires:       time.Unix(sig.Expires, 0),
+		PayloadDigest: e.ResponseHeaders.Get(e.payloadEncoding().DigestHeaderName()),
+	}, nil
+}
+
+// MarshalBinary encodes the metadata as a CBOR array of the version, the
+// request URL, the cert-sha256, the expires timestamp and the payload digest.
+func (m *Metadata) MarshalBinary() ([]byte, error) {
+	if m.Expires.Unix() < 0 {
+		return nil, fmt.Errorf("signedexchange: expires (%v) is before the Unix epoch", m.Expires)
+	}
+	var buf bytes.Buffer
+	enc := cbor.NewEncoder(&buf)
+	if err := enc.EncodeArrayHeader(5); err != nil {
+		return nil, err
+	}
+	if err := enc.EncodeTextString(string(m.Version)); err != nil {
+		return nil, err
+	}
+	if err := enc.EncodeTextString(m.RequestURI); err != nil {
+		return nil, err
+	}
+	if err := enc.EncodeByteString(m.CertSha256); err != nil {
+		return nil, err
+	}
+	if err := enc.EncodeUint(uint64(m.Expires.Unix())); err != nil {
+		return nil, err
+	}
+	if err := enc.EncodeTextString(m.PayloadDigest); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// UnmarshalBinary decodes metadata encoded by MarshalBinary.
+func (m *Metadata) UnmarshalBinary(data []byte) error {
+	r := bytes.NewReader(data)
+	dec := cbor.NewDecoder(r)
+	n, err := dec.DecodeArrayHeader()
+	if err != nil {
+		return fmt.Errorf("signedexchange: failed to decode metadata array header: %v", err)
+	}
+	if n != 5 {
+		return fmt.Errorf("signedexchange: metadata array must have 5 elements, got %d", n)
+	}
+	ver, err := dec.DecodeTextString()
+	if err != nil {
+		return fmt.Errorf("signedexchange: failed to decode metadata version: %v", err)
+	}
+	v, ok := version.Parse(ver)
+	if !ok {
+		return fmt.Errorf("signedexchange: unknown version %q in metadata", ver)
+	}
+	uri, err := dec.DecodeTextString()
+	if err != nil {
+		return fmt.Errorf("signedexchange: failed to decode metadata request URL: %v", err)
+	}
+	certSha256, err := dec.DecodeByteString()
+	if err != nil {
+		return fmt.Errorf("signedexchange: failed to decode metadata cert-sha256: %v", err)
+	}
+	expires, err := dec.DecodeUint()
+	if err != nil {
+		return fmt.Errorf("signedexchange: failed to decode metadata expires: %v", err)
+	}
+	digest, err := dec.DecodeTextString()
+	if err != nil {
+		return fmt.Errorf("signedexchange: failed to decode metadata payload digest: %v", err)
+	}
+	if r.Len() != 0 {
+		return fmt.Errorf("signedexchange: %d trailing bytes after metadata", r.Len())
+	}
+
+	*m = Metadata{
+		Version:       v,
+		RequestURI:    uri,
+		CertSha256:    certSha256,
+		Expires:       time.Unix(int64(expires), 0),
+		PayloadDigest: digest,
+	}
+	return nil
+}
+
+// TrustSurfaceReport describes everything a client trusts the certificate
+// holder for when it accepts a signed exchange, for security review.
+type TrustSurfaceReport struct {
+	// RequestURI is the URL the exchange is trusted to be a response for.
+	RequestURI string
+	// RequestMethod and RequestHeaders are covered by the signature only for
+	// versions 1b1 and 1b2. RequestHeaders is nil for later versions.
+	RequestMethod  string
+	RequestHeaders http.Header
+	// ResponseStatus and ResponseHeaders are covered by the signature.
+	ResponseStatus  int
+	ResponseHeaders http.Header
+	// PayloadDigest is the integrity proof that covers the payload.
+	PayloadDigest string
+
+	// CertSubject and CertSANs identify the certificate the signature was
+	// made with, and CertSha256 is its hash as listed in the signature.
+	CertSubject string
+	CertSANs    []string
+	CertSha256  []byte
+	CertURL     string
+	ValidityURL string
+	// Date and Expires are the validity window of the signature.
+	Date    time.Time
+	Expires time.Time
+}
+
+// TrustSurface returns the report of what a client trusts when it accepts e
+// with the signature for the main certificate of chain. It uses no network,
+// does not modify e and does not verify the signature.
+func (e *Exchange) TrustSurface(chain certurl.CertChain) (*TrustSurfaceReport, error) {
+	sig, err := e.signatureForCertChain(chain)
+	if err != nil {
+		return nil, err
+	}
+	cert := chain[0].Cert
+	r := &TrustSurfaceReport{
+		RequestURI:      e.RequestURI,
+		ResponseStatus:  e.ResponseStatus,
+		ResponseHeaders: e.ResponseHeaders.Clone(),
+		PayloadDigest:   e.ResponseHeaders.Get(e.payloadEncoding().DigestHeaderName()),
+		CertSubject:     cert.Subject.String(),
+		CertSANs:        append([]string(nil), cert.DNSNames...),
+		CertSha256:      sig.CertSha256,
+		CertURL:         sig.CertUrl,
+		ValidityURL:     sig.ValidityUrl,
+		Date:            time.Unix(sig.Date, 0),
+		Expires:         time.Unix(sig.Expires, 0),
+	}
+	if e.Version == version.Version1b1 || e.Version == version.Version1b2 {
+		r.RequestMethod = e.RequestMethod
+		r.RequestHeaders = e.RequestHeaders.Clone()
+		if r.RequestHeaders == nil {
+			r.RequestHeaders = http.Header{}
+		}
+	}
+	return r, nil
+}
@@ -5,10 +5,12 @@ package mice
 import (
 	"bytes"
 	"crypto/sha256"
+	"crypto/sha512"
 	"encoding/base64"
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"strings"
 )
@@ -21,16 +23,64 @@ const (
 	Draft02Encoding Encoding = "mi-sha256-draft2"
 	// https://tools.ietf.org/html/draft-thomson-http-mice-03
 	Draft03Encoding Encoding = "mi-sha256-03"
+	// Draft03SHA512Encoding is draft 03 with SHA-512 instead of SHA-256. It
+	// is not part of any draft, and is only meant for experimenting with
+	// client support for larger hashes.
+	Draft03SHA512Encoding Encoding = "mi-sha512-03"
 )
 
 // ErrValidationFailure is returned when integrity check have failed.
 var ErrValidationFailure = errors.New("mice: failed to validate record")
 
+// RecordError is returned by decoders when a record does not match its
+// integrity proof. It wraps ErrValidationFailure.
+type RecordError struct {
+	// Record is the index of the record, starting at 0.
+	Record int
+	// Offset is the offset of the data of the record in the decoded output.
+	Offset uint64
+}
+
+func (e *RecordError) Error() string {
+	return fmt.Sprintf("%v %d (decoded offset %d)", ErrValidationFailure, e.Record, e.Offset)
+}
+
+func (e *RecordError) Unwrap() error {
+	return ErrValidationFailure
+}
+
+// ErrTooLarge is returned when the decoded output exceeds the limit given to
+// the decoder.
+var ErrTooLarge = errors.New("mice: decoded output exceeds the size limit")
+
+// MaxRecordSize is the largest record size that signed exchange clients are
+// required to process.
+// draft-yasskin-http-origin-signed-responses.html#signature-validity
+// Step 8. "If validating integrity using the selected header field requires
+// the client to process records larger than 16384 bytes, return "invalid"."
+const MaxRecordSize = 16384
+
+// DefaultMaxDecodedBytes is the limit of the decoded output of decoders
+// created by NewDecoder, and of the payload decoded by Verify by default.
+const DefaultMaxDecodedBytes = 1 << 30
+
 // ContentEncoding returns content encoding name of the Encoding.
 func (enc Encoding) ContentEncoding() string {
 	return string(enc)
 }
 
+// EncodingFromContentEncoding returns the Encoding listed in the value of a
+// Content-Encoding header, or false if it lists none of them.
+func EncodingFromContentEncoding(contentEncoding string) (Encoding, bool) {
+	for _, token := range strings.Split(contentEncoding, ",") {
+		switch enc := Encoding(strings.ToLower(strings.TrimSpace(token))); enc {
+		case Draft02Encoding, Draft03Encoding, Draft03SHA512Encoding:
+			return enc, true
+		}
+	}
+	return "", false
+}
+
 // DigestHeaderName returns the name of HTTP header that carries integrity proofs.
 func (enc Encoding) DigestHeaderName() string {
 	if enc == Draft02Encoding {
@@ -47,6 +97,8 @@ func (enc Encoding) IntegrityIdentifier() string {
 		return "mi-draft2"
 	case Draft03Encoding:
 		return "digest/mi-sha256-03"
+	case Draft03SHA512Encoding:
+		return "digest/mi-sha512-03"
 	default:
 		panic("not reached")
 	}
@@ -60,34 +112,157 @@ func (enc Encoding) base64Encoding() *base64.Encoding {
 	switch enc {
 	case Draft02Encoding:
 		return base64.RawURLEncoding
-	case Draft03Encoding:
+	case Draft03Encoding, Draft03SHA512Encoding:
 		return base64.StdEncoding
 	default:
 		panic("not reached")
 	}
 }
 
+// newHash returns the hash function used for the integrity proofs.
+func (enc Encoding) newHash() hash.Hash {
+	if enc == Draft03SHA512Encoding {
+		return sha512.New()
+	}
+	return sha256.New()
+}
+
+// RecommendRecordSize returns the smallest record size that splits a payload
+// of payloadLen bytes into at most targetRecords records, clamped to the
+// valid range of 1 to MaxRecordSize. A targetRecords below 1 is treated as 1,
+// so a large payload may still need more records than targetRecords.
+func RecommendRecordSize(payloadLen int, targetRecords int) int {
+	if targetRecords < 1 {
+		targetRecords = 1
+	}
+	if payloadLen < 0 {
+		payloadLen = 0
+	}
+	size := (payloadLen + targetRecords - 1) / targetRecords
+	if size < 1 {
+		return 1
+	}
+	if size > MaxRecordSize {
+		return MaxRecordSize
+	}
+	return size
+}
+
+// AutoRecordSize returns the record size to encode a payload of payloadLen
+// bytes with when the caller has no preference: the smallest power of two
+// that holds the payload in a single record, up to MaxRecordSize. The largest
+// record size keeps the integrity proofs to about 0.2% of the payload.
+func AutoRecordSize(payloadLen int) int {
+	size := 1
+	for size < payloadLen && size < MaxRecordSize {
+		size *= 2
+	}
+	return size
+}
+
+// Overhead returns the number of records, and the number of bytes the
+// encoding adds to the payload (the record size and the integrity proofs),
+// when a payload of payloadLen bytes is encoded with recordSize. recordSize
+// must be positive.
+func (enc Encoding) Overhead(payloadLen, recordSize int) (records int, extraBytes int) {
+	records = (payloadLen + recordSize - 1) / recordSize
+	if payloadLen == 0 {
+		if enc != Draft02Encoding {
+			return 0, 0
+		}
+		records = 1
+	}
+	return records, 8 + (records-1)*enc.newHash().Size()
+}
+
 // Encode encodes content of buf and writes to w. Encode returns Digest header
 // value (or MI header value in draft 02), and error if one exists.
 func (enc Encoding) Encode(w io.Writer, buf []byte, recordSize int) (string, error) {
+	return enc.EncodeReaderAt(w, bytes.NewReader(buf), int64(len(buf)), recordSize)
+}
 
-	numRecords := (len(buf) + recordSize - 1) / recordSize
+// EncodeReaderAt is like Encode, but reads the size bytes of content from r
+// instead of holding them in memory. The proofs are calculated from the tail
+// of the content, so r is read twice: once backwards to calculate them, and
+// once forwards to write the records. Only one record and the proofs are held
+// in memory.
+func (enc Encoding) EncodeReaderAt(w io.Writer, r io.ReaderAt, size int64, recordSize int) (string, error) {
+	c, err := enc.newProofChain(r, size, recordSize)
+	if err != nil || c.numRecords == 0 {
+		return c.digest(), err
+	}
+
+	if err := binary.Write(w, binary.BigEndian, uint64(recordSize)); err != nil {
+		return "", err
+	}
+	for rec := int64(0); rec < c.numRecords; rec++ {
+		if rec != 0 {
+			if _, err := w.Write(c.proof(rec)); err != nil {
+				return "", err
+			}
+		}
+		data, err := c.readRecord(rec)
+		if err != nil {
+			return "", err
+		}
+		if _, err := w.Write(data); err != nil {
+			return "", err
+		}
+	}
+	return c.digest(), nil
+}
+
+// DigestReaderAt returns the Digest header value (or MI header value in draft
+// 02) that EncodeReaderAt would return for the same arguments, without
+// writing the encoded payload. r is read once, backwards.
+func (enc Encoding) DigestReaderAt(r io.ReaderAt, size int64, recordSize int) (string, error) {
+	c, err := enc.newProofChain(r, size, recordSize)
+	if err != nil {
+		return "", err
+	}
+	return c.digest(), nil
+}
+
+// proofChain holds the integrity proofs of content read from a ReaderAt.
+type proofChain struct {
+	enc        Encoding
+	r          io.ReaderAt
+	size       int64
+	recordSize int64
+	numRecords int64
+	record     []byte
+	// proofs holds the proof of each record back to back.
+	proofs []byte
+}
+
+func (enc Encoding) newProofChain(r io.ReaderAt, size int64, recordSize int) (*proofChain, error) {
+	if recordSize <= 0 {
+		return nil, fmt.Errorf("mice: invalid record size %d", recordSize)
+	}
+	rs := int64(recordSize)
+	c := &proofChain{
+		enc:        enc,
+		r:          r,
+		size:       size,
+		recordSize: rs,
+		numRecords: (size + rs - 1) / rs,
+	}
 
 	switch enc {
 	case Draft02Encoding:
-		if len(buf) == 0 {
-			numRecords = 1
+		if size == 0 {
+			c.numRecords = 1
 		}
 
-	case Draft03Encoding:
-		if len(buf) == 0 {
+	case Draft03Encoding, Draft03SHA512Encoding:
+		if size == 0 {
 			// As a special case, the encoding of an empty payload is itself an
 			// empty message (i.e. it omits the initial record size), and its
 			// integrity proof is SHA-256("\0"). [spec text]
-			h := sha256.New()
+			h := enc.newHash()
 			h.Write([]byte{0})
-			proof := h.Sum(nil)
-			return enc.FormatDigestHeader(proof), nil
+			c.proofs = h.Sum(nil)
+			return c, nil
 		}
 
 	default:
@@ -96,39 +271,53 @@ func (enc Encoding) Encode(w io.Writer, buf []byte, recordSize int) (string, err
 
 	// Calculate proofs. This loop iterates from the tail of the content and creates
 	// the proof chain.
-	proofs := make([][]byte, numRecords)
-	for i := 0; i < numRecords; i++ {
-		rec := numRecords - i - 1
-		h := sha256.New()
-		if i == 0 {
-			h.Write(buf[rec*recordSize:])
+	c.record = make([]byte, recordSize)
+	c.proofs = make([]byte, c.numRecords*int64(enc.newHash().Size()))
+	for rec := c.numRecords - 1; rec >= 0; rec-- {
+		data, err := c.readRecord(rec)
+		if err != nil {
+			return nil, err
+		}
+		h := enc.newHash()
+		h.Write(data)
+		if rec == c.numRecords-1 {
 			h.Write([]byte{0})
 		} else {
-			h.Write(buf[rec*recordSize : (rec+1)*recordSize])
-			h.Write(proofs[rec+1])
+			h.Write(c.proof(rec + 1))
 			h.Write([]byte{1})
 		}
-		proofs[rec] = h.Sum(nil)
+		copy(c.proof(rec), h.Sum(nil))
 	}
+	return c, nil
+}
 
-	if err := binary.Write(w, binary.BigEndian, uint64(recordSize)); err != nil {
-		return "", err
+func (c *proofChain) proof(i int64) []byte {
+	proofSize := int64(c.enc.newHash().Size())
+	return c.proofs[i*proofSize : (i+1)*proofSize]
+}
+
+func (c *proofChain) digest() string {
+	if c == nil {
+		return ""
 	}
-	for i, proof := range proofs {
-		if i != 0 {
-			if _, err := w.Write(proof); err != nil {
-				return "", err
-			}
-		}
-		high := (i + 1) * recordSize
-		if high > len(buf) {
-			high = len(buf)
-		}
-		if _, err := w.Write(buf[i*recordSize : high]); err != nil {
-			return "", err
-		}
+	return c.enc.FormatDigestHeader(c.proof(0))
+}
+
+// readRecord reads the data of the i-th record. The returned slice is only
+// valid until the next call.
+func (c *proofChain) readRecord(i int64) ([]byte, error) {
+	n := c.recordSize
+	if rest := c.size - i*c.recordSize; rest < n {
+		n = rest
+	}
+	read, err := c.r.ReadAt(c.record[:n], i*c.recordSize)
+	if int64(read) == n {
+		return c.record[:n], nil
 	}
-	return enc.FormatDigestHeader(proofs[0]), nil
+	if err == nil || err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return nil, fmt.Errorf("mice: cannot read record %d: %v", i, err)
 }
 
 func (enc Encoding) parseDigestHeader(digestHeaderValue string) ([]byte, error) {
@@ -146,25 +335,114 @@ func (enc Encoding) parseDigestHeader(digestHeaderValue string) ([]byte, error)
 	if err != nil {
 		return nil, fmt.Errorf("mice: failed to decode digest value %q: %v", digest, err)
 	}
-	if len(proof) != sha256.Size {
+	if len(proof) != enc.newHash().Size() {
 		return nil, fmt.Errorf("mice: wrong digest length %q", digest)
 	}
 	return proof, nil
 }
 
+// RecordSize returns the record size declared at the head of the encoded
+// payload. As a special case, an empty payload of Draft03Encoding has no
+// records and its record size is reported as zero.
+func (enc Encoding) RecordSize(encoded []byte) (uint64, error) {
+	if len(encoded) == 0 && enc != Draft02Encoding {
+		return 0, nil
+	}
+	if len(encoded) < 8 {
+		return 0, errors.New("mice: cannot read record size: payload too short")
+	}
+	return binary.BigEndian.Uint64(encoded[:8]), nil
+}
+
+// Record describes a record of an encoded payload.
+type Record struct {
+	// Offset and Size locate the data of the record in the encoded payload.
+	Offset, Size int
+	// Proof is the integrity proof of the record, calculated from its data
+	// and the EncodedProof of the next record.
+	Proof []byte
+	// EncodedProof is the integrity proof of the record that precedes it in
+	// the encoded payload. It is nil for the first record, whose proof is in
+	// the digest header.
+	EncodedProof []byte
+}
+
+// Records splits encoded into its records and calculates their integrity
+// proofs, e.g. for inspecting the layout of a payload. Unlike decoders, it
+// does not check the proofs, so it also describes payloads whose proofs do
+// not match. It fails only if encoded cannot be split into records.
+func (enc Encoding) Records(encoded []byte) ([]Record, error) {
+	recordSize, err := enc.RecordSize(encoded)
+	if err != nil {
+		return nil, err
+	}
+	if len(encoded) == 0 {
+		return nil, nil
+	}
+	if recordSize == 0 {
+		return nil, errors.New("mice: invalid record size 0")
+	}
+	proofSize := enc.newHash().Size()
+	var records []Record
+	pos := 8
+	for {
+		var encodedProof []byte
+		if len(records) > 0 {
+			if len(encoded)-pos < proofSize {
+				return nil, errors.New("mice: end of input reached in the middle of hash")
+			}
+			encodedProof = encoded[pos : pos+proofSize]
+			pos += proofSize
+		}
+		size := len(encoded) - pos
+		if uint64(size) > recordSize {
+			size = int(recordSize)
+		}
+		records = append(records, Record{Offset: pos, Size: size, EncodedProof: encodedProof})
+		pos += size
+		if pos == len(encoded) {
+			break
+		}
+	}
+
+	for i := len(records) - 1; i >= 0; i-- {
+		r := &records[i]
+		h := enc.newHash()
+		h.Write(encoded[r.Offset : r.Offset+r.Size])
+		if i == len(records)-1 {
+			h.Write([]byte{0})
+		} else {
+			h.Write(records[i+1].EncodedProof)
+			h.Write([]byte{1})
+		}
+		r.Proof = h.Sum(nil)
+	}
+	return records, nil
+}
+
 type decoder struct {
-	encoding   Encoding
-	recordSize uint64
-	r          io.Reader
-	nextProof  []byte
-	recordBuf  []byte
-	out        []byte // leftover decoded output
+	encoding        Encoding
+	recordSize      uint64
+	r               io.Reader
+	nextProof       []byte
+	recordBuf       []byte
+	out             []byte // leftover decoded output
+	decodedBytes    uint64 // total size of the records decoded so far
+	maxDecodedBytes uint64
+	records         int // number of records decoded so far
 }
 
 // NewDecoder creates a new http-mice stream decoder. It reads first few bytes
 // from r to determine the record size, and fails if the record size exceeds
-// maxRecordSize.
+// maxRecordSize. The decoder fails with ErrTooLarge once the decoded output
+// exceeds DefaultMaxDecodedBytes.
 func (enc Encoding) NewDecoder(r io.Reader, digestHeaderValue string, maxRecordSize uint64) (io.Reader, error) {
+	return enc.NewDecoderWithLimit(r, digestHeaderValue, maxRecordSize, DefaultMaxDecodedBytes)
+}
+
+// NewDecoderWithLimit is like NewDecoder, but the decoder fails with
+// ErrTooLarge once the decoded output exceeds maxDecodedBytes.
+func (enc Encoding) NewDecoderWithLimit(r io.Reader, digestHeaderValue string, maxRecordSize, maxDecodedBytes uint64) (io.Reader, error) {
 	toplevelProof, err := enc.parseDigestHeader(digestHeaderValue)
 	if err != nil {
 		return nil, err
@@ -176,8 +454,8 @@ func (enc Encoding) NewDecoder(r io.Reader, digestHeaderValue string, maxRecordS
 		// As a special case, the encoding of an empty payload is itself an
 		// empty message (i.e. it omits the initial record size), and its
 		// integrity proof is SHA-256("\0"). [spec text]
-		if !validateRecord(nil, toplevelProof, true) {
-			return nil, ErrValidationFailure
+		if !enc.validateRecord(nil, toplevelProof, true) {
+			return nil, &RecordError{}
 		}
 		// Return an empty reader.
 		return &decoder{encoding: enc}, nil
@@ -189,11 +467,12 @@ func (enc Encoding) NewDecoder(r io.Reader, digestHeaderValue string, maxRecordS
 		return nil, fmt.Errorf("mice: invalid record size %v", recordSize)
 	}
 	return &decoder{
-		encoding:   enc,
-		recordSize: recordSize,
-		r:          r,
-		nextProof:  toplevelProof,
-		recordBuf:  make([]byte, recordSize+sha256.Size),
+		encoding:        enc,
+		recordSize:      recordSize,
+		r:               r,
+		nextProof:       toplevelProof,
+		recordBuf:       make([]byte, recordSize+uint64(enc.newHash().Size())),
+		maxDecodedBytes: maxDecodedBytes,
 	}, nil
 }
 
@@ -213,13 +492,18 @@ func (d *decoder) Read(dst []byte) (int, error) {
 }
 
 func (d *decoder) readNextRecord() error {
+	recordErr := &RecordError{Record: d.records, Offset: d.decodedBytes}
+	d.records++
 	readBytes, err := io.ReadFull(d.r, d.recordBuf)
 	if err == io.ErrUnexpectedEOF {
 		if uint64(readBytes) > d.recordSize {
 			return errors.New("mice: end of input reached in the middle of hash")
 		}
-		if !validateRecord(d.recordBuf[:readBytes], d.nextProof, true) {
-			return ErrValidationFailure
+		if err := d.countDecodedBytes(uint64(readBytes)); err != nil {
+			return err
+		}
+		if !d.encoding.validateRecord(d.recordBuf[:readBytes], d.nextProof, true) {
+			return recordErr
 		}
 		d.out = d.recordBuf[:readBytes]
 		d.nextProof = nil
@@ -228,8 +512,8 @@ func (d *decoder) readNextRecord() error {
 	if err == io.EOF {
 		// Draft02 allows empty final record.
 		if d.encoding == Draft02Encoding {
-			if !validateRecord(nil, d.nextProof, true) {
-				return ErrValidationFailure
+			if !d.encoding.validateRecord(nil, d.nextProof, true) {
+				return recordErr
 			}
 			d.out = nil
 			d.nextProof = nil
@@ -240,16 +524,29 @@ func (d *decoder) readNextRecord() error {
 	if err != nil {
 		return err
 	}
-	if !validateRecord(d.recordBuf, d.nextProof, false) {
-		return ErrValidationFailure
+	if err := d.countDecodedBytes(d.recordSize); err != nil {
+		return err
+	}
+	if !d.encoding.validateRecord(d.recordBuf, d.nextProof, false) {
+		return recordErr
 	}
 	d.out = d.recordBuf[:d.recordSize]
 	copy(d.nextProof, d.recordBuf[d.recordSize:])
 	return nil
 }
 
-func validateRecord(record, proof []byte, isLastRecord bool) bool {
-	h := sha256.New()
+// countDecodedBytes accounts for a record of n bytes, and fails if it would
+// make the decoded output exceed the limit.
+func (d *decoder) countDecodedBytes(n uint64) error {
+	if n > d.maxDecodedBytes-d.decodedBytes {
+		return ErrTooLarge
+	}
+	d.decodedBytes += n
+	return nil
+}
+
+func (enc Encoding) validateRecord(record, proof []byte, isLastRecord bool) bool {
+	h := enc.newHash()
 	h.Write(record)
 	if isLastRecord {
 		h.Write([]byte{0})
@@ -3,17 +3,18 @@ package mice_test
 import (
 	"bytes"
 	"crypto/sha256"
+	"crypto/sha512"
 	"encoding/base64"
 	"encoding/binary"
+	"errors"
 	"io"
 	"io/ioutil"
+	"strings"
 	"testing"
 
 	. "github.com/WICG/webpackage/go/signedexchange/mice"
 )
 
-const MaxRecordSize = 16*1024
-
 var allEncodings = []Encoding{Draft02Encoding, Draft03Encoding}
 
 func TestEncodeEmptyDraft02(t *testing.T) {
@@ -269,6 +270,52 @@ func (b *inputBuilder) hash(h string) *inputBuilder {
 	return b
 }
 
+func TestEncodeReaderAtShortInput(t *testing.T) {
+	for _, enc := range allEncodings {
+		var buf bytes.Buffer
+		if _, err := enc.EncodeReaderAt(&buf, strings.NewReader("hello"), 20, 16); err == nil {
+			t.Errorf("%s: EncodeReaderAt unexpectedly succeeded with a short input", enc)
+		}
+		if _, err := enc.EncodeReaderAt(&buf, strings.NewReader("hello"), 5, 0); err == nil {
+			t.Errorf("%s: EncodeReaderAt unexpectedly succeeded with record size 0", enc)
+		}
+	}
+}
+
+func TestRecords(t *testing.T) {
+	for _, enc := range allEncodings {
+		var buf bytes.Buffer
+		digest, err := enc.Encode(&buf, []byte("When I grow up, I want to be a watermelon"), 16)
+		if err != nil {
+			t.Fatal(err)
+		}
+		encoded := buf.Bytes()
+		records, err := enc.Records(encoded)
+		if err != nil {
+			t.Fatal(err)
+		}
+		wantLayout := [][2]int{{8, 16}, {56, 16}, {104, 9}}
+		if len(records) != len(wantLayout) {
+			t.Fatalf("%s: got %d records, want %d", enc, len(records), len(wantLayout))
+		}
+		for i, r := range records {
+			if r.Offset != wantLayout[i][0] || r.Size != wantLayout[i][1] {
+				t.Errorf("%s: record %d at %d with size %d, want %v", enc, i, r.Offset, r.Size, wantLayout[i])
+			}
+			if i > 0 && !bytes.Equal(r.Proof, r.EncodedProof) {
+				t.Errorf("%s: proof of record %d does not match the encoded one", enc, i)
+			}
+		}
+		if got := enc.FormatDigestHeader(records[0].Proof); got != digest {
+			t.Errorf("%s: proof of the first record: got %q, want %q", enc, got, digest)
+		}
+
+		if _, err := enc.Records(encoded[:40]); err == nil {
+			t.Errorf("%s: Records unexpectedly succeeded with a truncated proof", enc)
+		}
+	}
+}
+
 func TestDecodeEmptyDraft02(t *testing.T) {
 	input := []byte{}
 	proof := sha256.Sum256([]byte{0})
@@ -416,6 +463,42 @@ func TestDecodeMultipleRecords(t *testing.T) {
 	}
 }
 
+func TestDecodeExceedingLimit(t *testing.T) {
+	msg := []byte("When I grow up, I want to be a watermelon")
+	input := newInputBuilder(16).
+		message(msg[:16]).
+		hash("OElbplJlPK+Rv6JNK6p5/515IaoPoZo+2elWL7OQ60A=").
+		message(msg[16:32]).
+		hash("iPMpmgExHPrbEX3/RvwP4d16fWlK4l++p75PUu/KyN0=").
+		message(msg[32:]).
+		Bytes()
+	proof := mustStdEncodeBase64("IVa9shfs0nyKEhHqtB3WVNANJ2Njm5KjQLjRtnbkYJ4=")
+	for _, encoding := range allEncodings {
+		digest := encoding.FormatDigestHeader(proof)
+		for _, limit := range []uint64{0, 16, uint64(len(msg)) - 1} {
+			dec, err := encoding.NewDecoderWithLimit(bytes.NewReader(input), digest, MaxRecordSize, limit)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := ioutil.ReadAll(dec); err != ErrTooLarge {
+				t.Errorf("%s: limit %d: got error %v, want %v", encoding, limit, err, ErrTooLarge)
+			}
+		}
+
+		dec, err := encoding.NewDecoderWithLimit(bytes.NewReader(input), digest, MaxRecordSize, uint64(len(msg)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := ioutil.ReadAll(dec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, msg) {
+			t.Errorf("Unexpected decode output: got %v, want %v", got, msg)
+		}
+	}
+}
+
 func TestDecodeMultipleRecordsWrongLastRecordHash(t *testing.T) {
 	msg := []byte("When I grow up, I want to be a watermelon")
 	input := newInputBuilder(16).
@@ -433,3 +516,171 @@ func TestDecodeMultipleRecordsWrongLastRecordHash(t *testing.T) {
 		}
 	}
 }
+
+func TestRecordSize(t *testing.T) {
+	for _, enc := range allEncodings {
+		var buf bytes.Buffer
+		if _, err := enc.Encode(&buf, []byte("When I grow up, I want to be a watermelon"), 16); err != nil {
+			t.Fatal(err)
+		}
+		size, err := enc.RecordSize(buf.Bytes())
+		if err != nil {
+			t.Errorf("%s: RecordSize unexpectedly failed: %v", enc, err)
+		}
+		if size != 16 {
+			t.Errorf("%s: RecordSize: got %d, want 16", enc, size)
+		}
+		if _, err := enc.RecordSize([]byte{0, 0, 0}); err == nil {
+			t.Errorf("%s: RecordSize unexpectedly succeeded for truncated input", enc)
+		}
+	}
+}
+
+func TestRecommendRecordSize(t *testing.T) {
+	cases := []struct {
+		payloadLen    int
+		targetRecords int
+		want          int
+	}{
+		{0, 4, 1},
+		{1, 4, 1},
+		{100, 1, 100},
+		{100, 3, 34},
+		{100, 100, 1},
+		{100, 1000, 1},
+		{4096, 4, 1024},
+		{100000, 10, 10000},
+		{100000, 2, MaxRecordSize},
+		{100, 0, 100},
+		{-1, 4, 1},
+	}
+	for _, c := range cases {
+		got := RecommendRecordSize(c.payloadLen, c.targetRecords)
+		if got != c.want {
+			t.Errorf("RecommendRecordSize(%d, %d) = %d, want %d", c.payloadLen, c.targetRecords, got, c.want)
+		}
+		if c.payloadLen > 0 && c.targetRecords > 0 && got < MaxRecordSize {
+			if n := (c.payloadLen + got - 1) / got; n > c.targetRecords {
+				t.Errorf("RecommendRecordSize(%d, %d) = %d yields %d records", c.payloadLen, c.targetRecords, got, n)
+			}
+		}
+	}
+}
+
+func TestOverhead(t *testing.T) {
+	for _, enc := range []Encoding{Draft02Encoding, Draft03Encoding, Draft03SHA512Encoding} {
+		for _, payloadLen := range []int{0, 1, 15, 16, 17, 100, 1317} {
+			for _, recordSize := range []int{1, 16, 100, AutoRecordSize(payloadLen)} {
+				var buf bytes.Buffer
+				if _, err := enc.Encode(&buf, make([]byte, payloadLen), recordSize); err != nil {
+					t.Fatal(err)
+				}
+				records, extraBytes := enc.Overhead(payloadLen, recordSize)
+				if want := buf.Len() - payloadLen; extraBytes != want {
+					t.Errorf("%s: Overhead(%d, %d): got %d extra bytes, want %d", enc, payloadLen, recordSize, extraBytes, want)
+				}
+				rs, err := enc.Records(buf.Bytes())
+				if err != nil {
+					t.Fatal(err)
+				}
+				if records != len(rs) {
+					t.Errorf("%s: Overhead(%d, %d): got %d records, want %d", enc, payloadLen, recordSize, records, len(rs))
+				}
+			}
+		}
+	}
+}
+
+func TestAutoRecordSize(t *testing.T) {
+	cases := []struct {
+		payloadLen int
+		want       int
+	}{
+		{0, 1},
+		{1, 1},
+		{100, 128},
+		{128, 128},
+		{MaxRecordSize - 1, MaxRecordSize},
+		{MaxRecordSize, MaxRecordSize},
+		{5 << 20, MaxRecordSize},
+	}
+	for _, c := range cases {
+		if got := AutoRecordSize(c.payloadLen); got != c.want {
+			t.Errorf("AutoRecordSize(%d) = %d, want %d", c.payloadLen, got, c.want)
+		}
+	}
+}
+
+func TestRecordError(t *testing.T) {
+	for _, enc := range []Encoding{Draft02Encoding, Draft03Encoding, Draft03SHA512Encoding} {
+		var buf bytes.Buffer
+		digest, err := enc.Encode(&buf, bytes.Repeat([]byte("x"), 100), 16)
+		if err != nil {
+			t.Fatal(err)
+		}
+		encoded := buf.Bytes()
+		// Corrupt the data of the record 3.
+		proofSize := sha256.Size
+		if enc == Draft03SHA512Encoding {
+			proofSize = sha512.Size
+		}
+		encoded[8+16+2*(proofSize+16)+proofSize] ^= 1
+
+		dec, err := enc.NewDecoder(bytes.NewReader(encoded), digest, 16)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = ioutil.ReadAll(dec)
+		var recordErr *RecordError
+		if !errors.As(err, &recordErr) {
+			t.Fatalf("%s: got error %v, want a *RecordError", enc, err)
+		}
+		if recordErr.Record != 3 || recordErr.Offset != 48 {
+			t.Errorf("%s: got record %d at offset %d, want record 3 at offset 48", enc, recordErr.Record, recordErr.Offset)
+		}
+		if !errors.Is(err, ErrValidationFailure) {
+			t.Errorf("%s: error %v does not wrap ErrValidationFailure", enc, err)
+		}
+	}
+}
+
+func TestRoundTripSHA512(t *testing.T) {
+	enc := Draft03SHA512Encoding
+	msg := []byte("When I grow up, I want to be a watermelon")
+	for _, payload := range [][]byte{nil, msg[:16], msg} {
+		var buf bytes.Buffer
+		digest, err := enc.Encode(&buf, payload, 16)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(digest, "mi-sha512-03=") {
+			t.Errorf("unexpected digest %q", digest)
+		}
+		dec, err := enc.NewDecoder(bytes.NewReader(buf.Bytes()), digest, MaxRecordSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := ioutil.ReadAll(dec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, payload) {
+			t.Errorf("Unexpected decode output: got %v, want %v", got, payload)
+		}
+		if len(payload) > 16 {
+			// 8 bytes of record size, then SHA-512 proofs between records.
+			if want := 8 + len(payload) + 2*sha512.Size; buf.Len() != want {
+				t.Errorf("encoded length: got %d, want %d", buf.Len(), want)
+			}
+		}
+
+		// A SHA-256 proof is not accepted.
+		sha256Digest, err := Draft03Encoding.Encode(ioutil.Discard, payload, 16)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := enc.NewDecoder(bytes.NewReader(buf.Bytes()), strings.Replace(sha256Digest, "sha256", "sha512", 1), MaxRecordSize); err == nil {
+			t.Errorf("NewDecoder should fail on a SHA-256 proof")
+		}
+	}
+}
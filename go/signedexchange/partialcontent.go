@@ -0,0 +1,98 @@
+package signedexchange
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+
+	"github.com/WICG/webpackage/go/signedexchange/mice"
+)
+
+// contentRange is a parsed byte-range Content-Range header value (Section 4.2
+// of RFC 7233). completeLength is -1 if it is unknown ("*").
+type contentRange struct {
+	first, last, completeLength int64
+}
+
+func parseContentRange(value string) (*contentRange, error) {
+	const prefix = "bytes "
+	if !strings.HasPrefix(value, prefix) {
+		return nil, fmt.Errorf("Content-Range %q is not a byte range", value)
+	}
+	spec := strings.SplitN(value[len(prefix):], "/", 2)
+	if len(spec) != 2 {
+		return nil, fmt.Errorf("malformed Content-Range %q", value)
+	}
+	positions := strings.SplitN(spec[0], "-", 2)
+	if len(positions) != 2 {
+		return nil, fmt.Errorf("malformed Content-Range %q", value)
+	}
+	cr := &contentRange{completeLength: -1}
+	var err error
+	if cr.first, err = strconv.ParseInt(positions[0], 10, 64); err != nil || cr.first < 0 {
+		return nil, fmt.Errorf("malformed Content-Range %q", value)
+	}
+	if cr.last, err = strconv.ParseInt(positions[1], 10, 64); err != nil || cr.last < cr.first {
+		return nil, fmt.Errorf("malformed Content-Range %q", value)
+	}
+	if spec[1] != "*" {
+		if cr.completeLength, err = strconv.ParseInt(spec[1], 10, 64); err != nil || cr.last >= cr.completeLength {
+			return nil, fmt.Errorf("malformed Content-Range %q", value)
+		}
+	}
+	return cr, nil
+}
+
+// validatePartialContent checks a 206 (Partial Content) response. Such an
+// exchange is signed like any other: the Content-Range header is part of the
+// signed headers and the payload is the partial body, MI-encoded on its own,
+// so its integrity is verified independently of the rest of the resource.
+// Only single ranges are supported; multipart/byteranges responses should be
+// split into one exchange per range.
+func (e *Exchange) validatePartialContent() error {
+	if strings.HasPrefix(strings.ToLower(e.ResponseHeaders.Get("Content-Type")), "multipart/byteranges") {
+		return errors.New("multipart/byteranges responses are not supported; sign one exchange per range instead")
+	}
+	value := e.ResponseHeaders.Get("Content-Range")
+	if value == "" {
+		return errors.New("a 206 response must have a Content-Range header")
+	}
+	cr, err := parseContentRange(value)
+	if err != nil {
+		return err
+	}
+	n, err := e.decodedPayloadLength()
+	if err != nil {
+		return err
+	}
+	if want := cr.last - cr.first + 1; n != want {
+		return fmt.Errorf("Content-Range %q covers %d bytes, but the payload has %d bytes", value, want, n)
+	}
+	return nil
+}
+
+// decodedPayloadLength returns the length of the payload. If the payload is
+// MI-encoded, it is decoded, which also checks its integrity.
+func (e *Exchange) decodedPayloadLength() (int64, error) {
+	enc, err := e.MiceEncoding()
+	if err != nil {
+		return int64(len(e.Payload)), nil
+	}
+	digest := e.ResponseHeaders.Get(enc.DigestHeaderName())
+	if digest == "" {
+		return 0, fmt.Errorf("response header %q not present", enc.DigestHeaderName())
+	}
+	dec, err := enc.NewDecoder(bytes.NewReader(e.Payload), digest, mice.MaxRecordSize)
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(ioutil.Discard, dec)
+	if err != nil {
+		return 0, fmt.Errorf("cannot decode payload: %v", err)
+	}
+	return n, nil
+}
@@ -0,0 +1,338 @@
+// Package server provides an http.Handler middleware that serves the
+// responses of an existing handler as signed exchanges to clients that prefer
+// them.
+package server
+
+import (
+	"bytes"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/WICG/webpackage/go/signedexchange"
+	"github.com/WICG/webpackage/go/signedexchange/version"
+)
+
+// defaultValidity is the validity of signatures if Handler.Validity is zero.
+const defaultValidity = 24 * time.Hour
+
+// Handler is an http.Handler that serves the responses of Handler as signed
+// exchanges of version 1b3 to the requests that prefer them, see
+// PrefersSignedExchange, and as is to other requests.
+//
+// The response of Handler is buffered and signed with Pool. Only successful
+// responses to GET requests that can be captured inside a signed exchange are
+// signed; others, and responses that fail to be signed, are served as is.
+// The Vary header of all responses lists Accept, so that HTTP caches keep the
+// two forms apart.
+type Handler struct {
+	// Handler produces the responses. It must not depend on the Accept
+	// header.
+	Handler http.Handler
+
+	// Pool signs the exchanges. Its certificate must be valid for the
+	// hosts Handler serves.
+	Pool *signedexchange.SignerPool
+
+	// Validity is the duration signatures are valid for, at most 7 days.
+	// If zero, 24 hours is used.
+	Validity time.Duration
+
+	// RecordSize is the Merkle Integrity record size of the payloads. If
+	// zero, it is chosen from the size of each payload, see
+	// Exchange.MiEncodePayloadAuto.
+	RecordSize int
+
+	// Cache, if non-nil, keeps the signed exchanges, so that a response is
+	// signed again only when it or its URL changes, or its cached signed
+	// exchange has been used for half of Validity.
+	Cache Cache
+
+	// RequestURL returns the URL of the exchange that r is answered with.
+	// If nil, the https URL of r's Host and request URI is used.
+	RequestURL func(r *http.Request) string
+
+	// Now returns the time exchanges are signed at. If nil, time.Now is
+	// used.
+	Now func() time.Time
+
+	// OnError, if non-nil, is called with the request and the error when a
+	// response fails to be signed and is served as is.
+	OnError func(r *http.Request, err error)
+}
+
+func (h *Handler) validity() time.Duration {
+	if h.Validity == 0 {
+		return defaultValidity
+	}
+	return h.Validity
+}
+
+func (h *Handler) requestURL(r *http.Request) string {
+	if h.RequestURL == nil {
+		return "https://" + r.Host + r.URL.RequestURI()
+	}
+	return h.RequestURL(r)
+}
+
+func (h *Handler) now() time.Time {
+	if h.Now == nil {
+		return time.Now()
+	}
+	return h.Now()
+}
+
+// ServeHTTP implements http.Handler.
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet || !PrefersSignedExchange(r.Header.Get("Accept")) {
+		// The wrapped handler may set Vary itself, so Accept is added when
+		// the response header is written.
+		vw := &varyWriter{ResponseWriter: w}
+		h.Handler.ServeHTTP(vw, r)
+		vw.WriteHeader(http.StatusOK)
+		return
+	}
+	w.Header().Add("Vary", "Accept")
+
+	rec := &responseRecorder{header: http.Header{}, status: http.StatusOK}
+	h.Handler.ServeHTTP(rec, r)
+	sxg, err := h.sign(r, rec)
+	if err != nil {
+		if h.OnError != nil {
+			h.OnError(r, err)
+		}
+		rec.writeTo(w)
+		return
+	}
+	w.Header().Set("Content-Type", version.Version1b3.MimeType())
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Length", strconv.Itoa(len(sxg)))
+	w.Write(sxg)
+}
+
+// sign returns the serialized signed exchange of the recorded response to r.
+func (h *Handler) sign(r *http.Request, rec *responseRecorder) ([]byte, error) {
+	if rec.status != http.StatusOK {
+		return nil, &statusError{rec.status}
+	}
+	header := rec.header.Clone()
+	// The payload is Merkle Integrity encoded, so its length changes.
+	header.Del("Content-Length")
+	if header.Get("Content-Type") == "" {
+		header.Set("Content-Type", http.DetectContentType(rec.body.Bytes()))
+	}
+	signedexchange.StripConnectionHeaders(header)
+	if err := signedexchange.VerifyUncachedHeader(header); err != nil {
+		return nil, err
+	}
+
+	e := signedexchange.NewExchange(version.Version1b3, h.requestURL(r), http.MethodGet, nil, http.StatusOK, header, rec.body.Bytes())
+	var err error
+	if h.RecordSize == 0 {
+		err = e.MiEncodePayloadAuto()
+	} else {
+		err = e.MiEncodePayload(h.RecordSize)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	now := h.now()
+	var key string
+	if h.Cache != nil {
+		integrity, err := e.ComputeHeaderIntegrity()
+		if err != nil {
+			return nil, err
+		}
+		key = e.RequestURI + " " + integrity
+		if sxg, ok := h.Cache.Get(key, now); ok {
+			return sxg, nil
+		}
+	}
+
+	if err := h.Pool.Sign(e, now, now.Add(h.validity())); err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := e.Write(&buf); err != nil {
+		return nil, err
+	}
+	if h.Cache != nil {
+		h.Cache.Put(key, buf.Bytes(), now.Add(h.validity()/2))
+	}
+	return buf.Bytes(), nil
+}
+
+type statusError struct {
+	status int
+}
+
+func (e *statusError) Error() string {
+	return "server: status " + strconv.Itoa(e.status) + " is not signed"
+}
+
+// responseRecorder buffers the response of the wrapped handler.
+type responseRecorder struct {
+	header      http.Header
+	status      int
+	wroteHeader bool
+	body        bytes.Buffer
+}
+
+func (rec *responseRecorder) Header() http.Header {
+	return rec.header
+}
+
+func (rec *responseRecorder) WriteHeader(status int) {
+	if rec.wroteHeader {
+		return
+	}
+	rec.wroteHeader = true
+	rec.status = status
+}
+
+func (rec *responseRecorder) Write(b []byte) (int, error) {
+	rec.WriteHeader(http.StatusOK)
+	return rec.body.Write(b)
+}
+
+// writeTo writes the recorded response to w.
+func (rec *responseRecorder) writeTo(w http.ResponseWriter) {
+	for name, values := range rec.header {
+		for _, value := range values {
+			w.Header().Add(name, value)
+		}
+	}
+	w.WriteHeader(rec.status)
+	w.Write(rec.body.Bytes())
+}
+
+// varyWriter adds Accept to the Vary header of the response of the wrapped
+// handler when the header is written.
+type varyWriter struct {
+	http.ResponseWriter
+	wroteHeader bool
+}
+
+func (vw *varyWriter) WriteHeader(status int) {
+	if vw.wroteHeader {
+		return
+	}
+	vw.wroteHeader = true
+	vw.Header().Add("Vary", "Accept")
+	vw.ResponseWriter.WriteHeader(status)
+}
+
+func (vw *varyWriter) Write(b []byte) (int, error) {
+	vw.WriteHeader(http.StatusOK)
+	return vw.ResponseWriter.Write(b)
+}
+
+// Flush implements http.Flusher if the underlying ResponseWriter does.
+func (vw *varyWriter) Flush() {
+	if f, ok := vw.ResponseWriter.(http.Flusher); ok {
+		vw.WriteHeader(http.StatusOK)
+		f.Flush()
+	}
+}
+
+// PrefersSignedExchange reports whether the Accept header value accept
+// prefers signed exchanges of version 1b3, i.e. it lists
+// application/signed-exchange;v=b3 with a q-value that is positive and not
+// lower than that of any other media type. Browsers list signed exchanges
+// with a lower q-value than HTML, so that they are served the unsigned
+// response, while crawlers that prefetch signed exchanges prefer them.
+func PrefersSignedExchange(accept string) bool {
+	sxgQ, otherQ := 0.0, 0.0
+	for _, part := range strings.Split(accept, ",") {
+		if strings.TrimSpace(part) == "" {
+			continue
+		}
+		mediaType, params, err := mime.ParseMediaType(part)
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if s, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(s, 64); err != nil {
+				continue
+			}
+		}
+		if mediaType == "application/signed-exchange" && params["v"] == "b3" {
+			if q > sxgQ {
+				sxgQ = q
+			}
+		} else if q > otherQ {
+			otherQ = q
+		}
+	}
+	return sxgQ > 0 && sxgQ >= otherQ
+}
+
+// Cache stores serialized signed exchanges by key. Implementations must be
+// safe for concurrent use.
+type Cache interface {
+	// Get returns the signed exchange stored with key, unless it expired
+	// at now.
+	Get(key string, now time.Time) (sxg []byte, ok bool)
+	// Put stores sxg with key until expires.
+	Put(key string, sxg []byte, expires time.Time)
+}
+
+type memoryCacheEntry struct {
+	sxg     []byte
+	expires time.Time
+}
+
+// MemoryCache is a Cache that keeps signed exchanges in memory.
+type MemoryCache struct {
+	maxEntries int
+
+	mu      sync.Mutex
+	entries map[string]memoryCacheEntry
+}
+
+// NewMemoryCache returns a MemoryCache that holds at most maxEntries signed
+// exchanges. If maxEntries is not positive, the number is not limited.
+func NewMemoryCache(maxEntries int) *MemoryCache {
+	return &MemoryCache{
+		maxEntries: maxEntries,
+		entries:    map[string]memoryCacheEntry{},
+	}
+}
+
+// Get implements Cache.
+func (c *MemoryCache) Get(key string, now time.Time) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	if !now.Before(entry.expires) {
+		delete(c.entries, key)
+		return nil, false
+	}
+	return entry.sxg, true
+}
+
+// Put implements Cache. If the cache is full, the entry that expires first is
+// dropped.
+func (c *MemoryCache) Put(key string, sxg []byte, expires time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.entries[key]; !ok && c.maxEntries > 0 && len(c.entries) >= c.maxEntries {
+		var first string
+		var firstExpires time.Time
+		for k, entry := range c.entries {
+			if firstExpires.IsZero() || entry.expires.Before(firstExpires) {
+				first, firstExpires = k, entry.expires
+			}
+		}
+		delete(c.entries, first)
+	}
+	c.entries[key] = memoryCacheEntry{sxg, expires}
+}
@@ -0,0 +1,181 @@
+package server_test
+
+import (
+	"bytes"
+	"crypto"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/WICG/webpackage/go/signedexchange"
+	. "github.com/WICG/webpackage/go/signedexchange/server"
+	"github.com/WICG/webpackage/go/signedexchange/signedexchangetest"
+	"github.com/WICG/webpackage/go/signedexchange/version"
+)
+
+const (
+	payload = "<p>Hello, world!</p>"
+
+	browserAccept = "text/html,application/xhtml+xml,application/signed-exchange;v=b3;q=0.9,*/*;q=0.8"
+	crawlerAccept = "application/signed-exchange;v=b3,*/*;q=0.8"
+)
+
+var signatureDate = signedexchangetest.SignatureDate
+
+// createTestPool returns a SignerPool and the cert-chain+cbor its certificate
+// is served as.
+func createTestPool(t *testing.T) (*signedexchange.SignerPool, []byte) {
+	s, certBytes := signedexchangetest.NewSigner(t)
+	pool, err := signedexchange.NewSignerPool(s.Certs, s.CertUrl, s.ValidityUrl, s.PrivKey.(crypto.Signer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pool, certBytes
+}
+
+func TestPrefersSignedExchange(t *testing.T) {
+	for _, tc := range []struct {
+		accept string
+		want   bool
+	}{
+		{"", false},
+		{"*/*", false},
+		{browserAccept, false},
+		{crawlerAccept, true},
+		{"application/signed-exchange;v=b3", true},
+		{"application/signed-exchange;v=b3;q=0.5, text/html;q=0.5", true},
+		{"application/signed-exchange;v=b2", false},
+		{"application/signed-exchange;v=b3;q=0", false},
+		{"application/signed-exchange;v=b3;q=bad", false},
+	} {
+		if got := PrefersSignedExchange(tc.accept); got != tc.want {
+			t.Errorf("PrefersSignedExchange(%q): got %v, want %v", tc.accept, got, tc.want)
+		}
+	}
+}
+
+func TestHandlerVary(t *testing.T) {
+	pool, _ := createTestPool(t)
+	h := &Handler{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Vary", "Cookie")
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.Write([]byte(payload))
+		}),
+		Pool: pool,
+		Now:  func() time.Time { return signatureDate },
+	}
+	for _, accept := range []string{browserAccept, crawlerAccept} {
+		req := httptest.NewRequest(http.MethodGet, "https://example.com/", nil)
+		req.Header.Set("Accept", accept)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		listed := false
+		for _, v := range rec.Header().Values("Vary") {
+			listed = listed || v == "Accept"
+		}
+		if !listed {
+			t.Errorf("Accept %q: Vary: got %q, want it to list Accept", accept, rec.Header().Values("Vary"))
+		}
+	}
+}
+
+func TestHandler(t *testing.T) {
+	pool, certBytes := createTestPool(t)
+	now := signatureDate
+	var lastErr error
+	h := &Handler{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/cookie" {
+				http.SetCookie(w, &http.Cookie{Name: "a", Value: "b"})
+			}
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.Write([]byte(payload))
+		}),
+		Pool:    pool,
+		Cache:   NewMemoryCache(0),
+		Now:     func() time.Time { return now },
+		OnError: func(_ *http.Request, err error) { lastErr = err },
+	}
+	serve := func(path, accept string) *httptest.ResponseRecorder {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodGet, "https://example.com"+path, nil)
+		req.Header.Set("Accept", accept)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if got := rec.Header().Get("Vary"); got != "Accept" {
+			t.Errorf("%s: Vary: got %q, want %q", path, got, "Accept")
+		}
+		return rec
+	}
+
+	// Browsers get the response as is.
+	rec := serve("/", browserAccept)
+	if rec.Body.String() != payload || rec.Header().Get("Content-Type") != "text/html; charset=utf-8" {
+		t.Errorf("Unexpected response: Content-Type %q, body %q", rec.Header().Get("Content-Type"), rec.Body)
+	}
+
+	// Clients preferring signed exchanges get a valid signed exchange.
+	rec = serve("/", crawlerAccept)
+	if lastErr != nil {
+		t.Fatal(lastErr)
+	}
+	if got := rec.Header().Get("Content-Type"); got != version.Version1b3.MimeType() {
+		t.Fatalf("Content-Type: got %q, want %q", got, version.Version1b3.MimeType())
+	}
+	sxg := rec.Body.Bytes()
+	e, err := signedexchange.ReadExchange(bytes.NewReader(sxg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.RequestURI != "https://example.com/" {
+		t.Errorf("Unexpected request URL %q", e.RequestURI)
+	}
+	certFetcher := func(_ string) ([]byte, error) { return certBytes, nil }
+	result, err := e.VerifyWithResult(signatureDate, certFetcher)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(result.Payload) != payload {
+		t.Errorf("Unexpected payload %q", result.Payload)
+	}
+
+	// The signed exchange is cached for half of its validity.
+	now = signatureDate.Add(11 * time.Hour)
+	if rec := serve("/", crawlerAccept); !bytes.Equal(rec.Body.Bytes(), sxg) {
+		t.Error("Signed exchange was not served from the cache")
+	}
+	now = signatureDate.Add(13 * time.Hour)
+	if rec := serve("/", crawlerAccept); bytes.Equal(rec.Body.Bytes(), sxg) {
+		t.Error("Expired signed exchange was served from the cache")
+	}
+
+	// Responses that cannot be captured inside a signed exchange are served
+	// as is.
+	rec = serve("/cookie", crawlerAccept)
+	if lastErr == nil {
+		t.Error("Response with Set-Cookie was unexpectedly signed")
+	}
+	if rec.Body.String() != payload || rec.Header().Get("Set-Cookie") == "" {
+		t.Errorf("Unexpected response: Set-Cookie %q, body %q", rec.Header().Get("Set-Cookie"), rec.Body)
+	}
+}
+
+func TestMemoryCache(t *testing.T) {
+	c := NewMemoryCache(2)
+	c.Put("a", []byte("a"), signatureDate.Add(1*time.Hour))
+	c.Put("b", []byte("b"), signatureDate.Add(3*time.Hour))
+	c.Put("c", []byte("c"), signatureDate.Add(2*time.Hour))
+	if _, ok := c.Get("a", signatureDate); ok {
+		t.Error("The entry expiring first was not dropped")
+	}
+	for _, key := range []string{"b", "c"} {
+		if sxg, ok := c.Get(key, signatureDate); !ok || string(sxg) != key {
+			t.Errorf("Get(%q): got %q, %v", key, sxg, ok)
+		}
+	}
+	if _, ok := c.Get("c", signatureDate.Add(2*time.Hour)); ok {
+		t.Error("Expired entry was returned")
+	}
+}
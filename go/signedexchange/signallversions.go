@@ -0,0 +1,165 @@
+package signedexchange
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/WICG/webpackage/go/signedexchange/mice"
+	"github.com/WICG/webpackage/go/signedexchange/version"
+)
+
+// ExchangeParams holds the version-independent inputs for generating a signed
+// exchange.
+type ExchangeParams struct {
+	RequestURI      string
+	RequestMethod   string
+	RequestHeaders  http.Header
+	ResponseStatus  int
+	ResponseHeaders http.Header
+	// Payload is the unencoded response body. It is MI-encoded separately
+	// for each version, since the encodings differ between versions.
+	Payload []byte
+	// MIRecordSize is the record size of the Merkle Integrity encoding.
+	MIRecordSize int
+	Signer       *Signer
+}
+
+// VersionErrors is returned by SignAllVersions if generating the exchange
+// failed for some of the versions.
+type VersionErrors map[version.Version]error
+
+func (ve VersionErrors) Error() string {
+	vers := make([]string, 0, len(ve))
+	for v := range ve {
+		vers = append(vers, string(v))
+	}
+	sort.Strings(vers)
+	msgs := make([]string, 0, len(vers))
+	for _, v := range vers {
+		msgs = append(msgs, fmt.Sprintf("%s: %v", v, ve[version.Version(v)]))
+	}
+	return "signedexchange: failed to sign for versions: " + strings.Join(msgs, "; ")
+}
+
+// SignAllVersions generates a signed exchange for each of versions from the
+// same params, and returns the serialized exchanges keyed by version. The
+// headers in params are not modified.
+//
+// If some versions fail, the exchanges for the other versions are still
+// returned, along with a VersionErrors holding the error for each failed
+// version.
+func SignAllVersions(params *ExchangeParams, versions []version.Version) (map[version.Version][]byte, error) {
+	out := make(map[version.Version][]byte)
+	errs := make(VersionErrors)
+	for _, ver := range versions {
+		if _, ok := out[ver]; ok {
+			continue
+		}
+		if _, ok := version.Parse(string(ver)); !ok {
+			errs[ver] = fmt.Errorf("signedexchange: unknown version %q", ver)
+			continue
+		}
+		bs, err := signVersion(params, ver)
+		if err != nil {
+			errs[ver] = err
+			continue
+		}
+		out[ver] = bs
+	}
+	if len(errs) > 0 {
+		return out, errs
+	}
+	return out, nil
+}
+
+func signVersion(params *ExchangeParams, ver version.Version) ([]byte, error) {
+	// MiEncodePayload and AddSignatureHeader add headers, so each version
+	// needs its own copies.
+	e := NewExchange(ver, params.RequestURI, params.RequestMethod, params.RequestHeaders.Clone(), params.ResponseStatus, params.ResponseHeaders.Clone(), params.Payload)
+	if e.ResponseHeaders == nil {
+		e.ResponseHeaders = http.Header{}
+	}
+	if err := e.MiEncodePayload(params.MIRecordSize); err != nil {
+		return nil, err
+	}
+	if err := e.AddSignatureHeader(params.Signer); err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := e.Write(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// ListSupportedContentEncodings returns the Content-Encoding tokens of the
+// Merkle Integrity encodings that exchanges can be signed and verified with,
+// for any version. Use Version.MiceEncodings for the ones of a single
+// version.
+func ListSupportedContentEncodings() []string {
+	var encodings []string
+	seen := make(map[mice.Encoding]bool)
+	for _, ver := range version.AllVersions {
+		for _, enc := range ver.MiceEncodings() {
+			if !seen[enc] {
+				seen[enc] = true
+				encodings = append(encodings, enc.ContentEncoding())
+			}
+		}
+	}
+	return encodings
+}
+
+// MinimalVersion returns the lowest version in version.AllVersions that can
+// represent e and whose verification checks e would pass, according to the
+// checks listed by Version.VerificationChecks. If the payload is MI-encoded,
+// only versions using that encoding are considered.
+func MinimalVersion(e *Exchange) (version.Version, error) {
+	var problems []string
+	for _, ver := range version.AllVersions {
+		if err := e.representableAs(ver); err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %v", ver, err))
+			continue
+		}
+		return ver, nil
+	}
+	return "", fmt.Errorf("signedexchange: no version can represent the exchange: %s", strings.Join(problems, "; "))
+}
+
+// representableAs returns an error if e cannot be represented as an exchange
+// of version ver.
+func (e *Exchange) representableAs(ver version.Version) error {
+	if enc, ok := miceEncodingOf(e.ResponseHeaders); ok && !ver.SupportsMiceEncoding(enc) {
+		return fmt.Errorf("payload is encoded with %q", enc)
+	}
+	if ver.HasVerificationCheck(version.CheckRequestHeadersSigned) {
+		if ver.HasVerificationCheck(version.CheckRequestMethodSafe) && e.RequestMethod != http.MethodGet && e.RequestMethod != http.MethodHead {
+			return fmt.Errorf("request method %q is not safe", e.RequestMethod)
+		}
+	} else {
+		// The request is implicitly a GET without headers.
+		if e.RequestMethod != http.MethodGet {
+			return fmt.Errorf("request method %q is not GET", e.RequestMethod)
+		}
+		if len(e.RequestHeaders) > 0 {
+			return errors.New("request headers are not supported")
+		}
+	}
+	if ver.HasVerificationCheck(version.CheckContentTypeRequired) && e.ResponseHeaders.Get("Content-Type") == "" {
+		return errors.New("Content-Type response header is required")
+	}
+	if ver.HasVerificationCheck(version.CheckCacheabilityRequired) {
+		c := *e
+		c.Version = ver
+		if !c.IsCacheable(log.New(ioutil.Discard, "", 0)) {
+			return errors.New("response is not cacheable")
+		}
+	}
+	return nil
+}
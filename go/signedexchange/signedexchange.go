@@ -3,18 +3,26 @@ package signedexchange
 import (
 	"bytes"
 	"crypto/sha256"
+	"crypto/x509"
 	"encoding/base64"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"log"
 	"net/http"
 	"net/url"
+	"os"
+	"sort"
 	"strconv"
 	"strings"
 
 	"github.com/WICG/webpackage/go/internal/cbor"
+	"github.com/WICG/webpackage/go/internal/signingalgorithm"
 	"github.com/WICG/webpackage/go/signedexchange/internal/bigendian"
+	"github.com/WICG/webpackage/go/signedexchange/mice"
+	"github.com/WICG/webpackage/go/signedexchange/structuredheader"
 	"github.com/WICG/webpackage/go/signedexchange/version"
 )
 
@@ -33,6 +41,28 @@ type Exchange struct {
 
 	// Payload
 	Payload []byte
+
+	// ReadWarnings lists the nonconformances tolerated by
+	// ReadExchangeLenient. Verify refuses exchanges that have any.
+	ReadWarnings []string
+
+	// payloadFn produces Payload for exchanges created by NewExchangeLazy. It
+	// is cleared once called.
+	payloadFn func() (io.Reader, error)
+
+	// payloadStream, if non-nil, is the payload set by
+	// MiEncodePayloadStream, which is encoded while it is written.
+	payloadStream *streamedPayload
+
+	// signed is a snapshot of the headers as of the last AddSignatureHeader,
+	// for HeaderChangesSinceSigning.
+	signed *signedHeaders
+}
+
+type signedHeaders struct {
+	requestHeaders  http.Header
+	responseStatus  int
+	responseHeaders http.Header
 }
 
 var (
@@ -53,8 +83,265 @@ func NewExchange(ver version.Version, uri string, method string, requestHeaders
 	}
 }
 
+// NewExchangeLazy is like NewExchange, but the payload is produced by
+// payloadFn when it is first needed, i.e. by MiEncodePayload, RefreshDigest or
+// Write. payloadFn is called at most once. If the returned reader is an
+// io.Closer, it is closed after reading.
+func NewExchangeLazy(ver version.Version, uri string, method string, requestHeaders http.Header, status int, responseHeaders http.Header, payloadFn func() (io.Reader, error)) *Exchange {
+	e := NewExchange(ver, uri, method, requestHeaders, status, responseHeaders, nil)
+	e.payloadFn = payloadFn
+	return e
+}
+
+// ResponseOption configures NewExchangeFromResponse.
+type ResponseOption func(*responseOptions)
+
+type responseOptions struct {
+	maxBodySize  int64
+	headerPolicy *HeaderPolicy
+}
+
+// WithMaxBodySize makes NewExchangeFromResponse fail if the response body is
+// larger than n bytes, without reading more than n+1 bytes of it. If n is not
+// positive, the size of the body is not limited, which is the default.
+func WithMaxBodySize(n int64) ResponseOption {
+	return func(o *responseOptions) {
+		o.maxBodySize = n
+	}
+}
+
+// WithHeaderPolicy makes NewExchangeFromResponse apply p to the response
+// headers, after removing the headers that cannot be captured.
+func WithHeaderPolicy(p *HeaderPolicy) ResponseOption {
+	return func(o *responseOptions) {
+		o.headerPolicy = p
+	}
+}
+
+// NewExchangeFromResponse creates an exchange of version ver from resp, a
+// response to resp.Request, with the body of resp as the payload. The body is
+// read and closed. Header values folded over several lines (obs-fold,
+// Section 3.2.4 of RFC 7230) are unfolded by replacing each fold with a
+// space, as browsers reject folded values. Values with other line breaks are
+// rejected.
+//
+// Header fields that cannot be captured inside a signed exchange are removed:
+// the connection-specific response headers (see StripConnectionHeaders), the
+// other uncached response headers (see IsUncachedHeader), and for versions
+// 1b1 and 1b2 the stateful request headers (see IsStatefulRequestHeader).
+func NewExchangeFromResponse(ver version.Version, resp *http.Response, opts ...ResponseOption) (*Exchange, error) {
+	defer resp.Body.Close()
+
+	o := &responseOptions{}
+	for _, opt := range opts {
+		opt(o)
+	}
+	if resp.Request == nil || resp.Request.URL == nil {
+		return nil, errors.New("signedexchange: response has no request URL")
+	}
+	requestHeaders, err := unfoldHeader(resp.Request.Header)
+	if err != nil {
+		return nil, fmt.Errorf("signedexchange: invalid request header: %v", err)
+	}
+	responseHeaders, err := unfoldHeader(resp.Header)
+	if err != nil {
+		return nil, fmt.Errorf("signedexchange: invalid response header: %v", err)
+	}
+	filterResponseHeaders(ver, requestHeaders, responseHeaders)
+	if o.headerPolicy != nil {
+		o.headerPolicy.Apply(responseHeaders)
+	}
+
+	var body io.Reader = resp.Body
+	if o.maxBodySize > 0 {
+		body = io.LimitReader(resp.Body, o.maxBodySize+1)
+	}
+	payload, err := ioutil.ReadAll(body)
+	if err != nil {
+		return nil, fmt.Errorf("signedexchange: failed to read the response body: %v", err)
+	}
+	if o.maxBodySize > 0 && int64(len(payload)) > o.maxBodySize {
+		return nil, fmt.Errorf("signedexchange: response body is larger than %d bytes", o.maxBodySize)
+	}
+	method := resp.Request.Method
+	if method == "" {
+		method = http.MethodGet
+	}
+	return NewExchange(ver, resp.Request.URL.String(), method, requestHeaders, resp.StatusCode, responseHeaders, payload), nil
+}
+
+// filterResponseHeaders removes the header fields that cannot be captured
+// inside an exchange of version ver from the request and response headers of
+// a fetched response.
+func filterResponseHeaders(ver version.Version, requestHeaders, responseHeaders http.Header) {
+	StripConnectionHeaders(responseHeaders)
+	for name := range responseHeaders {
+		if IsUncachedHeader(name) {
+			delete(responseHeaders, name)
+		}
+	}
+	if ver == version.Version1b1 || ver == version.Version1b2 {
+		for name := range requestHeaders {
+			if IsStatefulRequestHeader(name) {
+				delete(requestHeaders, name)
+			}
+		}
+	}
+}
+
+// unfoldHeader returns a copy of h with obs-folds in the values replaced by a
+// single space. It fails if a value has a CR or LF that is not part of an
+// obs-fold.
+func unfoldHeader(h http.Header) (http.Header, error) {
+	unfolded := make(http.Header, len(h))
+	for name, values := range h {
+		for _, value := range values {
+			v, err := unfoldHeaderValue(value)
+			if err != nil {
+				return nil, fmt.Errorf("header %q: %v", name, err)
+			}
+			unfolded[name] = append(unfolded[name], v)
+		}
+	}
+	return unfolded, nil
+}
+
+// unfoldHeaderValue replaces each obs-fold in value, i.e. a line break
+// followed by spaces or tabs, with a single space.
+//
+//	obs-fold = CRLF 1*( SP / HTAB )
+//
+// A bare LF is accepted as a line break, like recipients of HTTP/1.1 messages
+// do.
+func unfoldHeaderValue(value string) (string, error) {
+	if !strings.ContainsAny(value, "\r\n") {
+		return value, nil
+	}
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		if c != '\r' && c != '\n' {
+			b.WriteByte(c)
+			continue
+		}
+		if c == '\r' {
+			if i+1 >= len(value) || value[i+1] != '\n' {
+				return "", fmt.Errorf("bare CR in value %q", value)
+			}
+			i++
+		}
+		if i+1 >= len(value) || (value[i+1] != ' ' && value[i+1] != '\t') {
+			return "", fmt.Errorf("line break not followed by whitespace in value %q", value)
+		}
+		for i+1 < len(value) && (value[i+1] == ' ' || value[i+1] == '\t') {
+			i++
+		}
+		b.WriteByte(' ')
+	}
+	return b.String(), nil
+}
+
+// loadPayload sets e.Payload from the payload producer given to
+// NewExchangeLazy, if it hasn't been called yet.
+func (e *Exchange) loadPayload() error {
+	if e.payloadFn == nil {
+		return nil
+	}
+	fn := e.payloadFn
+	e.payloadFn = nil
+	r, err := fn()
+	if err != nil {
+		return fmt.Errorf("signedexchange: failed to produce the payload: %v", err)
+	}
+	if c, ok := r.(io.Closer); ok {
+		defer c.Close()
+	}
+	payload, err := ioutil.ReadAll(r)
+	if err != nil {
+		return fmt.Errorf("signedexchange: failed to read the payload: %v", err)
+	}
+	e.Payload = payload
+	return nil
+}
+
+// RecordSizeError is returned by ValidateRecordSize for a Merkle Integrity
+// record size that clients of a version do not accept.
+type RecordSizeError struct {
+	Version    version.Version
+	RecordSize int
+	// Max is the largest record size accepted for Version.
+	Max int
+}
+
+func (e *RecordSizeError) Error() string {
+	return fmt.Sprintf("signedexchange: record size %d is not between 1 and %d, as required for version %s", e.RecordSize, e.Max, e.Version)
+}
+
+// ValidateRecordSize returns a *RecordSizeError if exchanges of version ver
+// whose payload is encoded with recordSize are rejected by clients. It
+// returns an error for an unknown version. MiEncodePayload itself accepts any
+// positive record size, e.g. for testing clients.
+func ValidateRecordSize(ver version.Version, recordSize int) error {
+	var max int
+	switch ver {
+	case version.Version1b1, version.Version1b2, version.Version1b3:
+		// Every version so far limits records to mice.MaxRecordSize bytes.
+		max = mice.MaxRecordSize
+	default:
+		return fmt.Errorf("signedexchange: unknown version %q", ver)
+	}
+	if recordSize < 1 || recordSize > max {
+		return &RecordSizeError{Version: ver, RecordSize: recordSize, Max: max}
+	}
+	return nil
+}
+
 func (e *Exchange) MiEncodePayload(recordSize int) error {
-	enc := e.Version.MiceEncoding()
+	return e.MiEncodePayloadWithEncoding(recordSize, e.Version.MiceEncoding())
+}
+
+// MiEncodePayloadAuto is like MiEncodePayload, but picks the record size from
+// the length of the payload with mice.AutoRecordSize.
+func (e *Exchange) MiEncodePayloadAuto() error {
+	if err := e.loadPayload(); err != nil {
+		return err
+	}
+	return e.MiEncodePayload(mice.AutoRecordSize(len(e.Payload)))
+}
+
+// MiOverhead returns the number of records of the Merkle Integrity encoded
+// payload, and the number of bytes the encoding added to it, i.e. the length
+// of the encoded payload minus the one of the original payload. It fails if
+// the payload is not encoded yet.
+func (e *Exchange) MiOverhead() (records int, extraBytes int, err error) {
+	if p := e.payloadStream; p != nil {
+		records, extraBytes = p.enc.Overhead(int(p.size), p.recordSize)
+		return records, extraBytes, nil
+	}
+	enc, err := e.MiceEncoding()
+	if err != nil {
+		return 0, 0, err
+	}
+	rs, err := enc.Records(e.Payload)
+	if err != nil {
+		return 0, 0, err
+	}
+	extraBytes = len(e.Payload)
+	for _, r := range rs {
+		extraBytes -= r.Size
+	}
+	return len(rs), extraBytes, nil
+}
+
+// MiEncodePayloadWithEncoding is like MiEncodePayload, but encodes the payload
+// with enc, which must be one of e.Version.MiceEncodings().
+func (e *Exchange) MiEncodePayloadWithEncoding(recordSize int, enc mice.Encoding) error {
+	if !e.Version.SupportsMiceEncoding(enc) {
+		return fmt.Errorf("signedexchange: version %s does not support the encoding %q", e.Version, enc)
+	}
+	if err := e.loadPayload(); err != nil {
+		return err
+	}
 
 	if e.ResponseHeaders.Get(enc.DigestHeaderName()) != "" {
 		return fmt.Errorf("signedexchange: response already has %q header", enc.DigestHeaderName())
@@ -65,20 +352,599 @@ func (e *Exchange) MiEncodePayload(recordSize int) error {
 		return err
 	}
 	e.Payload = buf.Bytes()
-	e.ResponseHeaders.Add("Content-Encoding", enc.ContentEncoding())
+	addContentCoding(e.ResponseHeaders, enc.ContentEncoding())
 	e.ResponseHeaders.Add(enc.DigestHeaderName(), digest)
 	return nil
 }
 
+// SetMiEncodedPayload sets the payload to encoded, which is already encoded
+// with Merkle Integrity content encoding and has the integrity proof digest,
+// e.g. "mi-sha256-03=...". It sets the Content-Encoding and digest headers
+// like MiEncodePayload does, so the exchange can be signed without encoding
+// the payload again. The encoding is the one named by digest, which must be
+// supported by e.Version. It fails if encoded does not match digest.
+func (e *Exchange) SetMiEncodedPayload(encoded []byte, digest string) error {
+	algorithm := strings.TrimSpace(strings.SplitN(digest, "=", 2)[0])
+	enc, ok := mice.EncodingFromContentEncoding(algorithm)
+	if !ok || !e.Version.SupportsMiceEncoding(enc) {
+		return fmt.Errorf("signedexchange: digest algorithm %q is not supported by version %s", algorithm, e.Version)
+	}
+	if e.ResponseHeaders.Get(enc.DigestHeaderName()) != "" {
+		return fmt.Errorf("signedexchange: response already has %q header", enc.DigestHeaderName())
+	}
+	dec, err := enc.NewDecoder(bytes.NewReader(encoded), digest, mice.MaxRecordSize)
+	if err != nil {
+		return fmt.Errorf("signedexchange: encoded payload does not match the digest: %v", err)
+	}
+	if _, err := io.Copy(ioutil.Discard, dec); err != nil {
+		return fmt.Errorf("signedexchange: encoded payload does not match the digest: %v", err)
+	}
+	e.payloadFn = nil
+	e.Payload = encoded
+	addContentCoding(e.ResponseHeaders, enc.ContentEncoding())
+	e.ResponseHeaders.Add(enc.DigestHeaderName(), digest)
+	return nil
+}
+
+// MiEncodeStream reads a payload from src, encodes it with the mi-sha256-03
+// Merkle Integrity content encoding and writes it to dst, without holding the
+// payload in memory. It returns the value of the Digest header for the
+// encoded payload, which is the same as the one MiEncodePayload sets for the
+// same payload and recordSize. The Content-Encoding and Digest headers are up
+// to the caller.
+//
+// Since the integrity proofs are computed from the end of the payload, src is
+// read twice. If it is an io.ReaderAt and io.Seeker, like *os.File, it is
+// read in place from its current offset, which is left unchanged; otherwise
+// it is first copied to a temporary file.
+func MiEncodeStream(dst io.Writer, src io.Reader, recordSize int) (string, error) {
+	r, size, tmp, err := payloadReaderAt(src)
+	if err != nil {
+		return "", err
+	}
+	if tmp != nil {
+		defer removeTempFile(tmp)
+	}
+	return mice.Draft03Encoding.EncodeReaderAt(dst, r, size, recordSize)
+}
+
+// payloadReaderAt returns the rest of src as an io.ReaderAt of size bytes, so
+// that it can be read twice, as Merkle Integrity encoding requires. If src is
+// an io.ReaderAt and io.Seeker, it is read in place from its current offset,
+// which is left unchanged. Otherwise src is copied to a temporary file, which
+// is returned as tmp for the caller to remove with removeTempFile.
+func payloadReaderAt(src io.Reader) (r io.ReaderAt, size int64, tmp *os.File, err error) {
+	if ra, ok := src.(interface {
+		io.ReaderAt
+		io.Seeker
+	}); ok {
+		start, err := ra.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return nil, 0, nil, fmt.Errorf("signedexchange: cannot seek the payload: %v", err)
+		}
+		end, err := ra.Seek(0, io.SeekEnd)
+		if err != nil {
+			return nil, 0, nil, fmt.Errorf("signedexchange: cannot seek the payload: %v", err)
+		}
+		if _, err := ra.Seek(start, io.SeekStart); err != nil {
+			return nil, 0, nil, fmt.Errorf("signedexchange: cannot seek the payload: %v", err)
+		}
+		return io.NewSectionReader(ra, start, end-start), end - start, nil, nil
+	}
+
+	f, err := ioutil.TempFile("", "mi-payload-")
+	if err != nil {
+		return nil, 0, nil, fmt.Errorf("signedexchange: cannot create a temporary file: %v", err)
+	}
+	size, err = io.Copy(f, src)
+	if err != nil {
+		removeTempFile(f)
+		return nil, 0, nil, fmt.Errorf("signedexchange: failed to read the payload: %v", err)
+	}
+	return f, size, f, nil
+}
+
+// removeTempFile closes and removes the temporary file f.
+func removeTempFile(f *os.File) {
+	f.Close()
+	os.Remove(f.Name())
+}
+
+// streamedPayload is a payload that is read from r and encoded with enc when
+// it is written.
+type streamedPayload struct {
+	enc        mice.Encoding
+	r          io.ReaderAt
+	size       int64
+	recordSize int
+	digest     string
+	// tmp, if non-nil, is the temporary file r is, see Exchange.Close.
+	tmp *os.File
+}
+
+// MiEncodePayloadStream is like MiEncodePayload, but reads the payload from
+// src instead of e.Payload, for payloads too large to hold in memory. It only
+// calculates the integrity proofs and sets the Content-Encoding and Digest
+// headers, so the exchange can be signed; Write then reads the payload again
+// and encodes it while writing it, holding one record and the proofs in
+// memory. e.Payload is cleared, and methods that inspect the payload, like
+// Verify, need the exchange to be read back.
+//
+// src is read in place from its current offset if it is an io.ReaderAt and
+// io.Seeker, like *os.File, and must not change until the exchange is
+// written; its offset is left unchanged. Other readers are copied to a
+// temporary file, which Close removes.
+func (e *Exchange) MiEncodePayloadStream(src io.Reader, recordSize int) error {
+	enc := e.Version.MiceEncoding()
+	if e.ResponseHeaders.Get(enc.DigestHeaderName()) != "" {
+		return fmt.Errorf("signedexchange: response already has %q header", enc.DigestHeaderName())
+	}
+	r, size, tmp, err := payloadReaderAt(src)
+	if err != nil {
+		return err
+	}
+	p := &streamedPayload{
+		enc:        enc,
+		r:          r,
+		size:       size,
+		recordSize: recordSize,
+		tmp:        tmp,
+	}
+	p.digest, err = enc.DigestReaderAt(p.r, p.size, recordSize)
+	if err != nil {
+		if tmp != nil {
+			removeTempFile(tmp)
+		}
+		return err
+	}
+	e.Close()
+	e.payloadFn = nil
+	e.Payload = nil
+	e.payloadStream = p
+	addContentCoding(e.ResponseHeaders, enc.ContentEncoding())
+	e.ResponseHeaders.Add(enc.DigestHeaderName(), p.digest)
+	return nil
+}
+
+// Close removes the temporary file a payload given to MiEncodePayloadStream
+// may have been copied to. The exchange cannot be written afterwards. Close is
+// a no-op for other exchanges, and always returns nil.
+func (e *Exchange) Close() error {
+	if p := e.payloadStream; p != nil && p.tmp != nil {
+		removeTempFile(p.tmp)
+		p.tmp = nil
+	}
+	return nil
+}
+
+// writePayload writes the payload of e to w.
+func (e *Exchange) writePayload(w io.Writer) error {
+	p := e.payloadStream
+	if p == nil {
+		_, err := w.Write(e.Payload)
+		return err
+	}
+	digest, err := p.enc.EncodeReaderAt(w, p.r, p.size, p.recordSize)
+	if err != nil {
+		return err
+	}
+	if digest != p.digest {
+		return errors.New("signedexchange: the payload changed since MiEncodePayloadStream")
+	}
+	return nil
+}
+
+// RefreshDigest encodes the exchange's payload with Merkle Integrity content
+// encoding, replacing the Digest (or MI) header and the Content-Encoding
+// coding left by an earlier MiEncodePayload. The payload is encoded with the
+// same encoding as before. Use this when the payload has been transformed
+// after it was encoded. e.Payload must hold the new payload unencoded: one
+// still encoded by the earlier MiEncodePayload would be encoded twice.
+func (e *Exchange) RefreshDigest(recordSize int) error {
+	if err := e.loadPayload(); err != nil {
+		return err
+	}
+	if e.Payload == nil {
+		return errors.New("signedexchange: payload is not set")
+	}
+	enc := e.payloadEncoding()
+	removeMiceHeaders(e.ResponseHeaders, enc)
+	return e.MiEncodePayloadWithEncoding(recordSize, enc)
+}
+
+// addContentCoding appends coding to the codings listed in the Content-Encoding
+// header of h, keeping them in a single value like removeMiceHeaders does.
+func addContentCoding(h http.Header, coding string) {
+	codings := append(h.Values("Content-Encoding"), coding)
+	h.Set("Content-Encoding", strings.Join(codings, ", "))
+}
+
+// removeMiceHeaders removes the digest header of enc from h, and enc from the
+// codings listed in its Content-Encoding header.
+func removeMiceHeaders(h http.Header, enc mice.Encoding) {
+	h.Del(enc.DigestHeaderName())
+
+	var codings []string
+	for _, v := range h.Values("Content-Encoding") {
+		for _, c := range strings.Split(v, ",") {
+			if c = strings.TrimSpace(c); c != "" && c != enc.ContentEncoding() {
+				codings = append(codings, c)
+			}
+		}
+	}
+	h.Del("Content-Encoding")
+	if len(codings) > 0 {
+		h.Set("Content-Encoding", strings.Join(codings, ", "))
+	}
+}
+
+// minimalResponseHeaders lists the response headers kept by MinimizeExchange
+// in addition to the digest header of the version. Cache-Control and Expires
+// decide whether an exchange of version 1b3 is cacheable, which Verify
+// requires.
+var minimalResponseHeaders = []string{"Content-Type", "Content-Encoding", "Cache-Control", "Expires"}
+
+// MinimizeExchange returns a copy of e with only the response headers needed
+// to decode and verify it: Content-Type, Content-Encoding, the digest header
+// of the version, Cache-Control and Expires. Request headers are dropped.
+// This is meant for producing small, shareable reproductions of bugs. Since
+// the signature covers the headers, the signature of the copy is left as is
+// but no longer validates if any header was dropped, which
+// HeaderChangesSinceSigning of the copy reports. Only the payload held in
+// e.Payload is copied: a payload that is yet to be produced (NewExchangeLazy)
+// or streamed (MiEncodePayloadStream) stays with e.
+func MinimizeExchange(e *Exchange) *Exchange {
+	m := *e
+	m.RequestHeaders = http.Header{}
+	m.ResponseHeaders = http.Header{}
+	names := []string{e.Version.MiceEncoding().DigestHeaderName()}
+	for _, name := range append(names, minimalResponseHeaders...) {
+		if values, ok := e.ResponseHeaders[http.CanonicalHeaderKey(name)]; ok {
+			m.ResponseHeaders[http.CanonicalHeaderKey(name)] = append([]string(nil), values...)
+		}
+	}
+	m.Payload = append([]byte(nil), e.Payload...)
+	m.ReadWarnings = nil
+	// The copy must not share the payload source or the signing snapshot.
+	m.payloadFn = nil
+	m.payloadStream = nil
+	if e.signed != nil {
+		m.signed = &signedHeaders{
+			requestHeaders:  e.signed.requestHeaders.Clone(),
+			responseStatus:  e.signed.responseStatus,
+			responseHeaders: e.signed.responseHeaders.Clone(),
+		}
+	}
+	return &m
+}
+
+// MiceEncoding returns the Merkle Integrity encoding of the payload, as
+// listed in the Content-Encoding response header. It can differ from the one
+// of e.Version for exchanges read by ReadExchangeLenient.
+func (e *Exchange) MiceEncoding() (mice.Encoding, error) {
+	enc, ok := miceEncodingOf(e.ResponseHeaders)
+	if !ok {
+		return "", errors.New("signedexchange: Content-Encoding does not list a Merkle Integrity encoding")
+	}
+	return enc, nil
+}
+
+// miceEncodingOf returns the Merkle Integrity encoding listed in the
+// Content-Encoding header of h, which may be spread over several values, e.g.
+// after another coding was added with Header.Add.
+func miceEncodingOf(h http.Header) (mice.Encoding, bool) {
+	for _, v := range h.Values("Content-Encoding") {
+		if enc, ok := mice.EncodingFromContentEncoding(v); ok {
+			return enc, true
+		}
+	}
+	return "", false
+}
+
+// payloadEncoding returns the Merkle Integrity encoding the payload is, or is
+// to be, encoded with: the one listed in Content-Encoding if e.Version
+// supports it, and e.Version.MiceEncoding() otherwise.
+func (e *Exchange) payloadEncoding() mice.Encoding {
+	if enc, err := e.MiceEncoding(); err == nil && e.Version.SupportsMiceEncoding(enc) {
+		return enc
+	}
+	return e.Version.MiceEncoding()
+}
+
+// MIRecordSize returns the Merkle Integrity record size the exchange's payload
+// was encoded with, as declared in the payload itself. ReadExchange and Verify
+// do not need it: the decoder reads the record size from the payload.
+func (e *Exchange) MIRecordSize() (uint64, error) {
+	return e.payloadEncoding().RecordSize(e.Payload)
+}
+
+// DecodePayload returns the payload with its Merkle Integrity content encoding
+// removed, checking every record against its integrity proof, e.g. for
+// proxies that serve the inner response. It does not verify the signature. If
+// a record does not match its proof, the error is a *mice.RecordError naming
+// the record.
+func (e *Exchange) DecodePayload() ([]byte, error) {
+	enc, err := e.MiceEncoding()
+	if err != nil {
+		return nil, err
+	}
+	if !e.Version.SupportsMiceEncoding(enc) {
+		return nil, fmt.Errorf("signedexchange: version %s does not support the encoding %q", e.Version, enc)
+	}
+	return e.decodePayload(enc, mice.DefaultMaxDecodedBytes)
+}
+
+// decodePayload decodes the payload, failing with mice.ErrTooLarge if it is
+// larger than maxDecodedBytes.
+func (e *Exchange) decodePayload(enc mice.Encoding, maxDecodedBytes uint64) ([]byte, error) {
+	if err := checkDigestHeader(e.ResponseHeaders, enc); err != nil {
+		return nil, err
+	}
+	dec, err := enc.NewDecoderWithLimit(bytes.NewReader(e.Payload), e.ResponseHeaders.Get(enc.DigestHeaderName()), mice.MaxRecordSize, maxDecodedBytes)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(dec)
+}
+
+// ToResponse returns the response inside the exchange, as a response to its
+// request, so that it can be handled like a response received over HTTP. The
+// body is the payload decoded as by DecodePayload, and the headers are the
+// response headers without the Merkle Integrity coding in Content-Encoding and
+// the digest header. The signature is not verified; use Verify or
+// VerifyWithResult for that first. The exchange is not modified.
+func (e *Exchange) ToResponse() (*http.Response, error) {
+	if _, err := e.MiceEncoding(); err != nil {
+		return nil, err
+	}
+	payload, err := e.DecodePayload()
+	if err != nil {
+		return nil, err
+	}
+	return e.ResponseWithPayload(payload)
+}
+
+// ResponseWithPayload is like ToResponse, but with payload as the body
+// instead of decoding the payload of e again, e.g. the Payload of the
+// VerificationResult of e.
+func (e *Exchange) ResponseWithPayload(payload []byte) (*http.Response, error) {
+	enc, err := e.MiceEncoding()
+	if err != nil {
+		return nil, err
+	}
+	u, err := url.Parse(e.RequestURI)
+	if err != nil {
+		return nil, fmt.Errorf("signedexchange: cannot parse request URL %q: %v", e.RequestURI, err)
+	}
+	method := e.RequestMethod
+	if method == "" {
+		method = http.MethodGet
+	}
+	header := e.ResponseHeaders.Clone()
+	removeMiceHeaders(header, enc)
+	requestHeader := e.RequestHeaders.Clone()
+	if requestHeader == nil {
+		requestHeader = http.Header{}
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", e.ResponseStatus, http.StatusText(e.ResponseStatus)),
+		StatusCode:    e.ResponseStatus,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          ioutil.NopCloser(bytes.NewReader(payload)),
+		ContentLength: int64(len(payload)),
+		Request: &http.Request{
+			Method:     method,
+			URL:        u,
+			Proto:      "HTTP/1.1",
+			ProtoMajor: 1,
+			ProtoMinor: 1,
+			Header:     requestHeader,
+			Host:       u.Host,
+		},
+	}, nil
+}
+
+// AddSignatureHeader signs the exchange with s and sets the resulting
+// Signature header value. Connection-specific response headers are removed
+// from the exchange before signing, see StripConnectionHeaders, and the
+// Content-Type is canonicalized if s.CanonicalizeContentType is set. Signing
+// fails with a *SizeLimitError if the payload is larger than
+// s.MaxPayloadSize, or if the signed headers or the resulting Signature header
+// value are larger than the format allows.
 func (e *Exchange) AddSignatureHeader(s *Signer) error {
-	h, err := s.signatureHeaderValue(e)
+	return e.AddSignatureHeaders([]*Signer{s})
+}
+
+// AddSignatureHeaders is like AddSignatureHeader, but signs the exchange with
+// each of signers, e.g. to rotate certificates. The Signature header lists
+// the signatures sorted by label, so the Signers must have distinct labels.
+// The Content-Type is canonicalized if any of the Signers has
+// CanonicalizeContentType set.
+func (e *Exchange) AddSignatureHeaders(signers []*Signer) error {
+	if len(signers) == 0 {
+		return errors.New("signedexchange: no signers")
+	}
+	sorted := append([]*Signer{}, signers...)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].label() < sorted[j].label() })
+	canonicalize := false
+	for i, s := range sorted {
+		if i > 0 && s.label() == sorted[i-1].label() {
+			return fmt.Errorf("signedexchange: several signers have the label %q", s.label())
+		}
+		canonicalize = canonicalize || s.CanonicalizeContentType
+	}
+
+	StripConnectionHeaders(e.ResponseHeaders)
+	for _, s := range sorted {
+		if s.HeaderPolicy != nil {
+			s.HeaderPolicy.Apply(e.ResponseHeaders)
+		}
+	}
+	if contentType := e.ResponseHeaders.Get("Content-Type"); canonicalize && contentType != "" {
+		canonical, err := canonicalContentType(contentType)
+		if err != nil {
+			return err
+		}
+		e.ResponseHeaders.Set("Content-Type", canonical)
+	}
+	for _, s := range sorted {
+		if err := e.checkPayloadSize(s.MaxPayloadSize); err != nil {
+			return err
+		}
+	}
+	if err := e.checkHeaderSize(); err != nil {
+		return err
+	}
+	var list structuredheader.ParameterisedList
+	for _, s := range sorted {
+		pi, err := s.signature(e)
+		if err != nil {
+			return err
+		}
+		list = append(list, *pi)
+	}
+	h, err := list.String()
 	if err != nil {
 		return err
 	}
+	if err := checkSignatureSize(e.Version, h); err != nil {
+		return err
+	}
 	e.SignatureHeaderValue = h
+	e.signed = &signedHeaders{
+		requestHeaders:  e.RequestHeaders.Clone(),
+		responseStatus:  e.ResponseStatus,
+		responseHeaders: e.ResponseHeaders.Clone(),
+	}
 	return nil
 }
 
+// AddSignature appends the signature of s to the Signature header of the
+// exchange, keeping the signatures already there, e.g. to add a signature
+// with a new algorithm to an exchange that was signed elsewhere. Unlike
+// AddSignatureHeader, it does not modify the headers, since that would
+// invalidate the existing signatures, so it fails if s has
+// CanonicalizeContentType set and the Content-Type is not canonical, or a
+// HeaderPolicy that would change the headers. It also fails if the headers
+// have changed since the exchange was signed by this package, or if s has the
+// label of an existing signature. If the exchange has no signature yet, it is
+// the same as AddSignatureHeader.
+func (e *Exchange) AddSignature(s *Signer) error {
+	if e.SignatureHeaderValue == "" {
+		return e.AddSignatureHeader(s)
+	}
+	list, err := structuredheader.ParseParameterisedListStrict(e.SignatureHeaderValue)
+	if err != nil {
+		return fmt.Errorf("signedexchange: cannot parse the existing Signature header: %v", err)
+	}
+	for _, pi := range list {
+		if string(pi.Label) == s.label() {
+			return fmt.Errorf("signedexchange: the exchange already has a signature with the label %q", s.label())
+		}
+	}
+	if changes := e.HeaderChangesSinceSigning(); len(changes) > 0 {
+		return fmt.Errorf("signedexchange: the existing signatures are invalid: %s", strings.Join(changes, "; "))
+	}
+	if contentType := e.ResponseHeaders.Get("Content-Type"); s.CanonicalizeContentType && contentType != "" {
+		canonical, err := canonicalContentType(contentType)
+		if err != nil {
+			return err
+		}
+		if canonical != contentType {
+			return fmt.Errorf("signedexchange: cannot canonicalize Content-Type %q without invalidating the existing signatures", contentType)
+		}
+	}
+	if s.HeaderPolicy != nil {
+		h := e.ResponseHeaders.Clone()
+		s.HeaderPolicy.Apply(h)
+		if len(diffHeaders("response", e.ResponseHeaders, h)) > 0 {
+			return errors.New("signedexchange: cannot apply the header policy without invalidating the existing signatures")
+		}
+	}
+	if err := e.checkPayloadSize(s.MaxPayloadSize); err != nil {
+		return err
+	}
+	if err := e.checkHeaderSize(); err != nil {
+		return err
+	}
+
+	pi, err := s.signature(e)
+	if err != nil {
+		return err
+	}
+	list = append(list, *pi)
+	h, err := list.String()
+	if err != nil {
+		return err
+	}
+	if err := checkSignatureSize(e.Version, h); err != nil {
+		return err
+	}
+	e.SignatureHeaderValue = h
+	if e.signed == nil {
+		e.signed = &signedHeaders{
+			requestHeaders:  e.RequestHeaders.Clone(),
+			responseStatus:  e.ResponseStatus,
+			responseHeaders: e.ResponseHeaders.Clone(),
+		}
+	}
+	return nil
+}
+
+// HeaderChangesSinceSigning describes how the request and response headers
+// and the response status of the exchange differ from when it was signed by
+// AddSignatureHeader, e.g. `response header "Etag" was added after signing`.
+// Header values are compared in the form they are signed in. It returns nil
+// if nothing changed, or if the exchange was not signed by AddSignatureHeader,
+// e.g. because it was read with ReadExchange.
+func (e *Exchange) HeaderChangesSinceSigning() []string {
+	if e.signed == nil {
+		return nil
+	}
+	var changes []string
+	if e.signed.responseStatus != e.ResponseStatus {
+		changes = append(changes, fmt.Sprintf("response status was changed from %d to %d after signing", e.signed.responseStatus, e.ResponseStatus))
+	}
+	if e.Version == version.Version1b1 || e.Version == version.Version1b2 {
+		changes = append(changes, diffHeaders("request", e.signed.requestHeaders, e.RequestHeaders)...)
+	}
+	changes = append(changes, diffHeaders("response", e.signed.responseHeaders, e.ResponseHeaders)...)
+	return changes
+}
+
+// diffHeaders describes the differences from the headers before to after, in
+// the order of the header names.
+func diffHeaders(kind string, before, after http.Header) []string {
+	var names []string
+	for name := range before {
+		names = append(names, name)
+	}
+	for name := range after {
+		if _, ok := before[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	var changes []string
+	for _, name := range names {
+		b, inBefore := before[name]
+		a, inAfter := after[name]
+		switch {
+		case !inBefore:
+			changes = append(changes, fmt.Sprintf("%s header %q was added after signing", kind, name))
+		case !inAfter:
+			changes = append(changes, fmt.Sprintf("%s header %q was removed after signing", kind, name))
+		case normalizeHeaderValues(name, b) != normalizeHeaderValues(name, a):
+			changes = append(changes, fmt.Sprintf("%s header %q was changed from %q to %q after signing", kind, name, normalizeHeaderValues(name, b), normalizeHeaderValues(name, a)))
+		}
+	}
+	return changes
+}
+
 func (e *Exchange) encodeRequestMap(enc *cbor.Encoder) error {
 	if e.Version != version.Version1b1 && e.Version != version.Version1b2 {
 		panic("signedexchange: b3 and beyond don't have request map.")
@@ -102,7 +968,17 @@ func (e *Exchange) encodeRequestMap(enc *cbor.Encoder) error {
 	return enc.EncodeMap(mes)
 }
 
-func normalizeHeaderValues(values []string) string {
+// trimmedListHeaders lists the lowercase names of the list-valued headers
+// whose values normalizeHeaderValues trims, dropping empty ones.
+var trimmedListHeaders = map[string]struct{}{
+	"cache-control": {},
+	"link":          {},
+	"vary":          {},
+}
+
+// normalizeHeaderValues returns the single value the values of the header
+// field name are signed as.
+func normalizeHeaderValues(name string, values []string) string {
 	// RFC 2616 - Hypertext Transfer Protocol -- HTTP/1.1
 	// 4.2 Message Headers
 	// https://tools.ietf.org/html/rfc2616#section-4.2
@@ -117,10 +993,42 @@ func normalizeHeaderValues(values []string) string {
 	// field-name are received is therefore significant to the
 	// interpretation of the combined field value, and thus a proxy MUST NOT
 	// change the order of these field values when a message is forwarded.
-	return strings.Join(values, ",")
+	//
+	// The signed headers have a single value per name, so list-valued headers
+	// such as Link, Vary and Cache-Control given as several values are
+	// combined this way, in order, separated by "," without whitespace. A
+	// value that already holds several comma-separated entries is kept as
+	// is. For Link, Vary and Cache-Control, leading and trailing whitespace,
+	// which is not part of a field value, and empty list elements, which
+	// recipients ignore (Section 7 of RFC 7230), are dropped when combining.
+	// The values of other headers are kept as they are.
+	if _, ok := trimmedListHeaders[strings.ToLower(name)]; !ok {
+		return strings.Join(values, ",")
+	}
+	if len(values) == 1 {
+		return strings.Trim(values[0], " \t")
+	}
+	nonEmpty := make([]string, 0, len(values))
+	for _, v := range values {
+		if v = strings.Trim(v, " \t"); v != "" {
+			nonEmpty = append(nonEmpty, v)
+		}
+	}
+	return strings.Join(nonEmpty, ",")
+}
+
+// nonconformance reports a violation of the format found while reading the
+// exchange. If lenient is true, it is recorded in e.ReadWarnings and nil is
+// returned; otherwise it is returned as an error.
+func (e *Exchange) nonconformance(lenient bool, err error) error {
+	if !lenient {
+		return err
+	}
+	e.ReadWarnings = append(e.ReadWarnings, err.Error())
+	return nil
 }
 
-func (e *Exchange) decodeRequestMap(dec *cbor.Decoder) error {
+func (e *Exchange) decodeRequestMap(dec *cbor.Decoder, lenient bool) error {
 	n, err := dec.DecodeMapHeader()
 	if err != nil {
 		return fmt.Errorf("signedexchange: failed to decode response map header: %v", err)
@@ -132,7 +1040,9 @@ func (e *Exchange) decodeRequestMap(dec *cbor.Decoder) error {
 		}
 		key_str := string(key)
 		if key_str != strings.ToLower(key_str) {
-			return fmt.Errorf("signedexchange: request header key MUST NOT contain uppercase alphabet(s): %s", key)
+			if err := e.nonconformance(lenient, fmt.Errorf("signedexchange: request header key MUST NOT contain uppercase alphabet(s): %s", key)); err != nil {
+				return err
+			}
 		}
 		value, err := dec.DecodeByteString()
 		if err != nil {
@@ -146,11 +1056,17 @@ func (e *Exchange) decodeRequestMap(dec *cbor.Decoder) error {
 			if e.Version == version.Version1b1 {
 				e.RequestURI, err = validateFallbackURL(value)
 				if err != nil {
-					return err
+					if err := e.nonconformance(lenient, err); err != nil {
+						return err
+					}
+					e.RequestURI = string(value)
 				}
 				continue
 			}
-			return fmt.Errorf("signedexchange: found a deprecated request key %q", keyURL)
+			if err := e.nonconformance(lenient, fmt.Errorf("signedexchange: found a deprecated request key %q", keyURL)); err != nil {
+				return err
+			}
+			continue
 		}
 		e.RequestHeaders.Add(key_str, string(value))
 	}
@@ -169,17 +1085,36 @@ func (e *Exchange) encodeResponseMap(enc *cbor.Encoder) error {
 }
 
 func encodeHeaders(encs []*cbor.MapEntryEncoder, headers http.Header) []*cbor.MapEntryEncoder {
-	for name, value := range headers {
+	// Header names are case-insensitive, but a header map built without the
+	// http.Header methods may have several keys for the same name. Combine
+	// their values, in the order of the keys, so that none is lost.
+	var names []string
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	values := map[string][]string{}
+	var lowerNames []string
+	for _, name := range names {
+		lower := strings.ToLower(name)
+		if _, ok := values[lower]; !ok {
+			lowerNames = append(lowerNames, lower)
+		}
+		values[lower] = append(values[lower], headers[name]...)
+	}
+
+	for _, name := range lowerNames {
+		value := values[name]
 		encs = append(encs,
 			cbor.GenerateMapEntry(func(keyE *cbor.Encoder, valueE *cbor.Encoder) {
-				keyE.EncodeByteString([]byte(strings.ToLower(name)))
-				valueE.EncodeByteString([]byte(normalizeHeaderValues(value)))
+				keyE.EncodeByteString([]byte(name))
+				valueE.EncodeByteString([]byte(normalizeHeaderValues(name, value)))
 			}))
 	}
 	return encs
 }
 
-func (e *Exchange) decodeResponseMap(dec *cbor.Decoder) error {
+func (e *Exchange) decodeResponseMap(dec *cbor.Decoder, lenient bool) error {
 	n, err := dec.DecodeMapHeader()
 	if err != nil {
 		return fmt.Errorf("signedexchange: failed to decode response map header: %v", err)
@@ -191,7 +1126,9 @@ func (e *Exchange) decodeResponseMap(dec *cbor.Decoder) error {
 		}
 		key_str := string(key)
 		if key_str != strings.ToLower(key_str) {
-			return fmt.Errorf("signedexchange: response header key MUST NOT contain uppercase alphabet(s): %s", key)
+			if err := e.nonconformance(lenient, fmt.Errorf("signedexchange: response header key MUST NOT contain uppercase alphabet(s): %s", key)); err != nil {
+				return err
+			}
 		}
 		value, err := dec.DecodeByteString()
 		if err != nil {
@@ -209,6 +1146,42 @@ func (e *Exchange) decodeResponseMap(dec *cbor.Decoder) error {
 	return nil
 }
 
+// CBORFromHeader returns the canonical CBOR serialization of a response
+// header map, including the ":status" pseudo-header, as used in exchanges of
+// version ver. For versions 1b1 and 1b2 this is the response map part of the
+// signed headers.
+func CBORFromHeader(h http.Header, status int, ver version.Version) ([]byte, error) {
+	if _, ok := version.Parse(string(ver)); !ok {
+		return nil, fmt.Errorf("signedexchange: unknown version %q", ver)
+	}
+	e := &Exchange{Version: ver, ResponseStatus: status, ResponseHeaders: h}
+	var buf bytes.Buffer
+	if err := e.encodeResponseMap(cbor.NewEncoder(&buf)); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// HeaderFromCBOR parses a response header map serialized by CBORFromHeader and
+// returns the response status and headers.
+func HeaderFromCBOR(bs []byte, ver version.Version) (int, http.Header, error) {
+	if _, ok := version.Parse(string(ver)); !ok {
+		return 0, nil, fmt.Errorf("signedexchange: unknown version %q", ver)
+	}
+	e := &Exchange{Version: ver, ResponseHeaders: http.Header{}}
+	r := bytes.NewReader(bs)
+	if err := e.decodeResponseMap(cbor.NewDecoder(r), false); err != nil {
+		return 0, nil, err
+	}
+	if r.Len() != 0 {
+		return 0, nil, fmt.Errorf("signedexchange: %d bytes of extra data after response map", r.Len())
+	}
+	if e.ResponseStatus == 0 {
+		return 0, nil, fmt.Errorf("signedexchange: response map has no %q", keyStatus)
+	}
+	return e.ResponseStatus, e.ResponseHeaders, nil
+}
+
 // draft-yasskin-http-origin-signed-responses.html#rfc.section.3.4
 func (e *Exchange) encodeExchangeHeaders(enc *cbor.Encoder) error {
 	if e.Version == version.Version1b1 || e.Version == version.Version1b2 {
@@ -230,7 +1203,7 @@ func (e *Exchange) DumpExchangeHeaders(w io.Writer) error {
 	return e.encodeExchangeHeaders(enc)
 }
 
-func (e *Exchange) decodeExchangeHeaders(dec *cbor.Decoder) error {
+func (e *Exchange) decodeExchangeHeaders(dec *cbor.Decoder, lenient bool) error {
 	if e.Version == version.Version1b1 || e.Version == version.Version1b2 {
 		n, err := dec.DecodeArrayHeader()
 		if err != nil {
@@ -239,19 +1212,78 @@ func (e *Exchange) decodeExchangeHeaders(dec *cbor.Decoder) error {
 		if n != 2 {
 			return fmt.Errorf("signedexchange: length of header array must be 2 but %d", n)
 		}
-		if err := e.decodeRequestMap(dec); err != nil {
+		if err := e.decodeRequestMap(dec, lenient); err != nil {
 			return err
 		}
 	} else {
 		e.RequestMethod = http.MethodGet
 	}
-	if err := e.decodeResponseMap(dec); err != nil {
+	if err := e.decodeResponseMap(dec, lenient); err != nil {
 		return err
 	}
 	return nil
 }
 
-func (e *Exchange) Write(w io.Writer) error {
+// WriteOption configures Write.
+type WriteOption func(*writeOptions)
+
+type writeOptions struct {
+	flushAfterHeaders bool
+}
+
+// WithFlushAfterHeaders makes Write flush w once everything before the
+// payload is written, so that a client can start processing the signature
+// and headers of a large exchange while the payload is still being sent. w
+// is flushed if it is an http.Flusher or has a Flush() error method, like
+// *bufio.Writer. Otherwise the option has no effect.
+func WithFlushAfterHeaders() WriteOption {
+	return func(o *writeOptions) {
+		o.flushAfterHeaders = true
+	}
+}
+
+func (o *writeOptions) flushHeaders(w io.Writer) error {
+	if !o.flushAfterHeaders {
+		return nil
+	}
+	switch f := w.(type) {
+	case http.Flusher:
+		f.Flush()
+	case interface{ Flush() error }:
+		return f.Flush()
+	}
+	return nil
+}
+
+// Write writes the exchange to w in the application/signed-exchange format of
+// e.Version. The signature and the headers are written before the payload,
+// so a client can process them before the payload arrives. The payload is
+// written with a single call to w.Write, or record by record if it was set by
+// MiEncodePayloadStream, so a slow w holds back the reading of the payload.
+func (e *Exchange) Write(w io.Writer, opts ...WriteOption) error {
+	if err := e.loadPayload(); err != nil {
+		return err
+	}
+	if err := e.WritePrologue(w, opts...); err != nil {
+		return err
+	}
+
+	// 1b1: Step 6. "The payload body (Section 3.3 of [RFC7230]) of the exchange represented by the application/signed-exchange resource." [spec text]
+	// 1b2 and later: "8. The payload body (Section 3.3 of [RFC7230]) of the exchange represented by the application/signed-exchange resource.
+	// Note that the use of the payload body here means that a Transfer-Encoding header field inside the application/signed-exchange header block has no effect. A Transfer-Encoding header field on the outer HTTP response that transfers this resource still has its normal effect." [spec text]
+	return e.writePayload(w)
+}
+
+// WritePrologue writes everything of the exchange that precedes the payload
+// to w, i.e. the part ReadExchangePrologue reads. It lets callers stream the
+// Merkle Integrity encoded payload to w themselves, e.g. from the output of
+// MiEncodeStream, after signing the exchange with the Content-Encoding and
+// Digest headers set for that payload.
+func (e *Exchange) WritePrologue(w io.Writer, opts ...WriteOption) error {
+	o := &writeOptions{}
+	for _, opt := range opts {
+		opt(o)
+	}
 	var headerBuf bytes.Buffer
 	if err := e.DumpExchangeHeaders(&headerBuf); err != nil {
 		return err
@@ -295,9 +1327,7 @@ func (e *Exchange) Write(w io.Writer) error {
 		if _, err := io.Copy(w, &headerBuf); err != nil {
 			return err
 		}
-
-		// Step 6. "The payload body (Section 3.3 of [RFC7230]) of the exchange represented by the application/signed-exchange resource." [spec text]
-		if _, err := w.Write(e.Payload); err != nil {
+		if err := o.flushHeaders(w); err != nil {
 			return err
 		}
 
@@ -325,13 +1355,9 @@ func (e *Exchange) Write(w io.Writer) error {
 			return err
 		}
 
-		const (
-			maxSignatureHeaderValueLen = 16 * 1024
-			maxHeaderLen               = 512 * 1024
-		)
 		// "4. 3 bytes storing a big-endian integer sigLength. If this is larger than 16384 (16*1024), parsing MUST fail." [spec text]
-		if len(e.SignatureHeaderValue) > maxSignatureHeaderValueLen {
-			return fmt.Errorf("signedexchange: sigLength must <= %d but %d", maxSignatureHeaderValueLen, len(e.SignatureHeaderValue))
+		if err := checkSignatureSize(e.Version, e.SignatureHeaderValue); err != nil {
+			return err
 		}
 
 		encodedSigLength, err := bigendian.EncodeBytesUint(int64(len(e.SignatureHeaderValue)), 3)
@@ -344,7 +1370,7 @@ func (e *Exchange) Write(w io.Writer) error {
 
 		// "5. 3 bytes storing a big-endian integer headerLength. If this is larger than 524288 (512*1024), parsing MUST fail." [spec text]
 		if headerLength > maxHeaderLen {
-			return fmt.Errorf("signedexchange: headerLength must <= %d but %d", maxHeaderLen, headerLength)
+			return &SizeLimitError{Part: "headers", Size: int64(headerLength), Limit: maxHeaderLen}
 		}
 		encodedHeaderLength, err := bigendian.EncodeBytesUint(int64(headerLength), 3)
 		if err != nil {
@@ -363,10 +1389,7 @@ func (e *Exchange) Write(w io.Writer) error {
 		if _, err := io.Copy(w, &headerBuf); err != nil {
 			return err
 		}
-
-		// "8. The payload body (Section 3.3 of [RFC7230]) of the exchange represented by the application/signed-exchange resource.
-		// Note that the use of the payload body here means that a Transfer-Encoding header field inside the application/signed-exchange header block has no effect. A Transfer-Encoding header field on the outer HTTP response that transfers this resource still has its normal effect." [spec text]
-		if _, err := w.Write(e.Payload); err != nil {
+		if err := o.flushHeaders(w); err != nil {
 			return err
 		}
 
@@ -377,16 +1400,122 @@ func (e *Exchange) Write(w io.Writer) error {
 	return nil
 }
 
-// draft-yasskin-http-origin-signed-responses.html#application-http-exchange
+// Limits of the application/signed-exchange format of versions 1b2 and later.
+const (
+	maxSignatureHeaderValueLen = 16 * 1024
+	maxHeaderLen               = 512 * 1024
+)
+
+// SizeLimitError is the error returned when a part of an exchange is larger
+// than the signed exchange format allows, or than the caller allows for the
+// payload, e.g. with Signer.MaxPayloadSize or WithMaxPayloadSize. Browsers
+// reject such exchanges.
+type SizeLimitError struct {
+	// Part is "signature" for the Signature header value, "headers" for the
+	// signed headers, or "payload".
+	Part string
+	// Size is the size of the part in bytes. If the part was not read to its
+	// end, it is the number of bytes read, i.e. Limit+1.
+	Size  int64
+	Limit int64
+}
+
+func (e *SizeLimitError) Error() string {
+	return fmt.Sprintf("signedexchange: %s is %d bytes, more than the limit of %d", e.Part, e.Size, e.Limit)
+}
+
+// checkPayloadSize returns a *SizeLimitError if the payload of the exchange
+// is larger than maxPayloadSize, if positive.
+func (e *Exchange) checkPayloadSize(maxPayloadSize int64) error {
+	if size := e.payloadSize(); maxPayloadSize > 0 && size > maxPayloadSize {
+		return &SizeLimitError{Part: "payload", Size: size, Limit: maxPayloadSize}
+	}
+	return nil
+}
+
+// payloadSize returns the size of the payload as it is written. For a payload
+// given to MiEncodePayloadStream, which is not in e.Payload, it is the size
+// of the bytes read from the source once encoded.
+func (e *Exchange) payloadSize() int64 {
+	if p := e.payloadStream; p != nil {
+		_, extraBytes := p.enc.Overhead(int(p.size), p.recordSize)
+		return p.size + int64(extraBytes)
+	}
+	return int64(len(e.Payload))
+}
+
+// checkHeaderSize returns a *SizeLimitError if the signed headers of the
+// exchange are larger than its version allows. Version 1b1 has no limit.
+func (e *Exchange) checkHeaderSize() error {
+	if e.Version == version.Version1b1 {
+		return nil
+	}
+	var headerBuf bytes.Buffer
+	if err := e.DumpExchangeHeaders(&headerBuf); err != nil {
+		return err
+	}
+	if headerBuf.Len() > maxHeaderLen {
+		return &SizeLimitError{Part: "headers", Size: int64(headerBuf.Len()), Limit: maxHeaderLen}
+	}
+	return nil
+}
+
+// checkSignatureSize returns a *SizeLimitError if sig is larger than version
+// ver allows for the Signature header value. Version 1b1 has no limit.
+func checkSignatureSize(ver version.Version, sig string) error {
+	if ver != version.Version1b1 && len(sig) > maxSignatureHeaderValueLen {
+		return &SizeLimitError{Part: "signature", Size: int64(len(sig)), Limit: maxSignatureHeaderValueLen}
+	}
+	return nil
+}
+
+// ReadOption configures ReadExchange, ReadExchangeLenient and
+// ReadExchangeFromResponse.
+type ReadOption func(*readOptions)
+
+type readOptions struct {
+	maxPayloadSize int64
+}
+
+// WithMaxPayloadSize makes reading an exchange fail with a *SizeLimitError if
+// its payload is larger than n bytes, without reading more than n+1 bytes of
+// it. If n is not positive, the size of the payload is not limited, which is
+// the default. The signature and the headers are always limited to the sizes
+// the format allows.
+func WithMaxPayloadSize(n int64) ReadOption {
+	return func(o *readOptions) {
+		o.maxPayloadSize = n
+	}
+}
+
+var utf8BOM = []byte{0xef, 0xbb, 0xbf}
+
+// ReadExchangePrologue reads the exchange from r up to, but not including, the
+// payload.
 func ReadExchangePrologue(r io.Reader) (*Exchange, error) {
+	return readExchangePrologue(r, false)
+}
+
+// draft-yasskin-http-origin-signed-responses.html#application-http-exchange
+func readExchangePrologue(r io.Reader, lenient bool) (*Exchange, error) {
 	// Step 1. "8 bytes consisting of the ASCII characters “sxg1” followed by 4 0x00 bytes, to serve as a file signature. This is redundant with the MIME type, and recipients that receive both MUST check that they match and stop parsing if they don’t." [spec text]
 	// "Note: RFC EDITOR PLEASE DELETE THIS NOTE; The implementation of the final RFC MUST use this file signature, but implementations of drafts MUST NOT use it and MUST use another implementation-specific 8-byte string beginning with “sxg1-“." [spec text]
 	magic := make([]byte, version.HeaderMagicBytesLen)
 	if _, err := io.ReadFull(r, magic); err != nil {
 		return nil, err
 	}
+	// Some file transfer pipelines prepend a UTF-8 BOM to files. Skip it.
+	if bytes.HasPrefix(magic, utf8BOM) {
+		copy(magic, magic[len(utf8BOM):])
+		if _, err := io.ReadFull(r, magic[len(magic)-len(utf8BOM):]); err != nil {
+			return nil, err
+		}
+	}
 	ver, err := version.FromMagicBytes(magic)
 	if err != nil {
+		if !bytes.HasPrefix(magic, []byte("sxg1")) {
+			return nil, fmt.Errorf("signedexchange: unexpected leading bytes before magic: %x", magic)
+		}
 		return nil, err
 	}
 
@@ -411,7 +1540,10 @@ func ReadExchangePrologue(r io.Reader) (*Exchange, error) {
 		var err error
 		e.RequestURI, err = validateFallbackURL(fallbackUrl)
 		if err != nil {
-			return nil, err
+			if err := e.nonconformance(lenient, err); err != nil {
+				return nil, err
+			}
+			e.RequestURI = string(fallbackUrl)
 		}
 	}
 
@@ -421,6 +1553,9 @@ func ReadExchangePrologue(r io.Reader) (*Exchange, error) {
 		return nil, err
 	}
 	sigLength := bigendian.Decode3BytesUint(sigLengthBytes)
+	if ver != version.Version1b1 && sigLength > maxSignatureHeaderValueLen {
+		return nil, &SizeLimitError{Part: "signature", Size: int64(sigLength), Limit: maxSignatureHeaderValueLen}
+	}
 
 	// Step 5. "3 bytes storing a big-endian integer headerLength. If this is larger than 524288 (512*1024), parsing MUST fail." [spec text]
 	headerLengthBytes := [3]byte{}
@@ -428,6 +1563,9 @@ func ReadExchangePrologue(r io.Reader) (*Exchange, error) {
 		return nil, err
 	}
 	headerLength := bigendian.Decode3BytesUint(headerLengthBytes)
+	if ver != version.Version1b1 && headerLength > maxHeaderLen {
+		return nil, &SizeLimitError{Part: "headers", Size: int64(headerLength), Limit: maxHeaderLen}
+	}
 
 	// Step 6. "sigLength bytes holding the Signature header field’s value (Section 3.1)." [spec text]
 	sig := make([]byte, sigLength)
@@ -443,18 +1581,95 @@ func ReadExchangePrologue(r io.Reader) (*Exchange, error) {
 	}
 
 	dec := cbor.NewDecoder(bytes.NewReader(encodedHeader))
-	if err := e.decodeExchangeHeaders(dec); err != nil {
+	if err := e.decodeExchangeHeaders(dec, lenient); err != nil {
 		return nil, err
 	}
 
+	if enc, ok := miceEncodingOf(e.ResponseHeaders); ok {
+		if !ver.SupportsMiceEncoding(enc) {
+			if err := e.nonconformance(lenient, fmt.Errorf("signedexchange: Content-Encoding %q does not match version %s, which uses %q", enc, ver, ver.MiceEncoding())); err != nil {
+				return nil, err
+			}
+		} else if err := checkDigestHeader(e.ResponseHeaders, enc); err != nil {
+			if err := e.nonconformance(lenient, fmt.Errorf("signedexchange: %v", err)); err != nil {
+				return nil, err
+			}
+		}
+	}
+
 	return e, nil
 }
 
-func ReadExchange(r io.Reader) (*Exchange, error) {
-	e, err := ReadExchangePrologue(r)
+// checkDigestHeader returns an error unless the digest header of enc, i.e.
+// Digest or MI-Draft2, is in h and has a digest with the algorithm token of
+// enc. A mismatch means the producer labeled the payload with one encoding
+// but computed the proof for another.
+func checkDigestHeader(h http.Header, enc mice.Encoding) error {
+	name := enc.DigestHeaderName()
+	value := h.Get(name)
+	if value == "" {
+		return fmt.Errorf("Content-Encoding is %q, but the %s header is absent", enc, name)
+	}
+	var algorithms []string
+	for _, digest := range strings.Split(value, ",") {
+		algorithm := strings.TrimSpace(strings.SplitN(digest, "=", 2)[0])
+		if strings.EqualFold(algorithm, enc.ContentEncoding()) {
+			return nil
+		}
+		algorithms = append(algorithms, algorithm)
+	}
+	return fmt.Errorf("Content-Encoding is %q, but the %s header has the algorithm %q", enc, name, strings.Join(algorithms, ", "))
+}
+
+// ReadExchange reads an exchange from r. It fails with a *SizeLimitError if
+// the signature or the headers are larger than the format allows, or if the
+// payload is larger than allowed by WithMaxPayloadSize.
+func ReadExchange(r io.Reader, opts ...ReadOption) (*Exchange, error) {
+	return readExchange(r, false, opts)
+}
+
+// ReadExchangeFromResponse reads an exchange from the body of resp, which must
+// have a Content-Type of application/signed-exchange with a v= parameter
+// matching the version of the exchange. The body is closed.
+func ReadExchangeFromResponse(resp *http.Response, opts ...ReadOption) (*Exchange, error) {
+	defer resp.Body.Close()
+
+	contentType := resp.Header.Get("Content-Type")
+	ver, err := version.FromMimeType(contentType)
+	if err != nil {
+		return nil, fmt.Errorf("signedexchange: response is not a signed exchange (Content-Type %q): %v", contentType, err)
+	}
+	e, err := ReadExchange(resp.Body, opts...)
 	if err != nil {
 		return nil, err
 	}
+	if e.Version != ver {
+		return nil, fmt.Errorf("signedexchange: Content-Type %q does not match the exchange version %s", contentType, e.Version)
+	}
+	return e, nil
+}
+
+// ReadExchangeLenient is like ReadExchange, but tolerates inputs that are
+// well-formed but don't conform to the canonical form required by the spec,
+// e.g. upper-case header names or a non-https fallback URL. Such
+// nonconformances are recorded in the returned Exchange's ReadWarnings, and
+// Verify refuses the exchange. Size limits are enforced as by ReadExchange.
+func ReadExchangeLenient(r io.Reader, opts ...ReadOption) (*Exchange, error) {
+	return readExchange(r, true, opts)
+}
+
+func readExchange(r io.Reader, lenient bool, opts []ReadOption) (*Exchange, error) {
+	o := &readOptions{}
+	for _, opt := range opts {
+		opt(o)
+	}
+	e, err := readExchangePrologue(r, lenient)
+	if err != nil {
+		return nil, err
+	}
+	if o.maxPayloadSize > 0 {
+		r = io.LimitReader(r, o.maxPayloadSize+1)
+	}
 
 	// Step 8. "The payload body (Section 3.3 of [RFC7230]) of the exchange represented by the application/signed-exchange resource." [spec text]
 	// "Note that the use of the payload body here means that a Transfer-Encoding header field inside the application/signed-exchange header block has no effect. A Transfer-Encoding header field on the outer HTTP response that transfers this resource still has its normal effect." [spec text]
@@ -462,6 +1677,9 @@ func ReadExchange(r io.Reader) (*Exchange, error) {
 	if err != nil {
 		return nil, err
 	}
+	if o.maxPayloadSize > 0 && int64(len(e.Payload)) > o.maxPayloadSize {
+		return nil, &SizeLimitError{Part: "payload", Size: int64(len(e.Payload)), Limit: o.maxPayloadSize}
+	}
 
 	return e, nil
 }
@@ -480,8 +1698,181 @@ func validateFallbackURL(urlBytes []byte) (string, error) {
 	return urlStr, nil
 }
 
+// ValidateServingURL returns an error if the exchange would be unusable when
+// served from servingURL. If the fallback URL is the URL the exchange itself
+// is served from, a browser that fails to load the exchange navigates to the
+// fallback URL, receives the same exchange again, and loops.
+func (e *Exchange) ValidateServingURL(servingURL string) error {
+	fallback, err := url.Parse(e.RequestURI)
+	if err != nil {
+		return fmt.Errorf("signedexchange: cannot parse fallback URL %q: %v", e.RequestURI, err)
+	}
+	serving, err := url.Parse(servingURL)
+	if err != nil {
+		return fmt.Errorf("signedexchange: cannot parse serving URL %q: %v", servingURL, err)
+	}
+	// Fragments are not sent to the server, so they can't break the loop.
+	fallback.Fragment, fallback.RawFragment = "", ""
+	serving.Fragment, serving.RawFragment = "", ""
+	if strings.EqualFold(fallback.Scheme, serving.Scheme) &&
+		strings.EqualFold(fallback.Host, serving.Host) &&
+		fallback.EscapedPath() == serving.EscapedPath() &&
+		fallback.RawQuery == serving.RawQuery {
+		return fmt.Errorf("signedexchange: fallback URL %q is the URL the exchange is served from; falling back would cause a redirect loop", e.RequestURI)
+	}
+	return nil
+}
+
+// ConformanceError describes a way in which an exchange does not conform to
+// the signed exchange format or to what browsers require of it.
+type ConformanceError struct {
+	// Check names the check that failed, e.g. "uncached-header".
+	Check   string
+	Message string
+}
+
+func (e ConformanceError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Check, e.Message)
+}
+
+// ConformanceErrors is the error returned by Validate. It lists every
+// problem found.
+type ConformanceErrors []ConformanceError
+
+func (errs ConformanceErrors) Error() string {
+	messages := make([]string, len(errs))
+	for i, e := range errs {
+		messages[i] = e.Message
+	}
+	return "signedexchange: invalid exchange: " + strings.Join(messages, "; ")
+}
+
+// Validate checks that the exchange conforms to the spec and to what browsers
+// rely on, without signing or verifying it, so that every problem can be
+// reported at once. It returns a ConformanceErrors listing each of them, or
+// nil if there are none. See CheckConformance for the checks. The payload may
+// be either MI-encoded or not.
+func (e *Exchange) Validate() error {
+	if errs := e.CheckConformance(); len(errs) > 0 {
+		return ConformanceErrors(errs)
+	}
+	return nil
+}
+
+// CheckConformance returns the conformance problems of the exchange, in a
+// stable order:
+//   - 204 (No Content) and 304 (Not Modified) responses must not have a body
+//     (Section 3.3.3 of RFC 7230), and a 206 (Partial Content) response must
+//     have a single-range Content-Range header that matches the payload, see
+//     validatePartialContent.
+//   - Versions that require it must have a Content-Type.
+//   - The request URL must be an absolute https URL.
+//   - For versions 1b1 and 1b2, the request method must be safe and the
+//     request must have no stateful headers.
+//   - The response must have no uncached headers, and must be cacheable by a
+//     shared cache for versions that require it.
+//   - The Variants and Variant-Key headers must be consistent, see
+//     ValidateVariants.
+//   - The MI record size, the signature and the headers must be within the
+//     limits clients process.
+func (e *Exchange) CheckConformance() []ConformanceError {
+	var errs []ConformanceError
+	add := func(check, format string, a ...interface{}) {
+		errs = append(errs, ConformanceError{Check: check, Message: fmt.Sprintf(format, a...)})
+	}
+
+	switch e.ResponseStatus {
+	case http.StatusNoContent, http.StatusNotModified:
+		if !e.payloadIsEmpty() {
+			add("status", "a %d response must not have a body", e.ResponseStatus)
+		}
+	case http.StatusPartialContent:
+		if err := e.validatePartialContent(); err != nil {
+			add("partial-content", "%v", err)
+		}
+	}
+	if e.Version.HasVerificationCheck(version.CheckContentTypeRequired) && e.ResponseHeaders.Get("Content-Type") == "" {
+		add("content-type", "version %s requires a Content-Type response header", e.Version)
+	}
+	if _, err := validateFallbackURL([]byte(e.RequestURI)); err != nil {
+		add("request-url", "%v", strings.TrimPrefix(err.Error(), "signedexchange: "))
+	}
+
+	if e.Version.HasVerificationCheck(version.CheckRequestMethodSafe) &&
+		e.RequestMethod != http.MethodGet && e.RequestMethod != http.MethodHead {
+		add("request-method", "request method %q is not safe", e.RequestMethod)
+	}
+	for _, k := range sortedHeaderNames(e.RequestHeaders) {
+		if IsStatefulRequestHeader(k) {
+			add("stateful-header", "exchange has stateful request header %q", k)
+		}
+	}
+	for _, k := range sortedHeaderNames(e.ResponseHeaders) {
+		if IsUncachedHeader(k) {
+			add("uncached-header", "exchange has uncached response header %q", k)
+		}
+	}
+	if err := e.ValidateVariants(); err != nil {
+		add("variants", "%v", strings.TrimPrefix(err.Error(), "signedexchange: "))
+	}
+	if e.Version.HasVerificationCheck(version.CheckCacheabilityRequired) {
+		var logBuf bytes.Buffer
+		if !e.IsCacheable(log.New(&logBuf, "", 0)) {
+			messages := strings.Split(strings.TrimSpace(logBuf.String()), "\n")
+			add("cacheability", "response is not cacheable: %s", strings.Join(messages, "; "))
+		}
+	}
+
+	if _, err := e.MiceEncoding(); err == nil {
+		if size, err := e.MIRecordSize(); err != nil {
+			add("payload", "%v", err)
+		} else if err := ValidateRecordSize(e.Version, int(size)); err != nil {
+			add("payload", "%v", strings.TrimPrefix(err.Error(), "signedexchange: "))
+		}
+	}
+	if e.Version != version.Version1b1 {
+		if len(e.SignatureHeaderValue) > maxSignatureHeaderValueLen {
+			add("signature-length", "signature is %d bytes, more than %d", len(e.SignatureHeaderValue), maxSignatureHeaderValueLen)
+		}
+		var headerBuf bytes.Buffer
+		if err := e.DumpExchangeHeaders(&headerBuf); err != nil {
+			add("headers", "cannot serialize headers: %v", err)
+		} else if headerBuf.Len() > maxHeaderLen {
+			add("headers", "headers are %d bytes, more than %d", headerBuf.Len(), maxHeaderLen)
+		}
+	}
+	return errs
+}
+
+func sortedHeaderNames(h http.Header) []string {
+	names := make([]string, 0, len(h))
+	for k := range h {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// payloadIsEmpty returns true if the payload, decoded if MI-encoded, is empty.
+func (e *Exchange) payloadIsEmpty() bool {
+	enc, err := e.MiceEncoding()
+	if err != nil {
+		return len(e.Payload) == 0
+	}
+	if enc == mice.Draft02Encoding {
+		// A single empty record after the record size.
+		return len(e.Payload) <= 8
+	}
+	// The encoding of an empty payload is itself empty.
+	return len(e.Payload) == 0
+}
+
 func (e *Exchange) DumpSignedMessage(w io.Writer, s *Signer) error {
-	bs, err := serializeSignedMessage(e, calculateCertSha256(s.Certs), s.ValidityUrl.String(), s.Date.Unix(), s.Expires.Unix())
+	context, err := s.contextString(e.Version)
+	if err != nil {
+		return err
+	}
+	bs, err := serializeSignedMessage(e, context, calculateCertSha256(s.Certs), s.ValidityUrl.String(), s.Date.Unix(), s.Expires.Unix())
 	if err != nil {
 		return err
 	}
@@ -515,6 +1906,13 @@ func (e *Exchange) PrettyPrintPayload(w io.Writer) {
 	w.Write(e.Payload)
 }
 
+// ComputeHeaderIntegrity returns the header-integrity of the exchange: the
+// SHA-256 hash of its signed headers, i.e. the canonical CBOR serialization of
+// the response headers with the ":status" pseudo-header (see CBORFromHeader),
+// as "sha256-" followed by the base64 of the hash. This is the value of the
+// header-integrity parameter of an allowed-alt-sxg link to the exchange (see
+// SubresourceLink). For versions 1b1 and 1b2, which do not support subresource
+// substitution, the request map is hashed along with the response map.
 func (e *Exchange) ComputeHeaderIntegrity() (string, error) {
 	var headerBuf bytes.Buffer
 	if err := e.DumpExchangeHeaders(&headerBuf); err != nil {
@@ -524,6 +1922,22 @@ func (e *Exchange) ComputeHeaderIntegrity() (string, error) {
 	return "sha256-" + base64.StdEncoding.EncodeToString(sum[:]), nil
 }
 
+// VerifyHeaderIntegrity checks that the header-integrity of the exchange, as
+// computed by ComputeHeaderIntegrity, equals expected. Browsers match signed
+// subresources by this value, so it can be used to check the linkage between a
+// parent and a subresource exchange without fetching certificates or
+// verifying signatures.
+func (e *Exchange) VerifyHeaderIntegrity(expected string) error {
+	headerIntegrity, err := e.ComputeHeaderIntegrity()
+	if err != nil {
+		return err
+	}
+	if headerIntegrity != expected {
+		return fmt.Errorf("signedexchange: header-integrity mismatch: computed %q, expected %q", headerIntegrity, expected)
+	}
+	return nil
+}
+
 func (e *Exchange) PrettyPrintHeaderIntegrity(w io.Writer) error {
 	headerIntegrity, err := e.ComputeHeaderIntegrity()
 	if err != nil {
@@ -532,3 +1946,79 @@ func (e *Exchange) PrettyPrintHeaderIntegrity(w io.Writer) error {
 	fmt.Fprintf(w, "header integrity: %s\n", headerIntegrity)
 	return nil
 }
+
+// SignatureBytes returns the decoded "sig" parameter of the signature labeled
+// label in the exchange's Signature header. This allows tests to compare the
+// signature blob independently of the other signature parameters.
+func (e *Exchange) SignatureBytes(label string) ([]byte, error) {
+	signatures, err := structuredheader.ParseParameterisedListStrict(e.SignatureHeaderValue)
+	if err != nil {
+		return nil, fmt.Errorf("signedexchange: could not parse signature header: %v", err)
+	}
+	for _, item := range signatures {
+		if string(item.Label) != label {
+			continue
+		}
+		sig, ok := item.Params["sig"].([]byte)
+		if !ok {
+			return nil, fmt.Errorf("signedexchange: signature %q has no valid 'sig' value", label)
+		}
+		return sig, nil
+	}
+	return nil, fmt.Errorf("signedexchange: no signature labeled %q", label)
+}
+
+// Names of the signature algorithms returned by SignedMessage, from the TLS
+// SignatureScheme registry. ECDSA signatures are in the ASN.1 DER encoding.
+// Browsers only support SignatureAlgorithmECDSAP256SHA256.
+const (
+	// ECDSA over the P-256 curve with SHA-256.
+	SignatureAlgorithmECDSAP256SHA256 = signingalgorithm.ECDSAP256SHA256
+	// ECDSA over the P-384 curve with SHA-384.
+	SignatureAlgorithmECDSAP384SHA384 = signingalgorithm.ECDSAP384SHA384
+	// Ed25519, which only version 1b3 allows, experimentally.
+	SignatureAlgorithmEd25519 = signingalgorithm.Ed25519
+)
+
+// SignedMessage returns the exact bytes signed by the signature labeled label
+// in the exchange's Signature header, along with the signature and the name of
+// the signature algorithm, so that the signature can be verified outside of
+// this package.
+//
+// cert is the main certificate at the signature's cert-url, which is not
+// fetched. It is needed because the Signature header does not name the
+// signature algorithm: the algorithm is the one of the public key of cert,
+// which is also the key to verify with. cert must match the cert-sha256 of
+// the signature.
+//
+// The message is built with the context string of e.Version, so it does not
+// match signatures made by a Signer with a custom ContextString unless the
+// same string is passed with WithContextString. Other options are ignored.
+func (e *Exchange) SignedMessage(label string, cert *x509.Certificate, opts ...VerifyOption) (message []byte, signature []byte, alg string, err error) {
+	o := &verifyOptions{contextString: contextString(e.Version)}
+	for _, opt := range opts {
+		opt(o)
+	}
+	params, err := ParseSignatureHeaderBytes([]byte(e.SignatureHeaderValue), e.Version)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	for _, sig := range params.Signatures {
+		if string(sig.Label) != label {
+			continue
+		}
+		if sig.CertSha256 != nil && !bytes.Equal(sig.CertSha256, calculateCertSha256([]*x509.Certificate{cert})) {
+			return nil, nil, "", fmt.Errorf("signedexchange: the certificate does not match the cert-sha256 of signature %q", label)
+		}
+		alg, err := signingalgorithm.AlgorithmName(cert.PublicKey)
+		if err != nil {
+			return nil, nil, "", err
+		}
+		message, err := serializeSignedMessage(e, o.contextString, sig.CertSha256, sig.ValidityUrl, sig.Date, sig.Expires)
+		if err != nil {
+			return nil, nil, "", err
+		}
+		return message, sig.Sig, alg, nil
+	}
+	return nil, nil, "", fmt.Errorf("signedexchange: no signature labeled %q", label)
+}
@@ -2,19 +2,44 @@ package signedexchange_test
 
 import (
 	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
+	"math/big"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"os"
+	"path/filepath"
 	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/WICG/webpackage/go/internal/signingalgorithm"
 	. "github.com/WICG/webpackage/go/signedexchange"
 	"github.com/WICG/webpackage/go/signedexchange/certurl"
+	"github.com/WICG/webpackage/go/signedexchange/mice"
+	"github.com/WICG/webpackage/go/signedexchange/signedexchangetest"
 	"github.com/WICG/webpackage/go/signedexchange/version"
+	"golang.org/x/crypto/ocsp"
 )
 
 const (
@@ -180,216 +205,3397 @@ func TestSignedExchange(t *testing.T) {
 	})
 }
 
-func TestSignedExchangeBannedCertUrlScheme(t *testing.T) {
+// flushRecorder records the number of bytes written at each Flush.
+type flushRecorder struct {
+	bytes.Buffer
+	flushedAt []int
+}
+
+func (f *flushRecorder) Flush() error {
+	f.flushedAt = append(f.flushedAt, f.Len())
+	return nil
+}
+
+func TestWriteFlushAfterHeaders(t *testing.T) {
 	testForEachVersion(t, func(ver version.Version, t *testing.T) {
-		e := NewExchange(ver, requestUrl, http.MethodGet, nil, 200, http.Header{}, []byte(payload))
-		if err := e.MiEncodePayload(16); err != nil {
+		e, s, _ := createTestExchange(ver, t)
+		if err := e.AddSignatureHeader(s); err != nil {
 			t.Fatal(err)
 		}
 
-		certs, _ := signingalgorithm.ParseCertificates([]byte(pemCerts))
-		certUrl, _ := url.Parse("http://example.com/cert.msg")
-		validityUrl, _ := url.Parse("https://example.com/resource.validity")
-		privKey, _ := signingalgorithm.ParsePrivateKey([]byte(pemPrivateKey))
-		s := &Signer{
-			Date:        signatureDate,
-			Expires:     signatureDate.Add(1 * time.Hour),
-			Certs:       certs,
-			CertUrl:     certUrl,
-			ValidityUrl: validityUrl,
-			PrivKey:     privKey,
+		var w flushRecorder
+		if err := e.Write(&w, WithFlushAfterHeaders()); err != nil {
+			t.Fatal(err)
 		}
-		if err := e.AddSignatureHeader(s); err == nil {
-			t.Errorf("non-{https,data} cert-url unexpectedly allowed in an exchange")
+		out := w.Bytes()
+		headersEnd := len(out) - len(e.Payload)
+		if !bytes.Equal(out[headersEnd:], e.Payload) {
+			t.Fatal("The exchange does not end with the payload")
+		}
+		if i := bytes.Index(out, []byte(e.SignatureHeaderValue)); i < 0 || i+len(e.SignatureHeaderValue) > headersEnd {
+			t.Errorf("The signature is not before the payload (at %d, payload at %d)", i, headersEnd)
+		}
+		if !reflect.DeepEqual(w.flushedAt, []int{headersEnd}) {
+			t.Errorf("Flushed after %v bytes, want [%d]", w.flushedAt, headersEnd)
+		}
+
+		w = flushRecorder{}
+		if err := e.Write(&w); err != nil {
+			t.Fatal(err)
+		}
+		if len(w.flushedAt) != 0 {
+			t.Errorf("Write flushed without WithFlushAfterHeaders")
 		}
 	})
 }
 
-func createTestExchange(ver version.Version, t *testing.T) (e *Exchange, s *Signer, certBytes []byte) {
-	header := http.Header{}
-	header.Add("Content-Type", "text/html; charset=utf-8")
+func TestRequestHeadersRoundTrip(t *testing.T) {
+	for _, ver := range []version.Version{version.Version1b1, version.Version1b2} {
+		t.Run(string(ver), func(t *testing.T) {
+			reqHeader := http.Header{}
+			reqHeader.Add("Accept", `text/html,application/xhtml+xml,application/signed-exchange;v="b3";q=0.9,*/*;q=0.8`)
+			reqHeader.Add("Accept-Language", "en-US")
+			reqHeader.Add("Accept-Language", "ja;q=0.5")
+			reqHeader.Add("AMP-Cache-Transform", `google;v="1..2", any`)
+			reqHeader.Add("X-Empty", "")
+			// Keys for the same name that were not canonicalized.
+			reqHeader["x-lower"] = []string{"a"}
+			reqHeader["X-LOWER"] = []string{"b"}
 
-	e = NewExchange(ver, requestUrl, http.MethodGet, nil, 200, header, []byte(payload))
-	if err := e.MiEncodePayload(16); err != nil {
-		t.Fatal(err)
+			e := NewExchange(ver, requestUrl, http.MethodGet, reqHeader, 200, http.Header{"Content-Type": {"text/html"}}, []byte(payload))
+			var buf bytes.Buffer
+			if err := e.Write(&buf); err != nil {
+				t.Fatal(err)
+			}
+			got, err := ReadExchange(bytes.NewReader(buf.Bytes()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := http.Header{
+				"Accept":              {`text/html,application/xhtml+xml,application/signed-exchange;v="b3";q=0.9,*/*;q=0.8`},
+				"Accept-Language":     {"en-US,ja;q=0.5"},
+				"Amp-Cache-Transform": {`google;v="1..2", any`},
+				"X-Empty":             {""},
+				"X-Lower":             {"b,a"},
+			}
+			if !reflect.DeepEqual(got.RequestHeaders, want) {
+				t.Errorf("Unexpected request headers:\ngot:  %q\nwant: %q", got.RequestHeaders, want)
+			}
+
+			// Once normalized, request headers round-trip exactly.
+			var buf2 bytes.Buffer
+			if err := got.Write(&buf2); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(buf.Bytes(), buf2.Bytes()) {
+				t.Error("Serialization changed on the second round trip")
+			}
+			again, err := ReadExchange(&buf2)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(again.RequestHeaders, got.RequestHeaders) {
+				t.Errorf("Request headers changed on the second round trip: %q", again.RequestHeaders)
+			}
+		})
 	}
+}
 
-	certs, err := signingalgorithm.ParseCertificates([]byte(pemCerts))
+func TestCBORHeaderRoundTrip(t *testing.T) {
+	testForEachVersion(t, func(ver version.Version, t *testing.T) {
+		h := http.Header{}
+		h.Add("Content-Type", "text/html; charset=utf-8")
+		h.Add("Link", "<https://example.com/style.css>;rel=preload;as=style")
+		h.Add("Foo", "Bar")
+		h.Add("Foo", "Baz")
+
+		bs, err := CBORFromHeader(h, 404, ver)
+		if err != nil {
+			t.Fatal(err)
+		}
+		status, got, err := HeaderFromCBOR(bs, ver)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status != 404 {
+			t.Errorf("Unexpected status: got %d, want 404", status)
+		}
+		want := http.Header{
+			"Content-Type": []string{"text/html; charset=utf-8"},
+			"Link":         []string{"<https://example.com/style.css>;rel=preload;as=style"},
+			"Foo":          []string{"Bar,Baz"},
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("Unexpected headers: got %v, want %v", got, want)
+		}
+
+		again, err := CBORFromHeader(got, status, ver)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(again, bs) {
+			t.Errorf("Re-serialized CBOR differs: got %x, want %x", again, bs)
+		}
+	})
+}
+
+type closeRecorder struct {
+	io.Reader
+	closed bool
+}
+
+func (c *closeRecorder) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestReadExchangeFromResponse(t *testing.T) {
+	testForEachVersion(t, func(ver version.Version, t *testing.T) {
+		e, s, _ := createTestExchange(ver, t)
+		if err := e.AddSignatureHeader(s); err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		if err := e.Write(&buf); err != nil {
+			t.Fatal(err)
+		}
+
+		body := &closeRecorder{Reader: bytes.NewReader(buf.Bytes())}
+		resp := &http.Response{
+			Header: http.Header{"Content-Type": []string{ver.MimeType()}},
+			Body:   body,
+		}
+		got, err := ReadExchangeFromResponse(resp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Version != ver || got.RequestURI != e.RequestURI {
+			t.Errorf("Unexpected exchange: version %s, request URI %q", got.Version, got.RequestURI)
+		}
+		if !body.closed {
+			t.Error("Response body was not closed")
+		}
+
+		for _, contentType := range []string{"text/html; charset=utf-8", "application/signed-exchange", "application/signed-exchange;v=b0"} {
+			body := &closeRecorder{Reader: bytes.NewReader(buf.Bytes())}
+			resp := &http.Response{
+				Header: http.Header{"Content-Type": []string{contentType}},
+				Body:   body,
+			}
+			if _, err := ReadExchangeFromResponse(resp); err == nil {
+				t.Errorf("Content-Type %q unexpectedly accepted", contentType)
+			}
+			if !body.closed {
+				t.Errorf("Response body was not closed for Content-Type %q", contentType)
+			}
+		}
+	})
+}
+
+func TestNewExchangeFromResponse(t *testing.T) {
+	req, err := http.NewRequest(http.MethodGet, requestUrl, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
+	newResponse := func(header http.Header) (*http.Response, *closeRecorder) {
+		body := &closeRecorder{Reader: strings.NewReader(payload)}
+		return &http.Response{StatusCode: 200, Header: header, Body: body, Request: req}, body
+	}
 
-	privKey, err := signingalgorithm.ParsePrivateKey([]byte(pemPrivateKey))
+	resp, body := newResponse(http.Header{
+		"Content-Type": {"text/html; charset=utf-8"},
+		"Link":         {"</style.css>;rel=preload;as=style,\r\n\t </script.js>;rel=preload;as=script"},
+	})
+	e, err := NewExchangeFromResponse(version.Version1b3, resp)
 	if err != nil {
 		t.Fatal(err)
 	}
-	certUrl, _ := url.Parse("https://example.com/cert.msg")
-	validityUrl, _ := url.Parse("https://example.com/resource.validity")
-	s = &Signer{
-		Date:        signatureDate,
-		Expires:     signatureDate.Add(1 * time.Hour),
-		Certs:       certs,
-		CertUrl:     certUrl,
-		ValidityUrl: validityUrl,
-		PrivKey:     privKey,
+	if !body.closed {
+		t.Error("Response body was not closed")
+	}
+	if want := "</style.css>;rel=preload;as=style, </script.js>;rel=preload;as=script"; e.ResponseHeaders.Get("Link") != want {
+		t.Errorf("Link header was not unfolded: got %q, want %q", e.ResponseHeaders.Get("Link"), want)
+	}
+	if e.RequestURI != requestUrl || e.RequestMethod != http.MethodGet || e.ResponseStatus != 200 || string(e.Payload) != payload {
+		t.Errorf("Unexpected exchange: %s %s, status %d, payload %q", e.RequestMethod, e.RequestURI, e.ResponseStatus, e.Payload)
 	}
 
-	certChain, err := certurl.NewCertChain(certs, []byte("dummy"), nil)
+	// Line breaks that are not obs-folds are rejected.
+	for _, value := range []string{"a\r\nb", "a\rb", "a\r\n"} {
+		resp, _ := newResponse(http.Header{"X-Folded": {value}})
+		if _, err := NewExchangeFromResponse(version.Version1b3, resp); err == nil {
+			t.Errorf("Header value %q unexpectedly accepted", value)
+		}
+	}
+
+	// Headers that cannot be captured inside an exchange are removed.
+	resp, _ = newResponse(http.Header{
+		"Content-Type": {"text/html; charset=utf-8"},
+		"Connection":   {"X-Hop"},
+		"X-Hop":        {"1"},
+		"Set-Cookie":   {"a=b"},
+		"Keep-Alive":   {"timeout=5"},
+	})
+	resp.Request = req.Clone(req.Context())
+	resp.Request.Header.Set("Cookie", "a=b")
+	resp.Request.Header.Set("Accept", "text/html")
+	e, err = NewExchangeFromResponse(version.Version1b2, resp)
 	if err != nil {
 		t.Fatal(err)
 	}
-	var certCBOR bytes.Buffer
-	if err := certChain.Write(&certCBOR); err != nil {
-		t.Fatal(err)
+	for _, name := range []string{"Connection", "X-Hop", "Set-Cookie", "Keep-Alive"} {
+		if _, ok := e.ResponseHeaders[name]; ok {
+			t.Errorf("Response header %q was not removed", name)
+		}
 	}
-	certBytes = certCBOR.Bytes()
-	return
-}
-
-func verificationShouldSucceed(t *testing.T, e *Exchange, certBytes []byte, verificationTime time.Time) {
-	certFetcher := func(_ string) ([]byte, error) { return certBytes, nil }
-	if _, ok := e.Verify(verificationTime, certFetcher, stdoutLogger); !ok {
-		t.Errorf("Verification should succeed")
+	if e.ResponseHeaders.Get("Content-Type") == "" {
+		t.Error("Content-Type was removed")
+	}
+	if e.RequestHeaders.Get("Cookie") != "" || e.RequestHeaders.Get("Accept") != "text/html" {
+		t.Errorf("Unexpected request headers: %v", e.RequestHeaders)
 	}
-}
 
-func verificationShouldFail(t *testing.T, e *Exchange, certBytes []byte, verificationTime time.Time) {
-	certFetcher := func(_ string) ([]byte, error) { return certBytes, nil }
-	if _, ok := e.Verify(verificationTime, certFetcher, nullLogger); ok {
-		t.Errorf("Verification should fail")
+	// The body size can be limited.
+	for _, tc := range []struct {
+		max int64
+		ok  bool
+	}{{0, true}, {int64(len(payload)), true}, {int64(len(payload)) - 1, false}} {
+		resp, body := newResponse(http.Header{})
+		_, err := NewExchangeFromResponse(version.Version1b3, resp, WithMaxBodySize(tc.max))
+		if (err == nil) != tc.ok {
+			t.Errorf("WithMaxBodySize(%d): got error %v, want ok %v", tc.max, err, tc.ok)
+		}
+		if !body.closed {
+			t.Errorf("WithMaxBodySize(%d): response body was not closed", tc.max)
+		}
 	}
 }
 
-func TestVerify(t *testing.T) {
+func TestSignedExchangeBannedCertUrlScheme(t *testing.T) {
 	testForEachVersion(t, func(ver version.Version, t *testing.T) {
-		e, s, c := createTestExchange(ver, t)
-		if err := e.AddSignatureHeader(s); err != nil {
+		e := NewExchange(ver, requestUrl, http.MethodGet, nil, 200, http.Header{}, []byte(payload))
+		if err := e.MiEncodePayload(16); err != nil {
 			t.Fatal(err)
 		}
-		verificationShouldSucceed(t, e, c, signatureDate)
-	})
-}
 
-func TestVerifyNotYetValidExchange(t *testing.T) {
-	testForEachVersion(t, func(ver version.Version, t *testing.T) {
-		e, s, c := createTestExchange(ver, t)
-		if err := e.AddSignatureHeader(s); err != nil {
-			t.Fatal(err)
+		certs, _ := signingalgorithm.ParseCertificates([]byte(pemCerts))
+		certUrl, _ := url.Parse("http://example.com/cert.msg")
+		validityUrl, _ := url.Parse("https://example.com/resource.validity")
+		privKey, _ := signingalgorithm.ParsePrivateKey([]byte(pemPrivateKey))
+		s := &Signer{
+			Date:        signatureDate,
+			Expires:     signatureDate.Add(1 * time.Hour),
+			Certs:       certs,
+			CertUrl:     certUrl,
+			ValidityUrl: validityUrl,
+			PrivKey:     privKey,
+		}
+		if err := e.AddSignatureHeader(s); err == nil {
+			t.Errorf("non-{https,data} cert-url unexpectedly allowed in an exchange")
 		}
-		verificationTime := signatureDate.Add(-1 * time.Second)
-		verificationShouldFail(t, e, c, verificationTime)
 	})
 }
 
-func TestVerifyExpiredExchange(t *testing.T) {
+func TestSignedExchangeBannedRequestURLScheme(t *testing.T) {
 	testForEachVersion(t, func(ver version.Version, t *testing.T) {
-		e, s, c := createTestExchange(ver, t)
-		if err := e.AddSignatureHeader(s); err != nil {
+		_, s, _ := createTestExchange(ver, t)
+		e := NewExchange(ver, "http://example.com/", http.MethodGet, nil, 200, http.Header{}, []byte(payload))
+		if err := e.MiEncodePayload(16); err != nil {
 			t.Fatal(err)
 		}
-		verificationTime := signatureDate.Add(1 * time.Hour).Add(1 * time.Second)
-		verificationShouldFail(t, e, c, verificationTime)
+		if err := e.AddSignatureHeader(s); err == nil {
+			t.Errorf("non-https request URL unexpectedly allowed in an exchange")
+		}
 	})
 }
 
-func TestVerifyBadValidityUrl(t *testing.T) {
+func TestSignerExpiresPolicy(t *testing.T) {
 	testForEachVersion(t, func(ver version.Version, t *testing.T) {
-		e, s, c := createTestExchange(ver, t)
-		s.ValidityUrl, _ = url.Parse("https://subdomain.example.com/resource.validity")
+		e, s, _ := createTestExchange(ver, t)
+		notAfter := s.Certs[0].NotAfter
+		s.Date = notAfter.Add(-1 * time.Hour)
+		s.Expires = notAfter.Add(1 * time.Hour)
+
+		s.ExpiresPolicy = RejectExpiresAfterCert
+		if err := e.AddSignatureHeader(s); err == nil {
+			t.Error("Expires after the certificate's NotAfter unexpectedly allowed")
+		}
+
+		s.ExpiresPolicy = ClampExpiresToCert
+		var logBuf bytes.Buffer
+		s.Logger = log.New(&logBuf, "", 0)
+		requested := s.Expires
 		if err := e.AddSignatureHeader(s); err != nil {
 			t.Fatal(err)
 		}
-		verificationShouldFail(t, e, c, signatureDate)
-	})
-}
-
-func TestVerifyBadMethod(t *testing.T) {
-	testForEachVersion(t, func(ver version.Version, t *testing.T) {
-		// The test doesn't make sense in version >= b3, which doesn't have request method.
-		if ver != version.Version1b1 && ver != version.Version1b2 {
-			return
+		if !s.Expires.Equal(requested) {
+			t.Errorf("Expires was modified: got %v, want %v", s.Expires, requested)
+		}
+		if !strings.Contains(e.SignatureHeaderValue, fmt.Sprintf("expires=%d", notAfter.Unix())) {
+			t.Errorf("Signature header does not have the clamped expires: %q", e.SignatureHeaderValue)
+		}
+		if !strings.Contains(logBuf.String(), "Warning") {
+			t.Errorf("no warning about clamping was logged: %q", logBuf.String())
 		}
 
-		e, s, c := createTestExchange(ver, t)
-		e.RequestMethod = "POST"
+		// The clamping is not permanent: with a later certificate, the
+		// requested Expires is used.
+		certs := s.Certs
+		cert := *certs[0]
+		cert.NotAfter = requested.Add(time.Hour)
+		s.Certs = append([]*x509.Certificate{&cert}, certs[1:]...)
+		logBuf.Reset()
 		if err := e.AddSignatureHeader(s); err != nil {
 			t.Fatal(err)
 		}
-		verificationShouldFail(t, e, c, signatureDate)
+		if !strings.Contains(e.SignatureHeaderValue, fmt.Sprintf("expires=%d", requested.Unix())) {
+			t.Errorf("Signature header does not have the requested expires: %q", e.SignatureHeaderValue)
+		}
+		if logBuf.Len() != 0 {
+			t.Errorf("unexpected warning: %q", logBuf.String())
+		}
+		s.Certs = certs
+
+		s.Date = notAfter.Add(1 * time.Hour)
+		s.Expires = notAfter.Add(2 * time.Hour)
+		if err := e.AddSignatureHeader(s); err == nil {
+			t.Error("Signing after the certificate's NotAfter unexpectedly allowed")
+		}
 	})
 }
 
-func TestVerifyStatefulRequestHeader(t *testing.T) {
+func TestSignerNow(t *testing.T) {
 	testForEachVersion(t, func(ver version.Version, t *testing.T) {
 		e, s, c := createTestExchange(ver, t)
-		if e.RequestHeaders == nil {
-			e.RequestHeaders = http.Header{}
-		}
-		e.RequestHeaders.Set("Authorization", "Basic Zm9vOmJhcg==")
+		s.Date = time.Time{}
+		s.Now = func() time.Time { return signatureDate }
 		if err := e.AddSignatureHeader(s); err != nil {
 			t.Fatal(err)
 		}
-		verificationShouldFail(t, e, c, signatureDate)
-	})
-}
+		if !s.Date.IsZero() {
+			t.Errorf("Date was modified to %v", s.Date)
+		}
+		if !strings.Contains(e.SignatureHeaderValue, fmt.Sprintf("date=%d", signatureDate.Unix())) {
+			t.Errorf("Signature header does not have the date of the clock: %q", e.SignatureHeaderValue)
+		}
+		verificationShouldSucceed(t, e, c, signatureDate)
 
-func TestVerifyUncachedHeader(t *testing.T) {
-	testForEachVersion(t, func(ver version.Version, t *testing.T) {
-		e, s, c := createTestExchange(ver, t)
-		e.ResponseHeaders.Set("Set-Cookie", "foo=bar")
+		// A reused Signer dates each signature by the clock.
+		later := signatureDate.Add(1 * time.Minute)
+		s.Now = func() time.Time { return later }
 		if err := e.AddSignatureHeader(s); err != nil {
 			t.Fatal(err)
 		}
-		verificationShouldFail(t, e, c, signatureDate)
-	})
-}
+		if !strings.Contains(e.SignatureHeaderValue, fmt.Sprintf("date=%d", later.Unix())) {
+			t.Errorf("Signature header does not have the later date of the clock: %q", e.SignatureHeaderValue)
+		}
 
-func TestVerifyBadSignature(t *testing.T) {
-	testForEachVersion(t, func(ver version.Version, t *testing.T) {
-		e, s, c := createTestExchange(ver, t)
+		// An explicit Date takes precedence over the clock.
+		e, s, _ = createTestExchange(ver, t)
+		s.Now = func() time.Time { return signatureDate.Add(1 * time.Minute) }
 		if err := e.AddSignatureHeader(s); err != nil {
 			t.Fatal(err)
 		}
-		e.ResponseHeaders.Add("Etag", "0123")
-		verificationShouldFail(t, e, c, signatureDate)
+		if !s.Date.Equal(signatureDate) {
+			t.Errorf("Date: got %v, want %v", s.Date, signatureDate)
+		}
 	})
 }
 
-func TestVerifyNoContentType(t *testing.T) {
+// TestSignerPool is meant to be run with -race.
+func TestSignerPool(t *testing.T) {
+	const numExchanges = 64
+	_, s, c := createTestExchange(version.Version1b3, t)
+	pool, err := NewSignerPool(s.Certs, s.CertUrl, s.ValidityUrl, s.PrivKey.(crypto.Signer))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exchanges := make([]*Exchange, numExchanges)
+	for i := range exchanges {
+		ver := version.AllVersions[i%len(version.AllVersions)]
+		exchanges[i], _, _ = createTestExchange(ver, t)
+	}
+	errs := make([]error, numExchanges)
+	var wg sync.WaitGroup
+	for i, e := range exchanges {
+		wg.Add(1)
+		go func(i int, e *Exchange) {
+			defer wg.Done()
+			date := signatureDate.Add(time.Duration(i) * time.Second)
+			errs[i] = pool.Sign(e, date, date.Add(time.Hour))
+		}(i, e)
+	}
+	wg.Wait()
+
+	for i, e := range exchanges {
+		if errs[i] != nil {
+			t.Errorf("exchange %d: %v", i, errs[i])
+			continue
+		}
+		// Each exchange is signed with its own date.
+		verificationTime := signatureDate.Add(time.Duration(i) * time.Second)
+		verificationShouldSucceed(t, e, c, verificationTime)
+		if i > 0 {
+			verificationShouldFail(t, e, c, verificationTime.Add(-time.Second))
+		}
+	}
+}
+
+func TestNewExchangeLazy(t *testing.T) {
 	testForEachVersion(t, func(ver version.Version, t *testing.T) {
-		e, s, c := createTestExchange(ver, t)
-		e.ResponseHeaders.Del("Content-Type")
-		if err := e.AddSignatureHeader(s); err != nil {
+		var events []string
+		header := http.Header{}
+		header.Add("Content-Type", "text/html; charset=utf-8")
+		e := NewExchangeLazy(ver, requestUrl, http.MethodGet, nil, 200, header, func() (io.Reader, error) {
+			events = append(events, "produce")
+			return strings.NewReader(payload), nil
+		})
+		events = append(events, "created")
+		if err := e.MiEncodePayload(16); err != nil {
 			t.Fatal(err)
 		}
+		events = append(events, "encoded")
 
-		// The requirement for Content-Type is only for version >= b3.
-		if ver == version.Version1b1 || ver == version.Version1b2 {
-			verificationShouldSucceed(t, e, c, signatureDate)
-		} else {
-			verificationShouldFail(t, e, c, signatureDate)
+		want, _, c := createTestExchange(ver, t)
+		if !bytes.Equal(e.Payload, want.Payload) {
+			t.Error("Lazily produced payload was encoded differently")
 		}
-	})
-}
 
-func TestVerifyNonCanonicalURL(t *testing.T) {
-	testForEachVersion(t, func(ver version.Version, t *testing.T) {
-		e, s, c := createTestExchange(ver, t)
-		// url.Parse() decodes "%73%78%67" to "sxg"
-		e.RequestURI = "https://example.com/%73%78%67"
+		_, s, _ := createTestExchange(ver, t)
 		if err := e.AddSignatureHeader(s); err != nil {
 			t.Fatal(err)
 		}
+		var buf bytes.Buffer
+		if err := e.Write(&buf); err != nil {
+			t.Fatal(err)
+		}
+		if wantEvents := []string{"created", "produce", "encoded"}; !reflect.DeepEqual(events, wantEvents) {
+			t.Errorf("Unexpected order of events: got %v, want %v", events, wantEvents)
+		}
 		verificationShouldSucceed(t, e, c, signatureDate)
 	})
 }
 
-func TestVerifyNonCacheable(t *testing.T) {
+func TestSignerCanonicalizeContentType(t *testing.T) {
 	testForEachVersion(t, func(ver version.Version, t *testing.T) {
-		e, s, c := createTestExchange(ver, t)
-		e.ResponseHeaders.Add("Cache-Control", "no-store")
-		if err := e.AddSignatureHeader(s); err != nil {
-			t.Fatal(err)
+		const canonical = "text/html; charset=utf-8"
+		for _, contentType := range []string{
+			"text/html; charset=utf-8",
+			"text/html;charset=UTF-8",
+			"TEXT/HTML; Charset=\"UTF-8\"",
+			" text/html ;  charset=utf-8",
+		} {
+			e, s, c := createTestExchange(ver, t)
+			e.ResponseHeaders.Set("Content-Type", contentType)
+			s.CanonicalizeContentType = true
+			if err := e.AddSignatureHeader(s); err != nil {
+				t.Fatal(err)
+			}
+			if got := e.ResponseHeaders.Get("Content-Type"); got != canonical {
+				t.Errorf("Content-Type %q was canonicalized to %q, want %q", contentType, got, canonical)
+			}
+
+			var buf bytes.Buffer
+			if err := e.Write(&buf); err != nil {
+				t.Fatal(err)
+			}
+			got, err := ReadExchange(&buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			verificationShouldSucceed(t, got, c, signatureDate)
+		}
+
+		// Off by default.
+		e, s, _ := createTestExchange(ver, t)
+		e.ResponseHeaders.Set("Content-Type", "TEXT/HTML")
+		if err := e.AddSignatureHeader(s); err != nil {
+			t.Fatal(err)
+		}
+		if got := e.ResponseHeaders.Get("Content-Type"); got != "TEXT/HTML" {
+			t.Errorf("Content-Type was modified without CanonicalizeContentType: %q", got)
+		}
+	})
+}
+
+func TestSignAllVersions(t *testing.T) {
+	_, s, c := createTestExchange(version.Version1b3, t)
+	header := http.Header{}
+	header.Add("Content-Type", "text/html; charset=utf-8")
+	params := &ExchangeParams{
+		RequestURI:      requestUrl,
+		RequestMethod:   http.MethodGet,
+		ResponseStatus:  200,
+		ResponseHeaders: header,
+		Payload:         []byte(payload),
+		MIRecordSize:    16,
+		Signer:          s,
+	}
+
+	out, err := SignAllVersions(params, version.AllVersions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(header) != 1 {
+		t.Errorf("SignAllVersions modified the response headers: %v", header)
+	}
+	for _, ver := range version.AllVersions {
+		bs, ok := out[ver]
+		if !ok {
+			t.Errorf("no exchange for version %s", ver)
+			continue
+		}
+		e, err := ReadExchange(bytes.NewReader(bs))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if e.Version != ver {
+			t.Errorf("got version %s, want %s", e.Version, ver)
+		}
+		verificationShouldSucceed(t, e, c, signatureDate)
+	}
+
+	out, err = SignAllVersions(params, []version.Version{version.Version1b3, "1b0"})
+	verrs, ok := err.(VersionErrors)
+	if !ok {
+		t.Fatalf("got error %v, want VersionErrors", err)
+	}
+	if _, ok := verrs["1b0"]; !ok || len(verrs) != 1 {
+		t.Errorf("unexpected errors: %v", verrs)
+	}
+	if _, ok := out[version.Version1b3]; !ok {
+		t.Error("no exchange for the successful version")
+	}
+}
+
+func TestListSupportedContentEncodings(t *testing.T) {
+	got := ListSupportedContentEncodings()
+	want := []string{"mi-sha256-draft2", "mi-sha256-03", "mi-sha512-03"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	// Each encoding can be signed and verified with a version supporting it.
+	for _, contentEncoding := range got {
+		enc, ok := mice.EncodingFromContentEncoding(contentEncoding)
+		if !ok {
+			t.Errorf("%q is not recognized as a Content-Encoding", contentEncoding)
+			continue
+		}
+		verified := false
+		for _, ver := range version.AllVersions {
+			if !ver.SupportsMiceEncoding(enc) {
+				continue
+			}
+			e, s, c := createTestExchange(ver, t)
+			e.Payload = []byte(payload)
+			e.ResponseHeaders.Del("Content-Encoding")
+			e.ResponseHeaders.Del(ver.MiceEncoding().DigestHeaderName())
+			if err := e.MiEncodePayloadWithEncoding(16, enc); err != nil {
+				t.Fatal(err)
+			}
+			if err := e.AddSignatureHeader(s); err != nil {
+				t.Fatal(err)
+			}
+			verificationShouldSucceed(t, e, c, signatureDate)
+			verified = true
+		}
+		if !verified {
+			t.Errorf("No version supports %q", contentEncoding)
+		}
+	}
+}
+
+func TestMinimalVersion(t *testing.T) {
+	newExchange := func() *Exchange {
+		header := http.Header{}
+		header.Add("Content-Type", "text/html; charset=utf-8")
+		header.Add("Cache-Control", "public, max-age=600")
+		return NewExchange(version.Version1b3, requestUrl, http.MethodGet, nil, 200, header, []byte(payload))
+	}
+	cases := []struct {
+		name   string
+		modify func(e *Exchange)
+		want   version.Version
+	}{
+		{"unencoded", func(e *Exchange) {}, version.Version1b1},
+		{"mi-sha256-draft2", func(e *Exchange) { e.Version = version.Version1b1; e.MiEncodePayload(16) }, version.Version1b1},
+		{"mi-sha256-03", func(e *Exchange) { e.MiEncodePayload(16) }, version.Version1b2},
+		{"request headers", func(e *Exchange) {
+			e.MiEncodePayload(16)
+			e.RequestHeaders = http.Header{"Accept": {"*/*"}}
+		}, version.Version1b2},
+		{"POST", func(e *Exchange) {
+			e.MiEncodePayload(16)
+			e.RequestMethod = http.MethodPost
+		}, ""},
+	}
+	for _, c := range cases {
+		e := newExchange()
+		c.modify(e)
+		got, err := MinimalVersion(e)
+		if c.want == "" {
+			if err == nil {
+				t.Errorf("%s: MinimalVersion unexpectedly succeeded with %s", c.name, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+		if got != c.want {
+			t.Errorf("%s: got %s, want %s", c.name, got, c.want)
+		}
+	}
+
+}
+
+func TestSignedMessage(t *testing.T) {
+	testForEachVersion(t, func(ver version.Version, t *testing.T) {
+		e, s, _ := createTestExchange(ver, t)
+		if err := e.AddSignatureHeader(s); err != nil {
+			t.Fatal(err)
+		}
+
+		msg, sig, alg, err := e.SignedMessage("label", s.Certs[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if alg != SignatureAlgorithmECDSAP256SHA256 {
+			t.Errorf("Unexpected algorithm: %q", alg)
+		}
+		pub, ok := s.Certs[0].PublicKey.(*ecdsa.PublicKey)
+		if !ok {
+			t.Fatalf("Unexpected public key type: %T", s.Certs[0].PublicKey)
+		}
+		digest := sha256.Sum256(msg)
+		if !ecdsa.VerifyASN1(pub, digest[:], sig) {
+			t.Error("The signed message does not verify with crypto/ecdsa")
+		}
+		msg[len(msg)-1] ^= 1
+		digest = sha256.Sum256(msg)
+		if ecdsa.VerifyASN1(pub, digest[:], sig) {
+			t.Error("A modified message unexpectedly verifies")
+		}
+
+		if _, _, _, err := e.SignedMessage("nonexistent", s.Certs[0]); err == nil {
+			t.Error("SignedMessage unexpectedly succeeded for an unknown label")
+		}
+		other := *s.Certs[0]
+		other.Raw = append([]byte{}, other.Raw...)
+		other.Raw[len(other.Raw)-1] ^= 1
+		if _, _, _, err := e.SignedMessage("label", &other); err == nil {
+			t.Error("SignedMessage unexpectedly succeeded for another certificate")
+		}
+	})
+}
+
+func TestSignedMessageCustomContextString(t *testing.T) {
+	const context = "HTTP Exchange 1 experiment"
+	testForEachVersion(t, func(ver version.Version, t *testing.T) {
+		e, s, _ := createTestExchange(ver, t)
+		s.ContextString = context
+		s.Experimental = true
+		if err := e.AddSignatureHeader(s); err != nil {
+			t.Fatal(err)
+		}
+		pub := s.Certs[0].PublicKey.(*ecdsa.PublicKey)
+
+		msg, sig, _, err := e.SignedMessage("label", s.Certs[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		digest := sha256.Sum256(msg)
+		if ecdsa.VerifyASN1(pub, digest[:], sig) {
+			t.Error("The signed message unexpectedly verifies without the custom context string")
+		}
+
+		msg, sig, _, err = e.SignedMessage("label", s.Certs[0], WithContextString(context))
+		if err != nil {
+			t.Fatal(err)
+		}
+		digest = sha256.Sum256(msg)
+		if !ecdsa.VerifyASN1(pub, digest[:], sig) {
+			t.Error("The signed message does not verify with the custom context string")
+		}
+	})
+}
+
+func TestParseSignatureHeaderBytes(t *testing.T) {
+	testForEachVersion(t, func(ver version.Version, t *testing.T) {
+		e, s, _ := createTestExchange(ver, t)
+		if err := e.AddSignatureHeader(s); err != nil {
+			t.Fatal(err)
+		}
+
+		params, err := ParseSignatureHeaderBytes([]byte(e.SignatureHeaderValue), ver)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(params.Signatures) != 1 {
+			t.Fatalf("got %d signatures, want 1", len(params.Signatures))
+		}
+		sig := params.Signatures[0]
+		if sig.Label != "label" || sig.CertUrl != "https://example.com/cert.msg" || sig.Date != signatureDate.Unix() || sig.Expires != signatureDate.Add(1*time.Hour).Unix() {
+			t.Errorf("unexpected signature: %+v", sig)
+		}
+
+		other := strings.Replace(e.SignatureHeaderValue, "label;", "other;", 1)
+		other = strings.Replace(other, "https://example.com/cert.msg", "https://example.com/other.msg", 1)
+		params, err = ParseSignatureHeaderBytes([]byte(e.SignatureHeaderValue+", "+other), ver)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(params.Signatures) != 2 {
+			t.Fatalf("got %d signatures, want 2", len(params.Signatures))
+		}
+		if params.Signatures[1].Label != "other" || params.Signatures[1].CertUrl != "https://example.com/other.msg" {
+			t.Errorf("unexpected second signature: %+v", params.Signatures[1])
+		}
+
+		if _, err := ParseSignatureHeaderBytes([]byte(strings.Replace(e.SignatureHeaderValue, "cert-url", "x-cert-url", 1)), ver); err == nil {
+			t.Error("signature without cert-url unexpectedly accepted")
+		}
+	})
+
+	e, s, _ := createTestExchange(version.Version1b1, t)
+	if err := e.AddSignatureHeader(s); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ParseSignatureHeaderBytes([]byte(e.SignatureHeaderValue), version.Version1b3); err == nil {
+		t.Error("signature with the integrity of another version unexpectedly accepted")
+	}
+}
+
+func TestSignatureBytes(t *testing.T) {
+	testForEachVersion(t, func(ver version.Version, t *testing.T) {
+		e, s, _ := createTestExchange(ver, t)
+		s.Algorithm = &signingalgorithm.MockSigningAlgorithm{}
+		if err := e.AddSignatureHeader(s); err != nil {
+			t.Fatal(err)
+		}
+
+		var buf bytes.Buffer
+		if err := e.Write(&buf); err != nil {
+			t.Fatal(err)
+		}
+		got, err := ReadExchange(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// MockSigningAlgorithm signs by taking the SHA-256 of the message.
+		var msg bytes.Buffer
+		if err := got.DumpSignedMessage(&msg, s); err != nil {
+			t.Fatal(err)
+		}
+		want := sha256.Sum256(msg.Bytes())
+
+		sig, err := got.SignatureBytes("label")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(sig, want[:]) {
+			t.Errorf("SignatureBytes: got %v, want %v", sig, want)
+		}
+
+		if _, err := got.SignatureBytes("nonexistent"); err == nil {
+			t.Error("SignatureBytes unexpectedly succeeded for unknown label")
+		}
+	})
+}
+
+func TestValidateServingURL(t *testing.T) {
+	testForEachVersion(t, func(ver version.Version, t *testing.T) {
+		e, _, _ := createTestExchange(ver, t)
+		if err := e.ValidateServingURL("https://cdn.example.net/example.com/index.sxg"); err != nil {
+			t.Errorf("ValidateServingURL unexpectedly failed: %v", err)
+		}
+		for _, u := range []string{requestUrl, "https://EXAMPLE.com/", "https://example.com/#frag"} {
+			if err := e.ValidateServingURL(u); err == nil {
+				t.Errorf("ValidateServingURL(%q) unexpectedly succeeded for a looping exchange", u)
+			}
+		}
+	})
+}
+
+func createTestExchange(ver version.Version, t testing.TB) (e *Exchange, s *Signer, certBytes []byte) {
+	header := http.Header{}
+	header.Add("Content-Type", "text/html; charset=utf-8")
+
+	e = NewExchange(ver, requestUrl, http.MethodGet, nil, 200, header, []byte(payload))
+	if err := e.MiEncodePayload(16); err != nil {
+		t.Fatal(err)
+	}
+
+	certs, err := signingalgorithm.ParseCertificates([]byte(pemCerts))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	privKey, err := signingalgorithm.ParsePrivateKey([]byte(pemPrivateKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	certUrl, _ := url.Parse("https://example.com/cert.msg")
+	validityUrl, _ := url.Parse("https://example.com/resource.validity")
+	s = &Signer{
+		Date:        signatureDate,
+		Expires:     signatureDate.Add(1 * time.Hour),
+		Certs:       certs,
+		CertUrl:     certUrl,
+		ValidityUrl: validityUrl,
+		PrivKey:     privKey,
+	}
+
+	// The certificate is self-signed, so it also signs its OCSP response.
+	ocspDER, err := ocsp.CreateResponse(certs[0], certs[0], ocsp.Response{
+		Status:       ocsp.Good,
+		SerialNumber: certs[0].SerialNumber,
+		ThisUpdate:   signatureDate.Add(-1 * time.Hour),
+	}, privKey.(crypto.Signer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	certChain, err := certurl.NewCertChain(certs, ocspDER, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var certCBOR bytes.Buffer
+	if err := certChain.Write(&certCBOR); err != nil {
+		t.Fatal(err)
+	}
+	certBytes = certCBOR.Bytes()
+	return
+}
+
+func verificationShouldSucceed(t *testing.T, e *Exchange, certBytes []byte, verificationTime time.Time) {
+	certFetcher := func(_ string) ([]byte, error) { return certBytes, nil }
+	if _, ok := e.Verify(verificationTime, certFetcher, stdoutLogger); !ok {
+		t.Errorf("Verification should succeed")
+	}
+}
+
+func verificationShouldFail(t *testing.T, e *Exchange, certBytes []byte, verificationTime time.Time) {
+	certFetcher := func(_ string) ([]byte, error) { return certBytes, nil }
+	if _, ok := e.Verify(verificationTime, certFetcher, nullLogger); ok {
+		t.Errorf("Verification should fail")
+	}
+}
+
+func TestVerifyMaxDecodedPayloadSize(t *testing.T) {
+	testForEachVersion(t, func(ver version.Version, t *testing.T) {
+		e, s, c := createTestExchange(ver, t)
+		if err := e.AddSignatureHeader(s); err != nil {
+			t.Fatal(err)
+		}
+		certFetcher := func(_ string) ([]byte, error) { return c, nil }
+		if _, err := e.VerifyWithError(signatureDate, certFetcher, WithMaxDecodedPayloadSize(int64(len(payload)))); err != nil {
+			t.Errorf("Verification of a payload at the limit failed: %v", err)
+		}
+		_, err := e.VerifyWithError(signatureDate, certFetcher, WithMaxDecodedPayloadSize(int64(len(payload)-1)))
+		if !errors.Is(err, ErrPayloadIntegrity) || !errors.Is(err, mice.ErrTooLarge) {
+			t.Errorf("got error %v for a payload over the limit, want one wrapping ErrPayloadIntegrity and mice.ErrTooLarge", err)
+		}
+	})
+}
+
+func TestVerify(t *testing.T) {
+	testForEachVersion(t, func(ver version.Version, t *testing.T) {
+		e, s, c := createTestExchange(ver, t)
+		if err := e.AddSignatureHeader(s); err != nil {
+			t.Fatal(err)
+		}
+		verificationShouldSucceed(t, e, c, signatureDate)
+	})
+}
+
+func TestReadExchangeLeadingBytes(t *testing.T) {
+	testForEachVersion(t, func(ver version.Version, t *testing.T) {
+		e, s, _ := createTestExchange(ver, t)
+		if err := e.AddSignatureHeader(s); err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		if err := e.Write(&buf); err != nil {
+			t.Fatal(err)
+		}
+
+		bom := append([]byte{0xef, 0xbb, 0xbf}, buf.Bytes()...)
+		got, err := ReadExchange(bytes.NewReader(bom))
+		if err != nil {
+			t.Fatalf("BOM-prefixed exchange: %v", err)
+		}
+		signedexchangetest.AssertExchangeEqual(t, got, e)
+
+		whitespace := append([]byte(" \n"), buf.Bytes()...)
+		_, err = ReadExchange(bytes.NewReader(whitespace))
+		if err == nil {
+			t.Fatal("whitespace-prefixed exchange unexpectedly read")
+		}
+		if want := "unexpected leading bytes before magic: 200a737867312d62"; !strings.Contains(err.Error(), want) {
+			t.Errorf("Unexpected error %q, want it to contain %q", err, want)
+		}
+	})
+}
+
+func TestReadExchangeLenient(t *testing.T) {
+	testForEachVersion(t, func(ver version.Version, t *testing.T) {
+		e, s, c := createTestExchange(ver, t)
+		if err := e.AddSignatureHeader(s); err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		if err := e.Write(&buf); err != nil {
+			t.Fatal(err)
+		}
+		// Upper-case header names are well-formed CBOR, but not canonical.
+		bs := bytes.Replace(buf.Bytes(), []byte("content-type"), []byte("Content-Type"), 1)
+		if bytes.Equal(bs, buf.Bytes()) {
+			t.Fatal("test case did not modify the exchange")
+		}
+
+		if _, err := ReadExchange(bytes.NewReader(bs)); err == nil {
+			t.Error("ReadExchange unexpectedly accepted a nonconformant exchange")
+		}
+
+		got, err := ReadExchangeLenient(bytes.NewReader(bs))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got.ReadWarnings) != 1 {
+			t.Errorf("Unexpected ReadWarnings: %q", got.ReadWarnings)
+		}
+		verificationShouldFail(t, got, c, signatureDate)
+
+		conformant, err := ReadExchangeLenient(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(conformant.ReadWarnings) != 0 {
+			t.Errorf("Unexpected ReadWarnings: %q", conformant.ReadWarnings)
+		}
+		verificationShouldSucceed(t, conformant, c, signatureDate)
+	})
+}
+
+func TestMinimizeExchange(t *testing.T) {
+	testForEachVersion(t, func(ver version.Version, t *testing.T) {
+		e, s, _ := createTestExchange(ver, t)
+		e.RequestHeaders = http.Header{"Accept": {"*/*"}}
+		e.ResponseHeaders.Add("Cache-Control", "max-age=300")
+		e.ResponseHeaders.Add("Link", "</style.css>;rel=preload;as=style")
+		e.ResponseHeaders.Add("X-Debug", "1")
+		if err := e.AddSignatureHeader(s); err != nil {
+			t.Fatal(err)
+		}
+
+		m := MinimizeExchange(e)
+		for _, name := range []string{"Link", "X-Debug"} {
+			if m.ResponseHeaders.Get(name) != "" {
+				t.Errorf("%s header was not removed", name)
+			}
+			if e.ResponseHeaders.Get(name) == "" {
+				t.Errorf("%s header was removed from the original exchange", name)
+			}
+		}
+		for _, name := range []string{"Content-Type", "Content-Encoding", "Cache-Control", ver.MiceEncoding().DigestHeaderName()} {
+			if got, want := m.ResponseHeaders.Get(name), e.ResponseHeaders.Get(name); got != want {
+				t.Errorf("%s header: got %q, want %q", name, got, want)
+			}
+		}
+		if len(m.RequestHeaders) != 0 {
+			t.Errorf("Unexpected request headers: %v", m.RequestHeaders)
+		}
+		if changes := m.HeaderChangesSinceSigning(); len(changes) == 0 {
+			t.Error("HeaderChangesSinceSigning of the minimized exchange reported no change")
+		}
+		if changes := e.HeaderChangesSinceSigning(); len(changes) != 0 {
+			t.Errorf("HeaderChangesSinceSigning of the original exchange: %q", changes)
+		}
+
+		var buf bytes.Buffer
+		if err := m.Write(&buf); err != nil {
+			t.Fatal(err)
+		}
+		got, err := ReadExchange(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		signedexchangetest.AssertExchangeEqual(t, got, m)
+
+		// The payload of a lazy exchange is produced for the original only.
+		produced := 0
+		lazy := NewExchangeLazy(ver, requestUrl, http.MethodGet, nil, 200, http.Header{"Content-Type": {"text/html; charset=utf-8"}}, func() (io.Reader, error) {
+			produced++
+			return strings.NewReader(payload), nil
+		})
+		if err := MinimizeExchange(lazy).MiEncodePayload(16); err != nil {
+			t.Fatal(err)
+		}
+		if err := lazy.MiEncodePayload(16); err != nil {
+			t.Fatal(err)
+		}
+		if produced != 1 || !bytes.Equal(lazy.Payload, e.Payload) {
+			t.Errorf("Lazy payload was produced %d times, want once for the original exchange", produced)
+		}
+	})
+}
+
+func TestReadExchangeContentEncodingMismatch(t *testing.T) {
+	e, s, _ := createTestExchange(version.Version1b3, t)
+	if enc, err := e.MiceEncoding(); err != nil || enc != mice.Draft03Encoding {
+		t.Errorf("MiceEncoding() = %q, %v, want %q", enc, err, mice.Draft03Encoding)
+	}
+	// A producer bug: the payload of a 1b3 exchange labeled with the encoding
+	// of 1b1.
+	e.ResponseHeaders.Set("Content-Encoding", string(mice.Draft02Encoding))
+	if err := e.AddSignatureHeader(s); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := e.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ReadExchange(bytes.NewReader(buf.Bytes())); err == nil {
+		t.Error("ReadExchange unexpectedly accepted a Content-Encoding of another version")
+	}
+
+	got, err := ReadExchangeLenient(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got.ReadWarnings) != 1 {
+		t.Errorf("Unexpected ReadWarnings: %q", got.ReadWarnings)
+	}
+	if enc, err := got.MiceEncoding(); err != nil || enc != mice.Draft02Encoding {
+		t.Errorf("MiceEncoding() = %q, %v, want %q", enc, err, mice.Draft02Encoding)
+	}
+}
+
+func TestReadExchangeDigestMismatch(t *testing.T) {
+	testForEachVersion(t, func(ver version.Version, t *testing.T) {
+		enc := ver.MiceEncoding()
+		name := enc.DigestHeaderName()
+		// The proof format of another version.
+		other := mice.Draft02Encoding
+		if enc == other {
+			other = mice.Draft03Encoding
+		}
+		cases := []struct {
+			name   string
+			modify func(h http.Header)
+			want   string
+		}{
+			{"other algorithm", func(h http.Header) {
+				h.Set(name, strings.Replace(h.Get(name), string(enc), string(other), 1))
+			}, fmt.Sprintf("has the algorithm %q", other)},
+			{"absent", func(h http.Header) {
+				h.Del(name)
+			}, "header is absent"},
+		}
+		for _, c := range cases {
+			e, s, certBytes := createTestExchange(ver, t)
+			c.modify(e.ResponseHeaders)
+			if err := e.AddSignatureHeader(s); err != nil {
+				t.Fatal(err)
+			}
+
+			var logBuf bytes.Buffer
+			certFetcher := func(_ string) ([]byte, error) { return certBytes, nil }
+			if _, ok := e.Verify(signatureDate, certFetcher, log.New(&logBuf, "", 0)); ok {
+				t.Errorf("%s: Verify unexpectedly succeeded", c.name)
+			}
+			if !strings.Contains(logBuf.String(), c.want) {
+				t.Errorf("%s: Verify did not log %q: %q", c.name, c.want, logBuf.String())
+			}
+
+			var buf bytes.Buffer
+			if err := e.Write(&buf); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := ReadExchange(bytes.NewReader(buf.Bytes())); err == nil || !strings.Contains(err.Error(), c.want) {
+				t.Errorf("%s: ReadExchange: got error %v, want one containing %q", c.name, err, c.want)
+			}
+			got, err := ReadExchangeLenient(bytes.NewReader(buf.Bytes()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got.ReadWarnings) != 1 {
+				t.Errorf("%s: Unexpected ReadWarnings: %q", c.name, got.ReadWarnings)
+			}
+		}
+	})
+}
+
+func TestEffectiveValidUntil(t *testing.T) {
+	e, s, _ := createTestExchange(version.Version1b3, t)
+	if err := e.AddSignatureHeader(s); err != nil {
+		t.Fatal(err)
+	}
+	leaf := s.Certs[0]
+
+	// The signature of the OCSP response is not checked, so any key will do.
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nextUpdate := signatureDate.Add(30 * time.Minute)
+	ocspDER, err := ocsp.CreateResponse(leaf, leaf, ocsp.Response{
+		Status:       ocsp.Good,
+		SerialNumber: leaf.SerialNumber,
+		ThisUpdate:   signatureDate,
+		NextUpdate:   nextUpdate,
+	}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name  string
+		chain certurl.CertChain
+		want  time.Time
+	}{
+		{"expires", certurl.CertChain{{Cert: leaf}}, s.Expires},
+		{"OCSP nextUpdate", certurl.CertChain{{Cert: leaf, OCSPResponse: ocspDER}}, nextUpdate},
+	}
+	for _, c := range cases {
+		got, err := e.EffectiveValidUntil(c.chain)
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+		if !got.Equal(c.want) {
+			t.Errorf("%s: got %v, want %v", c.name, got, c.want)
+		}
+	}
+
+	// The certificate's NotAfter is binding once the signature outlives it.
+	s.Date = leaf.NotAfter.Add(-time.Hour)
+	s.Expires = leaf.NotAfter.Add(time.Hour)
+	if err := e.AddSignatureHeader(s); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := e.EffectiveValidUntil(certurl.CertChain{{Cert: leaf}}); err != nil || !got.Equal(leaf.NotAfter) {
+		t.Errorf("NotAfter: got (%v, %v), want %v", got, err, leaf.NotAfter)
+	}
+
+	other := *leaf
+	other.Raw = append([]byte{0}, leaf.Raw...)
+	if _, err := e.EffectiveValidUntil(certurl.CertChain{{Cert: &other}}); err == nil {
+		t.Error("EffectiveValidUntil unexpectedly succeeded for a different certificate")
+	}
+}
+
+func TestHTTPCertFetcher(t *testing.T) {
+	_, _, certBytes := createTestExchange(version.Version1b3, t)
+	requests := 0
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		switch r.URL.Path {
+		case "/cert.cbor":
+			w.Header().Set("Content-Type", "application/cert-chain+cbor")
+		case "/cert.txt":
+			w.Header().Set("Content-Type", "text/plain")
+		default:
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(certBytes)
+	}))
+	defer server.Close()
+
+	fetch := NewHTTPCertFetcher(server.Client(), int64(len(certBytes)))
+	got, err := fetch(server.URL + "/cert.cbor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, certBytes) {
+		t.Error("Unexpected cert chain")
+	}
+	for _, path := range []string{"/cert.txt", "/missing"} {
+		if _, err := fetch(server.URL + path); err == nil {
+			t.Errorf("%s: fetch unexpectedly succeeded", path)
+		}
+	}
+	small := NewHTTPCertFetcher(server.Client(), int64(len(certBytes)-1))
+	if _, err := small(server.URL + "/cert.cbor"); err == nil {
+		t.Error("fetch of a too large cert chain unexpectedly succeeded")
+	}
+	// Like HTTPCertFetcher, it only fetches https URLs.
+	insecure := strings.Replace(server.URL, "https://", "http://", 1) + "/cert.cbor"
+	if _, err := fetch(insecure); err == nil {
+		t.Error("fetch of an http URL unexpectedly succeeded")
+	}
+
+	requests = 0
+	cached := NewCachingCertFetcher(fetch, time.Hour)
+	for i := 0; i < 2; i++ {
+		if _, err := cached(server.URL + "/cert.cbor"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := cached(server.URL + "/missing"); err == nil {
+			t.Error("fetch unexpectedly succeeded")
+		}
+	}
+	if requests != 3 {
+		t.Errorf("Got %d requests, want 3", requests)
+	}
+}
+
+func TestHTTPCertFetcherCachingAndRetries(t *testing.T) {
+	_, _, certBytes := createTestExchange(version.Version1b3, t)
+	var mu sync.Mutex
+	requests := map[string]int{}
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests[r.URL.Path]++
+		n := requests[r.URL.Path]
+		mu.Unlock()
+		switch {
+		case r.URL.Path == "/flaky" && n == 1:
+			http.Error(w, "try again", http.StatusServiceUnavailable)
+		case r.URL.Path == "/flaky" || r.URL.Path == "/cert.cbor":
+			w.Header().Set("Content-Type", "application/cert-chain+cbor")
+			w.Write(certBytes)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+	countRequests := func(path string) int {
+		mu.Lock()
+		defer mu.Unlock()
+		return requests[path]
+	}
+
+	// The OCSP response of the test cert chain has a thisUpdate an hour
+	// before signatureDate, so it can be used until 6 days and 23 hours
+	// after signatureDate.
+	now := signatureDate.Add(6*24*time.Hour + 22*time.Hour)
+	f := &HTTPCertFetcher{
+		Client:     server.Client(),
+		RetryDelay: time.Millisecond,
+		Now:        func() time.Time { return now },
+	}
+	for i := 0; i < 2; i++ {
+		got, err := f.Fetch(server.URL + "/flaky")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, certBytes) {
+			t.Error("unexpected cert chain")
+		}
+	}
+	if n := countRequests("/flaky"); n != 2 {
+		t.Errorf("got %d requests for a cert chain failing once, want 2", n)
+	}
+
+	if _, err := f.Fetch(server.URL + "/cert.cbor"); err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(59 * time.Minute)
+	if _, err := f.Fetch(server.URL + "/cert.cbor"); err != nil {
+		t.Fatal(err)
+	}
+	if n := countRequests("/cert.cbor"); n != 1 {
+		t.Errorf("got %d requests before the OCSP response is due, want 1", n)
+	}
+	now = now.Add(2 * time.Minute)
+	if _, err := f.Fetch(server.URL + "/cert.cbor"); err != nil {
+		t.Fatal(err)
+	}
+	if n := countRequests("/cert.cbor"); n != 2 {
+		t.Errorf("got %d requests after the OCSP response is due, want 2", n)
+	}
+
+	if _, err := f.Fetch(server.URL + "/missing"); err == nil {
+		t.Error("fetching a missing cert chain unexpectedly succeeded")
+	}
+	if n := countRequests("/missing"); n != 1 {
+		t.Errorf("got %d requests for a missing cert chain, want 1", n)
+	}
+	if _, err := f.Fetch(strings.Replace(server.URL, "https:", "http:", 1) + "/cert.cbor"); err == nil {
+		t.Error("fetching an http cert-url unexpectedly succeeded")
+	}
+	dataURL := "data:application/cert-chain+cbor;base64," + base64.StdEncoding.EncodeToString(certBytes)
+	if got, err := f.Fetch(dataURL); err != nil || !bytes.Equal(got, certBytes) {
+		t.Errorf("fetching a data cert-url: %v", err)
+	}
+}
+
+func TestVerifyContext(t *testing.T) {
+	e, s, certBytes := createTestExchange(version.Version1b3, t)
+	if err := e.AddSignatureHeader(s); err != nil {
+		t.Fatal(err)
+	}
+	fetch := CertFetcher(func(_ string) ([]byte, error) { return certBytes, nil })
+	result, err := e.VerifyContext(context.Background(), signatureDate, fetch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(result.Payload) != payload {
+		t.Error("unexpected payload")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = e.VerifyContext(ctx, signatureDate, fetch)
+	if !errors.Is(err, ErrCertFetch) || !errors.Is(err, context.Canceled) {
+		t.Errorf("got error %v with a cancelled context, want one wrapping ErrCertFetch and context.Canceled", err)
+	}
+
+	// Fetches that honor the context are interrupted.
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+	e.SignatureHeaderValue = strings.Replace(e.SignatureHeaderValue, "https://example.com/cert.msg", server.URL+"/cert.cbor", 1)
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = e.VerifyContext(ctx, signatureDate, NewHTTPContextCertFetcher(server.Client(), 0))
+	if !errors.Is(err, ErrCertFetch) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got error %v with a timed out fetch, want one wrapping ErrCertFetch and context.DeadlineExceeded", err)
+	}
+}
+
+func TestLocalCertFetcher(t *testing.T) {
+	_, _, certBytes := createTestExchange(version.Version1b3, t)
+	path := filepath.Join(t.TempDir(), "cert.cbor")
+	if err := ioutil.WriteFile(path, certBytes, 0644); err != nil {
+		t.Fatal(err)
+	}
+	urls := []string{
+		"data:application/cert-chain+cbor;base64," + base64.StdEncoding.EncodeToString(certBytes),
+		(&url.URL{Scheme: "file", Path: path}).String(),
+	}
+	for _, u := range urls {
+		got, err := LocalCertFetcher(u)
+		if err != nil {
+			t.Errorf("%s: %v", u, err)
+			continue
+		}
+		if !bytes.Equal(got, certBytes) {
+			t.Errorf("%s: unexpected cert chain", u)
+		}
+	}
+	if _, err := LocalCertFetcher("https://example.com/cert.msg"); err == nil {
+		t.Error("LocalCertFetcher unexpectedly fetched an https URL")
+	}
+}
+
+func TestDump(t *testing.T) {
+	e, s, _ := createTestExchange(version.Version1b3, t)
+	if err := e.AddSignatureHeader(s); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := e.Dump(&buf, true); err != nil {
+		t.Fatal(err)
+	}
+	got := buf.String()
+	for _, want := range []string{
+		"format version: 1b3\n",
+		"  uri: https://example.com/\n",
+		"  status: 200\n",
+		"    Content-Type: text/html; charset=utf-8\n",
+		"signature label:\n",
+		"  cert-url: https://example.com/cert.msg\n",
+		fmt.Sprintf("  expires: %d (", s.Expires.Unix()),
+		fmt.Sprintf("payload: %d bytes, mi-sha256-03, record size 16, 28 records\n", len(e.Payload)),
+		"  record 0: offset 8, 16 bytes, proof ",
+		"matches the Digest header",
+		"  record 27: offset 1304, 13 bytes, proof ",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("Dump output does not contain %q:\n%s", want, got)
+		}
+	}
+
+	// Broken exchanges are described as well.
+	e.Payload[len(e.Payload)-1] ^= 1
+	e.SignatureHeaderValue = "not a signature"
+	buf.Reset()
+	if err := e.Dump(&buf, true); err != nil {
+		t.Fatal(err)
+	}
+	got = buf.String()
+	for _, want := range []string{"cannot parse", "does not match the encoded proof"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("Dump output does not contain %q:\n%s", want, got)
+		}
+	}
+}
+
+func TestDumpJSON(t *testing.T) {
+	e, s, _ := createTestExchange(version.Version1b3, t)
+	if err := e.AddSignatureHeader(s); err != nil {
+		t.Fatal(err)
+	}
+	var buf, again bytes.Buffer
+	if err := e.DumpJSON(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.DumpJSON(&again); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), again.Bytes()) {
+		t.Errorf("DumpJSON output is not stable:\n%s\n%s", buf.Bytes(), again.Bytes())
+	}
+
+	var got struct {
+		Version string
+		Request struct {
+			Method  *string
+			URI     string
+			Headers map[string][]string
+		}
+		Response struct {
+			Status  int
+			Headers map[string][]string
+		}
+		Signatures []struct {
+			Label  string
+			Params map[string]interface{}
+		}
+		HeaderIntegrity string
+		Payload         struct {
+			Size            int
+			SHA256          []byte
+			ContentEncoding string
+			Digest          string
+			RecordSize      uint64
+		}
+	}
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	headerIntegrity, err := e.ComputeHeaderIntegrity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(e.Payload)
+	for _, c := range []struct {
+		name      string
+		got, want interface{}
+	}{
+		{"version", got.Version, "1b3"},
+		{"request method", got.Request.Method, (*string)(nil)},
+		{"request uri", got.Request.URI, requestUrl},
+		{"response status", got.Response.Status, 200},
+		{"response headers", got.Response.Headers, map[string][]string(e.ResponseHeaders)},
+		{"signatures", len(got.Signatures), 1},
+		{"header integrity", got.HeaderIntegrity, headerIntegrity},
+		{"payload size", got.Payload.Size, len(e.Payload)},
+		{"payload sha256", got.Payload.SHA256, sum[:]},
+		{"payload content encoding", got.Payload.ContentEncoding, "mi-sha256-03"},
+		{"payload digest", got.Payload.Digest, e.ResponseHeaders.Get("Digest")},
+		{"payload record size", got.Payload.RecordSize, uint64(16)},
+	} {
+		if !reflect.DeepEqual(c.got, c.want) {
+			t.Errorf("%s: got %v, want %v", c.name, c.got, c.want)
+		}
+	}
+	if len(got.Signatures) == 1 {
+		sig := got.Signatures[0]
+		if sig.Label != "label" || sig.Params["cert-url"] != "https://example.com/cert.msg" || sig.Params["expires"] != float64(s.Expires.Unix()) {
+			t.Errorf("got signature %v", sig)
+		}
+	}
+
+	// Broken exchanges are described as well.
+	e.SignatureHeaderValue = "not a signature"
+	buf.Reset()
+	if err := e.DumpJSON(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), `"signatureError": "`) {
+		t.Errorf("DumpJSON output does not have a signatureError:\n%s", buf.String())
+	}
+}
+
+func TestVerifyAtTimes(t *testing.T) {
+	testForEachVersion(t, func(ver version.Version, t *testing.T) {
+		e, s, c := createTestExchange(ver, t)
+		if err := e.AddSignatureHeader(s); err != nil {
+			t.Fatal(err)
+		}
+		fetches := 0
+		certFetcher := func(_ string) ([]byte, error) {
+			fetches++
+			return c, nil
+		}
+
+		date := s.Date
+		midpoint := s.Date.Add(s.Expires.Sub(s.Date) / 2)
+		afterExpires := s.Expires.Add(1 * time.Second)
+		got := e.VerifyAtTimes([]time.Time{date, midpoint, afterExpires}, certFetcher, nullLogger)
+		want := map[time.Time]bool{date: true, midpoint: true, afterExpires: false}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("VerifyAtTimes() = %v, want %v", got, want)
+		}
+		if fetches != 1 {
+			t.Errorf("certificate was fetched %d times, want 1", fetches)
+		}
+	})
+}
+
+func TestVerifyCustomContextString(t *testing.T) {
+	const context = "HTTP Exchange 1 experiment"
+	testForEachVersion(t, func(ver version.Version, t *testing.T) {
+		e, s, c := createTestExchange(ver, t)
+		s.ContextString = context
+		if err := e.AddSignatureHeader(s); err == nil {
+			t.Fatal("custom context string unexpectedly allowed without Experimental")
+		}
+
+		s.Experimental = true
+		if err := e.AddSignatureHeader(s); err != nil {
+			t.Fatal(err)
+		}
+		verificationShouldFail(t, e, c, signatureDate)
+
+		certFetcher := func(_ string) ([]byte, error) { return c, nil }
+		if _, ok := e.Verify(signatureDate, certFetcher, stdoutLogger, WithContextString(context)); !ok {
+			t.Errorf("Verification with the custom context string should succeed")
+		}
+	})
+}
+
+func TestVerifyMalformedSignatureHeader(t *testing.T) {
+	testForEachVersion(t, func(ver version.Version, t *testing.T) {
+		e, s, c := createTestExchange(ver, t)
+		if err := e.AddSignatureHeader(s); err != nil {
+			t.Fatal(err)
+		}
+		valid := e.SignatureHeaderValue
+		cases := []struct {
+			name, old, new string
+		}{
+			{"missing closing '*'", "*;cert-url", ";cert-url"},
+			{"bad base64", "cert-sha256=*", "cert-sha256=*_"},
+			{"unquoted URL", `cert-url="https://example.com/cert.msg"`, "cert-url=https://example.com/cert.msg"},
+		}
+		for _, tc := range cases {
+			e.SignatureHeaderValue = strings.Replace(valid, tc.old, tc.new, 1)
+			if e.SignatureHeaderValue == valid {
+				t.Fatalf("%s: test case did not modify the signature header", tc.name)
+			}
+			verificationShouldFail(t, e, c, signatureDate)
+		}
+	})
+}
+
+func TestVerifyNonDefaultRecordSize(t *testing.T) {
+	testForEachVersion(t, func(ver version.Version, t *testing.T) {
+		const recordSize = 4096
+		e, s, c := createTestExchange(ver, t)
+		e.Payload = bytes.Repeat([]byte(payload), 30)
+		e.ResponseHeaders.Del("Content-Encoding")
+		e.ResponseHeaders.Del(ver.MiceEncoding().DigestHeaderName())
+		if err := e.MiEncodePayload(recordSize); err != nil {
+			t.Fatal(err)
+		}
+		if err := e.AddSignatureHeader(s); err != nil {
+			t.Fatal(err)
+		}
+
+		var buf bytes.Buffer
+		if err := e.Write(&buf); err != nil {
+			t.Fatal(err)
+		}
+		got, err := ReadExchange(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		size, err := got.MIRecordSize()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if size != recordSize {
+			t.Errorf("MIRecordSize: got %d, want %d", size, recordSize)
+		}
+		verificationShouldSucceed(t, got, c, signatureDate)
+	})
+}
+
+func TestMiEncodePayloadSHA512(t *testing.T) {
+	testForEachVersion(t, func(ver version.Version, t *testing.T) {
+		e, s, c := createTestExchange(ver, t)
+		e.Payload = []byte(payload)
+		e.ResponseHeaders.Del("Content-Encoding")
+		e.ResponseHeaders.Del(ver.MiceEncoding().DigestHeaderName())
+		err := e.MiEncodePayloadWithEncoding(16, mice.Draft03SHA512Encoding)
+		if ver != version.Version1b3 {
+			if err == nil {
+				t.Errorf("mi-sha512-03 unexpectedly accepted for version %s", ver)
+			}
+			return
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := e.ResponseHeaders.Get("Digest"); !strings.HasPrefix(got, "mi-sha512-03=") {
+			t.Errorf("Unexpected Digest header: %q", got)
+		}
+		if err := e.AddSignatureHeader(s); err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(e.SignatureHeaderValue, `integrity="digest/mi-sha512-03"`) {
+			t.Errorf("Unexpected signature header: %s", e.SignatureHeaderValue)
+		}
+
+		var buf bytes.Buffer
+		if err := e.Write(&buf); err != nil {
+			t.Fatal(err)
+		}
+		got, err := ReadExchange(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		certFetcher := func(_ string) ([]byte, error) { return c, nil }
+		decoded, ok := got.Verify(signatureDate, certFetcher, stdoutLogger)
+		if !ok {
+			t.Fatal("Verification should succeed")
+		}
+		if !bytes.Equal(decoded, []byte(payload)) {
+			t.Errorf("Unexpected decoded payload: %q", decoded)
+		}
+
+		// The signature must match the encoding of the payload.
+		got.SignatureHeaderValue = strings.Replace(got.SignatureHeaderValue, "mi-sha512-03", "mi-sha256-03", 1)
+		verificationShouldFail(t, got, c, signatureDate)
+	})
+}
+
+// onlyReader hides all methods of the wrapped reader but Read.
+type onlyReader struct {
+	io.Reader
+}
+
+func TestMiEncodeStream(t *testing.T) {
+	for _, size := range []int{0, 1, 15, 16, 48, 50} {
+		for _, recordSize := range []int{16, 7} {
+			content := bytes.Repeat([]byte("0123456789"), 5)[:size]
+			e := NewExchange(version.Version1b3, requestUrl, http.MethodGet, nil, 200, http.Header{}, content)
+			if err := e.MiEncodePayload(recordSize); err != nil {
+				t.Fatal(err)
+			}
+			wantDigest := e.ResponseHeaders.Get("Digest")
+
+			for _, src := range []io.Reader{bytes.NewReader(content), onlyReader{bytes.NewReader(content)}} {
+				var buf bytes.Buffer
+				digest, err := MiEncodeStream(&buf, src, recordSize)
+				if err != nil {
+					t.Fatalf("size %d, record size %d, %T: %v", size, recordSize, src, err)
+				}
+				if digest != wantDigest {
+					t.Errorf("size %d, record size %d, %T: got digest %q, want %q", size, recordSize, src, digest, wantDigest)
+				}
+				if !bytes.Equal(buf.Bytes(), e.Payload) {
+					t.Errorf("size %d, record size %d, %T: encoded payload differs from MiEncodePayload", size, recordSize, src)
+				}
+			}
+		}
+	}
+
+	// A seekable source is read from its current offset.
+	src := bytes.NewReader([]byte("skipped" + payload))
+	src.Seek(int64(len("skipped")), io.SeekStart)
+	var buf bytes.Buffer
+	digest, err := MiEncodeStream(&buf, src, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if offset, _ := src.Seek(0, io.SeekCurrent); offset != int64(len("skipped")) {
+		t.Errorf("the offset of the source is %d after MiEncodeStream, want %d", offset, len("skipped"))
+	}
+	dec, err := mice.Draft03Encoding.NewDecoder(&buf, digest, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(dec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != payload {
+		t.Errorf("Unexpected decoded payload: %q", got)
+	}
+}
+
+func TestMiEncodePayloadAuto(t *testing.T) {
+	testForEachVersion(t, func(ver version.Version, t *testing.T) {
+		for _, size := range []int{0, 1317, 3*mice.MaxRecordSize + 1} {
+			content := bytes.Repeat([]byte("x"), size)
+			e := NewExchange(ver, requestUrl, http.MethodGet, nil, 200, http.Header{}, content)
+			if _, _, err := e.MiOverhead(); err == nil {
+				t.Errorf("size %d: MiOverhead unexpectedly succeeded before encoding", size)
+			}
+			if err := e.MiEncodePayloadAuto(); err != nil {
+				t.Fatal(err)
+			}
+			recordSize := mice.AutoRecordSize(size)
+			if got, err := e.MIRecordSize(); err != nil || (size > 0 && got != uint64(recordSize)) {
+				t.Errorf("size %d: got record size %d (err %v), want %d", size, got, err, recordSize)
+			}
+			records, extraBytes, err := e.MiOverhead()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := len(e.Payload) - size; extraBytes != want {
+				t.Errorf("size %d: got %d extra bytes, want %d", size, extraBytes, want)
+			}
+			wantRecords, wantExtraBytes := ver.MiceEncoding().Overhead(size, recordSize)
+			if records != wantRecords || extraBytes != wantExtraBytes {
+				t.Errorf("size %d: got overhead (%d, %d), want (%d, %d)", size, records, extraBytes, wantRecords, wantExtraBytes)
+			}
+		}
+	})
+}
+
+func TestMiEncodePayloadStream(t *testing.T) {
+	testForEachVersion(t, func(ver version.Version, t *testing.T) {
+		want, s, c := createTestExchange(ver, t)
+
+		path := filepath.Join(t.TempDir(), "payload")
+		if err := ioutil.WriteFile(path, []byte(payload), 0644); err != nil {
+			t.Fatal(err)
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+
+		// A reader that is not seekable is copied to a temporary file.
+		tmpDir := t.TempDir()
+		t.Setenv("TMPDIR", tmpDir)
+		tempFiles := func() int {
+			entries, err := ioutil.ReadDir(tmpDir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return len(entries)
+		}
+
+		for _, src := range []io.Reader{f, onlyReader{strings.NewReader(payload)}} {
+			header := http.Header{}
+			header.Add("Content-Type", "text/html; charset=utf-8")
+			e := NewExchange(ver, requestUrl, http.MethodGet, nil, 200, header, nil)
+			if err := e.MiEncodePayloadStream(src, 16); err != nil {
+				t.Fatal(err)
+			}
+			if src == f {
+				if offset, err := f.Seek(0, io.SeekCurrent); err != nil || offset != 0 {
+					t.Errorf("the offset of the file is %d (err %v) after MiEncodePayloadStream, want 0", offset, err)
+				}
+				if n := tempFiles(); n != 0 {
+					t.Errorf("got %d temporary files for a seekable reader, want 0", n)
+				}
+			} else if n := tempFiles(); n != 1 {
+				t.Errorf("got %d temporary files for a reader that is not seekable, want 1", n)
+			}
+			name := ver.MiceEncoding().DigestHeaderName()
+			if got, want := e.ResponseHeaders.Get(name), want.ResponseHeaders.Get(name); got != want {
+				t.Errorf("%T: got %s %q, want %q", src, name, got, want)
+			}
+			records, extraBytes, err := e.MiOverhead()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if records != 28 || extraBytes != len(want.Payload)-len(payload) {
+				t.Errorf("%T: got overhead (%d, %d), want (28, %d)", src, records, extraBytes, len(want.Payload)-len(payload))
+			}
+			if err := e.AddSignatureHeader(s); err != nil {
+				t.Fatal(err)
+			}
+			var buf bytes.Buffer
+			if err := e.Write(&buf); err != nil {
+				t.Fatal(err)
+			}
+			got, err := ReadExchange(&buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got.Payload, want.Payload) {
+				t.Errorf("%T: encoded payload differs from MiEncodePayload", src)
+			}
+			verificationShouldSucceed(t, got, c, signatureDate)
+			if err := e.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if n := tempFiles(); n != 0 {
+				t.Errorf("%T: got %d temporary files after Close, want 0", src, n)
+			}
+		}
+
+		// Write fails if the source changed after its proofs were calculated.
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			t.Fatal(err)
+		}
+		e := NewExchange(ver, requestUrl, http.MethodGet, nil, 200, http.Header{}, nil)
+		if err := e.MiEncodePayloadStream(f, 16); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(strings.ToUpper(payload)), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := e.Write(ioutil.Discard); err == nil {
+			t.Error("Write unexpectedly succeeded with a changed payload")
+		}
+	})
+}
+
+// maxWriteRecorder records the size of the largest write.
+type maxWriteRecorder struct {
+	max int
+}
+
+func (w *maxWriteRecorder) Write(p []byte) (int, error) {
+	if len(p) > w.max {
+		w.max = len(p)
+	}
+	return len(p), nil
+}
+
+func TestWritePrologue(t *testing.T) {
+	testForEachVersion(t, func(ver version.Version, t *testing.T) {
+		e, s, c := createTestExchange(ver, t)
+		if err := e.AddSignatureHeader(s); err != nil {
+			t.Fatal(err)
+		}
+		var whole, prologue bytes.Buffer
+		if err := e.Write(&whole); err != nil {
+			t.Fatal(err)
+		}
+		if err := e.WritePrologue(&prologue); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(append(prologue.Bytes(), e.Payload...), whole.Bytes()) {
+			t.Error("WritePrologue followed by the payload differs from Write")
+		}
+
+		// The payload is encoded to a file, and copied after the prologue.
+		if ver == version.Version1b3 {
+			f, err := ioutil.TempFile(t.TempDir(), "encoded")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			digest, err := MiEncodeStream(f, strings.NewReader(payload), 16)
+			if err != nil {
+				t.Fatal(err)
+			}
+			header := http.Header{}
+			header.Add("Content-Type", "text/html; charset=utf-8")
+			header.Add("Content-Encoding", "mi-sha256-03")
+			header.Add("Digest", digest)
+			e := NewExchange(ver, requestUrl, http.MethodGet, nil, 200, header, nil)
+			if err := e.AddSignatureHeader(s); err != nil {
+				t.Fatal(err)
+			}
+			var buf bytes.Buffer
+			if err := e.WritePrologue(&buf); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := f.Seek(0, io.SeekStart); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := io.Copy(&buf, f); err != nil {
+				t.Fatal(err)
+			}
+			got, err := ReadExchange(&buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			verificationShouldSucceed(t, got, c, signatureDate)
+		}
+
+		// A streamed payload is written a record at a time.
+		large := bytes.Repeat([]byte("x"), 1<<20)
+		e = NewExchange(ver, requestUrl, http.MethodGet, nil, 200, http.Header{}, nil)
+		if err := e.MiEncodePayloadStream(bytes.NewReader(large), 4096); err != nil {
+			t.Fatal(err)
+		}
+		var rec maxWriteRecorder
+		if err := e.Write(&rec); err != nil {
+			t.Fatal(err)
+		}
+		if rec.max > 4096 {
+			t.Errorf("largest write is %d bytes, want at most the record size", rec.max)
+		}
+	})
+}
+
+func TestDecodePayload(t *testing.T) {
+	testForEachVersion(t, func(ver version.Version, t *testing.T) {
+		e, s, c := createTestExchange(ver, t)
+		got, err := e.DecodePayload()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != payload {
+			t.Errorf("Unexpected decoded payload: %q", got)
+		}
+
+		records, err := ver.MiceEncoding().Records(e.Payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		e.Payload[records[5].Offset] ^= 1
+		_, err = e.DecodePayload()
+		var recordErr *mice.RecordError
+		if !errors.As(err, &recordErr) || recordErr.Record != 5 || recordErr.Offset != 5*16 {
+			t.Errorf("got error %v, want a *mice.RecordError for record 5", err)
+		}
+
+		if err := e.AddSignatureHeader(s); err != nil {
+			t.Fatal(err)
+		}
+		certFetcher := func(_ string) ([]byte, error) { return c, nil }
+		_, err = e.VerifyWithError(signatureDate, certFetcher)
+		if !errors.Is(err, ErrPayloadIntegrity) || !errors.As(err, &recordErr) {
+			t.Errorf("got error %v, want %v with a *mice.RecordError", err, ErrPayloadIntegrity)
+		}
+	})
+}
+
+func TestMiEncodePayloadWithOtherCoding(t *testing.T) {
+	testForEachVersion(t, func(ver version.Version, t *testing.T) {
+		header := http.Header{}
+		header.Add("Content-Type", "text/html; charset=utf-8")
+		header.Add("Content-Encoding", "gzip")
+		e := NewExchange(ver, requestUrl, http.MethodGet, nil, 200, header, []byte(payload))
+		if err := e.MiEncodePayload(4); err != nil {
+			t.Fatal(err)
+		}
+		if enc, err := e.MiceEncoding(); err != nil || enc != ver.MiceEncoding() {
+			t.Errorf("MiceEncoding: got %q, %v, want %q", enc, err, ver.MiceEncoding())
+		}
+		got, err := e.DecodePayload()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != payload {
+			t.Errorf("Unexpected decoded payload: %q", got)
+		}
+		if minVer, err := MinimalVersion(e); err != nil || !minVer.SupportsMiceEncoding(ver.MiceEncoding()) {
+			t.Errorf("MinimalVersion: got %q, %v, want a version supporting %q", minVer, err, ver.MiceEncoding())
+		}
+
+		resp, err := e.ToResponse()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := resp.Header.Get("Content-Encoding"); got != "gzip" {
+			t.Errorf("Content-Encoding: got %q, want %q", got, "gzip")
+		}
+
+		var buf bytes.Buffer
+		if err := e.Write(&buf); err != nil {
+			t.Fatal(err)
+		}
+		read, err := ReadExchange(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := read.DecodePayload(); err != nil {
+			t.Errorf("DecodePayload of the exchange read back: %v", err)
+		}
+	})
+}
+
+func TestToResponse(t *testing.T) {
+	testForEachVersion(t, func(ver version.Version, t *testing.T) {
+		e, _, _ := createTestExchange(ver, t)
+		e.ResponseHeaders.Set("Content-Encoding", "gzip, "+e.ResponseHeaders.Get("Content-Encoding"))
+		resp, err := e.ToResponse()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != 200 || resp.Status != "200 OK" {
+			t.Errorf("Unexpected status: %d %q", resp.StatusCode, resp.Status)
+		}
+		if resp.Request.URL.String() != requestUrl || resp.Request.Method != http.MethodGet {
+			t.Errorf("Unexpected request: %s %v", resp.Request.Method, resp.Request.URL)
+		}
+		if got := resp.Header.Get("Content-Encoding"); got != "gzip" {
+			t.Errorf("Content-Encoding: got %q, want %q", got, "gzip")
+		}
+		if got := resp.Header.Get(ver.MiceEncoding().DigestHeaderName()); got != "" {
+			t.Errorf("Digest header was not removed: %q", got)
+		}
+		if resp.Header.Get("Content-Type") != "text/html; charset=utf-8" {
+			t.Errorf("Unexpected Content-Type: %q", resp.Header.Get("Content-Type"))
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(body) != payload || resp.ContentLength != int64(len(payload)) {
+			t.Errorf("Unexpected body of %d bytes: %q", resp.ContentLength, body)
+		}
+		if e.ResponseHeaders.Get(ver.MiceEncoding().DigestHeaderName()) == "" {
+			t.Error("ToResponse modified the exchange")
+		}
+
+		e.Payload[len(e.Payload)-1] ^= 1
+		if _, err := e.ToResponse(); err == nil {
+			t.Error("ToResponse unexpectedly succeeded with a corrupted payload")
+		}
+	})
+}
+
+func TestValidateRecordSize(t *testing.T) {
+	testForEachVersion(t, func(ver version.Version, t *testing.T) {
+		for _, size := range []int{1, 4096, mice.MaxRecordSize} {
+			if err := ValidateRecordSize(ver, size); err != nil {
+				t.Errorf("ValidateRecordSize(%d): unexpected error: %v", size, err)
+			}
+		}
+		for _, size := range []int{-1, 0, mice.MaxRecordSize + 1} {
+			err := ValidateRecordSize(ver, size)
+			var sizeErr *RecordSizeError
+			if !errors.As(err, &sizeErr) {
+				t.Errorf("ValidateRecordSize(%d): got error %v, want a *RecordSizeError", size, err)
+				continue
+			}
+			if sizeErr.Version != ver || sizeErr.RecordSize != size || sizeErr.Max != mice.MaxRecordSize {
+				t.Errorf("ValidateRecordSize(%d): unexpected error %+v", size, sizeErr)
+			}
+		}
+	})
+	var sizeErr *RecordSizeError
+	if err := ValidateRecordSize(version.Version("1b4"), 4096); err == nil || errors.As(err, &sizeErr) {
+		t.Errorf("ValidateRecordSize of an unknown version: got %v, want a non-RecordSizeError error", err)
+	}
+}
+
+func TestSetMiEncodedPayload(t *testing.T) {
+	testForEachVersion(t, func(ver version.Version, t *testing.T) {
+		_, s, c := createTestExchange(ver, t)
+		// The payload is encoded by a separate pipeline.
+		var encoded bytes.Buffer
+		digest, err := ver.MiceEncoding().Encode(&encoded, []byte(payload), 16)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		header := http.Header{"Content-Type": {"text/html; charset=utf-8"}}
+		e := NewExchange(ver, requestUrl, http.MethodGet, nil, 200, header, nil)
+		if err := e.SetMiEncodedPayload(encoded.Bytes(), digest); err != nil {
+			t.Fatal(err)
+		}
+		if err := e.AddSignatureHeader(s); err != nil {
+			t.Fatal(err)
+		}
+		certFetcher := func(_ string) ([]byte, error) { return c, nil }
+		decoded, ok := e.Verify(signatureDate, certFetcher, stdoutLogger)
+		if !ok {
+			t.Fatal("Verification should succeed")
+		}
+		if string(decoded) != payload {
+			t.Errorf("Unexpected decoded payload: %q", decoded)
+		}
+
+		tampered := append([]byte(nil), encoded.Bytes()...)
+		tampered[len(tampered)-1] ^= 1
+		e = NewExchange(ver, requestUrl, http.MethodGet, nil, 200, http.Header{}, nil)
+		if err := e.SetMiEncodedPayload(tampered, digest); err == nil {
+			t.Error("SetMiEncodedPayload unexpectedly accepted a mismatched digest")
+		}
+		if len(e.ResponseHeaders) != 0 || e.Payload != nil {
+			t.Errorf("A failed SetMiEncodedPayload modified the exchange: %v", e.ResponseHeaders)
+		}
+	})
+}
+
+func TestRefreshDigest(t *testing.T) {
+	testForEachVersion(t, func(ver version.Version, t *testing.T) {
+		e, s, c := createTestExchange(ver, t)
+		transformed := []byte("<p>minified</p>")
+		e.Payload = transformed
+		if err := e.RefreshDigest(16); err != nil {
+			t.Fatal(err)
+		}
+		if got := e.ResponseHeaders.Values("Content-Encoding"); len(got) != 1 {
+			t.Errorf("Unexpected Content-Encoding: %v", got)
+		}
+		if err := e.AddSignatureHeader(s); err != nil {
+			t.Fatal(err)
+		}
+		certFetcher := func(_ string) ([]byte, error) { return c, nil }
+		decoded, ok := e.Verify(signatureDate, certFetcher, stdoutLogger)
+		if !ok {
+			t.Fatal("Verification should succeed")
+		}
+		if !bytes.Equal(decoded, transformed) {
+			t.Errorf("Unexpected decoded payload: %q", decoded)
+		}
+
+		e.Payload = nil
+		if err := e.RefreshDigest(16); err == nil {
+			t.Error("RefreshDigest unexpectedly succeeded without payload")
+		}
+	})
+}
+
+func TestRefreshDigestWithOtherCoding(t *testing.T) {
+	testForEachVersion(t, func(ver version.Version, t *testing.T) {
+		header := http.Header{}
+		header.Add("Content-Type", "text/html; charset=utf-8")
+		header.Add("Content-Encoding", "gzip")
+		e := NewExchange(ver, requestUrl, http.MethodGet, nil, 200, header, []byte(payload))
+		if err := e.MiEncodePayload(16); err != nil {
+			t.Fatal(err)
+		}
+		transformed := []byte("<p>minified</p>")
+		e.Payload = transformed
+		if err := e.RefreshDigest(4); err != nil {
+			t.Fatal(err)
+		}
+		want := []string{"gzip, " + ver.MiceEncoding().ContentEncoding()}
+		if got := e.ResponseHeaders.Values("Content-Encoding"); !reflect.DeepEqual(got, want) {
+			t.Errorf("Content-Encoding: got %q, want %q", got, want)
+		}
+		decoded, err := e.DecodePayload()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(decoded, transformed) {
+			t.Errorf("Unexpected decoded payload: %q", decoded)
+		}
+	})
+}
+
+func TestVerifyNotYetValidExchange(t *testing.T) {
+	testForEachVersion(t, func(ver version.Version, t *testing.T) {
+		e, s, c := createTestExchange(ver, t)
+		if err := e.AddSignatureHeader(s); err != nil {
+			t.Fatal(err)
+		}
+		verificationTime := signatureDate.Add(-1 * time.Second)
+		verificationShouldFail(t, e, c, verificationTime)
+	})
+}
+
+func TestVerifyExpiredExchange(t *testing.T) {
+	testForEachVersion(t, func(ver version.Version, t *testing.T) {
+		e, s, c := createTestExchange(ver, t)
+		if err := e.AddSignatureHeader(s); err != nil {
+			t.Fatal(err)
+		}
+		verificationTime := signatureDate.Add(1 * time.Hour).Add(1 * time.Second)
+		verificationShouldFail(t, e, c, verificationTime)
+	})
+}
+
+func TestSignatureValidityPeriod(t *testing.T) {
+	cases := []struct {
+		name    string
+		expires time.Time
+		ok      bool
+	}{
+		{"zero", time.Time{}, false},
+		{"equal to date", signatureDate, false},
+		{"before date", signatureDate.Add(-time.Hour), false},
+		{"7 days", signatureDate.Add(7 * 24 * time.Hour), true},
+		{"more than 7 days", signatureDate.Add(7*24*time.Hour + time.Second), false},
+	}
+	for _, c := range cases {
+		e, s, _ := createTestExchange(version.Version1b3, t)
+		s.Expires = c.expires
+		err := e.AddSignatureHeader(s)
+		if c.ok && err != nil {
+			t.Errorf("%s: AddSignatureHeader failed: %v", c.name, err)
+		}
+		if !c.ok && err == nil {
+			t.Errorf("%s: AddSignatureHeader unexpectedly succeeded", c.name)
+		}
+	}
+
+	// A signature header with a longer validity is rejected by Verify.
+	e, s, c := createTestExchange(version.Version1b3, t)
+	if err := e.AddSignatureHeader(s); err != nil {
+		t.Fatal(err)
+	}
+	e.SignatureHeaderValue = strings.Replace(e.SignatureHeaderValue,
+		fmt.Sprintf("expires=%d", s.Expires.Unix()),
+		fmt.Sprintf("expires=%d", signatureDate.Add(8*24*time.Hour).Unix()), 1)
+	certFetcher := func(_ string) ([]byte, error) { return c, nil }
+	if _, err := e.VerifyWithError(signatureDate, certFetcher); !errors.Is(err, ErrValidityTooLong) {
+		t.Errorf("got error %v, want %v", err, ErrValidityTooLong)
+	}
+}
+
+func TestVerifyIgnoreExpiry(t *testing.T) {
+	testForEachVersion(t, func(ver version.Version, t *testing.T) {
+		e, s, c := createTestExchange(ver, t)
+		if err := e.AddSignatureHeader(s); err != nil {
+			t.Fatal(err)
+		}
+		certFetcher := func(_ string) ([]byte, error) { return c, nil }
+		verificationTime := signatureDate.Add(365 * 24 * time.Hour)
+		verificationShouldFail(t, e, c, verificationTime)
+
+		var logBuf bytes.Buffer
+		if _, ok := e.Verify(verificationTime, certFetcher, log.New(&logBuf, "", 0), WithIgnoreExpiry()); !ok {
+			t.Errorf("Verification with WithIgnoreExpiry should succeed")
+		}
+		if !strings.Contains(logBuf.String(), "expiry was not checked") {
+			t.Errorf("Skipped expiry check was not logged: %q", logBuf.String())
+		}
+		result, err := e.VerifyWithResult(verificationTime, certFetcher, WithIgnoreExpiry())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !result.ExpiryIgnored {
+			t.Error("VerificationResult.ExpiryIgnored is false with WithIgnoreExpiry")
+		}
+		result, err = e.VerifyWithResult(signatureDate, certFetcher)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.ExpiryIgnored {
+			t.Error("VerificationResult.ExpiryIgnored is true without WithIgnoreExpiry")
+		}
+
+		// The signature itself is still checked.
+		e.ResponseHeaders.Add("Etag", "0123")
+		if _, ok := e.Verify(verificationTime, certFetcher, nullLogger, WithIgnoreExpiry()); ok {
+			t.Errorf("Verification of a tampered exchange should fail")
+		}
+	})
+}
+
+func TestVerifyAllowedContentTypes(t *testing.T) {
+	testForEachVersion(t, func(ver version.Version, t *testing.T) {
+		e, s, c := createTestExchange(ver, t)
+		if err := e.AddSignatureHeader(s); err != nil {
+			t.Fatal(err)
+		}
+		certFetcher := func(_ string) ([]byte, error) { return c, nil }
+
+		allowed := WithAllowedContentTypes([]string{"TEXT/HTML", "application/xhtml+xml"})
+		if _, ok := e.Verify(signatureDate, certFetcher, stdoutLogger, allowed); !ok {
+			t.Errorf("Verification of an allowed Content-Type should succeed")
+		}
+
+		var logBuf bytes.Buffer
+		disallowed := WithAllowedContentTypes([]string{"image/png"})
+		if _, ok := e.Verify(signatureDate, certFetcher, log.New(&logBuf, "", 0), disallowed); ok {
+			t.Errorf("Verification of a disallowed Content-Type should fail")
+		}
+		if !strings.Contains(logBuf.String(), `"text/html; charset=utf-8"`) {
+			t.Errorf("Rejected Content-Type was not logged: %q", logBuf.String())
+		}
+
+		// An empty allowlist accepts nothing.
+		if _, ok := e.Verify(signatureDate, certFetcher, nullLogger, WithAllowedContentTypes([]string{})); ok {
+			t.Errorf("Verification with an empty allowlist should fail")
+		}
+	})
+}
+
+func TestVerifyVerifiedHeadersHook(t *testing.T) {
+	testForEachVersion(t, func(ver version.Version, t *testing.T) {
+		e, s, c := createTestExchange(ver, t)
+		if err := e.AddSignatureHeader(s); err != nil {
+			t.Fatal(err)
+		}
+		certFetcher := func(_ string) ([]byte, error) { return c, nil }
+		want := e.ResponseHeaders.Clone()
+
+		var got http.Header
+		hook := WithVerifiedHeadersHook(func(h http.Header) {
+			got = h.Clone()
+			// Normalizing the headers does not affect the exchange.
+			h.Set("Content-Type", "text/plain")
+		})
+		if _, ok := e.Verify(signatureDate, certFetcher, stdoutLogger, hook); !ok {
+			t.Fatal("Verification should succeed")
+		}
+		if !reflect.DeepEqual(e.ResponseHeaders, want) {
+			t.Errorf("The hook modified the exchange: %v", e.ResponseHeaders)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("The hook got %v, want %v", got, want)
+		}
+
+		called := false
+		hook = WithVerifiedHeadersHook(func(http.Header) { called = true })
+		if _, ok := e.Verify(signatureDate.Add(2*time.Hour), certFetcher, nullLogger, hook); ok {
+			t.Fatal("Verification of an expired exchange should fail")
+		}
+		if called {
+			t.Error("The hook was called for a failed verification")
+		}
+	})
+}
+
+func TestVerifyWithLeafCert(t *testing.T) {
+	testForEachVersion(t, func(ver version.Version, t *testing.T) {
+		e, s, _ := createTestExchange(ver, t)
+		if err := e.AddSignatureHeader(s); err != nil {
+			t.Fatal(err)
+		}
+		leaf := s.Certs[0]
+
+		var logBuf bytes.Buffer
+		if _, ok := e.VerifyWithLeafCert(signatureDate, leaf, log.New(&logBuf, "", 0)); !ok {
+			t.Errorf("Verification with the leaf certificate should succeed: %s", logBuf.String())
+		}
+		if !strings.Contains(logBuf.String(), "chain of trust is not checked") {
+			t.Errorf("Skipped chain validation was not logged: %q", logBuf.String())
+		}
+
+		if _, ok := e.VerifyWithLeafCert(signatureDate.Add(2*time.Hour), leaf, nullLogger); ok {
+			t.Errorf("Verification of an expired signature should fail")
+		}
+
+		// A certificate with the same key but different bytes does not match
+		// the cert-sha256 of the signature.
+		other := *leaf
+		other.Raw = append([]byte{0}, leaf.Raw...)
+		if _, ok := e.VerifyWithLeafCert(signatureDate, &other, nullLogger); ok {
+			t.Errorf("Verification with a different certificate should fail")
+		}
+	})
+}
+
+func TestVerifyBadValidityUrl(t *testing.T) {
+	testForEachVersion(t, func(ver version.Version, t *testing.T) {
+		e, s, c := createTestExchange(ver, t)
+		s.ValidityUrl, _ = url.Parse("https://subdomain.example.com/resource.validity")
+		if err := e.AddSignatureHeader(s); err != nil {
+			t.Fatal(err)
+		}
+		verificationShouldFail(t, e, c, signatureDate)
+	})
+}
+
+func TestVerifyBadMethod(t *testing.T) {
+	testForEachVersion(t, func(ver version.Version, t *testing.T) {
+		// The test doesn't make sense in version >= b3, which doesn't have request method.
+		if ver != version.Version1b1 && ver != version.Version1b2 {
+			return
+		}
+
+		e, s, c := createTestExchange(ver, t)
+		e.RequestMethod = "POST"
+		if err := e.AddSignatureHeader(s); err != nil {
+			t.Fatal(err)
+		}
+		verificationShouldFail(t, e, c, signatureDate)
+	})
+}
+
+func TestVerifyStatefulRequestHeader(t *testing.T) {
+	testForEachVersion(t, func(ver version.Version, t *testing.T) {
+		e, s, c := createTestExchange(ver, t)
+		if e.RequestHeaders == nil {
+			e.RequestHeaders = http.Header{}
+		}
+		e.RequestHeaders.Set("Authorization", "Basic Zm9vOmJhcg==")
+		if err := e.AddSignatureHeader(s); err != nil {
+			t.Fatal(err)
+		}
+		verificationShouldFail(t, e, c, signatureDate)
+	})
+}
+
+func TestVerifyUncachedHeader(t *testing.T) {
+	testForEachVersion(t, func(ver version.Version, t *testing.T) {
+		e, s, c := createTestExchange(ver, t)
+		e.ResponseHeaders.Set("Set-Cookie", "foo=bar")
+		if err := e.AddSignatureHeader(s); err != nil {
+			t.Fatal(err)
+		}
+		verificationShouldFail(t, e, c, signatureDate)
+	})
+}
+
+func TestVerifyWithResult(t *testing.T) {
+	testForEachVersion(t, func(ver version.Version, t *testing.T) {
+		e, s, c := createTestExchange(ver, t)
+		if err := e.AddSignatureHeader(s); err != nil {
+			t.Fatal(err)
+		}
+		certFetcher := func(_ string) ([]byte, error) { return c, nil }
+		verificationTime := signatureDate.Add(10 * time.Minute)
+		result, err := e.VerifyWithResult(verificationTime, certFetcher)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(result.Payload) != payload {
+			t.Errorf("Unexpected payload: %q", result.Payload)
+		}
+		sig := result.Signature
+		if sig.Label != "label" || sig.CertUrl != s.CertUrl.String() || sig.ValidityUrl != s.ValidityUrl.String() {
+			t.Errorf("Unexpected signature: %+v", sig)
+		}
+		if want := ver.MiceEncoding().IntegrityIdentifier(); sig.Integrity != want {
+			t.Errorf("got integrity %q, want %q", sig.Integrity, want)
+		}
+		if sum := sha256.Sum256(s.Certs[0].Raw); !bytes.Equal(sig.CertSha256, sum[:]) {
+			t.Errorf("Unexpected cert-sha256: %x", sig.CertSha256)
+		}
+		if !result.Certificate.Equal(s.Certs[0]) || len(result.CertChain) != 1 {
+			t.Error("Unexpected certificate")
+		}
+		if !result.Date.Equal(s.Date) || !result.Expires.Equal(s.Expires) {
+			t.Errorf("got date %v and expires %v, want %v and %v", result.Date, result.Expires, s.Date, s.Expires)
+		}
+		if result.Remaining != 50*time.Minute {
+			t.Errorf("got remaining %v, want 50m", result.Remaining)
+		}
+
+		if _, err := e.VerifyWithResult(signatureDate.Add(2*time.Hour), certFetcher); !errors.Is(err, ErrExpired) {
+			t.Errorf("got error %v, want %v", err, ErrExpired)
+		}
+	})
+}
+
+func TestVerificationError(t *testing.T) {
+	testForEachVersion(t, func(ver version.Version, t *testing.T) {
+		cases := []struct {
+			name      string
+			modify    func(e *Exchange)
+			tamper    func(e *Exchange)
+			time      time.Time
+			wantCode  error
+			wantLabel string
+		}{
+			{name: "expired", time: signatureDate.Add(2 * time.Hour), wantCode: ErrExpired, wantLabel: "label"},
+			{
+				name: "stateful header",
+				modify: func(e *Exchange) {
+					e.RequestHeaders = http.Header{"Authorization": {"Basic Zm9vOmJhcg=="}}
+				},
+				wantCode:  ErrStatefulHeader,
+				wantLabel: "label",
+			},
+			{
+				name:     "malformed signature",
+				tamper:   func(e *Exchange) { e.SignatureHeaderValue = "" },
+				wantCode: ErrMalformedSignature,
+			},
+		}
+		for _, c := range cases {
+			e, s, certBytes := createTestExchange(ver, t)
+			if c.modify != nil {
+				c.modify(e)
+			}
+			if err := e.AddSignatureHeader(s); err != nil {
+				t.Fatal(err)
+			}
+			if c.tamper != nil {
+				c.tamper(e)
+			}
+			if c.time.IsZero() {
+				c.time = signatureDate
+			}
+			certFetcher := func(_ string) ([]byte, error) { return certBytes, nil }
+			_, err := e.VerifyWithError(c.time, certFetcher)
+			var verr *VerificationError
+			if !errors.As(err, &verr) {
+				t.Errorf("%s: got error %v, want a *VerificationError", c.name, err)
+				continue
+			}
+			if verr.Code != c.wantCode || verr.Label != c.wantLabel {
+				t.Errorf("%s: got code %v and label %q, want %v and %q", c.name, verr.Code, verr.Label, c.wantCode, c.wantLabel)
+			}
+			if !errors.Is(err, c.wantCode) {
+				t.Errorf("%s: error %v does not wrap %v", c.name, err, c.wantCode)
+			}
+		}
+	})
+}
+
+func TestVerifyConfigurableHeaders(t *testing.T) {
+	testForEachVersion(t, func(ver version.Version, t *testing.T) {
+		cases := []struct {
+			name   string
+			header string
+			opts   []VerifyOption
+			ok     bool
+		}{
+			{name: "default uncached", header: "Set-Cookie", ok: false},
+			{name: "allowed uncached", header: "Set-Cookie", opts: []VerifyOption{WithAllowedHeaders([]string{"set-cookie"})}, ok: true},
+			{name: "default allowed", header: "X-Internal-Token", ok: true},
+			{name: "forbidden", header: "X-Internal-Token", opts: []VerifyOption{WithForbiddenHeaders([]string{"x-internal-TOKEN"})}, ok: false},
+			{
+				name:   "forbidden overrides allowed",
+				header: "X-Internal-Token",
+				opts: []VerifyOption{
+					WithAllowedHeaders([]string{"X-Internal-Token"}),
+					WithForbiddenHeaders([]string{"X-Internal-Token"}),
+				},
+				ok: false,
+			},
+		}
+		for _, c := range cases {
+			e, s, certBytes := createTestExchange(ver, t)
+			e.ResponseHeaders.Set(c.header, "foo")
+			if err := e.AddSignatureHeader(s); err != nil {
+				t.Fatal(err)
+			}
+			certFetcher := func(_ string) ([]byte, error) { return certBytes, nil }
+			_, err := e.VerifyWithError(signatureDate, certFetcher, c.opts...)
+			if c.ok && err != nil {
+				t.Errorf("%s: unexpected error: %v", c.name, err)
+			} else if !c.ok && !errors.Is(err, ErrUncachedHeader) {
+				t.Errorf("%s: got error %v, want %v", c.name, err, ErrUncachedHeader)
+			}
+		}
+	})
+}
+
+func TestVerifyWithError(t *testing.T) {
+	testForEachVersion(t, func(ver version.Version, t *testing.T) {
+		cases := []struct {
+			name     string
+			modify   func(e *Exchange, s *Signer)
+			fetchErr error
+			time     time.Time
+			want     error
+			context  string
+		}{
+			{name: "expired", time: signatureDate.Add(2 * time.Hour), want: ErrExpired},
+			{name: "not yet valid", time: signatureDate.Add(-time.Second), want: ErrNotYetValid},
+			{
+				name: "validity-url",
+				modify: func(e *Exchange, s *Signer) {
+					s.ValidityUrl, _ = url.Parse("https://subdomain.example.com/resource.validity")
+				},
+				want:    ErrValidityURLMismatch,
+				context: `validity-url is "https://subdomain.example.com/resource.validity", request URL is "https://example.com/"`,
+			},
+			{
+				name: "uncached header",
+				modify: func(e *Exchange, s *Signer) {
+					e.ResponseHeaders.Set("Set-Cookie", "foo=bar")
+				},
+				want:    ErrUncachedHeader,
+				context: `"Set-Cookie"`,
+			},
+			{name: "cert fetch", fetchErr: errors.New("connection refused"), want: ErrCertFetch, context: "connection refused"},
+		}
+		for _, c := range cases {
+			e, s, certBytes := createTestExchange(ver, t)
+			if c.modify != nil {
+				c.modify(e, s)
+			}
+			if err := e.AddSignatureHeader(s); err != nil {
+				t.Fatal(err)
+			}
+			if c.time.IsZero() {
+				c.time = signatureDate
+			}
+			certFetcher := func(_ string) ([]byte, error) { return certBytes, c.fetchErr }
+			_, err := e.VerifyWithError(c.time, certFetcher)
+			if !errors.Is(err, c.want) {
+				t.Errorf("%s: got error %v, want %v", c.name, err, c.want)
+			} else if !strings.Contains(err.Error(), c.context) {
+				t.Errorf("%s: error %q does not contain %q", c.name, err, c.context)
+			}
+		}
+
+		e, s, certBytes := createTestExchange(ver, t)
+		if err := e.AddSignatureHeader(s); err != nil {
+			t.Fatal(err)
+		}
+		certFetcher := func(_ string) ([]byte, error) { return certBytes, nil }
+		got, err := e.VerifyWithError(signatureDate, certFetcher)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, []byte(payload)) {
+			t.Errorf("Unexpected decoded payload: %q", got)
+		}
+
+		e.ResponseHeaders.Add("Etag", "0123")
+		if _, err := e.VerifyWithError(signatureDate, certFetcher); !errors.Is(err, ErrBadSignature) {
+			t.Errorf("got error %v, want %v", err, ErrBadSignature)
+		}
+	})
+}
+
+// opaqueSigner hides the type of the wrapped key, like a key held in a
+// hardware module, and records the source of randomness it is given.
+type opaqueSigner struct {
+	key  crypto.Signer
+	rand io.Reader
+}
+
+func (s *opaqueSigner) Public() crypto.PublicKey {
+	return s.key.Public()
+}
+
+func (s *opaqueSigner) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	s.rand = rand
+	return s.key.Sign(rand, digest, opts)
+}
+
+func TestSignWithCryptoSigner(t *testing.T) {
+	testForEachVersion(t, func(ver version.Version, t *testing.T) {
+		e, s, c := createTestExchange(ver, t)
+		key := &opaqueSigner{key: s.PrivKey.(crypto.Signer)}
+		s.PrivKey = key
+		s.Rand = strings.NewReader(strings.Repeat("0123456789abcdef", 64))
+		if err := e.AddSignatureHeader(s); err != nil {
+			t.Fatal(err)
+		}
+		if key.rand != s.Rand {
+			t.Error("Signer.Rand was not forwarded to the crypto.Signer")
+		}
+		verificationShouldSucceed(t, e, c, signatureDate)
+	})
+}
+
+func TestSignatureAlgorithms(t *testing.T) {
+	p256, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	p384, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	_, ed, _ := ed25519.GenerateKey(rand.Reader)
+	keys := map[string]crypto.Signer{
+		SignatureAlgorithmECDSAP256SHA256: p256,
+		SignatureAlgorithmECDSAP384SHA384: p384,
+		SignatureAlgorithmEd25519:         ed,
+	}
+
+	testForEachVersion(t, func(ver version.Version, t *testing.T) {
+		for name, key := range keys {
+			template := &x509.Certificate{
+				SerialNumber: big.NewInt(1),
+				DNSNames:     []string{"example.com"},
+				NotBefore:    signatureDate.Add(-24 * time.Hour),
+				NotAfter:     signatureDate.Add(24 * time.Hour),
+				ExtraExtensions: []pkix.Extension{
+					{Id: oidCanSignHttpExchanges, Value: asn1.NullBytes},
+				},
+			}
+			der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			cert, err := x509.ParseCertificate(der)
+			if err != nil {
+				t.Fatal(err)
+			}
+			chain, err := certurl.NewCertChain([]*x509.Certificate{cert}, []byte("dummy"), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var certCBOR bytes.Buffer
+			if err := chain.Write(&certCBOR); err != nil {
+				t.Fatal(err)
+			}
+
+			e, s, _ := createTestExchange(ver, t)
+			s.Certs = []*x509.Certificate{cert}
+			s.PrivKey = key
+			err = e.AddSignatureHeader(s)
+			if !ver.SupportsSignatureAlgorithm(name) {
+				if err == nil || !strings.Contains(err.Error(), name) {
+					t.Errorf("%s: got error %v, want one naming the algorithm", name, err)
+				}
+				continue
+			}
+			if err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+			certFetcher := func(_ string) ([]byte, error) { return certCBOR.Bytes(), nil }
+			if _, err := e.VerifyWithError(signatureDate, certFetcher, WithIgnoreOCSP()); err != nil {
+				t.Errorf("%s: %v", name, err)
+			}
+		}
+	})
+}
+
+func TestAddSignature(t *testing.T) {
+	testForEachVersion(t, func(ver version.Version, t *testing.T) {
+		e, s, certBytes := createTestExchange(ver, t)
+		if err := e.AddSignature(s); err != nil {
+			t.Fatal(err)
+		}
+		first := e.SignatureHeaderValue
+
+		s2 := *s
+		s2.Label = "second"
+		s2.CertUrl, _ = url.Parse("https://example.com/cert2.msg")
+		if err := e.AddSignature(&s2); err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(e.SignatureHeaderValue, first+", second;") {
+			t.Errorf("Signature header %q does not start with the first signature", e.SignatureHeaderValue)
+		}
+
+		// Both signatures are valid.
+		for _, c := range []struct {
+			failingURL string
+			wantLabel  string
+		}{
+			{"https://example.com/cert2.msg", "label"},
+			{"https://example.com/cert.msg", "second"},
+		} {
+			certFetcher := func(url string) ([]byte, error) {
+				if url == c.failingURL {
+					return nil, errors.New("not found")
+				}
+				return certBytes, nil
+			}
+			_, label, err := e.VerifyWithLabel(signatureDate, certFetcher)
+			if err != nil {
+				t.Errorf("%s failing: %v", c.failingURL, err)
+			} else if label != c.wantLabel {
+				t.Errorf("%s failing: got label %q, want %q", c.failingURL, label, c.wantLabel)
+			}
+		}
+
+		if err := e.AddSignature(&s2); err == nil {
+			t.Error("AddSignature with a duplicate label unexpectedly succeeded")
+		}
+		s3 := *s
+		s3.Label = "third"
+		e.ResponseHeaders.Set("X-Added", "1")
+		if err := e.AddSignature(&s3); err == nil {
+			t.Error("AddSignature after changing the headers unexpectedly succeeded")
+		}
+	})
+}
+
+func sortedKeys(h http.Header) []string {
+	var names []string
+	for name := range h {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestHeaderPolicy(t *testing.T) {
+	newHeader := func() http.Header {
+		return http.Header{
+			"Content-Type":      {"text/html"},
+			"Content-Encoding":  {"mi-sha256-03"},
+			"Digest":            {"mi-sha256-03=abc"},
+			"Cache-Control":     {"max-age=60"},
+			"Set-Cookie":        {"a=b"},
+			"Server-Timing":     {"db;dur=53"},
+			"X-Internal-Host":   {"backend-7"},
+			"X-Internal-Region": {"eu"},
+			"X-Public-Link":     {"</a>"},
+		}
+	}
+	for _, tc := range []struct {
+		name   string
+		policy HeaderPolicy
+		want   []string
+	}{
+		{
+			name:   "deny",
+			policy: HeaderPolicy{Deny: []string{"server-timing", "X-Internal-*"}, StripUncached: true},
+			want:   []string{"Cache-Control", "Content-Encoding", "Content-Type", "Digest", "X-Public-Link"},
+		},
+		{
+			name:   "allow",
+			policy: HeaderPolicy{StripByDefault: true, Allow: []string{"Cache-Control", "X-Internal-*"}, Deny: []string{"X-Internal-Host"}},
+			want:   []string{"Cache-Control", "Content-Encoding", "Content-Type", "Digest", "X-Internal-Region"},
+		},
+		{
+			name:   "rename",
+			policy: HeaderPolicy{Rename: map[string]string{"x-public-link": "Link"}, StripByDefault: true, Allow: []string{"Link"}},
+			want:   []string{"Content-Encoding", "Content-Type", "Digest", "Link"},
+		},
+	} {
+		h := newHeader()
+		tc.policy.Apply(h)
+		if got := sortedKeys(h); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: got headers %v, want %v", tc.name, got, tc.want)
+		}
+	}
+
+	testForEachVersion(t, func(ver version.Version, t *testing.T) {
+		e, s, c := createTestExchange(ver, t)
+		e.ResponseHeaders.Set("Set-Cookie", "a=b")
+		e.ResponseHeaders.Set("Server-Timing", "db;dur=53")
+		s.HeaderPolicy = &HeaderPolicy{Deny: []string{"Server-Timing"}, StripUncached: true}
+		if err := e.AddSignatureHeader(s); err != nil {
+			t.Fatal(err)
+		}
+		if e.ResponseHeaders.Get("Set-Cookie") != "" || e.ResponseHeaders.Get("Server-Timing") != "" {
+			t.Errorf("Headers were not removed: %v", e.ResponseHeaders)
+		}
+		verificationShouldSucceed(t, e, c, signatureDate)
+
+		// AddSignature must not change the headers.
+		s2 := *s
+		s2.Label = "second"
+		s2.HeaderPolicy = &HeaderPolicy{Deny: []string{"Content-*"}}
+		if err := e.AddSignature(&s2); err != nil {
+			t.Errorf("AddSignature with a policy keeping the headers: %v", err)
+		}
+		s3 := *s
+		s3.Label = "third"
+		s3.HeaderPolicy = &HeaderPolicy{Rename: map[string]string{"Content-Type": "X-Content-Type"}}
+		if err := e.AddSignature(&s3); err == nil {
+			t.Error("AddSignature with a policy changing the headers unexpectedly succeeded")
+		}
+	})
+
+	req, err := http.NewRequest(http.MethodGet, requestUrl, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp := &http.Response{StatusCode: 200, Header: newHeader(), Body: ioutil.NopCloser(strings.NewReader(payload)), Request: req}
+	e, err := NewExchangeFromResponse(version.Version1b3, resp, WithHeaderPolicy(&HeaderPolicy{Deny: []string{"X-*"}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := sortedKeys(e.ResponseHeaders), []string{"Cache-Control", "Content-Encoding", "Content-Type", "Digest", "Server-Timing"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("NewExchangeFromResponse: got headers %v, want %v", got, want)
+	}
+}
+
+func TestAddSignatureHeaders(t *testing.T) {
+	testForEachVersion(t, func(ver version.Version, t *testing.T) {
+		e, s, c := createTestExchange(ver, t)
+		old := *s
+		old.Label = "old"
+		rotated := *s
+		rotated.Label = "new"
+		rotated.CertUrl, _ = url.Parse("https://example.com/unavailable.cbor")
+		if err := e.AddSignatureHeaders([]*Signer{&old, &rotated}); err != nil {
+			t.Fatal(err)
+		}
+
+		params, err := ParseSignatureHeaderBytes([]byte(e.SignatureHeaderValue), ver)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var labels []string
+		for _, sig := range params.Signatures {
+			labels = append(labels, string(sig.Label))
+		}
+		if want := []string{"new", "old"}; !reflect.DeepEqual(labels, want) {
+			t.Errorf("Signature labels: got %q, want %q", labels, want)
+		}
+
+		certFetcher := func(url string) ([]byte, error) {
+			if url != s.CertUrl.String() {
+				return nil, fmt.Errorf("%s not found", url)
+			}
+			return c, nil
+		}
+		got, label, err := e.VerifyWithLabel(signatureDate, certFetcher)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if label != "old" {
+			t.Errorf("Got label %q, want %q", label, "old")
+		}
+		if !bytes.Equal(got, []byte(payload)) {
+			t.Errorf("Unexpected decoded payload: %q", got)
+		}
+
+		if _, _, err := e.VerifyWithLabel(signatureDate.Add(2*time.Hour), certFetcher); !errors.Is(err, ErrCertFetch) {
+			t.Errorf("got error %v, want the one of the first signature", err)
+		}
+
+		for _, signers := range [][]*Signer{nil, {&old, &old}, {s, &Signer{}}} {
+			if err := e.AddSignatureHeaders(signers); err == nil {
+				t.Errorf("AddSignatureHeaders(%d signers) unexpectedly succeeded", len(signers))
+			}
+		}
+	})
+}
+
+func TestVerifyOCSP(t *testing.T) {
+	e, s, c := createTestExchange(version.Version1b3, t)
+	if err := e.AddSignatureHeader(s); err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFetcherWithOCSP := func(status int, thisUpdate time.Time, key crypto.Signer) CertFetcher {
+		leaf := s.Certs[0]
+		ocspDER, err := ocsp.CreateResponse(leaf, leaf, ocsp.Response{
+			Status:       status,
+			SerialNumber: leaf.SerialNumber,
+			ThisUpdate:   thisUpdate,
+		}, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		chain, err := certurl.NewCertChain(s.Certs, ocspDER, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		if err := chain.Write(&buf); err != nil {
+			t.Fatal(err)
+		}
+		return func(_ string) ([]byte, error) { return buf.Bytes(), nil }
+	}
+
+	cases := []struct {
+		name    string
+		fetcher CertFetcher
+	}{
+		{"revoked", certFetcherWithOCSP(ocsp.Revoked, signatureDate.Add(-time.Hour), s.PrivKey.(crypto.Signer))},
+		{"stale", certFetcherWithOCSP(ocsp.Good, signatureDate.Add(-8*24*time.Hour), s.PrivKey.(crypto.Signer))},
+		{"not signed by the issuer", certFetcherWithOCSP(ocsp.Good, signatureDate.Add(-time.Hour), otherKey)},
+	}
+	for _, c := range cases {
+		if _, err := e.VerifyWithError(signatureDate, c.fetcher); !errors.Is(err, ErrOCSP) {
+			t.Errorf("%s: got error %v, want %v", c.name, err, ErrOCSP)
+		}
+		if _, err := e.VerifyWithError(signatureDate, c.fetcher, WithIgnoreOCSP()); err != nil {
+			t.Errorf("%s: Verify with WithIgnoreOCSP failed: %v", c.name, err)
+		}
+	}
+
+	// The test certificate has no SCTs.
+	certFetcher := func(_ string) ([]byte, error) { return c, nil }
+	result, err := e.VerifyWithResult(signatureDate, certFetcher)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.OCSPResponse == nil || result.OCSPResponse.Status != ocsp.Good || !result.OCSPResponse.ThisUpdate.Equal(signatureDate.Add(-time.Hour)) {
+		t.Errorf("unexpected OCSP response in the result: %+v", result.OCSPResponse)
+	}
+	result, err = e.VerifyWithResult(signatureDate, certFetcher, WithIgnoreOCSP())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.OCSPResponse != nil {
+		t.Error("got an OCSP response in the result with WithIgnoreOCSP")
+	}
+	if _, err := e.VerifyWithError(signatureDate, certFetcher, WithCTPolicy(certurl.CTPolicy{MinSCTs: 1})); !errors.Is(err, ErrCTPolicy) {
+		t.Errorf("got error %v, want %v", err, ErrCTPolicy)
+	}
+}
+
+func TestStripConnectionHeaders(t *testing.T) {
+	testForEachVersion(t, func(ver version.Version, t *testing.T) {
+		e, s, c := createTestExchange(ver, t)
+		e.ResponseHeaders.Add("Connection", "X-Custom, keep-alive")
+		e.ResponseHeaders.Add("X-Custom", "1")
+		e.ResponseHeaders.Add("Keep-Alive", "timeout=5")
+		e.ResponseHeaders.Add("X-Other", "2")
+		if err := e.AddSignatureHeader(s); err != nil {
+			t.Fatal(err)
+		}
+		for _, name := range []string{"Connection", "X-Custom", "Keep-Alive"} {
+			if _, ok := e.ResponseHeaders[name]; ok {
+				t.Errorf("%s header was not stripped", name)
+			}
+		}
+		if e.ResponseHeaders.Get("X-Other") != "2" {
+			t.Error("X-Other header was stripped")
+		}
+		verificationShouldSucceed(t, e, c, signatureDate)
+	})
+}
+
+func TestVerifyBadSignature(t *testing.T) {
+	testForEachVersion(t, func(ver version.Version, t *testing.T) {
+		e, s, c := createTestExchange(ver, t)
+		if err := e.AddSignatureHeader(s); err != nil {
+			t.Fatal(err)
+		}
+		e.ResponseHeaders.Add("Etag", "0123")
+		verificationShouldFail(t, e, c, signatureDate)
+	})
+}
+
+func TestVerifyReportsHeaderChanges(t *testing.T) {
+	testForEachVersion(t, func(ver version.Version, t *testing.T) {
+		e, s, c := createTestExchange(ver, t)
+		if err := e.AddSignatureHeader(s); err != nil {
+			t.Fatal(err)
+		}
+		if changes := e.HeaderChangesSinceSigning(); changes != nil {
+			t.Errorf("Unexpected changes right after signing: %q", changes)
+		}
+		e.ResponseHeaders.Add("Etag", "0123")
+		e.ResponseHeaders.Set("Content-Type", "text/plain")
+
+		want := []string{
+			`response header "Content-Type" was changed from "text/html; charset=utf-8" to "text/plain" after signing`,
+			`response header "Etag" was added after signing`,
+		}
+		if got := e.HeaderChangesSinceSigning(); !reflect.DeepEqual(got, want) {
+			t.Errorf("HeaderChangesSinceSigning() = %q, want %q", got, want)
+		}
+
+		var logBuf bytes.Buffer
+		certFetcher := func(_ string) ([]byte, error) { return c, nil }
+		if _, ok := e.Verify(signatureDate, certFetcher, log.New(&logBuf, "", 0)); ok {
+			t.Fatal("Verification should fail")
+		}
+		if !strings.Contains(logBuf.String(), want[1]) {
+			t.Errorf("Verify did not report the added header: %q", logBuf.String())
+		}
+	})
+}
+
+func TestVerifyNoContentType(t *testing.T) {
+	testForEachVersion(t, func(ver version.Version, t *testing.T) {
+		e, s, c := createTestExchange(ver, t)
+		e.ResponseHeaders.Del("Content-Type")
+		if err := e.AddSignatureHeader(s); err != nil {
+			t.Fatal(err)
+		}
+
+		// The requirement for Content-Type is only for version >= b3.
+		if ver == version.Version1b1 || ver == version.Version1b2 {
+			verificationShouldSucceed(t, e, c, signatureDate)
+		} else {
+			verificationShouldFail(t, e, c, signatureDate)
+		}
+	})
+}
+
+func TestValidate(t *testing.T) {
+	testForEachVersion(t, func(ver version.Version, t *testing.T) {
+		e, _, _ := createTestExchange(ver, t)
+		if err := e.Validate(); err != nil {
+			t.Errorf("Validate unexpectedly failed: %v", err)
+		}
+
+		for _, status := range []int{204, 304} {
+			e, _, _ := createTestExchange(ver, t)
+			e.ResponseStatus = status
+			if err := e.Validate(); err == nil {
+				t.Errorf("%d response with a body unexpectedly accepted", status)
+			}
+
+			header := http.Header{}
+			header.Add("Content-Type", "text/html; charset=utf-8")
+			// A 304 response is not cacheable, so only the check of the body
+			// is looked at.
+			hasStatusError := func(e *Exchange) bool {
+				for _, err := range e.CheckConformance() {
+					if err.Check == "status" {
+						return true
+					}
+				}
+				return false
+			}
+			e = NewExchange(ver, requestUrl, http.MethodGet, nil, status, header, nil)
+			if hasStatusError(e) {
+				t.Errorf("%d response without a body unexpectedly rejected: %v", status, e.Validate())
+			}
+			if err := e.MiEncodePayload(16); err != nil {
+				t.Fatal(err)
+			}
+			if hasStatusError(e) {
+				t.Errorf("%d response with an MI-encoded empty body unexpectedly rejected: %v", status, e.Validate())
+			}
+		}
+
+		e, _, _ = createTestExchange(ver, t)
+		e.ResponseHeaders.Del("Content-Type")
+		err := e.Validate()
+		if ver.HasVerificationCheck(version.CheckContentTypeRequired) && err == nil {
+			t.Error("response without Content-Type unexpectedly accepted")
+		} else if !ver.HasVerificationCheck(version.CheckContentTypeRequired) && err != nil {
+			t.Errorf("response without Content-Type unexpectedly rejected: %v", err)
+		}
+	})
+}
+
+func TestCheckConformance(t *testing.T) {
+	testForEachVersion(t, func(ver version.Version, t *testing.T) {
+		e, _, _ := createTestExchange(ver, t)
+		e.RequestURI = "http://example.com/"
+		e.ResponseHeaders.Add("Set-Cookie", "foo=bar")
+		e.ResponseHeaders.Add("Authentication-Info", "foo")
+		e.ResponseHeaders.Add("Cache-Control", "no-store")
+		e.ResponseHeaders.Del("Content-Type")
+
+		want := []string{"request-url", "uncached-header", "uncached-header"}
+		if ver.HasVerificationCheck(version.CheckContentTypeRequired) {
+			want = append([]string{"content-type"}, want...)
+		}
+		if ver.HasVerificationCheck(version.CheckCacheabilityRequired) {
+			want = append(want, "cacheability")
+		}
+		var got []string
+		for _, err := range e.CheckConformance() {
+			got = append(got, err.Check)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("got checks %v, want %v", got, want)
+		}
+
+		err := e.Validate()
+		var errs ConformanceErrors
+		if !errors.As(err, &errs) || len(errs) != len(want) {
+			t.Errorf("Validate returned %v, want %d ConformanceErrors", err, len(want))
+		}
+		if !strings.Contains(err.Error(), `uncached response header "Set-Cookie"`) {
+			t.Errorf("error %q does not mention Set-Cookie", err)
+		}
+	})
+}
+
+func TestVariants(t *testing.T) {
+	testForEachVersion(t, func(ver version.Version, t *testing.T) {
+		e, s, c := createTestExchange(ver, t)
+		variants := Variants{{"Accept-Language", "en", "fr"}, {"Accept", "text/html", "application/json"}}
+		key := VariantKey{{"fr", "text/html"}}
+		if err := e.SetVariants(variants, key); err != nil {
+			t.Fatal(err)
+		}
+		if got, want := e.ResponseHeaders.Get("Variants"), "Accept-Language; en; fr, Accept; text/html; application/json"; got != want {
+			t.Errorf("Variants: got %q, want %q", got, want)
+		}
+		if got, want := e.ResponseHeaders.Get("Variant-Key"), "fr; text/html"; got != want {
+			t.Errorf("Variant-Key: got %q, want %q", got, want)
+		}
+		gotVariants, gotKey, err := e.Variants()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(gotVariants, variants) || !reflect.DeepEqual(gotKey, key) {
+			t.Errorf("Variants: got %v and %v, want %v and %v", gotVariants, gotKey, variants, key)
+		}
+		if err := e.AddSignatureHeader(s); err != nil {
+			t.Fatal(err)
+		}
+		verificationShouldSucceed(t, e, c, signatureDate)
+
+		for _, tc := range []struct {
+			variants Variants
+			key      VariantKey
+		}{
+			{nil, VariantKey{{"en"}}},
+			{Variants{{"Accept-Language", "en"}}, nil},
+			{Variants{{"Accept-Language"}}, VariantKey{{"en"}}},
+			{Variants{{"Accept-Language", "en"}}, VariantKey{{"en", "gzip"}}},
+			{Variants{{"Accept-Language", "en"}}, VariantKey{{"de"}}},
+		} {
+			if err := e.SetVariants(tc.variants, tc.key); err == nil {
+				t.Errorf("SetVariants(%v, %v) unexpectedly succeeded", tc.variants, tc.key)
+			}
+		}
+
+		e.ResponseHeaders.Set("Variant-Key", "de")
+		var got []string
+		for _, err := range e.CheckConformance() {
+			got = append(got, err.Check)
+		}
+		if !reflect.DeepEqual(got, []string{"variants"}) {
+			t.Errorf("got checks %v, want [variants]", got)
+		}
+	})
+}
+
+func TestSelectVariant(t *testing.T) {
+	variants := Variants{{"Accept-Language", "en", "fr", "ja"}, {"Accept-Encoding", "identity", "gzip"}}
+	var exchanges []*Exchange
+	for _, key := range []VariantKey{
+		{{"en", "identity"}},
+		{{"fr", "identity"}, {"ja", "identity"}},
+		{{"en", "gzip"}},
+	} {
+		e := NewExchange(version.Version1b3, requestUrl, http.MethodGet, nil, 200, http.Header{}, []byte(payload))
+		if err := e.SetVariants(variants, key); err != nil {
+			t.Fatal(err)
+		}
+		exchanges = append(exchanges, e)
+	}
+
+	for _, tc := range []struct {
+		header http.Header
+		want   int
+	}{
+		{http.Header{}, 0},
+		{http.Header{"Accept-Language": {"fr-CA, en;q=0.5"}}, 1},
+		{http.Header{"Accept-Language": {"ja"}, "Accept-Encoding": {"gzip"}}, 1},
+		{http.Header{"Accept-Language": {"en-US"}, "Accept-Encoding": {"gzip, identity;q=0.5"}}, 2},
+		{http.Header{"Accept-Language": {"de, *;q=0.1"}, "Accept-Encoding": {"br"}}, 0},
+		{http.Header{"Accept-Language": {"de"}}, 0},
+	} {
+		got, err := SelectVariant(exchanges, tc.header)
+		if err != nil {
+			t.Errorf("SelectVariant(%v): %v", tc.header, err)
+			continue
+		}
+		if got != exchanges[tc.want] {
+			key := got.ResponseHeaders.Get("Variant-Key")
+			t.Errorf("SelectVariant(%v): got the exchange with key %q, want %q", tc.header, key, exchanges[tc.want].ResponseHeaders.Get("Variant-Key"))
+		}
+	}
+
+	// Exchanges must have the same Variants.
+	other := NewExchange(version.Version1b3, requestUrl, http.MethodGet, nil, 200, http.Header{}, []byte(payload))
+	if err := other.SetVariants(Variants{{"Accept-Language", "en"}}, VariantKey{{"en"}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := SelectVariant(append(exchanges, other), http.Header{}); err == nil {
+		t.Error("SelectVariant unexpectedly accepted different Variants")
+	}
+	// A key that no exchange has cannot be selected.
+	if _, err := SelectVariant(exchanges[1:2], http.Header{}); err == nil {
+		t.Error("SelectVariant unexpectedly succeeded without an exchange of the default key")
+	}
+}
+
+func TestComputeHeaderIntegrity(t *testing.T) {
+	e, _, _ := createTestExchange(version.Version1b3, t)
+	got, err := e.ComputeHeaderIntegrity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	signedHeaders, err := CBORFromHeader(e.ResponseHeaders, e.ResponseStatus, e.Version)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(signedHeaders)
+	if want := "sha256-" + base64.StdEncoding.EncodeToString(sum[:]); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if err := e.VerifyHeaderIntegrity(got); err != nil {
+		t.Error(err)
+	}
+
+	// The header-integrity changes with any response header, but not with
+	// the signature or the payload.
+	e.Payload[0] ^= 1
+	e.SignatureHeaderValue = "label;sig=*AA==*"
+	if again, err := e.ComputeHeaderIntegrity(); err != nil || again != got {
+		t.Errorf("got %q, %v after changing the payload and signature, want %q", again, err, got)
+	}
+	e.ResponseHeaders.Set("Cache-Control", "max-age=60")
+	if err := e.VerifyHeaderIntegrity(got); err == nil {
+		t.Error("header-integrity did not change with the headers")
+	}
+}
+
+func TestSubresourceLinks(t *testing.T) {
+	const page = `<!DOCTYPE html>
+<link rel="stylesheet" href="/style.css">
+<link rel="preload" href="font.woff2" as="font" crossorigin>
+<script src="https://example.com/script.js#main"></script>
+<img src="https://other.example/image.png">
+<a href="/next.html">next</a>`
+	newExchange := func(uri, contentType, body string) *Exchange {
+		header := http.Header{"Content-Type": {contentType}, "Cache-Control": {"max-age=3600"}}
+		e := NewExchange(version.Version1b3, uri, http.MethodGet, nil, 200, header, []byte(body))
+		if err := e.MiEncodePayload(16); err != nil {
+			t.Fatal(err)
+		}
+		return e
+	}
+	e := newExchange(requestUrl, "text/html", page)
+	script := newExchange("https://example.com/script.js", "text/javascript", "alert(1)")
+	style := newExchange("https://example.com/style.css", "text/css", "p {}")
+	next := newExchange("https://example.com/next.html", "text/html", "next")
+	subresources := []*Exchange{script, style, next}
+
+	links, err := e.FindSubresourceLinks(subresources)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, l := range links {
+		got = append(got, l.URL+" "+l.As)
+	}
+	if want := []string{"https://example.com/style.css style", "https://example.com/script.js script"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got links %q, want %q", got, want)
+	}
+	integrity, err := style.ComputeHeaderIntegrity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `<https://example.com/style.css>;rel="allowed-alt-sxg";header-integrity="` + integrity + `",<https://example.com/style.css>;rel="preload";as="style"`; links[0].String() != want {
+		t.Errorf("Link: got %q, want %q", links[0].String(), want)
+	}
+
+	e.AddSubresourceLinks(links)
+	if err := e.ValidateSubresourceLinks(subresources); err != nil {
+		t.Error(err)
+	}
+	if err := e.ValidateSubresourceLinks([]*Exchange{script}); err == nil || !strings.Contains(err.Error(), `"https://example.com/style.css" has no signed exchange`) {
+		t.Errorf("got error %v, want a missing exchange", err)
+	}
+	script.ResponseHeaders.Set("X-Changed", "1")
+	if err := e.ValidateSubresourceLinks(subresources); err == nil || !strings.Contains(err.Error(), "header-integrity mismatch") {
+		t.Errorf("got error %v, want a header-integrity mismatch", err)
+	}
+
+	unpreloaded := newExchange(requestUrl, "text/html", page)
+	unpreloaded.ResponseHeaders.Set("Link", strings.Split(links[0].String(), ",")[0])
+	if err := unpreloaded.ValidateSubresourceLinks(subresources); err == nil || !strings.Contains(err.Error(), "is not preloaded") {
+		t.Errorf("got error %v, want a missing preload", err)
+	}
+}
+
+func TestPartialContent(t *testing.T) {
+	testForEachVersion(t, func(ver version.Version, t *testing.T) {
+		newPartial := func(contentRange string) *Exchange {
+			header := http.Header{}
+			header.Add("Content-Type", "video/mp4")
+			if contentRange != "" {
+				header.Add("Content-Range", contentRange)
+			}
+			e := NewExchange(ver, requestUrl, http.MethodGet, nil, http.StatusPartialContent, header, []byte(payload))
+			if err := e.MiEncodePayload(16); err != nil {
+				t.Fatal(err)
+			}
+			return e
+		}
+
+		e := newPartial(fmt.Sprintf("bytes 100-%d/100000", 100+len(payload)-1))
+		if err := e.Validate(); err != nil {
+			t.Fatalf("Validate unexpectedly failed: %v", err)
+		}
+		_, s, c := createTestExchange(ver, t)
+		if err := e.AddSignatureHeader(s); err != nil {
+			t.Fatal(err)
+		}
+		verificationShouldSucceed(t, e, c, signatureDate)
+
+		for _, contentRange := range []string{
+			"",
+			fmt.Sprintf("bytes 100-%d/100000", 100+len(payload)),
+			fmt.Sprintf("bytes 100-%d/200", 100+len(payload)-1),
+			"bytes */100000",
+			"items 0-1/2",
+		} {
+			if err := newPartial(contentRange).Validate(); err == nil {
+				t.Errorf("206 response with Content-Range %q unexpectedly accepted", contentRange)
+			}
+		}
+	})
+}
+
+func TestVerifyNonCanonicalURL(t *testing.T) {
+	testForEachVersion(t, func(ver version.Version, t *testing.T) {
+		e, s, c := createTestExchange(ver, t)
+		// url.Parse() decodes "%73%78%67" to "sxg"
+		e.RequestURI = "https://example.com/%73%78%67"
+		if err := e.AddSignatureHeader(s); err != nil {
+			t.Fatal(err)
+		}
+		verificationShouldSucceed(t, e, c, signatureDate)
+	})
+}
+
+func TestVerifyNonCacheable(t *testing.T) {
+	testForEachVersion(t, func(ver version.Version, t *testing.T) {
+		e, s, c := createTestExchange(ver, t)
+		e.ResponseHeaders.Add("Cache-Control", "no-store")
+		if err := e.AddSignatureHeader(s); err != nil {
+			t.Fatal(err)
 		}
 		switch ver {
 		case version.Version1b1, version.Version1b2:
@@ -400,6 +3606,93 @@ func TestVerifyNonCacheable(t *testing.T) {
 	})
 }
 
+func TestVerificationChecksMatchVerify(t *testing.T) {
+	// Each mutation should make Verify fail if and only if the version
+	// declares the corresponding check.
+	mutations := map[string]func(e *Exchange){
+		version.CheckRequestMethodSafe: func(e *Exchange) {
+			e.RequestMethod = "POST"
+		},
+		version.CheckContentTypeRequired: func(e *Exchange) {
+			e.ResponseHeaders.Del("Content-Type")
+		},
+		version.CheckCacheabilityRequired: func(e *Exchange) {
+			e.ResponseHeaders.Add("Cache-Control", "no-store")
+		},
+	}
+	testForEachVersion(t, func(ver version.Version, t *testing.T) {
+		for check, mutate := range mutations {
+			e, s, c := createTestExchange(ver, t)
+			mutate(e)
+			if err := e.AddSignatureHeader(s); err != nil {
+				t.Fatal(err)
+			}
+			if ver.HasVerificationCheck(check) {
+				verificationShouldFail(t, e, c, signatureDate)
+			} else {
+				verificationShouldSucceed(t, e, c, signatureDate)
+			}
+		}
+
+		// Request headers are covered by the signature only if declared.
+		e, s, c := createTestExchange(ver, t)
+		if err := e.AddSignatureHeader(s); err != nil {
+			t.Fatal(err)
+		}
+		e.RequestHeaders = http.Header{"Accept": []string{"text/html"}}
+		if ver.HasVerificationCheck(version.CheckRequestHeadersSigned) {
+			verificationShouldFail(t, e, c, signatureDate)
+		} else {
+			verificationShouldSucceed(t, e, c, signatureDate)
+		}
+	})
+}
+
+func TestVerifyHeaderIntegrity(t *testing.T) {
+	e, _, _ := createTestExchange(version.Version1b3, t)
+	const want = "sha256-edLXSxWXOuvZYtCpiNicrrEbHuMk7E6D9sooKKzkpDo="
+	if err := e.VerifyHeaderIntegrity(want); err != nil {
+		t.Errorf("VerifyHeaderIntegrity unexpectedly failed: %v", err)
+	}
+
+	e.ResponseHeaders.Set("Content-Type", "text/plain")
+	if err := e.VerifyHeaderIntegrity(want); err == nil {
+		t.Error("VerifyHeaderIntegrity unexpectedly succeeded with modified headers")
+	}
+}
+
+func TestValidateAsSubresource(t *testing.T) {
+	e, _, _ := createTestExchange(version.Version1b3, t)
+	if err := e.ValidateAsSubresource("https://example.com"); err != nil {
+		t.Errorf("Unexpected error for a same-origin subresource: %v", err)
+	}
+
+	if err := e.ValidateAsSubresource("https://other.example"); err == nil {
+		t.Error("Cross-origin subresource without Access-Control-Allow-Origin unexpectedly allowed")
+	}
+	e.ResponseHeaders.Set("Access-Control-Allow-Origin", "https://other.example")
+	if err := e.ValidateAsSubresource("https://other.example"); err != nil {
+		t.Errorf("Unexpected error for an allowed cross-origin subresource: %v", err)
+	}
+
+	e.ResponseHeaders.Set("Cache-Control", "no-store")
+	e.ResponseHeaders.Set("Set-Cookie", "foo=bar")
+	err := e.ValidateAsSubresource("https://example.com")
+	if err == nil {
+		t.Fatal("Uncacheable subresource with a stateful header unexpectedly allowed")
+	}
+	for _, want := range []string{"not cacheable", "Set-Cookie"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("Error %q does not mention %q", err, want)
+		}
+	}
+
+	old, _, _ := createTestExchange(version.Version1b2, t)
+	if err := old.ValidateAsSubresource("https://example.com"); err == nil {
+		t.Error("Version 1b2 subresource unexpectedly allowed")
+	}
+}
+
 func TestIsCacheable(t *testing.T) {
 	testForEachVersion(t, func(ver version.Version, t *testing.T) {
 		if ver == version.Version1b1 || ver == version.Version1b2 {
@@ -444,3 +3737,591 @@ func TestIsCacheable(t *testing.T) {
 		}
 	})
 }
+
+func TestValidateCacheHeaders(t *testing.T) {
+	valid := []http.Header{
+		{},
+		{"Cache-Control": {"public, max-age=300"}},
+		{"Cache-Control": {"private", "max-age=0"}},
+		{"Cache-Control": {"no-store"}},
+		{"Expires": {"Mon, 07 Jan 2019 07:29:39 GMT"}},
+	}
+	for _, h := range valid {
+		if err := ValidateCacheHeaders(h); err != nil {
+			t.Errorf("ValidateCacheHeaders(%v) unexpectedly failed: %v", h, err)
+		}
+	}
+
+	invalid := []http.Header{
+		{"Cache-Control": {"no-store, max-age=300"}},
+		{"Cache-Control": {"no-store", "public"}},
+		{"Cache-Control": {"private, public"}},
+		{"Cache-Control": {"max-age=soon"}},
+		{"Cache-Control": {"s-maxage=-1"}},
+		{"Expires": {"tomorrow"}},
+		{"Expires": {"0"}},
+		{"Expires": {"Mon, 07 Jan 2019 07:29:39 GMT", "Tue, 08 Jan 2019 07:29:39 GMT"}},
+	}
+	for _, h := range invalid {
+		if err := ValidateCacheHeaders(h); err == nil {
+			t.Errorf("ValidateCacheHeaders(%v) unexpectedly succeeded", h)
+		}
+	}
+
+	e, _, _ := createTestExchange(version.Version1b3, t)
+	e.ResponseHeaders.Add("Expires", "tomorrow")
+	var logBuf bytes.Buffer
+	if !e.IsCacheable(log.New(&logBuf, "", 0)) {
+		t.Error("Response with \"Expires\" header should be cacheable")
+	}
+	if !strings.Contains(logBuf.String(), "malformed Expires date") {
+		t.Errorf("IsCacheable did not warn about the malformed Expires header: %q", logBuf.String())
+	}
+}
+
+func TestListValuedHeaders(t *testing.T) {
+	testForEachVersion(t, func(ver version.Version, t *testing.T) {
+		e, s, c := createTestExchange(ver, t)
+		e.ResponseHeaders.Add("Link", " <https://example.com/style.css>;rel=preload;as=style")
+		e.ResponseHeaders.Add("Link", "")
+		e.ResponseHeaders.Add("Link", "<https://example.com/a.js>;rel=preload;as=script, <https://example.com/b.js>;rel=preload;as=script")
+		e.ResponseHeaders.Add("Vary", "Accept")
+		e.ResponseHeaders.Add("Vary", "Accept-Encoding")
+		e.ResponseHeaders.Add("Cache-Control", "public")
+		e.ResponseHeaders.Add("Cache-Control", "max-age=300")
+		if err := e.AddSignatureHeader(s); err != nil {
+			t.Fatal(err)
+		}
+
+		var buf bytes.Buffer
+		if err := e.Write(&buf); err != nil {
+			t.Fatal(err)
+		}
+		got, err := ReadExchange(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := map[string]string{
+			"Link":          "<https://example.com/style.css>;rel=preload;as=style,<https://example.com/a.js>;rel=preload;as=script, <https://example.com/b.js>;rel=preload;as=script",
+			"Vary":          "Accept,Accept-Encoding",
+			"Cache-Control": "public,max-age=300",
+		}
+		for name, value := range want {
+			if values := got.ResponseHeaders[name]; len(values) != 1 || values[0] != value {
+				t.Errorf("%s header: got %q, want %q", name, values, value)
+			}
+		}
+		verificationShouldSucceed(t, got, c, signatureDate)
+
+		// The combined value signs the same as the separate values.
+		combined := http.Header{}
+		for name, values := range e.ResponseHeaders {
+			combined[name] = values
+		}
+		for name, value := range want {
+			combined.Set(name, value)
+		}
+		bs1, err := CBORFromHeader(e.ResponseHeaders, 200, ver)
+		if err != nil {
+			t.Fatal(err)
+		}
+		bs2, err := CBORFromHeader(combined, 200, ver)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(bs1, bs2) {
+			t.Error("separate and combined list-valued headers serialize differently")
+		}
+
+		// The values of other headers are neither trimmed nor dropped.
+		other := http.Header{"Content-Type": {"text/html"}, "X-List": {" a", ""}}
+		bs1, err = CBORFromHeader(other, 200, ver)
+		if err != nil {
+			t.Fatal(err)
+		}
+		other.Set("X-List", " a,")
+		bs2, err = CBORFromHeader(other, 200, ver)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(bs1, bs2) {
+			t.Error("values of X-List were not combined as they are")
+		}
+	})
+}
+
+func TestEarlyHints(t *testing.T) {
+	e, _, _ := createTestExchange(version.Version1b3, t)
+	e.ResponseHeaders.Add("Link", `</style.css>;rel=preload;as=style, <https://example.com/x.js>;rel="preload";as=script`)
+	e.ResponseHeaders.Add("Link", `<https://cdn.example/a.js>;rel=preload;as=script`)
+	e.ResponseHeaders.Add("Link", `<https://cdn.example/f.woff2>; rel=preload; as=font; crossorigin`)
+	e.ResponseHeaders.Add("Link", `<./page.html>;rel=preload;as=document, <https://example.com/next>;rel=prefetch`)
+
+	hints, err := e.EarlyHints()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []struct {
+		link     string
+		eligible bool
+	}{
+		{"<https://example.com/style.css>;rel=preload;as=style", true},
+		{"<https://example.com/x.js>;rel=preload;as=script", true},
+		{"<https://cdn.example/f.woff2>;rel=preload;as=font;crossorigin", false},
+		{"<https://example.com/page.html>;rel=preload;as=document", false},
+	}
+	if len(hints) != len(want) {
+		t.Fatalf("got %d hints, want %d: %v", len(hints), len(want), hints)
+	}
+	for i, w := range want {
+		if got := hints[i].String(); got != w.link {
+			t.Errorf("hint %d: got %q, want %q", i, got, w.link)
+		}
+		if hints[i].Eligible != w.eligible {
+			t.Errorf("hint %d: got Eligible %v, want %v", i, hints[i].Eligible, w.eligible)
+		}
+	}
+
+	e.ResponseHeaders.Set("Link", `<https://example.com/a.css;rel=preload`)
+	if _, err := e.EarlyHints(); err == nil {
+		t.Error("EarlyHints unexpectedly accepted a malformed Link header")
+	}
+}
+
+func TestMetadataRoundTrip(t *testing.T) {
+	testForEachVersion(t, func(ver version.Version, t *testing.T) {
+		e, s, _ := createTestExchange(ver, t)
+		if err := e.AddSignatureHeader(s); err != nil {
+			t.Fatal(err)
+		}
+
+		m, err := e.Metadata()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m.Version != ver || m.RequestURI != requestUrl || !m.Expires.Equal(s.Expires) {
+			t.Errorf("Unexpected metadata: %+v", m)
+		}
+		if m.PayloadDigest == "" || m.PayloadDigest != e.ResponseHeaders.Get(ver.MiceEncoding().DigestHeaderName()) {
+			t.Errorf("Unexpected payload digest: %q", m.PayloadDigest)
+		}
+		if len(m.CertSha256) != sha256.Size {
+			t.Errorf("Unexpected cert-sha256: %v", m.CertSha256)
+		}
+
+		bs, err := m.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got Metadata
+		if err := got.UnmarshalBinary(bs); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(&got, m) {
+			t.Errorf("Metadata round trip mismatch: got %+v, want %+v", got, m)
+		}
+
+		if err := got.UnmarshalBinary(bs[:len(bs)-1]); err == nil {
+			t.Error("UnmarshalBinary unexpectedly accepted truncated metadata")
+		}
+	})
+}
+
+func TestTrustSurface(t *testing.T) {
+	testForEachVersion(t, func(ver version.Version, t *testing.T) {
+		e, s, c := createTestExchange(ver, t)
+		if err := e.AddSignatureHeader(s); err != nil {
+			t.Fatal(err)
+		}
+		chain, err := certurl.ReadCertChain(bytes.NewReader(c))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		r, err := e.TrustSurface(chain)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.RequestURI != requestUrl || r.ResponseStatus != 200 {
+			t.Errorf("Unexpected request URL and status: %q, %d", r.RequestURI, r.ResponseStatus)
+		}
+		if !reflect.DeepEqual(r.ResponseHeaders, e.ResponseHeaders) {
+			t.Errorf("Unexpected response headers: %v", r.ResponseHeaders)
+		}
+		if (r.RequestHeaders != nil) != (ver != version.Version1b3) {
+			t.Errorf("Unexpected request headers: %v", r.RequestHeaders)
+		}
+		if r.PayloadDigest != e.ResponseHeaders.Get(ver.MiceEncoding().DigestHeaderName()) {
+			t.Errorf("Unexpected payload digest: %q", r.PayloadDigest)
+		}
+		if r.CertSubject != s.Certs[0].Subject.String() || !reflect.DeepEqual(r.CertSANs, []string{"example.org"}) {
+			t.Errorf("Unexpected certificate subject and SANs: %q, %q", r.CertSubject, r.CertSANs)
+		}
+		if !bytes.Equal(r.CertSha256, chain[0].CertSha256()) {
+			t.Errorf("Unexpected cert-sha256: %v", r.CertSha256)
+		}
+		if r.CertURL != s.CertUrl.String() || r.ValidityURL != s.ValidityUrl.String() {
+			t.Errorf("Unexpected URLs: cert-url %q, validity-url %q", r.CertURL, r.ValidityURL)
+		}
+		if !r.Date.Equal(s.Date) || !r.Expires.Equal(s.Expires) {
+			t.Errorf("Unexpected validity window: %v - %v", r.Date, r.Expires)
+		}
+
+		// The report is a copy.
+		r.ResponseHeaders.Set("Content-Type", "text/plain")
+		if e.ResponseHeaders.Get("Content-Type") == "text/plain" {
+			t.Error("Modifying the report modified the exchange")
+		}
+	})
+}
+
+func createSignedTestExchanges(t testing.TB, n int) ([]*Exchange, []byte) {
+	var exchanges []*Exchange
+	var certBytes []byte
+	for i := 0; i < n; i++ {
+		e, s, c := createTestExchange(version.Version1b3, t)
+		if err := e.AddSignatureHeader(s); err != nil {
+			t.Fatal(err)
+		}
+		exchanges = append(exchanges, e)
+		certBytes = c
+	}
+	return exchanges, certBytes
+}
+
+func TestBatchVerify(t *testing.T) {
+	exchanges, c := createSignedTestExchanges(t, 3)
+	// A broken exchange doesn't affect the others.
+	exchanges[1].Payload[len(exchanges[1].Payload)-1] ^= 1
+
+	fetches := 0
+	certFetcher := func(_ string) ([]byte, error) {
+		fetches++
+		return c, nil
+	}
+	results := BatchVerify(exchanges, signatureDate, certFetcher, nullLogger)
+	if len(results) != len(exchanges) {
+		t.Fatalf("got %d results, want %d", len(results), len(exchanges))
+	}
+	for i, want := range []bool{true, false, true} {
+		if results[i].OK != want {
+			t.Errorf("result %d: got OK %v, want %v", i, results[i].OK, want)
+		}
+		if want && !bytes.Equal(results[i].Payload, []byte(payload)) {
+			t.Errorf("result %d: unexpected payload %q", i, results[i].Payload)
+		}
+	}
+	if fetches != 1 {
+		t.Errorf("certificate was fetched %d times, want 1", fetches)
+	}
+}
+
+const benchmarkBatchSize = 100
+
+func BenchmarkVerifyLoop(b *testing.B) {
+	exchanges, c := createSignedTestExchanges(b, benchmarkBatchSize)
+	certFetcher := func(_ string) ([]byte, error) { return c, nil }
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, e := range exchanges {
+			if _, ok := e.Verify(signatureDate, certFetcher, nullLogger); !ok {
+				b.Fatal("Verification failed")
+			}
+		}
+	}
+}
+
+func BenchmarkBatchVerify(b *testing.B) {
+	exchanges, c := createSignedTestExchanges(b, benchmarkBatchSize)
+	certFetcher := func(_ string) ([]byte, error) { return c, nil }
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, r := range BatchVerify(exchanges, signatureDate, certFetcher, nullLogger) {
+			if !r.OK {
+				b.Fatal("Verification failed")
+			}
+		}
+	}
+}
+
+func TestSizeLimits(t *testing.T) {
+	wantSizeLimitError := func(name string, err error, part string) {
+		t.Helper()
+		var sizeErr *SizeLimitError
+		if !errors.As(err, &sizeErr) {
+			t.Errorf("%s: got error %v, want a *SizeLimitError", name, err)
+		} else if sizeErr.Part != part {
+			t.Errorf("%s: got a *SizeLimitError for %q, want one for %q", name, sizeErr.Part, part)
+		}
+	}
+
+	e, s, _ := createTestExchange(version.Version1b3, t)
+	s.MaxPayloadSize = int64(len(e.Payload)) - 1
+	wantSizeLimitError("signing with MaxPayloadSize", e.AddSignatureHeader(s), "payload")
+	s.MaxPayloadSize = int64(len(e.Payload))
+	if err := e.AddSignatureHeader(s); err != nil {
+		t.Fatal(err)
+	}
+
+	// A streamed payload is limited by its encoded size too, although it is
+	// not in Payload.
+	streamed := NewExchange(version.Version1b3, requestUrl, http.MethodGet, nil, 200, http.Header{"Content-Type": {"text/html"}}, nil)
+	if err := streamed.MiEncodePayloadStream(onlyReader{strings.NewReader(payload)}, 16); err != nil {
+		t.Fatal(err)
+	}
+	defer streamed.Close()
+	s.MaxPayloadSize = int64(len(e.Payload)) - 1
+	wantSizeLimitError("signing a streamed payload with MaxPayloadSize", streamed.AddSignatureHeader(s), "payload")
+	s.MaxPayloadSize = int64(len(e.Payload))
+	if err := streamed.AddSignatureHeader(s); err != nil {
+		t.Errorf("signing a streamed payload of the maximum size: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := e.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	_, err := ReadExchange(bytes.NewReader(buf.Bytes()), WithMaxPayloadSize(int64(len(e.Payload))-1))
+	wantSizeLimitError("reading with WithMaxPayloadSize", err, "payload")
+	if _, err := ReadExchange(bytes.NewReader(buf.Bytes()), WithMaxPayloadSize(int64(len(e.Payload)))); err != nil {
+		t.Errorf("reading a payload of the maximum size: %v", err)
+	}
+
+	// The prologue is the magic, fallbackUrlLength, the fallback URL,
+	// sigLength and headerLength.
+	headerLengthOffset := len(version.Version1b3.HeaderMagicBytes()) + 2 + len(e.RequestURI) + 3
+	for _, c := range []struct {
+		part   string
+		offset int
+	}{
+		{"signature", headerLengthOffset - 3},
+		{"headers", headerLengthOffset},
+	} {
+		corrupted := append([]byte{}, buf.Bytes()...)
+		copy(corrupted[c.offset:], []byte{0xff, 0xff, 0xff})
+		_, err := ReadExchange(bytes.NewReader(corrupted))
+		wantSizeLimitError("reading an oversized "+c.part, err, c.part)
+		_, err = ReadExchangeLenient(bytes.NewReader(corrupted))
+		wantSizeLimitError("leniently reading an oversized "+c.part, err, c.part)
+	}
+
+	e, s, _ = createTestExchange(version.Version1b3, t)
+	e.ResponseHeaders.Set("X-Padding", strings.Repeat("a", 512*1024))
+	wantSizeLimitError("signing oversized headers", e.AddSignatureHeader(s), "headers")
+	if e.SignatureHeaderValue != "" {
+		t.Error("signing oversized headers set the Signature header")
+	}
+}
+
+func TestDiff(t *testing.T) {
+	e, s, _ := createTestExchange(version.Version1b3, t)
+	if err := e.AddSignatureHeader(s); err != nil {
+		t.Fatal(err)
+	}
+	roundTrip := func() *Exchange {
+		var buf bytes.Buffer
+		if err := e.Write(&buf); err != nil {
+			t.Fatal(err)
+		}
+		read, err := ReadExchange(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return read
+	}
+	if diffs := Diff(e, roundTrip()); diffs != nil {
+		t.Errorf("got differences %v after a round trip, want none", diffs)
+	}
+
+	resigned := roundTrip()
+	s.Date = s.Date.Add(time.Minute)
+	if err := resigned.AddSignatureHeader(s); err != nil {
+		t.Fatal(err)
+	}
+	diffs := Diff(e, resigned)
+	if !diffs.SignatureOnly() {
+		t.Errorf("got differences %v after re-signing, want only signature ones", diffs)
+	}
+	want := Difference{Kind: "signature", Name: "label;date", A: strconv.FormatInt(signatureDate.Unix(), 10), B: strconv.FormatInt(s.Date.Unix(), 10)}
+	if len(diffs) != 2 || diffs[0] != want || diffs[1].Name != "label;sig" {
+		t.Errorf("got differences %v after re-signing, want %v and one of label;sig", diffs, want)
+	}
+
+	changed := roundTrip()
+	changed.ResponseHeaders.Set("Cache-Control", "max-age=60")
+	changed.Payload[len(changed.Payload)-1] ^= 1
+	diffs = Diff(e, changed)
+	if diffs.SignatureOnly() {
+		t.Error("SignatureOnly returned true for changed headers and payload")
+	}
+	var got []string
+	for _, d := range diffs {
+		got = append(got, d.String())
+	}
+	if want := []string{
+		`response-header "Cache-Control": absent != "max-age=60"`,
+		fmt.Sprintf("payload: %q != %q", payloadHash(e.Payload), payloadHash(changed.Payload)),
+	}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got differences %q, want %q", got, want)
+	}
+}
+
+func payloadHash(payload []byte) string {
+	sum := sha256.Sum256(payload)
+	return "sha256-" + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func TestDeterministicSigning(t *testing.T) {
+	testForEachVersion(t, func(ver version.Version, t *testing.T) {
+		sign := func() []byte {
+			e, s, _ := createTestExchange(ver, t)
+			s.Deterministic = true
+			if err := e.AddSignatureHeader(s); err != nil {
+				t.Fatal(err)
+			}
+			var buf bytes.Buffer
+			if err := e.Write(&buf); err != nil {
+				t.Fatal(err)
+			}
+			return buf.Bytes()
+		}
+		first := sign()
+		if second := sign(); !bytes.Equal(first, second) {
+			t.Error("deterministic signing gave different exchanges")
+		}
+
+		e, s, c := createTestExchange(ver, t)
+		s.Deterministic = true
+		s.Date = time.Time{}
+		s.Now = func() time.Time { return signatureDate }
+		if err := e.AddSignatureHeader(s); err == nil {
+			t.Error("deterministic signing unexpectedly succeeded without a date")
+		}
+
+		read, err := ReadExchange(bytes.NewReader(first))
+		if err != nil {
+			t.Fatal(err)
+		}
+		verificationShouldSucceed(t, read, c, signatureDate)
+	})
+}
+
+func TestVerifyWithChainPolicy(t *testing.T) {
+	// The test certificate is self-signed, valid for example.org from
+	// 2018-11-05 to 2019-10-31, and has the CanSignHttpExchanges extension.
+	e, s, c := createTestExchange(version.Version1b3, t)
+	verificationTime := time.Date(2018, 11, 6, 0, 0, 0, 0, time.UTC)
+	e.RequestURI = "https://example.org/"
+	s.ValidityUrl, _ = url.Parse("https://example.org/resource.validity")
+	s.Date = verificationTime
+	s.Expires = verificationTime.Add(time.Hour)
+	if err := e.AddSignatureHeader(s); err != nil {
+		t.Fatal(err)
+	}
+	certFetcher := func(_ string) ([]byte, error) { return c, nil }
+	roots := x509.NewCertPool()
+	roots.AddCert(s.Certs[0])
+
+	for _, tc := range []struct {
+		name   string
+		policy certurl.ChainPolicy
+		ok     bool
+	}{
+		{"trusted", certurl.ChainPolicy{Roots: roots}, true},
+		{"untrusted", certurl.ChainPolicy{Roots: x509.NewCertPool()}, false},
+		{"self-signed allowed", certurl.ChainPolicy{Roots: x509.NewCertPool(), AllowSelfSigned: true}, true},
+	} {
+		_, err := e.VerifyWithError(verificationTime, certFetcher, WithIgnoreOCSP(), WithChainPolicy(tc.policy))
+		if tc.ok && err != nil {
+			t.Errorf("%s: verification failed: %v", tc.name, err)
+		}
+		if !tc.ok && !errors.Is(err, ErrUntrustedCert) {
+			t.Errorf("%s: got error %v, want ErrUntrustedCert", tc.name, err)
+		}
+	}
+
+	// The certificate is not valid for the host of the request URL.
+	e.RequestURI = "https://www.example.org/"
+	s.ValidityUrl, _ = url.Parse("https://www.example.org/resource.validity")
+	if err := e.AddSignatureHeader(s); err != nil {
+		t.Fatal(err)
+	}
+	_, err := e.VerifyWithError(verificationTime, certFetcher, WithIgnoreOCSP(), WithChainPolicy(certurl.ChainPolicy{AllowSelfSigned: true}))
+	if !errors.Is(err, ErrUntrustedCert) {
+		t.Errorf("got error %v for another host, want ErrUntrustedCert", err)
+	}
+}
+
+var oidCanSignHttpExchanges = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 11129, 2, 1, 22}
+
+func TestVerifyMainCertRequirements(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Browsers enforce the 90 days limit after 2019-08-01.
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, c := range []struct {
+		name                 string
+		canSignHttpExchanges bool
+		validity             time.Duration
+		ok                   bool
+	}{
+		{"valid", true, 90 * 24 * time.Hour, true},
+		{"no CanSignHttpExchanges", false, 90 * 24 * time.Hour, false},
+		{"validity too long", true, 91 * 24 * time.Hour, false},
+	} {
+		template := &x509.Certificate{
+			SerialNumber: big.NewInt(1),
+			DNSNames:     []string{"example.com"},
+			NotBefore:    now.Add(-time.Hour),
+			NotAfter:     now.Add(c.validity - time.Hour),
+		}
+		if c.canSignHttpExchanges {
+			template.ExtraExtensions = []pkix.Extension{{Id: oidCanSignHttpExchanges, Value: asn1.NullBytes}}
+		}
+		der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			t.Fatal(err)
+		}
+		chain, err := certurl.NewCertChain([]*x509.Certificate{cert}, []byte("dummy"), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var certCBOR bytes.Buffer
+		if err := chain.Write(&certCBOR); err != nil {
+			t.Fatal(err)
+		}
+		certFetcher := func(_ string) ([]byte, error) { return certCBOR.Bytes(), nil }
+
+		e, s, _ := createTestExchange(version.Version1b3, t)
+		s.Certs = []*x509.Certificate{cert}
+		s.PrivKey = key
+		s.Date = now
+		s.Expires = now.Add(time.Hour)
+		if err := e.AddSignatureHeader(s); err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = e.VerifyWithError(now, certFetcher, WithIgnoreOCSP())
+		if c.ok && err != nil {
+			t.Errorf("%s: verification failed: %v", c.name, err)
+		}
+		if !c.ok && !errors.Is(err, ErrCertRequirements) {
+			t.Errorf("%s: got error %v, want ErrCertRequirements", c.name, err)
+		}
+		spkiHash := base64.StdEncoding.EncodeToString(chain[0].SPKISha256())
+		for _, opt := range []VerifyOption{WithIgnoreCertRequirements(), WithIgnoreCertErrorsSPKIList([]string{spkiHash})} {
+			if _, err := e.VerifyWithError(now, certFetcher, WithIgnoreOCSP(), opt); err != nil {
+				t.Errorf("%s: verification with the requirements ignored failed: %v", c.name, err)
+			}
+		}
+		if _, err := e.VerifyWithError(now, certFetcher, WithIgnoreOCSP(), WithIgnoreCertErrorsSPKIList([]string{"other"})); c.ok != (err == nil) {
+			t.Errorf("%s: got error %v with the SPKI hash of another certificate", c.name, err)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package signedexchangetest_test
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/WICG/webpackage/go/signedexchange"
+	. "github.com/WICG/webpackage/go/signedexchange/signedexchangetest"
+	"github.com/WICG/webpackage/go/signedexchange/version"
+)
+
+type recorder struct {
+	errors []string
+}
+
+func (r *recorder) Helper() {}
+
+func (r *recorder) Errorf(format string, args ...interface{}) {
+	r.errors = append(r.errors, fmt.Sprintf(format, args...))
+}
+
+func (r *recorder) Fatal(args ...interface{}) {
+	panic(fmt.Sprint(args...))
+}
+
+func newExchange() *signedexchange.Exchange {
+	header := http.Header{}
+	header.Set("Content-Type", "text/html")
+	header.Set("Cache-Control", "max-age=60")
+	return signedexchange.NewExchange(version.Version1b3, "https://example.com/", http.MethodGet, nil, 200, header, []byte("<p>Hello</p>"))
+}
+
+func TestAssertExchangeEqual(t *testing.T) {
+	r := &recorder{}
+	AssertExchangeEqual(r, newExchange(), newExchange())
+	if len(r.errors) != 0 {
+		t.Errorf("Unexpected differences between equal exchanges: %q", r.errors)
+	}
+
+	got := newExchange()
+	got.ResponseStatus = 404
+	got.ResponseHeaders.Set("Content-Type", "text/plain")
+	got.ResponseHeaders.Del("Cache-Control")
+	got.ResponseHeaders.Set("Etag", "0123")
+	got.Payload = []byte("<p>Hello!</p>")
+
+	r = &recorder{}
+	AssertExchangeEqual(r, got, newExchange())
+	want := []string{
+		"ResponseStatus: got 404, want 200",
+		`ResponseHeaders: missing "Cache-Control"`,
+		`ResponseHeaders["Content-Type"]: got ["text/plain"], want ["text/html"]`,
+		`ResponseHeaders: unexpected "Etag"`,
+		"first difference at offset 8",
+	}
+	if len(r.errors) != len(want) {
+		t.Fatalf("Unexpected number of differences: got %q", r.errors)
+	}
+	for i, w := range want {
+		if !strings.Contains(r.errors[i], w) {
+			t.Errorf("difference %d: got %q, want it to contain %q", i, r.errors[i], w)
+		}
+	}
+}
+
+func TestNewSigner(t *testing.T) {
+	s, certBytes := NewSigner(t)
+	e := newExchange()
+	if err := e.MiEncodePayload(16); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.AddSignatureHeader(s); err != nil {
+		t.Fatal(err)
+	}
+	certFetcher := func(_ string) ([]byte, error) { return certBytes, nil }
+	if _, err := e.VerifyWithResult(SignatureDate, certFetcher); err != nil {
+		t.Errorf("Verification of an exchange signed with NewSigner failed: %v", err)
+	}
+}
@@ -6,8 +6,14 @@ import (
 	"crypto/rand"
 	"crypto/sha256"
 	"crypto/x509"
+	"errors"
 	"fmt"
+	"io"
+	"log"
+	"mime"
 	"net/url"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/WICG/webpackage/go/internal/cbor"
@@ -32,14 +38,190 @@ func contextString(v version.Version) string {
 	}
 }
 
+// ExpiresPolicy specifies what a Signer does when its Expires is after the
+// NotAfter of the leaf certificate, i.e. the signature would outlive the
+// certificate.
+type ExpiresPolicy int
+
+const (
+	// AllowExpiresAfterCert signs with Expires as is.
+	AllowExpiresAfterCert ExpiresPolicy = iota
+	// RejectExpiresAfterCert makes signing fail.
+	RejectExpiresAfterCert
+	// ClampExpiresToCert signs with the NotAfter of the leaf certificate as
+	// the expires of the signature, and logs a warning to the Signer's
+	// Logger. The Signer's Expires is not modified.
+	ClampExpiresToCert
+)
+
 type Signer struct {
 	Date        time.Time
 	Expires     time.Time
 	Certs       []*x509.Certificate
 	CertUrl     *url.URL
 	ValidityUrl *url.URL
-	PrivKey     crypto.PrivateKey
-	Algorithm   signingalgorithm.SigningAlgorithm
+	// PrivKey is the private key of Certs[0]. Besides *ecdsa.PrivateKey and
+	// ed25519.PrivateKey, it may be any crypto.Signer, e.g. a wrapper of a
+	// key in a hardware module or a cloud KMS that is never exported. It is
+	// not used if Algorithm is set.
+	PrivKey   crypto.PrivateKey
+	Algorithm signingalgorithm.SigningAlgorithm
+	// Rand is the source of randomness passed to PrivKey for signing. If nil,
+	// crypto/rand.Reader is used.
+	Rand io.Reader
+
+	// ContextString, if non-empty, replaces the version's context string in
+	// the signed message. It is intended for prototyping against draft
+	// context strings, and can only be used if Experimental is true.
+	// Exchanges signed with a non-standard context string are rejected by
+	// browsers.
+	ContextString string
+	Experimental  bool
+
+	// ExpiresPolicy is applied if Expires is after the NotAfter of Certs[0].
+	ExpiresPolicy ExpiresPolicy
+
+	// Logger, if non-nil, receives warnings about signing, e.g. when
+	// Expires is clamped by ClampExpiresToCert.
+	Logger *log.Logger
+
+	// Label is the label of the signature in the Signature header. If empty,
+	// "label" is used. The Signers of an exchange with several signatures
+	// must have distinct labels.
+	Label string
+
+	// Now returns the current time, which is used as the date of each
+	// signature if Date is zero. Date itself is left zero, so that a Signer
+	// used for many exchanges dates each signature when it is made. If nil,
+	// time.Now is used.
+	Now func() time.Time
+
+	// CanonicalizeContentType makes AddSignatureHeader rewrite the
+	// Content-Type response header to its canonical form before signing:
+	// a lowercased media type and parameter names, and a lowercased charset,
+	// e.g. "text/html; charset=utf-8". The exchange carries the rewritten
+	// header, so verifiers see the signed form.
+	CanonicalizeContentType bool
+
+	// HeaderPolicy, if non-nil, is applied to the response headers by
+	// AddSignatureHeader before signing, like CanonicalizeContentType.
+	HeaderPolicy *HeaderPolicy
+
+	// Deterministic makes signing reproducible, e.g. for build systems that
+	// check that artifacts are bit-identical across machines: given the
+	// same exchange and Signer, the signature is the same bytes. ECDSA
+	// nonces are derived from PrivKey and the signed message as in RFC 6979
+	// instead of read from Rand, and Date must be set, as Now is not used.
+	// PrivKey must be an *ecdsa.PrivateKey or an ed25519.PrivateKey. It is
+	// not used if Algorithm is set.
+	Deterministic bool
+
+	// MaxPayloadSize, if positive, makes signing fail with a
+	// *SizeLimitError if the payload of the exchange, as it is written, e.g.
+	// MI-encoded, is larger than MaxPayloadSize bytes. This includes a
+	// payload given to MiEncodePayloadStream.
+	MaxPayloadSize int64
+
+	// bufPool, if non-nil, holds the buffers signed messages are serialized
+	// into. It is shared by the Signers of a SignerPool.
+	bufPool *sync.Pool
+}
+
+// canonicalContentType returns the canonical form of the Content-Type value
+// contentType. See Signer.CanonicalizeContentType.
+func canonicalContentType(contentType string) (string, error) {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return "", fmt.Errorf("signedexchange: cannot parse Content-Type %q: %v", contentType, err)
+	}
+	if charset, ok := params["charset"]; ok {
+		params["charset"] = strings.ToLower(charset)
+	}
+	canonical := mime.FormatMediaType(mediaType, params)
+	if canonical == "" {
+		return "", fmt.Errorf("signedexchange: cannot canonicalize Content-Type %q", contentType)
+	}
+	return canonical, nil
+}
+
+func (s *Signer) getBuffer() *bytes.Buffer {
+	if s.bufPool == nil {
+		return &bytes.Buffer{}
+	}
+	buf := s.bufPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	return buf
+}
+
+func (s *Signer) putBuffer(buf *bytes.Buffer) {
+	if s.bufPool != nil {
+		s.bufPool.Put(buf)
+	}
+}
+
+func (s *Signer) now() time.Time {
+	if s.Now == nil {
+		return time.Now()
+	}
+	return s.Now()
+}
+
+// expires returns the expires of a signature dated date, which is s.Expires
+// checked against the validity of the leaf certificate according to
+// s.ExpiresPolicy.
+func (s *Signer) expires(date time.Time) (time.Time, error) {
+	if len(s.Certs) == 0 || !s.Expires.After(s.Certs[0].NotAfter) {
+		return s.Expires, nil
+	}
+	notAfter := s.Certs[0].NotAfter
+	switch s.ExpiresPolicy {
+	case AllowExpiresAfterCert:
+		return s.Expires, nil
+	case RejectExpiresAfterCert:
+		return time.Time{}, fmt.Errorf("signedexchange: expires (%v) is after the certificate's NotAfter (%v)", s.Expires, notAfter)
+	case ClampExpiresToCert:
+		if !notAfter.After(date) {
+			return time.Time{}, fmt.Errorf("signedexchange: the certificate expires (%v) before date (%v)", notAfter, date)
+		}
+		if s.Logger != nil {
+			s.Logger.Printf("Warning: expires (%v) is after the certificate's NotAfter; the signature expires at %v instead", s.Expires, notAfter)
+		}
+		return notAfter, nil
+	default:
+		return time.Time{}, fmt.Errorf("signedexchange: unknown ExpiresPolicy %d", s.ExpiresPolicy)
+	}
+}
+
+// label returns the label of the signatures by s.
+func (s *Signer) label() string {
+	if s.Label == "" {
+		return "label"
+	}
+	return s.Label
+}
+
+// checkValidity checks that expires is after date, by at most 7 days.
+func checkValidity(date, expires time.Time) error {
+	validity := expires.Sub(date)
+	if validity <= 0 {
+		return fmt.Errorf("signedexchange: expires (%v) is not after date (%v)", expires, date)
+	}
+	if validity > maxSignatureValidity {
+		return fmt.Errorf("signedexchange: signature validity %v exceeds the maximum of %v", validity, maxSignatureValidity)
+	}
+	return nil
+}
+
+// contextString returns the context string s signs exchanges of version v
+// with.
+func (s *Signer) contextString(v version.Version) (string, error) {
+	if s.ContextString == "" {
+		return contextString(v), nil
+	}
+	if !s.Experimental {
+		return "", fmt.Errorf("signedexchange: custom context string %q requires Experimental to be set", s.ContextString)
+	}
+	return s.ContextString, nil
 }
 
 func calculateCertSha256(certs []*x509.Certificate) []byte {
@@ -52,13 +234,22 @@ func calculateCertSha256(certs []*x509.Certificate) []byte {
 	return sum[:]
 }
 
-func serializeSignedMessage(e *Exchange, certSha256 []byte, validityUrl string, date, expires int64) ([]byte, error) {
+func serializeSignedMessage(e *Exchange, context string, certSha256 []byte, validityUrl string, date, expires int64) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := writeSignedMessage(&buf, e, context, certSha256, validityUrl, date, expires); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// writeSignedMessage is like serializeSignedMessage, but appends the message
+// to buf.
+func writeSignedMessage(buf *bytes.Buffer, e *Exchange, context string, certSha256 []byte, validityUrl string, date, expires int64) error {
 	switch e.Version {
 	case version.Version1b1:
 		// "Let message be the concatenation of the following byte strings.
 		// This matches the [I-D.ietf-tls-tls13] format to avoid cross-protocol
 		// attacks when TLS certificates are used to sign manifests." [spec text]
-		var buf bytes.Buffer
 
 		// "1. A string that consists of octet 32 (0x20) repeated 64 times." [spec text]
 		for i := 0; i < 64; i++ {
@@ -66,7 +257,7 @@ func serializeSignedMessage(e *Exchange, certSha256 []byte, validityUrl string,
 		}
 
 		// "2. A context string: the ASCII encoding of "HTTP Exchange"." [spec text]
-		buf.WriteString(contextString(e.Version))
+		buf.WriteString(context)
 
 		// "3. A single 0 byte which serves as a separator." [spec text]
 		buf.WriteByte(0)
@@ -112,17 +303,13 @@ func serializeSignedMessage(e *Exchange, certSha256 []byte, validityUrl string,
 			}),
 		)
 
-		enc := cbor.NewEncoder(&buf)
-		if err := enc.EncodeMap(mes); err != nil {
-			return nil, err
-		}
-		return buf.Bytes(), nil
+		enc := cbor.NewEncoder(buf)
+		return enc.EncodeMap(mes)
 
 	case version.Version1b2, version.Version1b3:
 		// draft-yasskin-http-origin-signed-responses.html#signature-validity
 
 		// "Let message be the concatenation of the following byte strings. This matches the [I-D.ietf-tls-tls13] format to avoid cross-protocol attacks if anyone uses the same key in a TLS certificate and an exchange-signing certificate." [spec text]
-		var buf bytes.Buffer
 
 		// "1. A string that consists of octet 32 (0x20) repeated 64 times." [spec text]
 		for i := 0; i < 64; i++ {
@@ -130,7 +317,7 @@ func serializeSignedMessage(e *Exchange, certSha256 []byte, validityUrl string,
 		}
 
 		// "2. A context string: the ASCII encoding of “HTTP Exchange 1”." [spec text]
-		buf.WriteString(contextString(e.Version))
+		buf.WriteString(context)
 
 		// "3. A single 0 byte which serves as a separator." [spec text]
 		buf.WriteByte(0)
@@ -165,58 +352,132 @@ func serializeSignedMessage(e *Exchange, certSha256 []byte, validityUrl string,
 		// "9. The 8-byte big-endian encoding of the length in bytes of headers, followed by the bytes of headers." [spec text]
 		headerBuf := &bytes.Buffer{}
 		if err := e.encodeExchangeHeaders(cbor.NewEncoder(headerBuf)); err != nil {
-			return nil, err
+			return err
 		}
 		headerLenBytes, _ := bigendian.EncodeBytesUint(int64(headerBuf.Len()), 8)
 		buf.Write(headerLenBytes)
-		headerBuf.WriteTo(&buf)
+		headerBuf.WriteTo(buf)
 
-		return buf.Bytes(), nil
+		return nil
 	default:
 		panic("not reached")
 	}
 }
 
-func (s *Signer) sign(e *Exchange) ([]byte, error) {
-	if s.Algorithm == nil {
+func (s *Signer) sign(e *Exchange, date, expires time.Time) ([]byte, error) {
+	if len(s.Certs) > 0 {
+		if err := checkSignatureAlgorithm(e.Version, s.Certs[0].PublicKey); err != nil {
+			return nil, err
+		}
+	}
+	algorithm := s.Algorithm
+	if algorithm == nil {
 		var err error
-		s.Algorithm, err = signingalgorithm.SigningAlgorithmForPrivateKey(s.PrivKey, rand.Reader)
+		algorithm, err = s.signingAlgorithm()
 		if err != nil {
 			return nil, err
 		}
 	}
 
-	msg, err := serializeSignedMessage(e, calculateCertSha256(s.Certs), s.ValidityUrl.String(), s.Date.Unix(), s.Expires.Unix())
+	context, err := s.contextString(e.Version)
 	if err != nil {
 		return nil, err
 	}
+	buf := s.getBuffer()
+	defer s.putBuffer(buf)
+	if err := writeSignedMessage(buf, e, context, calculateCertSha256(s.Certs), s.ValidityUrl.String(), date.Unix(), expires.Unix()); err != nil {
+		return nil, err
+	}
 
-	return s.Algorithm.Sign(msg)
+	return algorithm.Sign(buf.Bytes())
 }
 
-func (s *Signer) signatureHeaderValue(e *Exchange) (string, error) {
+// signingAlgorithm returns the SigningAlgorithm for s.PrivKey, which is
+// deterministic if s.Deterministic is set.
+func (s *Signer) signingAlgorithm() (signingalgorithm.SigningAlgorithm, error) {
+	if s.Deterministic {
+		return signingalgorithm.DeterministicSigningAlgorithmForPrivateKey(s.PrivKey)
+	}
+	random := s.Rand
+	if random == nil {
+		random = rand.Reader
+	}
+	return signingalgorithm.SigningAlgorithmForPrivateKey(s.PrivKey, random)
+}
+
+// checkSignatureAlgorithm returns an error if version ver does not allow the
+// signature algorithm of a certificate with the public key pub. Keys of
+// unknown types are left to the signing and verification to reject.
+func checkSignatureAlgorithm(ver version.Version, pub crypto.PublicKey) error {
+	name, err := signingalgorithm.AlgorithmName(pub)
+	if err != nil {
+		return nil
+	}
+	if !ver.SupportsSignatureAlgorithm(name) {
+		return fmt.Errorf("signedexchange: version %s does not allow the signature algorithm %s", ver, name)
+	}
+	return nil
+}
+
+// validateRequestURLScheme returns an error unless the request URL of an
+// exchange has the https scheme, which is required for the exchange to be
+// valid.
+func validateRequestURLScheme(requestURI string) error {
+	u, err := url.Parse(requestURI)
+	if err != nil {
+		return fmt.Errorf("signedexchange: cannot parse request URL %q: %v", requestURI, err)
+	}
+	if u.Scheme != "https" {
+		return fmt.Errorf("signedexchange: request URL with disallowed scheme %q. The request URL must have a scheme of \"https\".", u.Scheme)
+	}
+	return nil
+}
+
+// signature returns the signature of e by s, as an item of the Signature
+// header.
+func (s *Signer) signature(e *Exchange) (*structuredheader.ParameterisedIdentifier, error) {
 	switch s.CertUrl.Scheme {
 	case "https", "data":
 		break
 	default:
-		return "", fmt.Errorf("signedexchange: cert-url with disallowed scheme %q. cert-url must have a scheme of \"https\" or \"data\".", s.CertUrl.Scheme)
+		return nil, fmt.Errorf("signedexchange: cert-url with disallowed scheme %q. cert-url must have a scheme of \"https\" or \"data\".", s.CertUrl.Scheme)
+	}
+	if err := validateRequestURLScheme(e.RequestURI); err != nil {
+		return nil, err
 	}
 
-	sig, err := s.sign(e)
+	date := s.Date
+	if date.IsZero() {
+		if s.Deterministic {
+			return nil, errors.New("signedexchange: date is not set, which deterministic signing requires")
+		}
+		date = s.now()
+	}
+	if s.Expires.IsZero() {
+		return nil, errors.New("signedexchange: expires is not set")
+	}
+	expires, err := s.expires(date)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkValidity(date, expires); err != nil {
+		return nil, err
+	}
+
+	sig, err := s.sign(e, date, expires)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	pi := structuredheader.ParameterisedIdentifier{
-		Label: "label",
+	return &structuredheader.ParameterisedIdentifier{
+		Label: structuredheader.Token(s.label()),
 		Params: structuredheader.Parameters{
 			"sig":          sig,
 			"validity-url": s.ValidityUrl.String(),
-			"integrity":    e.Version.MiceEncoding().IntegrityIdentifier(),
+			"integrity":    e.payloadEncoding().IntegrityIdentifier(),
 			"cert-url":     s.CertUrl.String(),
 			"cert-sha256":  calculateCertSha256(s.Certs),
-			"date":         s.Date.Unix(),
-			"expires":      s.Expires.Unix(),
-		}}
-	return pi.String()
+			"date":         date.Unix(),
+			"expires":      expires.Unix(),
+		}}, nil
 }
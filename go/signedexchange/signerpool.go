@@ -0,0 +1,82 @@
+package signedexchange
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"errors"
+	"log"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/WICG/webpackage/go/internal/signingalgorithm"
+)
+
+// SignerPool signs exchanges with one certificate chain and private key,
+// parsed once, from many goroutines.
+//
+// All methods of SignerPool are safe for concurrent use, and do not lock the
+// key: each call gets its own Signer holding the Date and Expires of the
+// call, and only the certificates, the URLs and the key are shared. The key
+// must therefore be safe for concurrent use, which *ecdsa.PrivateKey is.
+// An Exchange must not be signed by several goroutines at once, since
+// signing modifies its headers.
+type SignerPool struct {
+	certs       []*x509.Certificate
+	certURL     *url.URL
+	validityURL *url.URL
+	algorithm   signingalgorithm.SigningAlgorithm
+	bufPool     sync.Pool
+
+	// ExpiresPolicy is used by the Signers of the pool. It must not be
+	// changed once the pool is in use.
+	ExpiresPolicy ExpiresPolicy
+	// Logger is the Logger of the Signers of the pool.
+	Logger *log.Logger
+}
+
+// NewSignerPool creates a SignerPool that signs with key, whose certificate is
+// certs[0]. The certificates and URLs must not be modified afterwards.
+func NewSignerPool(certs []*x509.Certificate, certURL, validityURL *url.URL, key crypto.Signer) (*SignerPool, error) {
+	if len(certs) == 0 {
+		return nil, errors.New("signedexchange: no certificates for the signer pool")
+	}
+	algorithm, err := signingalgorithm.SigningAlgorithmForSigner(key, rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &SignerPool{
+		certs:       certs,
+		certURL:     certURL,
+		validityURL: validityURL,
+		algorithm:   algorithm,
+		bufPool: sync.Pool{
+			New: func() interface{} { return &bytes.Buffer{} },
+		},
+	}, nil
+}
+
+// Signer returns a new Signer that signs with the certificate and key of the
+// pool, and with date and expires. The Signer must not be used by several
+// goroutines at once, but Signers returned by different calls may be.
+func (p *SignerPool) Signer(date, expires time.Time) *Signer {
+	return &Signer{
+		Date:          date,
+		Expires:       expires,
+		Certs:         p.certs,
+		CertUrl:       p.certURL,
+		ValidityUrl:   p.validityURL,
+		Algorithm:     p.algorithm,
+		ExpiresPolicy: p.ExpiresPolicy,
+		Logger:        p.Logger,
+		bufPool:       &p.bufPool,
+	}
+}
+
+// Sign signs e with date and expires, like
+// e.AddSignatureHeader(p.Signer(date, expires)).
+func (p *SignerPool) Sign(e *Exchange, date, expires time.Time) error {
+	return e.AddSignatureHeader(p.Signer(date, expires))
+}
@@ -27,6 +27,7 @@ func init() {
 		// "Hop-by-hop header fields listed in the Connection header field
 		// (Section 6.1 of {{!RFC7230}})." [spec text]
 		// Note: The Connection header field itself is banned as uncached headers, so no-op.
+		// StripConnectionHeaders removes both before signing.
 
 		// "Header fields listed in the no-cache response directive in the
 		// "Cache-Control header field (Section 5.2.2.2 of {{!RFC7234}})."
@@ -91,3 +92,18 @@ func VerifyUncachedHeader(h http.Header) error {
 	}
 	return nil
 }
+
+// StripConnectionHeaders removes the Connection header field and the header
+// fields it lists from h. These are specific to the connection a response
+// was received on (Section 6.1 of RFC 7230), and must not be captured inside a
+// signed exchange.
+func StripConnectionHeaders(h http.Header) {
+	for _, value := range h.Values("Connection") {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+	h.Del("Connection")
+}
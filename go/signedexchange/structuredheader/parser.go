@@ -37,9 +37,39 @@ type Item interface{}
 // https://tools.ietf.org/html/draft-ietf-httpbis-header-structure-09#section-3.9
 type Token string
 
+// SyntaxError is returned by the strict parsers. Offset is the byte offset
+// within the input where parsing failed.
+type SyntaxError struct {
+	Offset int
+	Msg    string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("structuredheader: %s at offset %d", e.Msg, e.Offset)
+}
 
 type parser struct {
 	input string
+
+	// strict rejects inputs that the lenient parser tolerates, such as
+	// unpadded or non-canonical base64 in Byte Sequences.
+	strict bool
+	// length is the length of the whole input, used to compute the error
+	// offsets in strict mode.
+	length int
+}
+
+func (p *parser) offset() int {
+	return p.length - len(p.input)
+}
+
+// syntaxError converts err into a *SyntaxError pointing at the current
+// position, unless it already is one.
+func (p *parser) syntaxError(err error) error {
+	if _, ok := err.(*SyntaxError); ok {
+		return err
+	}
+	return &SyntaxError{p.offset(), strings.TrimPrefix(err.Error(), "structuredheader: ")}
 }
 
 func (p *parser) discardLeadingOWS() {
@@ -73,7 +103,7 @@ func (p *parser) consumeChar(c byte) bool {
 // ParseListOfLists parses input as a List of Lists.
 // https://tools.ietf.org/html/draft-ietf-httpbis-header-structure-09#section-4.2
 func ParseListOfLists(input string) (ListOfLists, error) {
-	p := &parser{input}
+	p := &parser{input: input}
 	p.discardLeadingOWS()
 	ll, err := p.parseListOfLists()
 	if err != nil {
@@ -89,7 +119,7 @@ func ParseListOfLists(input string) (ListOfLists, error) {
 // ParseParameterisedList parses input as a Parameterised List.
 // https://tools.ietf.org/html/draft-ietf-httpbis-header-structure-09#section-4.2
 func ParseParameterisedList(input string) (ParameterisedList, error) {
-	p := &parser{input}
+	p := &parser{input: input}
 	p.discardLeadingOWS()
 	pl, err := p.parseParameterisedList()
 	if err != nil {
@@ -102,6 +132,23 @@ func ParseParameterisedList(input string) (ParameterisedList, error) {
 	return pl, nil
 }
 
+// ParseParameterisedListStrict is like ParseParameterisedList, but rejects
+// Byte Sequences that are not canonical padded base64. Errors are returned as
+// *SyntaxError pointing at the offending character.
+func ParseParameterisedListStrict(input string) (ParameterisedList, error) {
+	p := &parser{input: input, strict: true, length: len(input)}
+	p.discardLeadingOWS()
+	pl, err := p.parseParameterisedList()
+	if err != nil {
+		return nil, p.syntaxError(err)
+	}
+	p.discardLeadingOWS()
+	if !p.isEmpty() {
+		return nil, p.syntaxError(errors.New("extraneous data at the end"))
+	}
+	return pl, nil
+}
+
 // https://tools.ietf.org/html/draft-ietf-httpbis-header-structure-09#section-4.2.2
 func (p *parser) parseKey() (Key, error) {
 	if p.isEmpty() {
@@ -297,9 +344,16 @@ func (p *parser) parseByteSequence() ([]byte, error) {
 	if len < 0 {
 		return nil, errors.New("structuredheader: missing closing '*'")
 	}
+	if p.strict {
+		if err := p.validateStrictBase64(p.input[:len]); err != nil {
+			return nil, err
+		}
+	}
 	s := p.getString(len)
 	enc := base64.StdEncoding
-	if len%4 != 0 {
+	if p.strict {
+		enc = enc.Strict()
+	} else if len%4 != 0 {
 		// Allow unpadded encoding.
 		enc = base64.RawStdEncoding
 	}
@@ -313,6 +367,34 @@ func (p *parser) parseByteSequence() ([]byte, error) {
 	return data, nil
 }
 
+// validateStrictBase64 checks that s (the content of a Byte Sequence at the
+// current position) is padded base64 consisting only of the base64 alphabet.
+func (p *parser) validateStrictBase64(s string) error {
+	padding := 0
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '=':
+			padding++
+			if padding > 2 {
+				return &SyntaxError{p.offset() + i, "too much padding in byte sequence"}
+			}
+		case padding > 0:
+			return &SyntaxError{p.offset() + i, fmt.Sprintf("'%c' after padding in byte sequence", c)}
+		case !isBase64Char(c):
+			return &SyntaxError{p.offset() + i, fmt.Sprintf("invalid character '%c' in byte sequence", c)}
+		}
+	}
+	if len(s)%4 != 0 {
+		return &SyntaxError{p.offset() + len(s), "unpadded base64 in byte sequence"}
+	}
+	return nil
+}
+
+func isBase64Char(c byte) bool {
+	return isAlpha(c) || isDigit(c) || c == '+' || c == '/'
+}
+
 func isDigit(c byte) bool {
 	return c >= '0' && c <= '9'
 }
@@ -30,7 +30,7 @@ func TestParseNumber(t *testing.T) {
 		{"-9223372036854775809", false, 0, ""},                   // int64 min - 1
 	}
 	for _, c := range cases {
-		p := &parser{c.input}
+		p := &parser{input: c.input}
 		n, err := p.parseNumber()
 		if c.shouldSucceed {
 			if err != nil {
@@ -70,7 +70,7 @@ func TestParseString(t *testing.T) {
 		{"\"\u2318\"", false, "", ""},
 	}
 	for _, c := range cases {
-		p := &parser{c.input}
+		p := &parser{input: c.input}
 		s, err := p.parseString()
 		if c.shouldSucceed {
 			if err != nil {
@@ -106,7 +106,7 @@ func TestParseKey(t *testing.T) {
 		{"_foo", false, "", ""},
 	}
 	for _, c := range cases {
-		p := &parser{c.input}
+		p := &parser{input: c.input}
 		id, err := p.parseKey()
 		if c.shouldSucceed {
 			if err != nil {
@@ -142,7 +142,7 @@ func TestParseToken(t *testing.T) {
 		{"_foo", false, "", ""},
 	}
 	for _, c := range cases {
-		p := &parser{c.input}
+		p := &parser{input: c.input}
 		id, err := p.parseToken()
 		if c.shouldSucceed {
 			if err != nil {
@@ -179,7 +179,7 @@ func TestParseByteSequence(t *testing.T) {
 		{"*aG9nZQ=*", false, nil, ""},
 	}
 	for _, c := range cases {
-		p := &parser{c.input}
+		p := &parser{input: c.input}
 		b, err := p.parseByteSequence()
 		if c.shouldSucceed {
 			if err != nil {
@@ -210,7 +210,7 @@ func TestParseItem(t *testing.T) {
 		{"*Zm9v*;", []byte("foo"), ";"},
 	}
 	for _, c := range cases {
-		p := &parser{c.input}
+		p := &parser{input: c.input}
 		r, err := p.parseItem()
 		if c.expected != nil {
 			if err != nil {
@@ -245,7 +245,7 @@ func TestParseParameterisedIdentifier(t *testing.T) {
 		{"label;n= 123", nil, ""},
 	}
 	for _, c := range cases {
-		p := &parser{c.input}
+		p := &parser{input: c.input}
 		r, err := p.parseParameterisedIdentifier()
 		if c.expected != nil {
 			if err != nil {
@@ -325,3 +325,42 @@ func TestParseParameterisedList(t *testing.T) {
 		}
 	}
 }
+
+func TestParseParameterisedListStrict(t *testing.T) {
+	const valid = `label;cert-url="https://example.com/cert.msg";sig=*aG9nZQ==*`
+	if _, err := ParseParameterisedListStrict(valid); err != nil {
+		t.Errorf("ParseParameterisedListStrict(%q) unexpectedly failed: %v", valid, err)
+	}
+
+	cases := []struct {
+		input  string
+		offset int
+	}{
+		{`label;sig=*aG9nZQ==`, 11},                   // missing closing '*'
+		{`label;sig=*aG9nZQ*`, 17},                    // unpadded base64
+		{`label;sig=*aG9n_Q==*`, 15},                  // base64url character
+		{`label;sig=*aG9nZQ=a*`, 18},                  // data after padding
+		{`label;cert-url=https://example.com/ x`, 36}, // unquoted URL followed by garbage
+		{`label;sig=*aG9nZQ==*,`, 21},                 // trailing comma
+	}
+	for _, c := range cases {
+		_, err := ParseParameterisedListStrict(c.input)
+		if err == nil {
+			t.Errorf("ParseParameterisedListStrict(%q) did not fail", c.input)
+			continue
+		}
+		se, ok := err.(*SyntaxError)
+		if !ok {
+			t.Errorf("ParseParameterisedListStrict(%q): got error of type %T, want *SyntaxError", c.input, err)
+			continue
+		}
+		if se.Offset != c.offset {
+			t.Errorf("ParseParameterisedListStrict(%q): error %q at offset %d, want %d", c.input, se, se.Offset, c.offset)
+		}
+	}
+
+	// The lenient parser accepts unpadded base64.
+	if _, err := ParseParameterisedList(`label;sig=*aG9nZQ*`); err != nil {
+		t.Errorf("ParseParameterisedList unexpectedly failed: %v", err)
+	}
+}
@@ -0,0 +1,209 @@
+package signedexchange
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// SubresourceLink is a subresource of a page that browsers can load from a
+// signed exchange, as described by the Link headers of the page's exchange
+// (https://github.com/WICG/webpackage/blob/main/explainers/signed-exchange-subresource-substitution.md).
+type SubresourceLink struct {
+	// URL is the request URL of the subresource's exchange.
+	URL string
+	// As is the destination of the preload of the subresource, e.g.
+	// "script". Browsers only load subresources from signed exchanges when
+	// they are preloaded.
+	As string
+	// HeaderIntegrity is the header-integrity of the subresource's
+	// exchange, see Exchange.ComputeHeaderIntegrity.
+	HeaderIntegrity string
+}
+
+// NewSubresourceLink returns the link to the subresource exchange e, preloaded
+// with the destination as.
+func NewSubresourceLink(e *Exchange, as string) (*SubresourceLink, error) {
+	integrity, err := e.ComputeHeaderIntegrity()
+	if err != nil {
+		return nil, err
+	}
+	return &SubresourceLink{URL: e.RequestURI, As: as, HeaderIntegrity: integrity}, nil
+}
+
+// String returns the Link header value for l: an allowed-alt-sxg link with
+// the header-integrity, and a preload link.
+func (l *SubresourceLink) String() string {
+	s := fmt.Sprintf("<%s>;rel=\"allowed-alt-sxg\";header-integrity=%q", l.URL, l.HeaderIntegrity)
+	if l.As != "" {
+		s += fmt.Sprintf(",<%s>;rel=\"preload\";as=%q", l.URL, l.As)
+	}
+	return s
+}
+
+// AddSubresourceLinks adds the Link header of links to the response headers
+// of the exchange. It must be called before signing.
+func (e *Exchange) AddSubresourceLinks(links []*SubresourceLink) {
+	if len(links) == 0 {
+		return
+	}
+	values := make([]string, len(links))
+	for i, l := range links {
+		values[i] = l.String()
+	}
+	e.ResponseHeaders.Add("Link", strings.Join(values, ","))
+}
+
+// FindSubresourceLinks returns the links to the exchanges among subresources
+// that the HTML payload of the exchange loads: scripts, stylesheets, images
+// and preloads. The payload may be either MI-encoded or not. Subresources
+// that the payload does not load, and resources without an exchange, are
+// skipped.
+func (e *Exchange) FindSubresourceLinks(subresources []*Exchange) ([]*SubresourceLink, error) {
+	payload := e.Payload
+	if _, err := e.MiceEncoding(); err == nil {
+		if payload, err = e.DecodePayload(); err != nil {
+			return nil, err
+		}
+	}
+	base, err := url.Parse(e.RequestURI)
+	if err != nil {
+		return nil, fmt.Errorf("signedexchange: cannot parse request URL %q: %v", e.RequestURI, err)
+	}
+	byURL := map[string]*Exchange{}
+	for _, s := range subresources {
+		byURL[s.RequestURI] = s
+	}
+	var links []*SubresourceLink
+	seen := map[string]bool{}
+	for _, ref := range findHTMLSubresources(payload, base) {
+		s, ok := byURL[ref.url]
+		if !ok || seen[ref.url] {
+			continue
+		}
+		seen[ref.url] = true
+		l, err := NewSubresourceLink(s, ref.as)
+		if err != nil {
+			return nil, fmt.Errorf("signedexchange: subresource %q: %v", ref.url, err)
+		}
+		links = append(links, l)
+	}
+	return links, nil
+}
+
+// htmlSubresource is a resource loaded by an HTML document.
+type htmlSubresource struct {
+	url string
+	as  string
+}
+
+// findHTMLSubresources returns the resources that the HTML document doc with
+// the URL base loads, in document order, with their absolute URLs.
+func findHTMLSubresources(doc []byte, base *url.URL) []htmlSubresource {
+	var refs []htmlSubresource
+	add := func(ref, as string) {
+		if u, err := base.Parse(strings.TrimSpace(ref)); err == nil && ref != "" {
+			u.Fragment = ""
+			refs = append(refs, htmlSubresource{u.String(), as})
+		}
+	}
+	z := html.NewTokenizer(bytes.NewReader(doc))
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			return refs
+		case html.StartTagToken, html.SelfClosingTagToken:
+			t := z.Token()
+			attrs := map[string]string{}
+			for _, a := range t.Attr {
+				attrs[a.Key] = a.Val
+			}
+			rels := strings.Fields(strings.ToLower(attrs["rel"]))
+			switch t.Data {
+			case "base":
+				if u, err := base.Parse(attrs["href"]); err == nil && attrs["href"] != "" {
+					base = u
+				}
+			case "script":
+				add(attrs["src"], "script")
+			case "img":
+				add(attrs["src"], "image")
+			case "link":
+				if containsString(rels, "stylesheet") {
+					add(attrs["href"], "style")
+				} else if containsString(rels, "preload") {
+					add(attrs["href"], attrs["as"])
+				}
+			}
+		}
+	}
+}
+
+// ValidateSubresourceLinks checks that each allowed-alt-sxg link in the Link
+// response headers of the exchange refers to an exchange among subresources
+// with the header-integrity of the link, that the exchange can be loaded as a
+// subresource of this exchange (see ValidateAsSubresource), and that it is
+// preloaded. It returns an error describing every problem, or nil if there
+// are none.
+func (e *Exchange) ValidateSubresourceLinks(subresources []*Exchange) error {
+	base, err := url.Parse(e.RequestURI)
+	if err != nil {
+		return fmt.Errorf("signedexchange: cannot parse request URL %q: %v", e.RequestURI, err)
+	}
+	origin := base.Scheme + "://" + base.Host
+	byURL := map[string]*Exchange{}
+	for _, s := range subresources {
+		byURL[s.RequestURI] = s
+	}
+
+	var alternates []*link
+	preloaded := map[string]bool{}
+	for _, value := range e.ResponseHeaders.Values("Link") {
+		links, err := parseLinkHeader(value)
+		if err != nil {
+			return err
+		}
+		for _, l := range links {
+			if ref, err := base.Parse(l.target); err == nil {
+				l.target = ref.String()
+			}
+			if l.hasRel("allowed-alt-sxg") {
+				alternates = append(alternates, l)
+			}
+			if l.hasRel("preload") {
+				preloaded[l.target] = true
+			}
+		}
+	}
+
+	var problems []string
+	for _, l := range alternates {
+		integrity, ok := l.params["header-integrity"]
+		if !ok {
+			problems = append(problems, fmt.Sprintf("%q has no header-integrity", l.target))
+			continue
+		}
+		if !preloaded[l.target] {
+			problems = append(problems, fmt.Sprintf("%q is not preloaded", l.target))
+		}
+		s, ok := byURL[l.target]
+		if !ok {
+			problems = append(problems, fmt.Sprintf("%q has no signed exchange", l.target))
+			continue
+		}
+		if err := s.VerifyHeaderIntegrity(integrity); err != nil {
+			problems = append(problems, fmt.Sprintf("%q: %s", l.target, strings.TrimPrefix(err.Error(), "signedexchange: ")))
+		}
+		if err := s.ValidateAsSubresource(origin); err != nil {
+			problems = append(problems, fmt.Sprintf("%q: %s", l.target, strings.TrimPrefix(err.Error(), "signedexchange: ")))
+		}
+	}
+	if len(problems) > 0 {
+		return errors.New("signedexchange: invalid subresource links: " + strings.Join(problems, "; "))
+	}
+	return nil
+}
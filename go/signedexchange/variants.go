@@ -0,0 +1,422 @@
+package signedexchange
+
+import (
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/WICG/webpackage/go/signedexchange/structuredheader"
+)
+
+// Variants is the value of a Variants response header
+// (draft-ietf-httpbis-variants): for each request header the response is
+// negotiated on, the name of the header followed by the values available for
+// it, e.g. {{"Accept-Language", "en", "fr"}}. The first available value of
+// each header is the default.
+type Variants [][]string
+
+// VariantKey is the value of a Variant-Key response header: the keys of the
+// variants a response is, each holding one value for each header listed in
+// Variants, in the same order.
+type VariantKey [][]string
+
+// ParseVariants parses the value of a Variants header.
+func ParseVariants(s string) (Variants, error) {
+	ll, err := parseListOfStringLists(s)
+	if err != nil {
+		return nil, fmt.Errorf("signedexchange: cannot parse Variants %q: %v", s, err)
+	}
+	return Variants(ll), nil
+}
+
+// String returns the value of the Variants header.
+func (v Variants) String() (string, error) {
+	return formatListOfStringLists(v)
+}
+
+// ParseVariantKey parses the value of a Variant-Key header.
+func ParseVariantKey(s string) (VariantKey, error) {
+	ll, err := parseListOfStringLists(s)
+	if err != nil {
+		return nil, fmt.Errorf("signedexchange: cannot parse Variant-Key %q: %v", s, err)
+	}
+	return VariantKey(ll), nil
+}
+
+// String returns the value of the Variant-Key header.
+func (k VariantKey) String() (string, error) {
+	return formatListOfStringLists(k)
+}
+
+// parseListOfStringLists parses s as a List of Lists of strings or tokens.
+func parseListOfStringLists(s string) ([][]string, error) {
+	ll, err := structuredheader.ParseListOfLists(s)
+	if err != nil {
+		return nil, err
+	}
+	var result [][]string
+	for _, l := range ll {
+		var sl []string
+		for _, item := range l {
+			switch v := item.(type) {
+			case string:
+				sl = append(sl, v)
+			case structuredheader.Token:
+				sl = append(sl, string(v))
+			default:
+				return nil, fmt.Errorf("unexpected value of type %T", v)
+			}
+		}
+		result = append(result, sl)
+	}
+	return result, nil
+}
+
+// formatListOfStringLists serializes ll as a List of Lists, with the values
+// that are valid tokens as tokens and the others as strings.
+func formatListOfStringLists(ll [][]string) (string, error) {
+	var list structuredheader.ListOfLists
+	for _, l := range ll {
+		var items []structuredheader.Item
+		for _, s := range l {
+			var item structuredheader.Item = structuredheader.Token(s)
+			if _, err := (structuredheader.ListOfLists{{item}}).String(); err != nil {
+				item = s
+			}
+			items = append(items, item)
+		}
+		list = append(list, items)
+	}
+	return list.String()
+}
+
+// Variants returns the parsed Variants and Variant-Key response headers of
+// the exchange, or nil for the absent ones.
+func (e *Exchange) Variants() (Variants, VariantKey, error) {
+	var variants Variants
+	var key VariantKey
+	var err error
+	if value := e.ResponseHeaders.Get("Variants"); value != "" {
+		if variants, err = ParseVariants(value); err != nil {
+			return nil, nil, err
+		}
+	}
+	if value := e.ResponseHeaders.Get("Variant-Key"); value != "" {
+		if key, err = ParseVariantKey(value); err != nil {
+			return nil, nil, err
+		}
+	}
+	return variants, key, nil
+}
+
+// SetVariants sets the Variants and Variant-Key response headers of the
+// exchange to variants and key, which must be consistent, see
+// ValidateVariants. It must be called before signing.
+func (e *Exchange) SetVariants(variants Variants, key VariantKey) error {
+	if err := ValidateVariants(variants, key); err != nil {
+		return err
+	}
+	v, err := variants.String()
+	if err != nil {
+		return fmt.Errorf("signedexchange: cannot serialize Variants: %v", err)
+	}
+	k, err := key.String()
+	if err != nil {
+		return fmt.Errorf("signedexchange: cannot serialize Variant-Key: %v", err)
+	}
+	e.ResponseHeaders.Set("Variants", v)
+	e.ResponseHeaders.Set("Variant-Key", k)
+	return nil
+}
+
+// ValidateVariants checks that variants and key can be the Variants and
+// Variant-Key headers of a response: either both are absent, or each header
+// in variants has available values, and each key in key has an available
+// value for each header in variants.
+func ValidateVariants(variants Variants, key VariantKey) error {
+	if len(variants) == 0 && len(key) == 0 {
+		return nil
+	}
+	if len(variants) == 0 {
+		return errors.New("signedexchange: Variant-Key without Variants")
+	}
+	if len(key) == 0 {
+		return errors.New("signedexchange: Variants without Variant-Key")
+	}
+	for _, v := range variants {
+		if len(v) == 0 {
+			return errors.New("signedexchange: Variants has an empty entry")
+		}
+		if len(v) < 2 {
+			return fmt.Errorf("signedexchange: Variants lists no available value for %q", v[0])
+		}
+	}
+	for _, k := range key {
+		if len(k) != len(variants) {
+			return fmt.Errorf("signedexchange: Variant-Key %q has %d values, but Variants lists %d headers", k, len(k), len(variants))
+		}
+		for i, value := range k {
+			if !containsString(variants[i][1:], value) {
+				return fmt.Errorf("signedexchange: Variant-Key value %q is not available for %q", value, variants[i][0])
+			}
+		}
+	}
+	return nil
+}
+
+func containsString(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidateVariants checks that the Variants and Variant-Key response headers
+// of the exchange are consistent, see ValidateVariants.
+func (e *Exchange) ValidateVariants() error {
+	variants, key, err := e.Variants()
+	if err != nil {
+		return err
+	}
+	return ValidateVariants(variants, key)
+}
+
+// SelectVariant returns the exchange among exchanges, the variants of one
+// resource, that best matches a request with the headers requestHeader, as a
+// cache would (Section 4 of draft-ietf-httpbis-variants). The exchanges must
+// have the same Variants header. Accept, Accept-Encoding and Accept-Language
+// are negotiated with their q-values; the values of other headers must match
+// exactly. If a request header is absent or matches no available value, the
+// default value is used. SelectVariant fails if no exchange has the key of the
+// best match.
+func SelectVariant(exchanges []*Exchange, requestHeader http.Header) (*Exchange, error) {
+	if len(exchanges) == 0 {
+		return nil, errors.New("signedexchange: no exchanges to select from")
+	}
+	variants, _, err := exchanges[0].Variants()
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]VariantKey, len(exchanges))
+	for i, e := range exchanges {
+		v, k, err := e.Variants()
+		if err != nil {
+			return nil, err
+		}
+		if err := ValidateVariants(v, k); err != nil {
+			return nil, err
+		}
+		if !equalVariants(v, variants) {
+			return nil, fmt.Errorf("signedexchange: exchanges of %q have different Variants headers", e.RequestURI)
+		}
+		keys[i] = k
+	}
+	if len(variants) == 0 {
+		return exchanges[0], nil
+	}
+
+	// preferences[i] lists the available values of variants[i], most
+	// preferred first.
+	preferences := make([][]string, len(variants))
+	for i, v := range variants {
+		preferences[i] = preferredValues(v[0], v[1:], requestHeader.Values(v[0]))
+	}
+	// Try the combinations of preferred values, preferring the first header.
+	combination := make([]string, len(variants))
+	var find func(i int) *Exchange
+	find = func(i int) *Exchange {
+		if i == len(variants) {
+			for j, k := range keys {
+				for _, key := range k {
+					if equalStrings(key, combination) {
+						return exchanges[j]
+					}
+				}
+			}
+			return nil
+		}
+		for _, value := range preferences[i] {
+			combination[i] = value
+			if e := find(i + 1); e != nil {
+				return e
+			}
+		}
+		return nil
+	}
+	if e := find(0); e != nil {
+		return e, nil
+	}
+	return nil, fmt.Errorf("signedexchange: no exchange of %q matches the request", exchanges[0].RequestURI)
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func equalVariants(a, b Variants) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !strings.EqualFold(a[i][0], b[i][0]) || !equalStrings(a[i][1:], b[i][1:]) {
+			return false
+		}
+	}
+	return true
+}
+
+// qValue is an element of a request header listing values with q-values,
+// like Accept.
+type qValue struct {
+	value string
+	q     float64
+}
+
+// parseQValues parses the elements of the request header values. The
+// elements with an invalid q-value are ignored.
+func parseQValues(values []string) []qValue {
+	var result []qValue
+	for _, value := range values {
+		for _, element := range strings.Split(value, ",") {
+			parts := strings.Split(element, ";")
+			v := strings.TrimSpace(parts[0])
+			if v == "" {
+				continue
+			}
+			q := 1.0
+			valid := true
+			for _, param := range parts[1:] {
+				name, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+				if strings.EqualFold(strings.TrimSpace(name), "q") {
+					var err error
+					if q, err = strconv.ParseFloat(strings.TrimSpace(value), 64); err != nil || q < 0 || q > 1 {
+						valid = false
+					}
+				}
+			}
+			if valid {
+				result = append(result, qValue{v, q})
+			}
+		}
+	}
+	return result
+}
+
+// preferredValues returns the values of available that the request header
+// name with the values requestValues accepts, most preferred first, or the
+// default value if it accepts none of them.
+func preferredValues(name string, available []string, requestValues []string) []string {
+	if len(requestValues) == 0 {
+		return available[:1]
+	}
+	var match func(accepted, value string) int
+	switch strings.ToLower(name) {
+	case "accept":
+		match = matchMediaRange
+	case "accept-language":
+		match = matchLanguageRange
+	case "accept-encoding":
+		match = matchCoding
+	default:
+		match = func(accepted, value string) int {
+			if strings.EqualFold(accepted, value) {
+				return 1
+			}
+			return 0
+		}
+	}
+	accepted := parseQValues(requestValues)
+	type preference struct {
+		value string
+		q     float64
+	}
+	var prefs []preference
+	for _, value := range available {
+		// The q-value of a value is the one of the most specific element
+		// matching it.
+		specificity, q := 0, 0.0
+		for _, a := range accepted {
+			if s := match(a.value, value); s > specificity {
+				specificity, q = s, a.q
+			}
+		}
+		if strings.EqualFold(name, "accept-encoding") && specificity == 0 && strings.EqualFold(value, "identity") {
+			// identity is acceptable unless excluded (Section 5.3.4
+			// of RFC 7231).
+			q = 1
+		}
+		if q > 0 {
+			prefs = append(prefs, preference{value, q})
+		}
+	}
+	if len(prefs) == 0 {
+		return available[:1]
+	}
+	sort.SliceStable(prefs, func(i, j int) bool { return prefs[i].q > prefs[j].q })
+	values := make([]string, len(prefs))
+	for i, p := range prefs {
+		values[i] = p.value
+	}
+	return values
+}
+
+// matchMediaRange returns how specifically the media range accepted of an
+// Accept header matches the media type value, or 0 if it does not.
+func matchMediaRange(accepted, value string) int {
+	mediaType, _, err := mime.ParseMediaType(value)
+	if err != nil {
+		return 0
+	}
+	accepted = strings.ToLower(accepted)
+	switch {
+	case accepted == mediaType:
+		return 3
+	case strings.HasSuffix(accepted, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(accepted, "*")):
+		return 2
+	case accepted == "*/*":
+		return 1
+	}
+	return 0
+}
+
+// matchLanguageRange returns how specifically the language range accepted of
+// an Accept-Language header matches the language tag value, or 0 if it does
+// not. As in Lookup (Section 3.4 of RFC 4647), the range matches the tag if
+// the range, truncated after any of its subtags, equals the tag.
+func matchLanguageRange(accepted, value string) int {
+	accepted, value = strings.ToLower(accepted), strings.ToLower(value)
+	switch {
+	case accepted == "*":
+		return 1
+	case accepted == value || strings.HasPrefix(accepted, value+"-"):
+		return 1 + len(value)
+	}
+	return 0
+}
+
+// matchCoding returns how specifically the coding accepted of an
+// Accept-Encoding header matches the content coding value, or 0 if it does
+// not.
+func matchCoding(accepted, value string) int {
+	switch {
+	case strings.EqualFold(accepted, value):
+		return 2
+	case accepted == "*":
+		return 1
+	}
+	return 0
+}
@@ -2,26 +2,35 @@ package signedexchange
 
 import (
 	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"mime"
 	"net/http"
 	"net/url"
 	"sort"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/WICG/webpackage/go/internal/signingalgorithm"
 	"github.com/WICG/webpackage/go/signedexchange/certurl"
+	"github.com/WICG/webpackage/go/signedexchange/mice"
 	"github.com/WICG/webpackage/go/signedexchange/structuredheader"
 	"github.com/WICG/webpackage/go/signedexchange/version"
+	"golang.org/x/crypto/ocsp"
 )
 
+// maxSignatureValidity is the longest time between the date and expires of a
+// signature.
 // draft-yasskin-http-origin-signed-responses.html#signature-validity
-// Step 8. "If validating integrity using the selected header field requires
-// the client to process records larger than 16384 bytes, return "invalid"."
-const maxMIRecordSize = 16384
+// Step 4. "If expires is more than 7 days (604800 seconds) after date, return
+// "invalid"."
+const maxSignatureValidity = 7 * 24 * time.Hour
 
 type Signature struct {
 	Label       structuredheader.Token
@@ -37,47 +46,483 @@ type Signature struct {
 func extractSignatureFields(pi structuredheader.ParameterisedIdentifier) (*Signature, error) {
 	sig := &Signature{Label: pi.Label}
 	params := pi.Params
+	// URLs and the integrity identifier must be Strings. Tokens can't contain
+	// all URL characters, but an unquoted URL may still happen to parse as one.
+	for _, k := range []structuredheader.Key{"integrity", "cert-url", "validity-url"} {
+		if tok, ok := params[k].(structuredheader.Token); ok {
+			return nil, fmt.Errorf("%w: '%s' must be a quoted string, got token %q", ErrMalformedSignature, k, tok)
+		}
+	}
 	var ok bool
 	if sig.Sig, ok = params["sig"].([]byte); !ok {
-		return nil, errors.New("verify: no valid 'sig' value")
+		return nil, fmt.Errorf("%w: no valid 'sig' value", ErrMalformedSignature)
 	}
 	if sig.Integrity, ok = params["integrity"].(string); !ok {
-		return nil, errors.New("verify: no valid 'integrity' value")
+		return nil, fmt.Errorf("%w: no valid 'integrity' value", ErrMalformedSignature)
 	}
 	if sig.CertUrl, ok = params["cert-url"].(string); !ok {
-		return nil, errors.New("verify: no valid 'cert-url' value")
+		return nil, fmt.Errorf("%w: no valid 'cert-url' value", ErrMalformedSignature)
 	}
 	if sig.CertSha256, ok = params["cert-sha256"].([]byte); !ok {
-		return nil, errors.New("verify: no valid 'cert-sha256' value")
+		return nil, fmt.Errorf("%w: no valid 'cert-sha256' value", ErrMalformedSignature)
 	}
 	if sig.ValidityUrl, ok = params["validity-url"].(string); !ok {
-		return nil, errors.New("verify: no valid 'validity-url' value")
+		return nil, fmt.Errorf("%w: no valid 'validity-url' value", ErrMalformedSignature)
 	}
 	if sig.Date, ok = params["date"].(int64); !ok {
-		return nil, errors.New("verify: no valid 'date' value")
+		return nil, fmt.Errorf("%w: no valid 'date' value", ErrMalformedSignature)
 	}
 	if sig.Expires, ok = params["expires"].(int64); !ok {
-		return nil, errors.New("verify: no valid 'expires' value")
+		return nil, fmt.Errorf("%w: no valid 'expires' value", ErrMalformedSignature)
 	}
 	return sig, nil
 }
 
+// SignatureParams holds the parsed signatures of a Signature header value.
+type SignatureParams struct {
+	Signatures []*Signature
+}
+
+// ParseSignatureHeaderBytes parses the Signature header value of an exchange of
+// version ver, without the rest of the exchange. The value may hold multiple
+// signatures. It returns an error if any of them is malformed or uses an
+// integrity scheme not supported by ver. The signatures are not verified.
+func ParseSignatureHeaderBytes(value []byte, ver version.Version) (*SignatureParams, error) {
+	items, err := structuredheader.ParseParameterisedListStrict(string(value))
+	if err != nil {
+		return nil, fmt.Errorf("signedexchange: could not parse signature header: %v", err)
+	}
+	params := &SignatureParams{}
+	for _, item := range items {
+		sig, err := extractSignatureFields(item)
+		if err != nil {
+			return nil, fmt.Errorf("signedexchange: invalid signature %q: %v", item.Label, err)
+		}
+		if !integritySupported(ver, sig.Integrity) {
+			return nil, fmt.Errorf("signedexchange: signature %q has integrity %q, want %q for version %s", item.Label, sig.Integrity, ver.MiceEncoding().IntegrityIdentifier(), ver)
+		}
+		params.Signatures = append(params.Signatures, sig)
+	}
+	return params, nil
+}
+
+// integritySupported returns true if integrity identifies one of the Merkle
+// Integrity encodings of ver.
+func integritySupported(ver version.Version, integrity string) bool {
+	for _, enc := range ver.MiceEncodings() {
+		if enc.IntegrityIdentifier() == integrity {
+			return true
+		}
+	}
+	return false
+}
+
 // CertFetcher takes certificate URL and returns certificate bytes in
 // application/cert-chain+cbor format.
-type CertFetcher = func(url string) ([]byte, error)
+type CertFetcher func(url string) ([]byte, error)
 
-// DefaultCertFetcher fetches certificates using http.Get.
-func DefaultCertFetcher(url string) ([]byte, error) {
-	resp, err := http.Get(url)
+// FetchCertChain calls f, unless ctx is already done. It makes every
+// CertFetcher a ContextCertFetcher, though f itself cannot be cancelled.
+func (f CertFetcher) FetchCertChain(ctx context.Context, url string) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return f(url)
+}
+
+// ContextCertFetcher is like CertFetcher, but is passed the context of the
+// verification, so that fetches of cert-urls can be cancelled, time-limited
+// and instrumented. See VerifyContext.
+type ContextCertFetcher interface {
+	FetchCertChain(ctx context.Context, url string) ([]byte, error)
+}
+
+// ContextCertFetcherFunc adapts a function to a ContextCertFetcher.
+type ContextCertFetcherFunc func(ctx context.Context, url string) ([]byte, error)
+
+func (f ContextCertFetcherFunc) FetchCertChain(ctx context.Context, url string) ([]byte, error) {
+	return f(ctx, url)
+}
+
+// VerifyOption configures Verify.
+type VerifyOption func(*verifyOptions)
+
+type verifyOptions struct {
+	contextString string
+	ignoreExpiry  bool
+	// certChains, if non-nil, caches the fetched cert chains across
+	// verifications.
+	certChains map[string]*cachedCertChain
+	// allowedContentTypes, if non-nil, lists the media types the exchange
+	// may have.
+	allowedContentTypes []string
+	// certChain, if non-nil, is used for every signature instead of
+	// fetching the cert-url.
+	certChain certurl.CertChain
+	// onVerified, if non-nil, is called with the response headers after a
+	// successful verification.
+	onVerified func(http.Header)
+	ignoreOCSP bool
+	// ctPolicy, if non-nil, is the CT policy the main certificate must
+	// satisfy.
+	ctPolicy *certurl.CTPolicy
+	// chainPolicy, if non-nil, is the policy the cert chain is validated
+	// against.
+	chainPolicy *certurl.ChainPolicy
+	// ignoreCertRequirements disables the checks of the main certificate
+	// for all certificates, and ignoreCertErrorsSPKIs, if non-nil, for the
+	// ones with the listed base64 SPKI hashes.
+	ignoreCertRequirements bool
+	ignoreCertErrorsSPKIs  map[string]struct{}
+	// allowedHeaders and forbiddenHeaders hold lowercase header names that
+	// are exempted from, or added to, the built-in lists of stateful and
+	// uncached headers.
+	allowedHeaders   map[string]struct{}
+	forbiddenHeaders map[string]struct{}
+	// maxDecodedPayloadSize is the limit of the decoded payload, if positive.
+	maxDecodedPayloadSize int64
+}
+
+// maxDecodedPayloadBytes returns the limit of the decoded payload.
+func (o *verifyOptions) maxDecodedPayloadBytes() uint64 {
+	if o.maxDecodedPayloadSize <= 0 {
+		return mice.DefaultMaxDecodedBytes
+	}
+	return uint64(o.maxDecodedPayloadSize)
+}
+
+type cachedCertChain struct {
+	chain certurl.CertChain
+	err   error
+}
+
+// withCertChainCache makes Verify look up and store fetched cert chains in
+// cache.
+func withCertChainCache(cache map[string]*cachedCertChain) VerifyOption {
+	return func(o *verifyOptions) {
+		o.certChains = cache
+	}
+}
+
+// fetchCertChain fetches and parses the cert chain at certURL, or returns the
+// cached result of an earlier call.
+func (o *verifyOptions) fetchCertChain(ctx context.Context, fetcher ContextCertFetcher, certURL string) (certurl.CertChain, error) {
+	if o.certChain != nil {
+		return o.certChain, nil
+	}
+	if c, ok := o.certChains[certURL]; ok {
+		return c.chain, c.err
+	}
+	chain, err := fetchCertChain(ctx, fetcher, certURL)
+	if o.certChains != nil && ctx.Err() == nil {
+		o.certChains[certURL] = &cachedCertChain{chain: chain, err: err}
+	}
+	return chain, err
+}
+
+func fetchCertChain(ctx context.Context, fetcher ContextCertFetcher, certURL string) (certurl.CertChain, error) {
+	certBytes, err := fetcher.FetchCertChain(ctx, certURL)
 	if err != nil {
-		return nil, fmt.Errorf("verify: could not fetch %q: %v", url, err)
+		return nil, fmt.Errorf("%w: failed to fetch %q: %w", ErrCertFetch, certURL, err)
 	}
-	defer resp.Body.Close()
-	body, err := ioutil.ReadAll(resp.Body)
+	certs, err := certurl.ReadCertChain(bytes.NewReader(certBytes))
 	if err != nil {
-		return nil, fmt.Errorf("verify: could not read response body of %q: %v", url, err)
+		return nil, fmt.Errorf("%w: could not parse certificate CBOR: %v", ErrCertFetch, err)
+	}
+	return certs, nil
+}
+
+// WithContextString makes Verify check signatures against the custom context
+// string context instead of the version's one. It is the counterpart of
+// Signer.ContextString and is meant for experiments only.
+func WithContextString(context string) VerifyOption {
+	return func(o *verifyOptions) {
+		o.contextString = context
+	}
+}
+
+// WithIgnoreExpiry makes Verify skip checking that verificationTime is within
+// the date/expires window of the signature, e.g. to check the integrity of
+// archived exchanges. Everything else, including the signature and the
+// certificate binding, is still verified, and the OCSP response is checked at
+// the date of the signature. Verify logs that the check was skipped for the
+// signature that validated, and VerifyWithResult reports it in
+// VerificationResult.ExpiryIgnored.
+func WithIgnoreExpiry() VerifyOption {
+	return func(o *verifyOptions) {
+		o.ignoreExpiry = true
 	}
-	return body, nil
+}
+
+// WithIgnoreOCSP makes Verify skip checking the OCSP response of the main
+// certificate, e.g. to test with cert chains that have a dummy one.
+func WithIgnoreOCSP() VerifyOption {
+	return func(o *verifyOptions) {
+		o.ignoreOCSP = true
+	}
+}
+
+// WithCTPolicy makes Verify check that the main certificate has SCTs that
+// satisfy policy at the verification time (see CertChain.VerifyCTPolicy). By
+// default SCTs are not checked.
+func WithCTPolicy(policy certurl.CTPolicy) VerifyOption {
+	return func(o *verifyOptions) {
+		o.ctPolicy = &policy
+	}
+}
+
+// WithChainPolicy makes Verify validate the cert chain of a signature against
+// policy at the verification time: the main certificate must chain to one of
+// policy.Roots, be valid for the host of the request URL and for TLS server
+// authentication, and have the CanSignHttpExchanges extension (see
+// CertChain.VerifyChain). policy.AllowSelfSigned accepts self-signed
+// development certificates. By default the chain is not validated.
+func WithChainPolicy(policy certurl.ChainPolicy) VerifyOption {
+	return func(o *verifyOptions) {
+		o.chainPolicy = &policy
+	}
+}
+
+// WithIgnoreCertRequirements makes Verify accept main certificates that do
+// not meet the requirements browsers enforce (see
+// CertChain.VerifyMainCertRequirements), i.e. that lack the
+// CanSignHttpExchanges extension or have a validity period of more than 90
+// days. It is meant for testing with development certificates.
+func WithIgnoreCertRequirements() VerifyOption {
+	return func(o *verifyOptions) {
+		o.ignoreCertRequirements = true
+	}
+}
+
+// WithIgnoreCertErrorsSPKIList is the counterpart of Chrome's
+// --ignore-certificate-errors-spki-list flag: main certificates whose
+// SubjectPublicKeyInfo SHA-256 hash, base64 encoded, is in spkiHashes are
+// exempted from the requirements of WithIgnoreCertRequirements and from the
+// policy of WithChainPolicy. The hash of a certificate is printed by
+// CertChain.PrettyPrint.
+func WithIgnoreCertErrorsSPKIList(spkiHashes []string) VerifyOption {
+	return func(o *verifyOptions) {
+		if o.ignoreCertErrorsSPKIs == nil {
+			o.ignoreCertErrorsSPKIs = map[string]struct{}{}
+		}
+		for _, h := range spkiHashes {
+			o.ignoreCertErrorsSPKIs[h] = struct{}{}
+		}
+	}
+}
+
+// ignoresCertErrors returns true if the main certificate of certs is exempted
+// by WithIgnoreCertErrorsSPKIList.
+func (o *verifyOptions) ignoresCertErrors(certs certurl.CertChain) bool {
+	if o.ignoreCertErrorsSPKIs == nil {
+		return false
+	}
+	_, ok := o.ignoreCertErrorsSPKIs[base64.StdEncoding.EncodeToString(certs[0].SPKISha256())]
+	return ok
+}
+
+// WithAllowedContentTypes makes Verify reject exchanges whose Content-Type
+// media type (e.g. "text/html") is not one of types, compared
+// case-insensitively and ignoring parameters. Exchanges without a
+// Content-Type are rejected as well, and an empty types rejects every
+// exchange. By default any Content-Type is accepted.
+func WithAllowedContentTypes(types []string) VerifyOption {
+	return func(o *verifyOptions) {
+		o.allowedContentTypes = append([]string{}, types...)
+	}
+}
+
+// WithVerifiedHeadersHook makes Verify call hook with the response headers of
+// the exchange once it is verified, e.g. to normalize them for serving. hook
+// is not called if verification fails. It receives a copy of the headers, so
+// changing them affects neither the exchange nor the verification.
+func WithVerifiedHeadersHook(hook func(http.Header)) VerifyOption {
+	return func(o *verifyOptions) {
+		o.onVerified = hook
+	}
+}
+
+// WithMaxDecodedPayloadSize makes Verify fail with an error wrapping
+// ErrPayloadIntegrity and mice.ErrTooLarge if the decoded payload is larger
+// than n bytes, without decoding more of it. If n is not positive,
+// mice.DefaultMaxDecodedBytes (1 GiB) is used, which is the default. Unlike
+// WithMaxPayloadSize, which limits reading the encoded payload, it bounds the
+// memory Verify uses for the payload it returns.
+func WithMaxDecodedPayloadSize(n int64) VerifyOption {
+	return func(o *verifyOptions) {
+		o.maxDecodedPayloadSize = n
+	}
+}
+
+// WithAllowedHeaders makes Verify accept exchanges that have any of the header
+// fields names, even if they are stateful request headers or uncached
+// response headers. names are compared case-insensitively. It is meant for
+// caches with a policy laxer than the one of browsers.
+func WithAllowedHeaders(names []string) VerifyOption {
+	return func(o *verifyOptions) {
+		o.allowedHeaders = addHeaderNames(o.allowedHeaders, names)
+	}
+}
+
+// WithForbiddenHeaders makes Verify reject exchanges that have any of the
+// header fields names, in addition to the stateful request headers and
+// uncached response headers. names are compared case-insensitively and
+// override WithAllowedHeaders.
+func WithForbiddenHeaders(names []string) VerifyOption {
+	return func(o *verifyOptions) {
+		o.forbiddenHeaders = addHeaderNames(o.forbiddenHeaders, names)
+	}
+}
+
+func addHeaderNames(set map[string]struct{}, names []string) map[string]struct{} {
+	if set == nil {
+		set = make(map[string]struct{})
+	}
+	for _, n := range names {
+		set[strings.ToLower(n)] = struct{}{}
+	}
+	return set
+}
+
+// isForbiddenHeader returns whether the header field name is forbidden by o,
+// where builtin tells whether it is on the built-in list.
+func (o *verifyOptions) isForbiddenHeader(name string, builtin func(string) bool) bool {
+	cname := strings.ToLower(name)
+	if _, ok := o.forbiddenHeaders[cname]; ok {
+		return true
+	}
+	if _, ok := o.allowedHeaders[cname]; ok {
+		return false
+	}
+	return builtin(name)
+}
+
+// checkContentType returns an error if the Content-Type of e is not allowed
+// by o.
+func (o *verifyOptions) checkContentType(e *Exchange) error {
+	if o.allowedContentTypes == nil {
+		return nil
+	}
+	contentType := e.ResponseHeaders.Get("Content-Type")
+	if contentType == "" {
+		return fmt.Errorf("%w: exchange has no Content-Type", ErrContentTypeNotAllowed)
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return fmt.Errorf("%w: cannot parse Content-Type %q: %v", ErrContentTypeNotAllowed, contentType, err)
+	}
+	for _, t := range o.allowedContentTypes {
+		if strings.EqualFold(mediaType, t) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %q is not one of %q", ErrContentTypeNotAllowed, contentType, o.allowedContentTypes)
+}
+
+// Errors returned by VerifyWithError. The returned errors wrap one of them,
+// with details such as the offending header, and can be tested with
+// errors.Is.
+var (
+	// ErrNonconformant means the exchange was read with nonconformances
+	// tolerated (see ReadExchangeLenient).
+	ErrNonconformant = errors.New("verify: exchange is nonconformant")
+	// ErrContentTypeNotAllowed means the Content-Type of the exchange is not
+	// allowed by WithAllowedContentTypes.
+	ErrContentTypeNotAllowed = errors.New("verify: Content-Type is not allowed")
+	// ErrMalformedSignature means the Signature header could not be parsed.
+	ErrMalformedSignature = errors.New("verify: malformed signature")
+	// ErrValidityURLMismatch means the validity-url of the signature is not
+	// same-origin with the request URL.
+	ErrValidityURLMismatch = errors.New("verify: validity-url is not same-origin with the request URL")
+	// ErrCertFetch means the cert-url of the signature could not be fetched
+	// or parsed.
+	ErrCertFetch = errors.New("verify: cannot get the certificate chain")
+	// ErrValidityTooLong means the expires of the signature is more than 7
+	// days after its date.
+	ErrValidityTooLong = errors.New("verify: expires is more than 7 days (604800 seconds) after date")
+	// ErrNotYetValid means the verification time is before the date of the
+	// signature.
+	ErrNotYetValid = errors.New("verify: signature is not yet valid")
+	// ErrExpired means the verification time is after the expires of the
+	// signature.
+	ErrExpired = errors.New("verify: signature is expired")
+	// ErrCertSha256Mismatch means the cert-sha256 of the signature does not
+	// match the main certificate of the fetched chain.
+	ErrCertSha256Mismatch = errors.New("verify: cert-sha256 mismatch")
+	// ErrBadSignature means the signature does not match the exchange.
+	ErrBadSignature = errors.New("verify: signature verification failed")
+	// ErrMissingContentType means the exchange has no Content-Type, which
+	// version 1b3 requires.
+	ErrMissingContentType = errors.New("verify: Content-Type response header is absent")
+	// ErrPayloadIntegrity means the payload does not match its integrity
+	// proofs.
+	ErrPayloadIntegrity = errors.New("verify: payload integrity check failed")
+	// ErrOCSP means the OCSP response of the main certificate is missing,
+	// not "good", or not fresh at the verification time.
+	ErrOCSP = errors.New("verify: invalid OCSP response")
+	// ErrCTPolicy means the main certificate does not satisfy the policy
+	// given to WithCTPolicy.
+	ErrCTPolicy = errors.New("verify: certificate transparency policy is not met")
+	// ErrCertRequirements means the main certificate does not meet the
+	// requirements browsers enforce, e.g. it lacks the CanSignHttpExchanges
+	// extension. See WithIgnoreCertRequirements.
+	ErrCertRequirements = errors.New("verify: main certificate does not meet the requirements")
+	// ErrUntrustedCert means the cert chain does not satisfy the policy
+	// given to WithChainPolicy, e.g. it does not chain to a trusted root.
+	ErrUntrustedCert = errors.New("verify: certificate chain is not trusted")
+	// ErrUnsafeMethod means the request method is not safe or not
+	// cacheable, which versions 1b1 and 1b2 require.
+	ErrUnsafeMethod = errors.New("verify: request method is not safe or not cacheable")
+	// ErrNotCacheable means a shared cache may not store the response.
+	ErrNotCacheable = errors.New("verify: response is not cacheable")
+	// ErrUncachedHeader means the exchange has an uncached response header.
+	ErrUncachedHeader = errors.New("verify: uncached header")
+	// ErrStatefulHeader means the exchange has a stateful request header,
+	// which versions 1b1 and 1b2 forbid.
+	ErrStatefulHeader = errors.New("verify: stateful request header")
+)
+
+// verificationCodes lists the errors that are the Code of a
+// VerificationError.
+var verificationCodes = []error{
+	ErrNonconformant, ErrContentTypeNotAllowed, ErrMalformedSignature,
+	ErrValidityURLMismatch, ErrCertFetch, ErrValidityTooLong, ErrNotYetValid,
+	ErrExpired, ErrCertSha256Mismatch, ErrBadSignature, ErrMissingContentType,
+	ErrPayloadIntegrity, ErrOCSP, ErrCTPolicy, ErrCertRequirements, ErrUntrustedCert, ErrUnsafeMethod,
+	ErrNotCacheable, ErrUncachedHeader, ErrStatefulHeader,
+}
+
+// VerificationError is the error returned by VerifyWithError and
+// VerifyWithLabel, so that callers can branch on the reason of a failure
+// with a switch on Code instead of a chain of errors.Is.
+type VerificationError struct {
+	// Code is the Err* value of this package that the failure wraps, e.g.
+	// ErrExpired.
+	Code error
+	// Label is the label of the signature the failure is for, or empty if
+	// the failure is not specific to a signature, e.g. ErrMalformedSignature.
+	Label string
+	// Err is the error, with details such as the offending header.
+	Err error
+}
+
+func newVerificationError(label string, err error) *VerificationError {
+	ve := &VerificationError{Label: label, Err: err}
+	for _, code := range verificationCodes {
+		if errors.Is(err, code) {
+			ve.Code = code
+			break
+		}
+	}
+	return ve
+}
+
+func (e *VerificationError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *VerificationError) Unwrap() error {
+	return e.Err
 }
 
 // Verify validates the Exchange by running the algorithm described in
@@ -87,88 +532,387 @@ func DefaultCertFetcher(url string) ([]byte, error) {
 // Errors encountered during verification are logged to l.
 // If successful, it returns the decoded payload and true. otherwise it returns
 // nil and false.
-func (e *Exchange) Verify(verificationTime time.Time, certFetcher CertFetcher, l *log.Logger) ([]byte, bool) {
+func (e *Exchange) Verify(verificationTime time.Time, certFetcher CertFetcher, l *log.Logger, opts ...VerifyOption) ([]byte, bool) {
+	result, err := e.verify(context.Background(), verificationTime, certFetcher, l, opts)
+	if err != nil {
+		return nil, false
+	}
+	return result.Payload, true
+}
+
+// VerifyWithError is like Verify, but returns why the verification failed
+// instead of logging it. The error is a *VerificationError, and wraps one of
+// the Err* values of this package, e.g. ErrExpired. If the exchange has
+// several signatures and none of them is valid, the error is the one of the
+// first signature.
+func (e *Exchange) VerifyWithError(verificationTime time.Time, certFetcher CertFetcher, opts ...VerifyOption) ([]byte, error) {
+	decodedPayload, _, err := e.VerifyWithLabel(verificationTime, certFetcher, opts...)
+	return decodedPayload, err
+}
+
+// VerifyWithLabel is like VerifyWithError, but also returns the label of the
+// signature that is valid. The signatures are tried in the order of the
+// Signature header, and the first valid one is returned, so the exchange is
+// valid if any of its signatures is, even if the cert-urls of the others
+// cannot be fetched.
+func (e *Exchange) VerifyWithLabel(verificationTime time.Time, certFetcher CertFetcher, opts ...VerifyOption) ([]byte, string, error) {
+	result, err := e.VerifyWithResult(verificationTime, certFetcher, opts...)
+	if err != nil {
+		return nil, "", err
+	}
+	return result.Payload, string(result.Signature.Label), nil
+}
+
+// VerificationResult describes a successful verification.
+type VerificationResult struct {
+	// Payload is the decoded payload.
+	Payload []byte
+	// Signature is the parsed signature that is valid. Its Label identifies
+	// it in the Signature header.
+	Signature *Signature
+	// Certificate is the main certificate of CertChain, the cert chain
+	// fetched from the cert-url of the signature.
+	Certificate *x509.Certificate
+	CertChain   certurl.CertChain
+	// OCSPResponse is the OCSP response of Certificate, verified at the
+	// verification time. It is nil if the OCSP response is not checked, see
+	// WithIgnoreOCSP.
+	OCSPResponse *ocsp.Response
+	// Date and Expires are the validity window of the signature, and
+	// Remaining is the time from the verification time to Expires, e.g. for
+	// scheduling a refresh of a cached exchange.
+	Date      time.Time
+	Expires   time.Time
+	Remaining time.Duration
+	// ExpiryIgnored is true if the verification time was not checked against
+	// Date and Expires, see WithIgnoreExpiry.
+	ExpiryIgnored bool
+}
+
+// VerifyWithResult is like VerifyWithLabel, but returns the parameters of
+// the valid signature and the certificate it was made with along with the
+// payload.
+func (e *Exchange) VerifyWithResult(verificationTime time.Time, certFetcher CertFetcher, opts ...VerifyOption) (*VerificationResult, error) {
+	return e.verify(context.Background(), verificationTime, certFetcher, log.New(ioutil.Discard, "", 0), opts)
+}
+
+// VerifyContext is like VerifyWithResult, but fetches the cert-urls with
+// fetcher, passing it ctx. A CertFetcher can be passed as fetcher, but only a
+// ContextCertFetcher that honors ctx can be interrupted while fetching. Once
+// ctx is done, the signatures that are not verified yet fail with an error
+// wrapping both ErrCertFetch and ctx.Err().
+func (e *Exchange) VerifyContext(ctx context.Context, verificationTime time.Time, fetcher ContextCertFetcher, opts ...VerifyOption) (*VerificationResult, error) {
+	return e.verify(ctx, verificationTime, fetcher, log.New(ioutil.Discard, "", 0), opts)
+}
+
+func (e *Exchange) verify(ctx context.Context, verificationTime time.Time, fetcher ContextCertFetcher, l *log.Logger, opts []VerifyOption) (*VerificationResult, error) {
 	// draft-yasskin-http-origin-signed-responses.html#cross-origin-trust
 
+	o := &verifyOptions{contextString: contextString(e.Version)}
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	if len(e.ReadWarnings) > 0 {
+		err := fmt.Errorf("%w: %s", ErrNonconformant, strings.Join(e.ReadWarnings, "; "))
+		l.Print(err)
+		return nil, newVerificationError("", err)
+	}
+
+	if err := o.checkContentType(e); err != nil {
+		l.Print(err)
+		return nil, newVerificationError("", err)
+	}
+
 	// "The client MUST parse the Signature header into a list of signatures
 	// according to the instructions in Section 3.5, ..."
-	signatures, err := structuredheader.ParseParameterisedList(e.SignatureHeaderValue)
+	signatures, err := structuredheader.ParseParameterisedListStrict(e.SignatureHeaderValue)
 	if err != nil {
-		l.Printf("Could not parse signature header: %v", err)
-		return nil, false
+		err = fmt.Errorf("%w: could not parse signature header: %v", ErrMalformedSignature, err)
+		l.Print(err)
+		return nil, newVerificationError("", err)
+	}
+	if len(signatures) == 0 {
+		err := fmt.Errorf("%w: no signatures", ErrMalformedSignature)
+		l.Print(err)
+		return nil, newVerificationError("", err)
 	}
 	// "...and run the following algorithm for each signature, stopping at the
 	// first one that returns "valid". If any signature returns "valid", return
 	// "valid". Otherwise, return "invalid"."
+	var firstErr error
 	for _, item := range signatures {
-		signature, err := extractSignatureFields(item)
-		if err != nil {
-			l.Printf("Invalid signature: %v", err)
-			continue
-		}
-		// Step 1: "If the signature's "validity-url" parameter is not
-		//         same-origin with requestUrl, return "invalid"."
-		validityUrl, err := url.Parse(signature.ValidityUrl)
-		if err != nil {
-			l.Printf("Cannot parse validity-url: %q", signature.ValidityUrl)
-			continue
+		result, err := e.verifySignatureItem(ctx, item, verificationTime, fetcher, l, o)
+		if err == nil {
+			return result, nil
 		}
-		requestURI, err := url.Parse(e.RequestURI)
-		if err != nil {
-			l.Printf("Cannot parse request URI: %q", e.RequestURI)
-			continue
+		l.Printf("Signature %q is invalid: %v", item.Label, err)
+		if firstErr == nil {
+			firstErr = newVerificationError(string(item.Label), err)
 		}
-		if !isSameOrigin(validityUrl, requestURI) {
-			l.Printf("validity-url (%s) is not same-origin with request URL (%v)", signature.ValidityUrl, e.RequestURI)
-			continue
+	}
+	return nil, firstErr
+}
+
+// verifySignatureItem runs the algorithm of Verify for one signature.
+func (e *Exchange) verifySignatureItem(ctx context.Context, item structuredheader.ParameterisedIdentifier, verificationTime time.Time, fetcher ContextCertFetcher, l *log.Logger, o *verifyOptions) (*VerificationResult, error) {
+	signature, err := extractSignatureFields(item)
+	if err != nil {
+		return nil, err
+	}
+	// Step 1: "If the signature's "validity-url" parameter is not
+	//         same-origin with requestUrl, return "invalid"."
+	validityUrl, err := url.Parse(signature.ValidityUrl)
+	if err != nil {
+		return nil, fmt.Errorf("%w: cannot parse validity-url %q", ErrValidityURLMismatch, signature.ValidityUrl)
+	}
+	requestURI, err := url.Parse(e.RequestURI)
+	if err != nil {
+		return nil, fmt.Errorf("%w: cannot parse request URL %q", ErrValidityURLMismatch, e.RequestURI)
+	}
+	if !isSameOrigin(validityUrl, requestURI) {
+		return nil, fmt.Errorf("%w: validity-url is %q, request URL is %q", ErrValidityURLMismatch, signature.ValidityUrl, e.RequestURI)
+	}
+
+	// Step 2: "Use Section 3.5 to determine the signature's validity for
+	//         requestUrl, responseHeaders, and payload, getting
+	//         certificate-chain back. If this returned "invalid" or didn't
+	//         return a certificate chain, return "invalid"."
+	certs, decodedPayload, err := verifySignature(ctx, e, verificationTime, fetcher, signature, o)
+	if err != nil {
+		return nil, err
+	}
+
+	// Step 3: "Let response be the exchange metadata and headers parsed out
+	//         of responseHeaders."
+	// `e` contains the exchange metadata and headers.
+
+	if e.Version.HasVerificationCheck(version.CheckRequestMethodSafe) {
+		// Version 1b1 and 1b2 only -- Step 4 of
+		// https://tools.ietf.org/html/draft-yasskin-httpbis-origin-signed-exchanges-impl-02#section-4:
+		// "If exchange's request method is not safe (Section 4.2.1 of
+		// [RFC7231]) or not cacheable (Section 4.2.3 of [RFC7231]),
+		// return "invalid"."
+		// Per [RFC7231], only GET and HEAD are safe and cacheable.
+		if e.RequestMethod != http.MethodGet && e.RequestMethod != http.MethodHead {
+			return nil, fmt.Errorf("%w: %q", ErrUnsafeMethod, e.RequestMethod)
 		}
+	}
 
-		// Step 2: "Use Section 3.5 to determine the signature's validity for
-		//         requestUrl, responseHeaders, and payload, getting
-		//         certificate-chain back. If this returned "invalid" or didn't
-		//         return a certificate chain, return "invalid"."
-		_, decodedPayload, err := verifySignature(e, verificationTime, certFetcher, signature)
-		if err != nil {
-			l.Printf("Verification of signature %q failed: %v", signature.Label, err)
-			continue
+	// Step 4: If Section 3 of [RFC7234] forbids a shared cache from storing
+	//         response, return "invalid".
+	if e.Version.HasVerificationCheck(version.CheckCacheabilityRequired) {
+		// IsCacheable logs why the response is not cacheable, which goes
+		// into the error. Other messages are warnings.
+		var logBuf bytes.Buffer
+		if !e.IsCacheable(log.New(&logBuf, "", 0)) {
+			messages := strings.Split(strings.TrimSpace(logBuf.String()), "\n")
+			return nil, fmt.Errorf("%w: %s", ErrNotCacheable, strings.Join(messages, "; "))
 		}
+		if logBuf.Len() > 0 {
+			l.Print(strings.TrimSpace(logBuf.String()))
+		}
+	}
 
-		// Step 3: "Let response be the exchange metadata and headers parsed out
-		//         of responseHeaders."
-		// `e` contains the exchange metadata and headers.
-
-		if e.Version == version.Version1b1 || e.Version == version.Version1b2 {
-			// Version 1b1 and 1b2 only -- Step 4 of
-			// https://tools.ietf.org/html/draft-yasskin-httpbis-origin-signed-exchanges-impl-02#section-4:
-			// "If exchange's request method is not safe (Section 4.2.1 of
-			// [RFC7231]) or not cacheable (Section 4.2.3 of [RFC7231]),
-			// return "invalid"."
-			// Per [RFC7231], only GET and HEAD are safe and cacheable.
-			if e.RequestMethod != http.MethodGet && e.RequestMethod != http.MethodHead {
-				l.Printf("Request method %q is not safe or not cacheable.", e.RequestMethod)
-				continue
-			}
+	// Step 5: "If response's headers contain an uncached header field, as
+	//         defined in Section 4.1, return "invalid"."
+	if err := o.verifyRequestHeaders(e); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrStatefulHeader, err)
+	}
+	if err := o.verifyResponseHeaders(e); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrUncachedHeader, err)
+	}
+
+	// Step 6 and 7: Certificate verification. The requirements of the main
+	// certificate, its OCSP response and, with WithCTPolicy, its SCTs are
+	// checked, and with WithChainPolicy, the chain is validated.
+	certTime := verificationTime
+	if o.ignoreExpiry {
+		certTime = time.Unix(signature.Date, 0)
+	}
+	ignoreCertErrors := o.ignoresCertErrors(certs)
+	if !o.ignoreCertRequirements && !ignoreCertErrors {
+		if err := certs.VerifyMainCertRequirements(certTime); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrCertRequirements, err)
+		}
+	}
+	if o.chainPolicy != nil && !ignoreCertErrors {
+		if err := certs.VerifyChain(*o.chainPolicy, requestURI.Hostname(), certTime); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrUntrustedCert, err)
+		}
+	}
+	var ocspResp *ocsp.Response
+	if !o.ignoreOCSP {
+		if ocspResp, err = certs.VerifiedOCSPResponse(certTime); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrOCSP, err)
 		}
+	}
+	if o.ctPolicy != nil {
+		if err := certs.VerifyCTPolicy(*o.ctPolicy, certTime); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrCTPolicy, err)
+		}
+	}
+
+	if o.ignoreExpiry {
+		l.Printf("Signature %q is valid, but its expiry was not checked (date=%d, expires=%d)", signature.Label, signature.Date, signature.Expires)
+	}
+
+	if o.onVerified != nil {
+		o.onVerified(e.ResponseHeaders.Clone())
+	}
+
+	// Step 8: "Return "valid"."
+	return &VerificationResult{
+		Payload:       decodedPayload,
+		Signature:     signature,
+		Certificate:   certs[0].Cert,
+		CertChain:     certs,
+		OCSPResponse:  ocspResp,
+		Date:          time.Unix(signature.Date, 0),
+		Expires:       time.Unix(signature.Expires, 0),
+		Remaining:     time.Unix(signature.Expires, 0).Sub(verificationTime),
+		ExpiryIgnored: o.ignoreExpiry,
+	}, nil
+}
+
+// VerifyWithLeafCert is like Verify, but uses leaf as the certificate of every
+// signature instead of fetching the cert-url, for when the rest of the chain
+// is established out-of-band. The signature, the cert-sha256 binding to leaf,
+// the date/expires window and the exchange structure are verified as usual,
+// but leaf is not validated against a root, and it has no OCSP response to
+// check. This is logged to l as a warning.
+func (e *Exchange) VerifyWithLeafCert(verificationTime time.Time, leaf *x509.Certificate, l *log.Logger, opts ...VerifyOption) ([]byte, bool) {
+	chain := certurl.CertChain{&certurl.AugmentedCertificate{Cert: leaf}}
+	opts = append(opts[:len(opts):len(opts)], func(o *verifyOptions) {
+		o.certChain = chain
+		o.ignoreOCSP = true
+	})
+	l.Printf("Warning: verifying with leaf certificate %q only; its chain of trust is not checked", leaf.Subject.CommonName)
+	return e.Verify(verificationTime, nil, l, opts...)
+}
 
-		// Step 4: If Section 3 of [RFC7234] forbids a shared cache from storing
-		//         response, return "invalid".
-		if e.Version != version.Version1b1 && e.Version != version.Version1b2 && !e.IsCacheable(l) {
-			continue
+// signatureForCertChain returns the signature of the exchange for the main
+// certificate of chain. If there are several, the one with the latest
+// expires is returned.
+func (e *Exchange) signatureForCertChain(chain certurl.CertChain) (*Signature, error) {
+	if len(chain) == 0 {
+		return nil, errors.New("signedexchange: cert chain must not be empty")
+	}
+	params, err := ParseSignatureHeaderBytes([]byte(e.SignatureHeaderValue), e.Version)
+	if err != nil {
+		return nil, err
+	}
+	certSha256 := chain[0].CertSha256()
+	var found *Signature
+	for _, sig := range params.Signatures {
+		if bytes.Equal(sig.CertSha256, certSha256) && (found == nil || sig.Expires > found.Expires) {
+			found = sig
 		}
+	}
+	if found == nil {
+		return nil, errors.New("signedexchange: exchange has no signature for the certificate")
+	}
+	return found, nil
+}
+
+// EffectiveValidUntil returns the time until which the exchange can be
+// valid when served with chain: the earliest of the expires of its
+// signatures for the main certificate of chain, the NotAfter of that
+// certificate, and the NextUpdate of its OCSP response, if any. If several
+// signatures are for the certificate, the latest of their expires is used.
+// This is the time a renewal should be scheduled against. The exchange and
+// chain are not verified.
+func (e *Exchange) EffectiveValidUntil(chain certurl.CertChain) (time.Time, error) {
+	sig, err := e.signatureForCertChain(chain)
+	if err != nil {
+		return time.Time{}, err
+	}
+	validUntil := time.Unix(sig.Expires, 0)
+	if notAfter := chain[0].Cert.NotAfter; notAfter.Before(validUntil) {
+		validUntil = notAfter
+	}
+	ocspResp, err := chain.ParsedOCSPResponse()
+	if err != nil {
+		return time.Time{}, err
+	}
+	if ocspResp != nil && !ocspResp.NextUpdate.IsZero() && ocspResp.NextUpdate.Before(validUntil) {
+		validUntil = ocspResp.NextUpdate
+	}
+	return validUntil, nil
+}
+
+// VerifyAtTimes runs Verify at each of times and returns whether the exchange
+// is valid at each of them. Each certificate URL is fetched at most once,
+// regardless of the number of times. The keys of the returned map are the
+// elements of times, so lookups must use the same time.Time values.
+func (e *Exchange) VerifyAtTimes(times []time.Time, certFetcher CertFetcher, l *log.Logger, opts ...VerifyOption) map[time.Time]bool {
+	opts = append(opts[:len(opts):len(opts)], withCertChainCache(map[string]*cachedCertChain{}))
+	results := make(map[time.Time]bool, len(times))
+	for _, t := range times {
+		_, ok := e.Verify(t, certFetcher, l, opts...)
+		results[t] = ok
+	}
+	return results
+}
+
+// VerifyResult is the result of verifying one exchange with BatchVerify.
+type VerifyResult struct {
+	// Payload is the decoded payload if OK is true.
+	Payload []byte
+	OK      bool
+}
+
+// BatchVerify runs Verify for each of exchanges and returns the results in the
+// same order. Each certificate URL is fetched and parsed only once, and the
+// parsed cert chain is shared by all exchanges that reference it.
+func BatchVerify(exchanges []*Exchange, verificationTime time.Time, certFetcher CertFetcher, l *log.Logger, opts ...VerifyOption) []VerifyResult {
+	opts = append(opts[:len(opts):len(opts)], withCertChainCache(map[string]*cachedCertChain{}))
+	results := make([]VerifyResult, len(exchanges))
+	for i, e := range exchanges {
+		results[i].Payload, results[i].OK = e.Verify(verificationTime, certFetcher, l, opts...)
+	}
+	return results
+}
 
-		// Step 5: "If response's headers contain an uncached header field, as
-		//         defined in Section 4.1, return "invalid"."
-		if err := verifyHeaders(e); err != nil {
-			l.Printf("Header validation failed: %v", err)
-			continue
+// ValidateAsSubresource checks the additional constraints an exchange must
+// satisfy to be substituted by a browser as a subresource of a page with the
+// origin parentOrigin (e.g. "https://example.com"). It returns an error
+// describing every unmet constraint, or nil if there are none.
+func (e *Exchange) ValidateAsSubresource(parentOrigin string) error {
+	var problems []string
+	if e.Version == version.Version1b1 || e.Version == version.Version1b2 {
+		problems = append(problems, fmt.Sprintf("subresource signed exchanges require version %s or later, got %s", version.Version1b3, e.Version))
+	} else {
+		var logBuf bytes.Buffer
+		if !e.IsCacheable(log.New(&logBuf, "", 0)) {
+			problems = append(problems, fmt.Sprintf("response is not cacheable: %s", strings.TrimSpace(logBuf.String())))
 		}
+	}
+	if err := (&verifyOptions{}).verifyHeaders(e); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if _, err := e.ComputeHeaderIntegrity(); err != nil {
+		problems = append(problems, fmt.Sprintf("cannot compute header-integrity: %v", err))
+	}
 
-		// TODO: Implement Step 6 and 7 (certificate verification).
+	parent, err := url.Parse(parentOrigin)
+	if err != nil || parent.Scheme == "" || parent.Host == "" {
+		problems = append(problems, fmt.Sprintf("invalid parent origin %q", parentOrigin))
+	} else if requestURL, err := url.Parse(e.RequestURI); err != nil {
+		problems = append(problems, fmt.Sprintf("cannot parse request URL %q", e.RequestURI))
+	} else if !isSameOrigin(parent, requestURL) {
+		// A cross-origin subresource can only be used if the response allows
+		// the parent to read it.
+		allowed := e.ResponseHeaders.Get("Access-Control-Allow-Origin")
+		if allowed != "*" && allowed != parent.Scheme+"://"+parent.Host {
+			problems = append(problems, fmt.Sprintf("request URL %q is cross-origin to %q and Access-Control-Allow-Origin does not allow it", e.RequestURI, parentOrigin))
+		}
+	}
 
-		// Step 8: "Return "valid"."
-		return decodedPayload, true
+	if len(problems) > 0 {
+		return fmt.Errorf("signedexchange: not loadable as a subresource: %s", strings.Join(problems, "; "))
 	}
-	return nil, false
+	return nil
 }
 
 // IsCacheable returns true if Exchange is cacheable by a shared cache
@@ -193,6 +937,10 @@ func (e *Exchange) IsCacheable(l *log.Logger) bool {
 		return false
 	}
 
+	if err := ValidateCacheHeaders(e.ResponseHeaders); err != nil {
+		l.Printf("Warning: %v", err)
+	}
+
 	cacheDirectives := parseCacheControlDirectives(e.ResponseHeaders.Get("Cache-Control"))
 
 	// "o  the "no-store" cache directive (see Section 5.2) does not appear
@@ -259,6 +1007,57 @@ func (e *Exchange) IsCacheable(l *log.Logger) bool {
 	return false
 }
 
+// contradictoryCacheDirectives lists pairs of Cache-Control response
+// directives that should not appear together.
+var contradictoryCacheDirectives = [][2]string{
+	{"no-store", "max-age"},
+	{"no-store", "s-maxage"},
+	{"no-store", "public"},
+	{"no-store", "immutable"},
+	{"private", "public"},
+	{"private", "s-maxage"},
+}
+
+// ValidateCacheHeaders checks the values of the caching-related response
+// headers. It reports Cache-Control directives that contradict each other or
+// have malformed arguments, and Expires values that are not valid HTTP dates.
+// Browsers may handle such headers inconsistently even though the exchange
+// can be signed.
+func ValidateCacheHeaders(h http.Header) error {
+	var problems []string
+	if cc := h.Values("Cache-Control"); len(cc) > 0 {
+		directives := parseCacheControlDirectives(strings.Join(cc, ","))
+		for _, pair := range contradictoryCacheDirectives {
+			_, ok0 := directives[pair[0]]
+			_, ok1 := directives[pair[1]]
+			if ok0 && ok1 {
+				problems = append(problems, fmt.Sprintf("Cache-Control has contradictory directives %q and %q", pair[0], pair[1]))
+			}
+		}
+		for _, name := range []string{"max-age", "s-maxage"} {
+			arg, ok := directives[name]
+			if !ok {
+				continue
+			}
+			// delta-seconds (Section 1.2.1 of [RFC7234]).
+			if _, err := strconv.ParseUint(strings.Trim(arg, `"`), 10, 64); err != nil {
+				problems = append(problems, fmt.Sprintf("Cache-Control directive %q has malformed argument %q", name, arg))
+			}
+		}
+	}
+	if expires := h.Values("Expires"); len(expires) > 1 {
+		problems = append(problems, fmt.Sprintf("multiple Expires headers: %q", expires))
+	} else if len(expires) == 1 {
+		if _, err := http.ParseTime(expires[0]); err != nil {
+			problems = append(problems, fmt.Sprintf("malformed Expires date %q", expires[0]))
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("signedexchange: invalid cache headers: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
 // parseCacheControlDirectives parses a Cache-Control header value
 // (Section 5.2 of [RFC7234]).
 func parseCacheControlDirectives(cacheControl string) map[string]string {
@@ -279,55 +1078,61 @@ func parseCacheControlDirectives(cacheControl string) map[string]string {
 // verifySignature verifies single signature, as described in
 // https://wicg.github.io/webpackage/draft-yasskin-http-origin-signed-responses.html#signature-validity.
 // On success, returns a potentially-valid cert chain and decoded payload bytes.
-func verifySignature(e *Exchange, verificationTime time.Time, fetch CertFetcher, signature *Signature) (certurl.CertChain, []byte, error) {
+func verifySignature(ctx context.Context, e *Exchange, verificationTime time.Time, fetcher ContextCertFetcher, signature *Signature, o *verifyOptions) (certurl.CertChain, []byte, error) {
 	// Step 1: Extract the signature fields
 	// |signature| is the parsed signature.
 
 	// Step 2: Fetch cert-url and determine the signing algorithm
-	certBytes, err := fetch(signature.CertUrl)
-	if err != nil {
-		return nil, nil, fmt.Errorf("verify: failed to fetch %q: %v", signature.CertUrl, err)
-	}
-	certs, err := certurl.ReadCertChain(bytes.NewReader(certBytes))
+	certs, err := o.fetchCertChain(ctx, fetcher, signature.CertUrl)
 	if err != nil {
-		return nil, nil, fmt.Errorf("verify: could not parse certificate CBOR: %v", err)
+		return nil, nil, err
 	}
 	mainCert := certs[0]
 	verifier, err := signingalgorithm.VerifierForPublicKey(mainCert.Cert.PublicKey)
 	if err != nil {
-		return nil, nil, fmt.Errorf("verify: unsupported main certificate public key: %v", err)
+		return nil, nil, fmt.Errorf("%w: unsupported main certificate public key: %v", ErrBadSignature, err)
+	}
+	if err := checkSignatureAlgorithm(e.Version, mainCert.Cert.PublicKey); err != nil {
+		return nil, nil, fmt.Errorf("%w: %v", ErrBadSignature, err)
 	}
 
 	// Step 3 and 4: Timestamp checks
+	if o.ignoreExpiry {
+		// Still check that date and expires are consistent.
+		verificationTime = time.Unix(signature.Date, 0)
+	}
 	if err := verifyTimestamps(signature, verificationTime); err != nil {
 		return nil, nil, err
 	}
 	// Step 5: Reconstruct the signing message
 	certSha256 := mainCert.CertSha256()
-	msg, err := serializeSignedMessage(e, certSha256, signature.ValidityUrl, signature.Date, signature.Expires)
+	msg, err := serializeSignedMessage(e, o.contextString, certSha256, signature.ValidityUrl, signature.Date, signature.Expires)
 	if err != nil {
-		return nil, nil, errors.New("verify: cannot reconstruct signed message")
+		return nil, nil, fmt.Errorf("%w: cannot reconstruct signed message: %v", ErrBadSignature, err)
 	}
 	// Step 6: Cert-sha256 check
 	if !bytes.Equal(signature.CertSha256, certSha256) {
-		return nil, nil, errors.New("verify: cert-sha256 mismatch")
+		return nil, nil, ErrCertSha256Mismatch
 	}
 	// Step 7: Signature verification
 	ok, err := verifier.Verify(msg, signature.Sig)
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, fmt.Errorf("%w: %v", ErrBadSignature, err)
 	}
 	if !ok {
-		return nil, nil, errors.New("verify: signature verification failed")
+		if changes := e.HeaderChangesSinceSigning(); len(changes) > 0 {
+			return nil, nil, fmt.Errorf("%w: %s", ErrBadSignature, strings.Join(changes, "; "))
+		}
+		return nil, nil, ErrBadSignature
 	}
 	// Step 8: (version >= 1b3) Response headers must contain Content-Type
-	if e.Version != version.Version1b1 && e.Version != version.Version1b2 {
+	if e.Version.HasVerificationCheck(version.CheckContentTypeRequired) {
 		if e.ResponseHeaders.Get("Content-Type") == "" {
-			return nil, nil, errors.New("verify: Content-Type response header is absent")
+			return nil, nil, ErrMissingContentType
 		}
 	}
 	// Step 9: Payload integrity check
-	decodedPayload, err := verifyPayload(e, signature)
+	decodedPayload, err := verifyPayload(e, signature, o.maxDecodedPayloadBytes())
 	if err != nil {
 		return nil, nil, err
 	}
@@ -339,35 +1144,27 @@ func verifySignature(e *Exchange, verificationTime time.Time, fetch CertFetcher,
 func verifyTimestamps(sig *Signature, verificationTime time.Time) error {
 	expiresTime := time.Unix(sig.Expires, 0)
 	creationTime := time.Unix(sig.Date, 0)
-	if expiresTime.Sub(creationTime) > 7*24*time.Hour {
-		return fmt.Errorf("verify: expires (%v) is more than 7 days (604800 seconds) after date (%v)", expiresTime, creationTime)
+	if expiresTime.Sub(creationTime) > maxSignatureValidity {
+		return fmt.Errorf("%w: expires=%v, date=%v", ErrValidityTooLong, expiresTime, creationTime)
 	}
 	if verificationTime.Before(creationTime) {
-		return fmt.Errorf("verify: signature is not yet valid. date=%d (%v)", sig.Date, creationTime)
+		return fmt.Errorf("%w. date=%d (%v)", ErrNotYetValid, sig.Date, creationTime)
 	}
 	if verificationTime.After(expiresTime) {
-		return fmt.Errorf("verify: signature is expired. expires=%d (%v)", sig.Expires, expiresTime)
+		return fmt.Errorf("%w. expires=%d (%v)", ErrExpired, sig.Expires, expiresTime)
 	}
 	return nil
 }
 
-func verifyPayload(e *Exchange, signature *Signature) ([]byte, error) {
-	enc := e.Version.MiceEncoding()
+func verifyPayload(e *Exchange, signature *Signature, maxDecodedBytes uint64) ([]byte, error) {
+	enc := e.payloadEncoding()
 	integrityStr := enc.IntegrityIdentifier()
 	if signature.Integrity != integrityStr {
-		return nil, fmt.Errorf("verify: unsupported integrity scheme %q", signature.Integrity)
-	}
-	digest := e.ResponseHeaders.Get(enc.DigestHeaderName())
-	if digest == "" {
-		return nil, fmt.Errorf("verify: response header %q not present", enc.DigestHeaderName())
-	}
-	dec, err := enc.NewDecoder(bytes.NewReader(e.Payload), digest, maxMIRecordSize)
-	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("%w: unsupported integrity scheme %q", ErrPayloadIntegrity, signature.Integrity)
 	}
-	decoded, err := ioutil.ReadAll(dec)
+	decoded, err := e.decodePayload(enc, maxDecodedBytes)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("%w: %w", ErrPayloadIntegrity, err)
 	}
 	return decoded, nil
 }
@@ -376,14 +1173,27 @@ func isSameOrigin(u1, u2 *url.URL) bool {
 	return u1.Scheme == u2.Scheme && u1.Host == u2.Host
 }
 
-func verifyHeaders(e *Exchange) error {
+func (o *verifyOptions) verifyHeaders(e *Exchange) error {
+	if err := o.verifyRequestHeaders(e); err != nil {
+		return err
+	}
+	return o.verifyResponseHeaders(e)
+}
+
+func (o *verifyOptions) verifyRequestHeaders(e *Exchange) error {
 	for k := range e.RequestHeaders {
-		if IsStatefulRequestHeader(k) {
+		if o.isForbiddenHeader(k, IsStatefulRequestHeader) {
 			return fmt.Errorf("exchange has stateful request header %q", k)
 		}
 	}
-	if err := VerifyUncachedHeader(e.ResponseHeaders); err != nil {
-		return err
+	return nil
+}
+
+func (o *verifyOptions) verifyResponseHeaders(e *Exchange) error {
+	for k := range e.ResponseHeaders {
+		if o.isForbiddenHeader(k, IsUncachedHeader) {
+			return fmt.Errorf("exchange has uncached response header %q", k)
+		}
 	}
 	return nil
 }
@@ -3,7 +3,9 @@ package version
 import (
 	"bytes"
 	"fmt"
+	"mime"
 
+	"github.com/WICG/webpackage/go/internal/signingalgorithm"
 	"github.com/WICG/webpackage/go/signedexchange/mice"
 )
 
@@ -52,6 +54,27 @@ func (v Version) MimeType() string {
 	return fmt.Sprintf("application/signed-exchange;v=%s", v[1:])
 }
 
+// FromMimeType returns the version identified by the v= parameter of an
+// application/signed-exchange media type, which is the inverse of MimeType.
+func FromMimeType(mimeType string) (Version, error) {
+	mediaType, params, err := mime.ParseMediaType(mimeType)
+	if err != nil {
+		return Version(""), fmt.Errorf("signedexchange: cannot parse media type %q: %v", mimeType, err)
+	}
+	if mediaType != "application/signed-exchange" {
+		return Version(""), fmt.Errorf("signedexchange: unsupported media type %q", mediaType)
+	}
+	v, ok := params["v"]
+	if !ok {
+		return Version(""), fmt.Errorf("signedexchange: media type %q has no v= parameter", mimeType)
+	}
+	ver, ok := Parse("1" + v)
+	if !ok {
+		return Version(""), fmt.Errorf("signedexchange: unknown signed exchange version %q", v)
+	}
+	return ver, nil
+}
+
 func FromMagicBytes(bs []byte) (Version, error) {
 	if bytes.Equal(bs, Version1b1.HeaderMagicBytes()) {
 		return Version1b1, nil
@@ -74,3 +97,92 @@ func (v Version) MiceEncoding() mice.Encoding {
 		panic("not reached")
 	}
 }
+
+// MiceEncodings returns the Merkle Integrity encodings exchanges of version v
+// may use. The first one is v.MiceEncoding(). Version 1b3 also allows the
+// experimental mice.Draft03SHA512Encoding.
+func (v Version) MiceEncodings() []mice.Encoding {
+	if v == Version1b3 {
+		return []mice.Encoding{mice.Draft03Encoding, mice.Draft03SHA512Encoding}
+	}
+	return []mice.Encoding{v.MiceEncoding()}
+}
+
+// SupportsMiceEncoding returns true if enc is one of v.MiceEncodings().
+func (v Version) SupportsMiceEncoding(enc mice.Encoding) bool {
+	for _, e := range v.MiceEncodings() {
+		if e == enc {
+			return true
+		}
+	}
+	return false
+}
+
+// SignatureAlgorithms returns the names of the signature algorithms exchanges
+// of version v may be signed with, from the TLS SignatureScheme registry. The
+// algorithm of a signature is determined by the public key of the
+// certificate. Version 1b3 also allows the experimental "ed25519", which
+// browsers do not support.
+func (v Version) SignatureAlgorithms() []string {
+	algorithms := []string{signingalgorithm.ECDSAP256SHA256, signingalgorithm.ECDSAP384SHA384}
+	if v == Version1b3 {
+		return append(algorithms, signingalgorithm.Ed25519)
+	}
+	return algorithms
+}
+
+// SupportsSignatureAlgorithm returns true if name is one of
+// v.SignatureAlgorithms().
+func (v Version) SupportsSignatureAlgorithm(name string) bool {
+	for _, a := range v.SignatureAlgorithms() {
+		if a == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Names of the checks performed by Exchange.Verify. See VerificationChecks.
+const (
+	CheckValidityURLSameOrigin = "validity-url-same-origin"
+	CheckCertSha256            = "cert-sha256"
+	CheckSignature             = "signature"
+	CheckTimestamps            = "timestamps"
+	CheckPayloadIntegrity      = "payload-integrity"
+	CheckUncachedHeaders       = "uncached-headers"
+	CheckRequestHeadersSigned  = "request-headers-signed"
+	CheckRequestMethodSafe     = "request-method-safe"
+	CheckContentTypeRequired   = "content-type-required"
+	CheckCacheabilityRequired  = "cacheability-required"
+)
+
+// VerificationChecks returns the names of the checks Exchange.Verify applies
+// to exchanges of version v.
+func (v Version) VerificationChecks() []string {
+	checks := []string{
+		CheckValidityURLSameOrigin,
+		CheckCertSha256,
+		CheckSignature,
+		CheckTimestamps,
+		CheckPayloadIntegrity,
+		CheckUncachedHeaders,
+	}
+	switch v {
+	case Version1b1, Version1b2:
+		return append(checks, CheckRequestHeadersSigned, CheckRequestMethodSafe)
+	case Version1b3:
+		return append(checks, CheckContentTypeRequired, CheckCacheabilityRequired)
+	default:
+		panic("not reached")
+	}
+}
+
+// HasVerificationCheck returns true if check is one of v.VerificationChecks().
+func (v Version) HasVerificationCheck(check string) bool {
+	for _, c := range v.VerificationChecks() {
+		if c == check {
+			return true
+		}
+	}
+	return false
+}